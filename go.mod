@@ -1,9 +1,15 @@
 module github.com/munnerz/hugo-multiversion
 
-go 1.13
+go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/fsnotify/fsnotify v1.5.4
+	github.com/go-git/go-git/v5 v5.4.2
 	github.com/go-logr/logr v0.1.0
 	github.com/spf13/pflag v1.0.5
+	github.com/yuin/goldmark v1.4.12
+	golang.org/x/text v0.3.3
+	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/klog v1.0.0
 )
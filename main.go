@@ -1,44 +1,260 @@
 package main
 
 import (
+	"context"
+	"errors"
 	goflag "flag"
-	"io"
-	"io/ioutil"
+	"fmt"
 	"os"
-	"os/exec"
-	"path"
-	"path/filepath"
-	"strings"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/go-logr/logr"
 	flag "github.com/spf13/pflag"
 	"k8s.io/klog"
 	"k8s.io/klog/klogr"
+
+	"github.com/munnerz/hugo-multiversion/pkg/multiversion"
 )
 
-// multiversion is a tool that builds a Hugo content/ directory based on
+// hugo-multiversion is a tool that builds a Hugo content/ directory based on
 // documents contained in different branches of a single repository.
-// It may also provide additional utilities to make working with
-// multi-version Hugo sites easier in future.
+// The work is done by the multiversion package, which may be embedded in
+// other tools.
 
 var (
-	repoURL string
-	repoContentDir string
-	outputDir string
-	latestBranch string
-	branches []string
-	debug bool
+	cfg        = multiversion.DefaultConfig()
+	configPath string
+	logFormat  string
 
 	log logr.Logger
 )
 
 func init() {
-	flag.StringVar(&repoURL, "repo-url", "", "Git repository URL of the repository containing a content/ directory")
-	flag.StringVar(&repoContentDir, "repo-content-dir", "content", "Path to the 'content' directory in the source git repository. This must be the same on all branches.")
-	flag.StringVar(&outputDir, "output-dir", "content", "output content/ directory")
-	flag.StringVar(&latestBranch, "latest-branch", "", "If true, the 'latest' version will also be fetched ")
-	flag.StringSliceVar(&branches, "branches", []string{}, "version=branch pairs that should be included in the generated content/ directory")
-	flag.BoolVar(&debug, "debug", false, "if true, do not clean up the temporary directory used for building the output")
+	flag.StringVar(&cfg.Fetch.RepoURL, "repo-url", "", "Git repository URL of the repository containing a content/ directory")
+	flag.StringVar(&cfg.Fetch.RepoContentDir, "repo-content-dir", cfg.Fetch.RepoContentDir, "Path to the 'content' directory in the source git repository. This must be the same on all branches. Ignored for versions with 'roots' set in the config file.")
+	flag.StringVar(&cfg.Output.Dir, "output-dir", cfg.Output.Dir, "output content/ directory")
+	flag.StringVar(&cfg.Fetch.LatestBranch, "latest-branch", "", "If true, the 'latest' version will also be fetched ")
+	flag.StringSliceVar(&cfg.Fetch.Branches, "branches", []string{}, "version=branch pairs that should be included in the generated content/ directory")
+	flag.IntVar(&cfg.Fetch.MaxVersions, "max-versions", 0, "If greater than zero, only the newest N versions, including 'latest', are built. Version names such as 'v1.10' are compared as semantic versions. Hidden versions and versions whose names are not version numbers, such as 'dev', do not count towards N and are always built.")
+	flag.StringVar(&cfg.Fetch.MinVersion, "min-version", "", "If set, versions older than this version number, e.g. 'v1.8', are not built. Versions whose names are not version numbers are always built.")
+	flag.StringVar(&cfg.Output.ArchivedVersionsURL, "archived-versions-url", "", "If set, versions excluded by --max-versions or --min-version are still listed in the versions data file as archived, linking to this URL with '{version}' replaced by the version name.")
+	flag.BoolVar(&cfg.Debug, "debug", false, "if true, do not clean up the temporary directory used for building the output")
+	flag.StringSliceVar(&cfg.InjectFailures, "inject-failure", []string{}, "Simulated failures to inject, for testing how pipelines retry and alert on failed builds. Each is one of 'clone-timeout', 'copy' or 'hook', optionally followed by '=version' to only fail that version.")
+	flag.StringVar(&configPath, "config", "", "Path to a YAML config file containing per-version options")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the log messages written to stderr. One of 'text' or 'json' (a JSON object per line).")
+	flag.StringVar(&cfg.Output.BuildReport, "build-report", "", "If set, a JSON report describing the build of each version (commit, files copied, bytes written, duration, warnings and transforms) is written to this file once the build completes or fails")
+	flag.StringVar(&cfg.Output.AuditLog, "audit-log", "", "If set, every file created, modified or deleted in the output directory is appended to this JSON Lines file, with the version and build step responsible for the change")
+	flag.IntVar(&cfg.Output.KeepBuilds, "keep-builds", 0, "If set, the output directory and --data-dir of this many successful builds are kept in --builds-dir, so that the rollback command can restore them")
+	flag.StringVar(&cfg.Output.BuildsDir, "builds-dir", "", "Directory builds are kept in with --keep-builds, and restored from by the rollback command")
+	flag.StringVar(&cfg.Output.StoreDir, "store-dir", "", "If set, each file in the output directory is stored in this content-addressed store once it has been built, and replaced with a hard link to it, so that identical files across versions and kept builds are only stored once. Must be on the same filesystem as --output-dir.")
+	flag.StringVar(&cfg.Transform.URLPrefix, "url-prefix", cfg.Transform.URLPrefix, "URL path that the output content directory is served from")
+	flag.StringVar(&cfg.Transform.ParamNamespace, "param-namespace", cfg.Transform.ParamNamespace, "Front matter key that params injected into pages are nested under. If empty, params are set at the top level of the front matter.")
+	flag.BoolVar(&cfg.Transform.FlatParams, "flat-params", false, "If true, injected params are also set at the top level of the front matter. Use this whilst migrating themes to namespaced params.")
+	flag.StringVar(&cfg.Output.DataDir, "data-dir", "", "Directory to write generated data files to, e.g. 'data/multiversion'. If empty, no data files are written.")
+	flag.IntVar(&cfg.Output.Compat, "output-compat", cfg.Output.Compat, "Output version to write pages and other files in. Pass the output version of an earlier release to keep the output of unchanged versions byte for byte identical after upgrading.")
+	flag.IntVar(&cfg.Output.DataFormatVersion, "data-format-version", cfg.Output.DataFormatVersion, "Format version of the generated data files. Older format versions remain supported so that themes are not broken by upgrades.")
+	flag.StringVar(&cfg.Output.RedirectsFormat, "redirects-format", "", "If set, a redirects file is generated in the given format. One of 'netlify', 'vercel' or 'nginx'.")
+	flag.StringVar(&cfg.Output.RootVersion, "root-version", cfg.Output.RootVersion, "Version written directly to the output directory and served from the root of the site, e.g. 'latest', rather than from a directory named after the version. Other versions remain in their own directories.")
+	flag.StringVar(&cfg.Output.VersionAliasStrategy, "version-alias-strategy", cfg.Output.VersionAliasStrategy, "How versions are made reachable at the 'aliases' set in the config file. One of 'aliases' (add each page's URL under the alias to its 'aliases'), 'redirect' (add redirects to the redirects file) or 'copy' (copy the version's directory).")
+	flag.StringVar(&cfg.Output.RedirectsFile, "redirects-file", "", "Path to write the redirects file to. Defaults to 'static/_redirects', 'vercel.json' or 'redirects.conf' depending on --redirects-format.")
+	flag.BoolVar(&cfg.Output.RedirectEOL, "redirect-eol", false, "If true, every page of an EOL version is permanently redirected to the same page in the latest version, or to the root of the latest version if it no longer exists, in the redirects file")
+	flag.StringVar(&cfg.Fetch.Fetcher, "fetcher", cfg.Fetch.Fetcher, "How versions are fetched, unless overridden in the config file. One of 'git' (clone with the git binary) or 'go-git' (clone without a git binary).")
+	flag.StringVar(&cfg.Fetch.AsOf, "as-of", "", "If set, each version is built from the last commit to its branch before this date, e.g. '2021-03-01' or '2021-03-01T12:00:00Z', to reproduce the site as it was at that time")
+	flag.StringVar(&cfg.Fetch.CacheDir, "cache-dir", "", "Directory used to cache downloaded sources between runs. If empty, nothing is cached.")
+	flag.BoolVar(&cfg.Transform.RemovedPageAliases, "removed-page-aliases", false, "If true, pages that were removed or moved between adjacent versions are added to the 'aliases' of the page they should redirect to in the newer version")
+	flag.StringSliceVar(&cfg.Checks.Enabled, "checks", []string{}, "List of checks to run against the built content. Available checks are 'frontmatter', 'duplicate-url', 'version-references', 'markdown' and 'links'.")
+	flag.IntVar(&cfg.Checks.Concurrency, "check-concurrency", cfg.Checks.Concurrency, "Number of files to check in parallel")
+	flag.BoolVar(&cfg.Checks.Strict, "strict-checks", false, "If true, exit with an error if any check reports a problem")
+	flag.BoolVar(&cfg.Transform.RewriteLinks, "rewrite-links", false, "If true, absolute links to pages and files within a version are rewritten to include the version's path")
+	flag.StringVar(&cfg.Output.InstallThemeDir, "install-theme-dir", "", "If set, the theme component containing the version banner, switcher and link templates is written to this directory, e.g. 'themes/hugo-multiversion'")
+	flag.BoolVar(&cfg.Transform.RewriteRefs, "rewrite-refs", false, "If true, the targets of 'ref' and 'relref' shortcodes are rewritten so that they resolve to pages within the same version")
+	flag.StringVar(&cfg.Hugo.ContentDir, "hugo-content-dir", cfg.Hugo.ContentDir, "Path to the Hugo site's content directory, used to resolve the targets of 'ref' and 'relref' shortcodes. --output-dir must be within this directory.")
+	flag.StringVar(&cfg.Fetch.RecordDir, "record", "", "If set, all resolved inputs to the build (commit SHAs, file listings and content) are recorded into this directory so the build can be re-executed with --replay")
+	flag.StringVar(&cfg.Fetch.ReplayDir, "replay", "", "If set, the build is re-executed from the inputs recorded into this directory with --record, without fetching any sources")
+	flag.StringSliceVar(&cfg.Jobs.OnlyVersions, "only-versions", []string{}, "If set, only the listed versions are built and steps that depend on every version (data files, redirects, checks across versions) are skipped. Use with --manifest-dir and --finalize-only to build versions in separate jobs.")
+	flag.BoolVar(&cfg.Jobs.FinalizeOnly, "finalize-only", false, "If true, no versions are fetched and only the steps that depend on every version are run against the existing output directory")
+	flag.BoolVar(&cfg.Jobs.KeepGoing, "keep-going", false, "If true, the remaining versions are still built when a version fails to build, and the site is assembled without the failed versions. Failures are summarised at the end, and the exit code is 3 if only some versions failed and 1 if every version failed.")
+	flag.StringVar(&cfg.Jobs.ManifestDir, "manifest-dir", "", "If set, a manifest describing each built version is written to this directory. With --finalize-only, the versions are read from the manifests in this directory.")
+	flag.BoolVar(&cfg.Transform.ExcludeDrafts, "exclude-drafts", false, "If true, pages with 'draft: true' in their front matter are not copied. May be overridden per version in the config file.")
+	flag.BoolVar(&cfg.Transform.ExcludeExpired, "exclude-expired", false, "If true, pages whose 'expiryDate' has passed are not copied. May be overridden per version in the config file.")
+	flag.BoolVar(&cfg.Transform.EditURLs, "edit-urls", false, "If true, an 'edit_url' param linking to the page's source file on the forge hosting --repo-url is injected into every page")
+	flag.StringVar(&cfg.Transform.EditURLTemplate, "edit-url-template", "", "Template used to generate 'edit_url' params, supporting the {repo}, {branch}, {version} and {path} placeholders. Implies --edit-urls.")
+	flag.BoolVar(&cfg.Transform.GitDates, "git-dates", false, "If true, the 'lastmod' and 'date' of each page are set from the dates of the most recent and first commits to the page's source file, unless already set")
+	flag.BoolVar(&cfg.Transform.GitContributors, "git-contributors", false, "If true, a 'contributors' param listing the authors of commits to the page's source file is injected into every page")
+	flag.BoolVar(&cfg.Transform.PreserveMtimes, "preserve-mtimes", false, "If true, the modification time of each copied file is set to the date of the most recent commit to its source file")
+	flag.StringVar(&cfg.Preview.SiteDir, "site-dir", cfg.Preview.SiteDir, "Directory containing the site built by Hugo, served by the preview command and compared with the deployed site by the audit command")
+	flag.StringVar(&cfg.Preview.ListenAddr, "listen", cfg.Preview.ListenAddr, "Address the preview command listens on")
+	flag.BoolVar(&cfg.Preview.Overlay, "preview-overlay", cfg.Preview.Overlay, "If true, the preview command injects a version switch overlay into every HTML page. Requires --data-dir.")
+	flag.StringVar(&cfg.Output.DuplicatesReport, "duplicates-report", "", "If set, a JSON report of the pages whose content is identical across versions, grouped with the URL of the page in the newest version, is written to this file. May contain the {lang} placeholder.")
+	flag.StringVar(&cfg.Output.DedupeMode, "dedupe-assets", "", "Deduplicate identical non-page files across versions. One of 'report' (log the space that could be saved), 'hardlink' or 'shared' (move them into --shared-assets-dir).")
+	flag.StringVar(&cfg.Output.SharedAssetsDir, "shared-assets-dir", cfg.Output.SharedAssetsDir, "Directory that duplicate assets are moved into with --dedupe-assets=shared")
+	flag.StringVar(&cfg.Output.SharedAssetsURL, "shared-assets-url", cfg.Output.SharedAssetsURL, "URL that --shared-assets-dir is served from")
+	flag.BoolVar(&cfg.Transform.SearchIndex, "search-index", false, "If true, a JSON search index of the pages of each version (title, headings, summary, version and URL), compatible with Lunr and Fuse.js, is written to --search-index-dir as <version>.json whilst the version is copied")
+	flag.StringVar(&cfg.Output.SearchIndexDir, "search-index-dir", cfg.Output.SearchIndexDir, "Directory the search index of each version is written to with --search-index. May contain the {lang} placeholder.")
+	flag.BoolVar(&cfg.Transform.SitemapHints, "sitemap-hints", false, "If true, Hugo's 'sitemap' changefreq and priority front matter is cascaded to the pages of each version, favouring the latest version, and sitemaps are disabled for the pages of deprecated, EOL and hidden versions. May be overridden per version in the config file.")
+	flag.StringVar(&cfg.Output.SitemapDir, "sitemap-dir", "", "If set, a sitemap of the pages of each version that is not deprecated, EOL or hidden is written to this directory as <version>.xml, with a sitemap index listing them as index.xml. Requires --base-url. May contain the {lang} placeholder.")
+	flag.StringVar(&cfg.Output.SitemapURL, "sitemap-url", cfg.Output.SitemapURL, "URL path --sitemap-dir is served from")
+	flag.StringVar(&cfg.Output.RobotsFile, "robots-file", "", "If set, a section disallowing crawling of deprecated and hidden versions, and pointing at the sitemap index of --sitemap-dir, is written to this robots.txt file, e.g. 'static/robots.txt'. The rest of the file is kept. Requires --base-url. May contain the {lang} placeholder.")
+	flag.StringVar(&cfg.Output.BaseURL, "base-url", "", "Absolute URL the site is served from, e.g. 'https://docs.example.com', used in sitemaps and robots.txt")
+	flag.StringVar(&cfg.Search.AlgoliaIndex, "algolia-index", "", "If set, the search index of each built version is pushed to this Algolia index once the build succeeds, tagging each record with its version and marking those of the latest version. Requires the ALGOLIA_APP_ID and ALGOLIA_API_KEY environment variables.")
+	flag.StringVar(&cfg.Search.AlgoliaURL, "algolia-url", "", "URL of the Algolia API, for proxies. Defaults to https://$ALGOLIA_APP_ID.algolia.net.")
+	flag.BoolVar(&cfg.Search.Prune, "search-prune", false, "If true, records of versions that are no longer built are deleted from --algolia-index")
+	flag.StringSliceVar(&cfg.Languages.Languages, "languages", nil, "Languages to build each version for, or '*' to build every language found in each version. --repo-content-dir and --output-dir must contain the {lang} placeholder.")
+	flag.StringVar(&cfg.Languages.Default, "default-language", "", "Language that is served without a language prefix. The {lang} placeholder is removed from --url-prefix for this language.")
+	flag.StringVar(&cfg.Languages.MatrixReport, "matrix-report", "", "If set, a JSON report of the languages each version was built for is written to this file")
+	flag.StringVar(&cfg.Output.CopyMode, "copy-mode", cfg.Output.CopyMode, "How files are placed into the output directory. One of 'copy', 'hardlink', 'symlink' or 'mount' (write Hugo module mounts to --mounts-file instead of copying). 'symlink' and 'mount' require --cache-dir, as sources are kept in the cache directory.")
+	flag.StringSliceVar(&cfg.Fetch.GlossaryFiles, "glossary-files", nil, "Paths to YAML files in each branch, relative to the root of the repository, mapping terms to their definitions. The terms of every version are combined into the glossary data file, noting the versions defining each term and those whose definition changed.")
+	flag.StringVar(&cfg.Fetch.VersionMetadataFile, "version-metadata-file", "", "Path to a YAML file in each branch, relative to the root of the repository, containing metadata about the version to merge into the versions data file")
+	flag.IntVar(&cfg.Output.CopyConcurrency, "copy-concurrency", cfg.Output.CopyConcurrency, "Number of files copied in parallel into the output directory. Tune for the disk, separately from --fetch-concurrency.")
+	flag.StringVar(&cfg.Output.NormalizeFilenames, "normalize-filenames", "", "If set, the names of copied files are converted to this unicode normalization form, 'nfc' or 'nfd', so that translated content is published at the same URLs whether it is built on macOS or Linux")
+	flag.IntVar(&cfg.Output.MaxPathLength, "max-path-length", cfg.Output.MaxPathLength, "Paths within the output directory longer than this many bytes are reported, as they may not be usable on Windows. 0 disables the report.")
+	flag.StringVar(&cfg.Tracing.OTLPEndpoint, "otlp-endpoint", "", "If set, trace spans for the phases of the build are exported to this OTLP/HTTP collector URL, e.g. 'http://localhost:4318'. Defaults to $OTEL_EXPORTER_OTLP_ENDPOINT.")
+	flag.StringSliceVar(&cfg.Tracing.OTLPHeaders, "otlp-headers", []string{}, "key=value headers sent when exporting trace spans. Defaults to $OTEL_EXPORTER_OTLP_HEADERS.")
+	flag.StringVar(&cfg.Tracing.ServiceName, "otlp-service-name", "", "Service name trace spans are exported with. Defaults to $OTEL_SERVICE_NAME, or otherwise 'hugo-multiversion'.")
+	flag.StringVar(&cfg.Fetch.PreviewBranch, "preview-branch", "", "If set, this branch, e.g. that of a pull request, is built as a hidden version into the 'preview' directory of the output alongside the other versions, for deploy previews")
+	flag.StringVar(&cfg.Fetch.PreviewName, "preview-name", "", "Name of the directory beneath 'preview' that --preview-branch is built into, e.g. 'pr-1234'. Defaults to 'pr-<number>' for pull and merge request refs, and otherwise to the branch name.")
+	flag.StringVar(&cfg.Fetch.Discover, "discover", "", "If set, versions are also discovered from the refs of --repo-url listed by the API of the forge hosting it, without cloning. One of 'github' or 'gitlab'. Requests are authenticated with GITHUB_TOKEN or GITLAB_TOKEN if set.")
+	flag.StringSliceVar(&cfg.Fetch.DiscoverRefs, "discover-refs", cfg.Fetch.DiscoverRefs, "Kinds of ref discovered with --discover, any of 'branches', 'tags' and 'releases'. If refs of several kinds are named after the same version, the kind listed first is used.")
+	flag.StringVar(&cfg.Fetch.DiscoverPattern, "discover-pattern", "", "Regular expression the names of refs discovered with --discover must match, e.g. '^release-(.+)$'. If it contains a capture group, versions are named after the first group rather than the ref.")
+	flag.StringVar(&cfg.Fetch.DiscoverAPIURL, "discover-api-url", "", "Base URL of the forge API used by --discover, e.g. 'https://git.example.com/api/v4'. Defaults to the API of the host of --repo-url.")
+	flag.IntVar(&cfg.Fetch.FetchConcurrency, "fetch-concurrency", cfg.Fetch.FetchConcurrency, "Number of versions fetched over the network in parallel, ahead of being copied into the output directory one at a time. Tune for the network, separately from --copy-concurrency.")
+	flag.BoolVar(&cfg.Output.DeltaSync, "delta-sync", false, "If true, versions are built in a staging directory and only files that have changed are written to the output directory. Files that no longer exist in a version are deleted.")
+	flag.StringSliceVar(&cfg.Backport.Versions, "to-versions", nil, "Versions the backport command applies commits to. Defaults to every configured version.")
+	flag.BoolVar(&cfg.Backport.Push, "push", false, "If true, the backport command pushes a branch for each version the commits apply cleanly to")
+	flag.BoolVar(&cfg.Backport.CreatePRs, "create-prs", false, "If true, the backport command pushes a branch and opens a pull request for each version the commits apply cleanly to. Requires GITHUB_TOKEN or GITLAB_TOKEN to be set.")
+	flag.BoolVar(&cfg.Watch.Enabled, "watch", false, "If true, keep running after the initial build and rebuild versions whenever their branch changes in the remote repository")
+	flag.DurationVar(&cfg.Watch.PollInterval, "poll-interval", cfg.Watch.PollInterval, "How often branches are polled for changes with --watch")
+	flag.StringVar(&cfg.Divergence.DefaultBranch, "default-branch", "", "Branch the divergence command compares the latest version's branch with. Defaults to the default branch of the repository.")
+	flag.StringVar(&cfg.Divergence.ReportFile, "divergence-report", "", "If set, the divergence command writes a JSON report of the commits that have not been backported to this file")
+	flag.StringVar(&cfg.Review.RoutingFile, "review-routing-file", "", "If set, a JSON file mapping the pages of each version changed since --review-base to their owners, read from the CODEOWNERS file of each branch, is written to this path")
+	flag.StringVar(&cfg.Review.Base, "review-base", "", "Commit, ref or branch that pages are compared with to find changed pages for --review-routing-file")
+	flag.StringVar(&cfg.Watch.MetricsListenAddr, "metrics-listen", "", "If set with --watch, Prometheus metrics are served on /metrics and health checks on /healthz and /readyz at this address")
+	flag.BoolVar(&cfg.Hugo.Run, "run-hugo", false, "If true, Hugo is run in --site-root once content has been assembled, and the run fails if Hugo fails. Arguments given after '--' are passed to Hugo, e.g. '-- server'.")
+	flag.StringVar(&cfg.Hugo.Bin, "hugo-bin", cfg.Hugo.Bin, "Path to the Hugo binary run with --run-hugo")
+	flag.StringVar(&cfg.Hugo.SiteRoot, "site-root", cfg.Hugo.SiteRoot, "Root directory of the Hugo site that Hugo is run in with --run-hugo")
+	flag.StringVar(&cfg.Output.VersionsFormat, "versions-format", "", "If set, the built versions are exported to --versions-file in this format, for version selectors built for other tools. One of 'mike', 'docusaurus' or 'template' (render --versions-template).")
+	flag.StringVar(&cfg.Output.VersionsFile, "versions-file", "", "File the versions are exported to with --versions-format, e.g. 'static/versions.json'")
+	flag.StringVar(&cfg.Output.VersionsTemplate, "versions-template", "", "Go template rendered with the versions data file to export the versions with --versions-format=template")
+	flag.StringVar(&cfg.Output.RTDAPIDir, "rtd-api-dir", "", "If set, a static API listing the versions, and the versions each page exists in, is written to this directory for flyout menus written for Read the Docs, e.g. 'static/_/api'")
+	flag.StringVar(&cfg.Output.DocsyVersionsFile, "docsy-versions-file", "", "If set, the built versions are written to this TOML config file as the 'versions' param read by the version menu of the Docsy theme, e.g. 'config/_default/params.toml'. Other keys in the file are kept.")
+	flag.StringVar(&cfg.Output.MountsFile, "mounts-file", cfg.Output.MountsFile, "File the Hugo module mounts of each version are written to with --copy-mode=mount")
+	flag.StringVar(&cfg.Output.Archive, "output", "", "If set to '-', content is assembled in memory and the output directory is written to stdout as a tar archive rather than to disk")
+	flag.StringVar(&cfg.Pages.Branch, "publish-branch", "", "If set, the assembled site is committed to this branch of --publish-repo and pushed once built, e.g. 'gh-pages'")
+	flag.StringVar(&cfg.Pages.Repo, "publish-repo", "", "URL of the repository, or name of a remote in the config file, that --publish-branch is pushed to. Defaults to --repo-url.")
+	flag.StringVar(&cfg.Pages.Dir, "publish-dir", "", "Directory committed to --publish-branch. Defaults to 'public' in --site-root with --run-hugo, and otherwise to --output-dir.")
+	flag.StringVar(&cfg.Pages.Message, "publish-message", cfg.Pages.Message, "Message of the commit pushed to --publish-branch")
+	flag.StringVar(&cfg.Pages.Author, "publish-author", cfg.Pages.Author, "Author of the commit pushed to --publish-branch, of the form 'Name <email>'")
+	flag.StringVar(&cfg.Pages.Strategy, "publish-strategy", cfg.Pages.Strategy, "How --publish-branch is updated. One of 'fast-forward' (add a commit, failing if the branch moved during the build) or 'force' (replace the branch with a single commit).")
+	flag.StringVar(&cfg.Bucket.URL, "bucket", "", "If set, the assembled site is uploaded to this object storage bucket URL once built, only uploading changed files, e.g. 's3://docs-bucket/site', 'gs://docs-bucket' or 'https://account.blob.core.windows.net/container'. Requires the aws, gcloud or azcopy CLI.")
+	flag.StringVar(&cfg.Bucket.Dir, "bucket-dir", "", "Directory uploaded with --bucket. Defaults to 'public' in --site-root with --run-hugo, and otherwise to --output-dir.")
+	flag.BoolVar(&cfg.Bucket.Delete, "bucket-delete", false, "If true, objects that are not in the uploaded directory are deleted from the bucket prefix uploaded to with --bucket")
+	flag.StringVar(&cfg.Bucket.AWSBin, "aws-bin", cfg.Bucket.AWSBin, "Path to the aws binary used to upload to s3:// buckets")
+	flag.StringVar(&cfg.Bucket.GCloudBin, "gcloud-bin", cfg.Bucket.GCloudBin, "Path to the gcloud binary used to upload to gs:// buckets")
+	flag.StringVar(&cfg.Bucket.AzCopyBin, "azcopy-bin", cfg.Bucket.AzCopyBin, "Path to the azcopy binary used to upload to Azure Blob Storage")
+	flag.StringVar(&cfg.Output.Format, "output-format", cfg.Output.Format, "Format the output is written in. One of 'directory', or 'archive' to also write an archive of each version, and of the whole site, to --archive-dir once the build has completed, e.g. for offline use.")
+	flag.StringVar(&cfg.Archives.Dir, "archive-dir", cfg.Archives.Dir, "Directory archives are written to with --output-format=archive")
+	flag.StringVar(&cfg.Archives.SourceDir, "archive-source-dir", "", "Directory the versions are archived from with --output-format=archive. Defaults to 'public' in --site-root with --run-hugo, and otherwise to --output-dir.")
+	flag.StringVar(&cfg.Archives.Type, "archive-type", cfg.Archives.Type, "Type of the archives written with --output-format=archive. One of 'tar.gz' or 'zip'.")
+	flag.StringVar(&cfg.OCI.Repo, "oci-repo", "", "If set, each built version is packaged as a gzipped tar archive and pushed to this repository as an OCI artifact once the build succeeds, tagged with the version name and its aliases, e.g. 'registry.example.com/docs/content'. Requires oras.")
+	flag.StringVar(&cfg.OCI.Dir, "oci-dir", "", "Directory the versions are packaged from with --oci-repo. Defaults to 'public' in --site-root with --run-hugo, and otherwise to --output-dir.")
+	flag.StringVar(&cfg.OCI.ORASBin, "oras-bin", cfg.OCI.ORASBin, "Path to the oras binary used to push artifacts with --oci-repo")
+	flag.StringVar(&cfg.Image.Ref, "image", "", "If set, the assembled site is packaged into a container image on top of --image-base and pushed to this reference, e.g. 'registry.example.com/docs:latest'. Requires crane.")
+	flag.StringVar(&cfg.Image.Base, "image-base", cfg.Image.Base, "Base image the site is added to as a layer with --image")
+	flag.StringVar(&cfg.Image.Path, "image-path", cfg.Image.Path, "Directory in the image the site is placed at with --image")
+	flag.StringVar(&cfg.Image.Dir, "image-dir", "", "Directory packaged into the image with --image. Defaults to 'public' in --site-root with --run-hugo, and otherwise to --output-dir.")
+	flag.StringVar(&cfg.Image.CraneBin, "crane-bin", cfg.Image.CraneBin, "Path to the crane binary used to push images with --image")
+	flag.StringSliceVar(&cfg.Output.ExtraDirs, "extra-dirs", nil, "Directories outside the content directory that are also copied for each version, as source=destination pairs, e.g. 'static=static/{version}'. Sources are relative to the root of the repository, and {version} is replaced with the version name.")
+	flag.StringVar(&cfg.Audit.Deployed, "deployed", "", "URL or directory of the deployed site compared with --site-dir by the audit command, e.g. 'https://docs.example.com'")
+	flag.IntVar(&cfg.Audit.Concurrency, "audit-concurrency", cfg.Audit.Concurrency, "Number of deployed pages the audit command fetches in parallel")
+	flag.StringVar(&cfg.Audit.ReportFile, "audit-report", "", "If set, the audit command writes a JSON report of the missing, extra and stale pages of each version to this file")
+	flag.StringVar(&cfg.Import.BaselineFile, "import-baseline", "", "Path the import command writes the baseline manifest of the imported tree to. Defaults to the path of the generated config file with a -baseline.json suffix.")
+	flag.StringVar(&cfg.Import.From, "import-from", "", "Tool that rendered the tree imported by the import command, 'mike' or 'sphinx-multiversion'. If set, versions are read from the tool's own metadata and redirects from the URLs of its pages are added to the config file.")
+	flag.BoolVar(&cfg.Import.Verify, "import-verify", cfg.Import.Verify, "If true, the import command builds each inferred version from its branch and compares it with the imported tree")
+	flag.Float64Var(&cfg.Diff.Threshold, "diff-threshold", cfg.Diff.Threshold, "Proportion of the lines of a page, between 0 and 1, that must be added or removed for the diff command to list it as changed")
+	flag.StringVar(&cfg.Diff.ReportFile, "diff-report", "", "If set, the diff command writes a JSON report of the added, removed and changed pages to this file")
+	flag.StringVar(&cfg.Diff.Page, "diff-page", "", "If set, the diff command writes a Markdown page listing the added, removed and changed pages to this file, e.g. within the Hugo content directory")
+	flag.StringVar(&cfg.Snapshot.TagTemplate, "snapshot-tag", cfg.Snapshot.TagTemplate, "Name of the tag the snapshot command creates for each version, supporting the {version} and {date} placeholders")
+	flag.BoolVar(&cfg.Transform.CanonicalLatest, "canonical-latest", false, "If true, pages in older versions that also exist in the latest version will have a 'canonical' param pointing at the latest version of the page")
+	flag.StringSliceVar(&cfg.Transform.NonLatestOutputs, "non-latest-outputs", nil, "If set, the pages of versions other than 'latest' are only rendered in these Hugo output formats, e.g. 'html', by cascading 'outputs' from the _index page of each version. May be overridden per version in the config file.")
+	flag.StringVar(&cfg.Transform.NonLatestList, "non-latest-list", "", "If set, the '_build.list' option cascaded to the pages of versions other than 'latest'. 'local' keeps them out of site-wide page lists and RSS feeds whilst still listing them within their own sections. One of 'always', 'local' or 'never'. May be overridden per version in the config file.")
+	flag.BoolVar(&cfg.Transform.RelatedIsolation, "related-isolation", false, "If true, a 'version' param is cascaded to every page of each version, so that the 'multiversion/related.html' partial of the theme component only relates pages within the same version")
+	flag.BoolVar(&cfg.Transform.OutdatedCascade, "outdated-cascade", false, "If true, a cascade marking pages as outdated will be written into the _index page of each non-latest version")
+}
+
+// commands maps the name of each subcommand to the function that runs it with
+// the remaining positional arguments. If no subcommand is given, the content
+// directory is built.
+var commands = map[string]func(ctx context.Context, b *multiversion.Builder, args []string) error{
+	"merge": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		return b.Merge(ctx, args)
+	},
+	"preview": func(ctx context.Context, b *multiversion.Builder, _ []string) error {
+		return b.Preview(ctx)
+	},
+	"backport": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		return b.Backport(ctx, args)
+	},
+	"divergence": func(ctx context.Context, b *multiversion.Builder, _ []string) error {
+		return b.Divergence(ctx)
+	},
+	"try": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: try <branch> [<version>]")
+		}
+		version := ""
+		if len(args) == 2 {
+			version = args[1]
+		}
+		return b.Try(ctx, args[0], version)
+	},
+	"diff": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: diff <from> <to>")
+		}
+		return b.Diff(ctx, args[0], args[1])
+	},
+	"publish": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: publish <version>")
+		}
+		return b.Publish(ctx, args[0])
+	},
+	"unpublish": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: unpublish <version>")
+		}
+		return b.Unpublish(ctx, args[0])
+	},
+	"scaffold": func(ctx context.Context, b *multiversion.Builder, _ []string) error {
+		return b.Scaffold(ctx)
+	},
+	"check-links": func(ctx context.Context, b *multiversion.Builder, _ []string) error {
+		return b.CheckLinks(ctx)
+	},
+	"audit": func(ctx context.Context, b *multiversion.Builder, _ []string) error {
+		return b.Audit(ctx)
+	},
+	"import": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: import <config-file>")
+		}
+		return b.Import(ctx, args[0])
+	},
+	"snapshot": func(ctx context.Context, b *multiversion.Builder, _ []string) error {
+		return b.Snapshot(ctx)
+	},
+	"rollback": func(ctx context.Context, b *multiversion.Builder, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("usage: rollback [<build>]")
+		}
+		id := ""
+		if len(args) == 1 {
+			id = args[0]
+		}
+		return b.Rollback(ctx, id)
+	},
 }
 
 func main() {
@@ -49,192 +265,73 @@ func main() {
 
 	// add just the --v flag to the pflag flagset
 	flag.CommandLine.AddGoFlag(goflag.CommandLine.Lookup("v"))
-	flag.Parse()
-
-	log = klogr.New()
-	if !validateFlags() {
-		os.Exit(1)
-	}
-	if err := run(); err != nil {
-		log.Error(err, "Failed to run")
-		os.Exit(1)
-	}
-}
-
-func validateFlags() bool {
-	valid := true
-	valid = notEmpty("repo-url", repoURL) && valid
-	valid = notEmpty("repo-content-dir", repoContentDir) && valid
-	valid = notEmpty("output-dir", outputDir) && valid
-	return valid
-}
-
-func notEmpty(name, val string) bool {
-	if val == "" {
-		log.Info("--"+name+" must be specified")
-		return false
-	}
-	return true
-}
-
-// parseBranchesFlag converts a list of a=b mapping strings into a map.
-// If one of the elements of 'branches' does not contain an = sign, the string
-// value will be used as both the version name and branch name in the map.
-func parseBranchesFlag(branches []string) map[string]string {
-	out := make(map[string]string)
-	for _, b := range branches {
-		splitStr := strings.Split(b, "=")
-		// no = sign, use the string as the version number and branch name
-		if len(splitStr) == 1 {
-			out[b] = b
-			continue
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			command, args = args[0], args[1:]
 		}
-		out[splitStr[0]] = strings.Join(splitStr[1:], "")
-	}
-	return out
-}
-
-// fetchRepository will use the system installed git command to fetch a copy of
-// the repository at the specified revision
-func fetchRepository(log logr.Logger, tmpdir, repoURL, version, branchName string) (string, error) {
-	log.Info("Fetching repository at revision")
-	cloneDir := filepath.Join(tmpdir, "repo", version)
-	if err := runCommand(log, "git", "clone", "-b", branchName, repoURL, cloneDir); err != nil {
-		return "", err
 	}
-	return cloneDir, nil
-}
-
-func run() error {
-	if latestBranch == "" && len(branches) == 0 {
-		log.Info("Nothing to do!")
-		return nil
-	}
-
-	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
-	if err != nil {
-		return err
-	}
-	defer cleanup(log, tmpdir)
-
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		log.Info("Error creating output directory")
-		return err
+	if err := flag.CommandLine.Parse(args); err != nil {
+		os.Exit(2)
 	}
 
-	versionMap := parseBranchesFlag(branches)
-	if latestBranch != "" {
-		versionMap["latest"] = latestBranch
+	log = klogr.New()
+	switch logFormat {
+	case "text":
+	case "json":
+		verbosity, _ := strconv.Atoi(goflag.CommandLine.Lookup("v").Value.String())
+		log = multiversion.NewJSONLogger(os.Stderr, verbosity)
+	default:
+		log.Info("--log-format must be one of 'text' or 'json'")
+		os.Exit(1)
 	}
-	for vers, branch := range versionMap {
-		log := log.WithValues("version", vers, "branch", branch)
-		log.Info("Adding version to list to generate")
-
-		loc, err := fetchRepository(log, tmpdir, repoURL, vers, branch)
-		if err != nil {
-			log.Error(err, "Failed to fetch repository")
-			return err
+	cfg.Log = log
+	if command == "" {
+		if flag.NArg() > 0 && !cfg.Hugo.Run {
+			log.Info("Arguments are only accepted with --run-hugo, to be passed to Hugo", "args", flag.Args())
+			os.Exit(1)
 		}
-
-		log.Info("Fetched repository", "path", loc)
-		log.Info("Copying content to output directory")
-
-		src := filepath.Join(loc, repoContentDir)
-		dst := filepath.Join(outputDir, vers)
-		if err := copyDir(src, dst); err != nil {
-			log.Error(err, "Failed to copy content from source repository to output directory")
-			return err
-		}
-	}
-
-	log.Info("Built content directory")
-	return nil
-}
-
-// copyFile copies a single file from src to dst
-func copyFile(src, dst string) error {
-	var err error
-	var srcfd *os.File
-	var dstfd *os.File
-	var srcinfo os.FileInfo
-
-	if srcfd, err = os.Open(src); err != nil {
-		return err
-	}
-	defer srcfd.Close()
-
-	if dstfd, err = os.Create(dst); err != nil {
-		return err
-	}
-	defer dstfd.Close()
-
-	if _, err = io.Copy(dstfd, srcfd); err != nil {
-		return err
-	}
-	if srcinfo, err = os.Stat(src); err != nil {
-		return err
-	}
-	return os.Chmod(dst, srcinfo.Mode())
-}
-
-// copyDir copies a whole directory recursively
-func copyDir(src string, dst string) error {
-	var err error
-	var fds []os.FileInfo
-	var srcinfo os.FileInfo
-
-	if srcinfo, err = os.Stat(src); err != nil {
-		return err
+		cfg.Hugo.Args = flag.Args()
 	}
-
-	if err = os.MkdirAll(dst, srcinfo.Mode()); err != nil {
-		return err
-	}
-
-	if fds, err = ioutil.ReadDir(src); err != nil {
-		return err
+	if err := multiversion.LoadConfigFile(configPath, &cfg); err != nil {
+		log.Error(err, "Failed to load config file", "path", configPath)
+		os.Exit(1)
 	}
-	for _, fd := range fds {
-		srcfp := path.Join(src, fd.Name())
-		dstfp := path.Join(dst, fd.Name())
-
-		if fd.IsDir() {
-			if err = copyDir(srcfp, dstfp); err != nil {
-				return err
-			}
-		} else {
-			if err = copyFile(srcfp, dstfp); err != nil {
-				return err
-			}
-		}
+	b, err := multiversion.New(cfg)
+	if err != nil {
+		log.Error(err, "Failed to create builder")
+		os.Exit(1)
 	}
-	return nil
-}
-
-func cleanup(log logr.Logger, dir string) {
-	log = log.WithValues("directory", dir)
-	if debug {
-		log.Info("Skipping cleaning up temporary directory")
-		return
+	// cancel the build on the first SIGINT or SIGTERM, so that commands are
+	// killed and temporary directories removed, and exit immediately on the
+	// second
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Info("Received signal, stopping", "signal", sig.String())
+		cancel()
+	}()
+	if command != "" {
+		err = commands[command](ctx, b, flag.Args())
+	} else {
+		_, err = b.Build(ctx)
 	}
-	if err := os.RemoveAll(dir); err != nil {
-		log.Error(err, "Failed to cleanup temporary directory")
-		return
+	if err != nil && ctx.Err() != nil {
+		log.Info("Stopped before completing", "error", err.Error())
+		os.Exit(1)
 	}
-	log.Info("Cleaned up temporary directory")
-}
-
-func runCommand(log logr.Logger, name string, args ...string) error {
-	log = log.WithValues("cmd", name, "args", args)
-	cmd := exec.Command(name, args...)
-	if debug {
-		log.Info("Running command")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	var buildErr *multiversion.BuildError
+	if errors.As(err, &buildErr) && buildErr.Partial() {
+		log.Error(err, "Failed to build some versions", "built", buildErr.Built)
+		os.Exit(3)
 	}
-	if err := cmd.Run(); err != nil {
-		log.Error(err, "Error running command")
-		return err
+	if err != nil {
+		log.Error(err, "Failed to run")
+		os.Exit(1)
 	}
-	return nil
 }
@@ -0,0 +1,166 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// algoliaBatchSize is the number of records written to Algolia in a single
+// request.
+const algoliaBatchSize = 1000
+
+// algoliaTag is added to every record pushed to Algolia, so that records added
+// to the index by other tools are never pruned.
+const algoliaTag = "hugo-multiversion"
+
+// algoliaRecord is a page of a version, as pushed to Algolia.
+type algoliaRecord struct {
+	searchEntry
+	ObjectID string `json:"objectID"`
+	// Latest is set for the pages of the latest version, so that search
+	// results can be restricted to it.
+	Latest bool `json:"latest"`
+	// Tags are the version's tag, 'latest' for the latest version, and the
+	// tag of the push that last wrote the record.
+	Tags []string `json:"_tags"`
+}
+
+// algoliaOperation is an operation of a batch request.
+type algoliaOperation struct {
+	Action string        `json:"action"`
+	Body   algoliaRecord `json:"body"`
+}
+
+// validateAlgolia returns an error if records cannot be pushed to Algolia
+// with the options given.
+func (st *state) validateAlgolia() error {
+	if st.opts.Search.AlgoliaIndex == "" {
+		return nil
+	}
+	if os.Getenv("ALGOLIA_APP_ID") == "" || os.Getenv("ALGOLIA_API_KEY") == "" {
+		return fmt.Errorf("the ALGOLIA_APP_ID and ALGOLIA_API_KEY environment variables must be set")
+	}
+	if len(st.opts.Languages.Languages) > 0 {
+		return fmt.Errorf("cannot be used with --languages")
+	}
+	return nil
+}
+
+// pushSearchRecords replaces the records of each built version in
+// --algolia-index with the pages of its search index, and then deletes the
+// version's records that were not replaced, which are those of pages that
+// have been removed. With --search-prune, the records of versions that are no
+// longer configured are deleted too.
+func (st *state) pushSearchRecords(log logr.Logger, built, versionMap map[string]string) error {
+	if st.opts.Search.AlgoliaIndex == "" {
+		return nil
+	}
+	log = log.WithValues("index", st.opts.Search.AlgoliaIndex)
+	push := "push:" + randomID(8)
+	for _, vers := range sortedVersionNames(built) {
+		data, err := ioutil.ReadFile(st.searchIndexFile(vers))
+		if os.IsNotExist(err) {
+			// the version failed to build with --keep-going
+			log.Info("WARNING: not pushing search records, as the version has no search index", "version", vers)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var entries []searchEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("reading search index of %q: %v", vers, err)
+		}
+		ops := make([]algoliaOperation, len(entries))
+		for i, e := range entries {
+			rec := algoliaRecord{
+				searchEntry: e,
+				ObjectID:    vers + ":" + e.URL,
+				Latest:      vers == latestVersion,
+				Tags:        []string{algoliaTag, "version:" + vers, push},
+			}
+			if rec.Latest {
+				rec.Tags = append(rec.Tags, latestVersion)
+			}
+			ops[i] = algoliaOperation{Action: "updateObject", Body: rec}
+		}
+		log.Info("Pushing search records", "version", vers, "records", len(ops))
+		for len(ops) > 0 {
+			n := len(ops)
+			if n > algoliaBatchSize {
+				n = algoliaBatchSize
+			}
+			if err := st.algoliaRequest(log, "/batch", map[string]interface{}{"requests": ops[:n]}); err != nil {
+				return fmt.Errorf("pushing search records of %q: %v", vers, err)
+			}
+			ops = ops[n:]
+		}
+		stale := algoliaTagFilter("version:"+vers) + " AND NOT " + algoliaTagFilter(push)
+		if err := st.algoliaRequest(log, "/deleteByQuery", map[string]string{"filters": stale}); err != nil {
+			return fmt.Errorf("deleting removed pages of %q: %v", vers, err)
+		}
+	}
+
+	if !st.opts.Search.Prune {
+		return nil
+	}
+	filters := []string{algoliaTagFilter(algoliaTag)}
+	for _, vers := range sortedVersionNames(versionMap) {
+		filters = append(filters, "NOT "+algoliaTagFilter("version:"+vers))
+	}
+	log.Info("Pruning search records of versions that are no longer built")
+	if err := st.algoliaRequest(log, "/deleteByQuery", map[string]string{"filters": strings.Join(filters, " AND ")}); err != nil {
+		return fmt.Errorf("pruning search records: %v", err)
+	}
+	return nil
+}
+
+// algoliaTagFilter returns a filter matching the records with the given tag.
+func algoliaTagFilter(tag string) string {
+	return `_tags:"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(tag) + `"`
+}
+
+// algoliaRequest sends body to the given endpoint of --algolia-index,
+// authenticated with the ALGOLIA_APP_ID and ALGOLIA_API_KEY environment
+// variables.
+func (st *state) algoliaRequest(log logr.Logger, endpoint string, body interface{}) error {
+	appID := os.Getenv("ALGOLIA_APP_ID")
+	baseURL := st.opts.Search.AlgoliaURL
+	if baseURL == "" {
+		baseURL = "https://" + appID + ".algolia.net"
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	reqURL := strings.TrimSuffix(baseURL, "/") + "/1/indexes/" + url.PathEscape(st.opts.Search.AlgoliaIndex) + endpoint
+	req, err := http.NewRequestWithContext(st.runCtx, http.MethodPost, reqURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Algolia-Application-Id", appID)
+	req.Header.Set("X-Algolia-API-Key", os.Getenv("ALGOLIA_API_KEY"))
+	req.Header.Set("Content-Type", "application/json")
+	log.V(4).Info("Sending Algolia request", "url", reqURL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if len(msg) > 1024 {
+			msg = msg[:1024]
+		}
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
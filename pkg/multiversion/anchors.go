@@ -0,0 +1,142 @@
+package multiversion
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	atxHeadingRE     = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextHeadingRE  = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	customHeadingRE  = regexp.MustCompile(`[ \t]*\{#([^}\s]+)[^}]*\}[ \t]*$`)
+	fenceRE          = regexp.MustCompile("^ {0,3}(```|~~~)")
+	markdownLinkRE   = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	htmlHeadingIDRE  = regexp.MustCompile(`(?i)<h[1-6][^>]*\sid=["']([^"']+)["']`)
+	inlineMarkupChar = strings.NewReplacer("`", "", "*", "")
+)
+
+// headingAnchors returns the anchors Hugo generates for the headings in the
+// body of the page at rel, in the order they appear.
+// Anchors are generated in the same way as Hugo's default 'github' heading ID
+// type, honouring custom '{#id}' attributes.
+func headingAnchors(rel string, body []byte) []string {
+	switch lowerExt(rel) {
+	case ".html", ".htm":
+		var anchors []string
+		for _, m := range htmlHeadingIDRE.FindAllSubmatch(body, -1) {
+			anchors = append(anchors, string(m[1]))
+		}
+		return anchors
+	case ".md", ".markdown":
+	default:
+		return nil
+	}
+
+	var anchors []string
+	seen := make(map[string]int)
+	scanHeadings(body, func(text string) {
+		var id string
+		if m := customHeadingRE.FindStringSubmatch(text); m != nil {
+			id = m[1]
+		} else {
+			id = sanitizeAnchorName(text)
+		}
+		if id == "" {
+			return
+		}
+		if n, ok := seen[id]; ok {
+			seen[id] = n + 1
+			id = fmt.Sprintf("%s-%d", id, n+1)
+		} else {
+			seen[id] = 0
+		}
+		anchors = append(anchors, id)
+	})
+	return anchors
+}
+
+// scanHeadings calls fn with the text of each ATX and setext heading in a
+// Markdown body, in the order they appear, skipping fenced code blocks.
+func scanHeadings(body []byte, fn func(text string)) {
+	var fence, prev string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := fenceRE.FindStringSubmatch(line); m != nil {
+			switch fence {
+			case "":
+				fence = m[1]
+			case m[1]:
+				fence = ""
+			}
+			prev = ""
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+		if m := atxHeadingRE.FindStringSubmatch(line); m != nil {
+			fn(m[2])
+			prev = ""
+			continue
+		}
+		if setextHeadingRE.MatchString(line) && strings.TrimSpace(prev) != "" {
+			fn(strings.TrimSpace(prev))
+			prev = ""
+			continue
+		}
+		prev = line
+	}
+}
+
+// sanitizeAnchorName converts heading text into an anchor in the same way as
+// Hugo's 'github' heading ID type.
+func sanitizeAnchorName(text string) string {
+	text = markdownLinkRE.ReplaceAllString(text, "$1")
+	text = inlineMarkupChar.Replace(text)
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.IsSpace(r):
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// anchorsData is the structure of the heading anchors data file.
+type anchorsData struct {
+	FormatVersion int `json:"formatVersion"`
+	// Versions maps each version name to the page paths in that version, and
+	// the heading anchors on each of those pages.
+	Versions map[string]map[string][]string `json:"versions"`
+}
+
+// buildAnchorsData builds the contents of the heading anchors data file.
+func (st *state) buildAnchorsData(idx *contentIndex) (*anchorsData, error) {
+	data := &anchorsData{FormatVersion: st.opts.Output.DataFormatVersion, Versions: map[string]map[string][]string{}}
+	for _, vers := range idx.versions {
+		pages := map[string][]string{}
+		for pp, rel := range idx.pages[vers] {
+			p, err := st.readPage(filepath.Join(st.versionDir(vers), filepath.FromSlash(rel)))
+			if err != nil {
+				return nil, err
+			}
+			anchors := headingAnchors(rel, p.body)
+			if anchors == nil {
+				anchors = []string{}
+			}
+			pages[pp] = anchors
+		}
+		data.Versions[vers] = pages
+	}
+	return data, nil
+}
@@ -0,0 +1,196 @@
+package multiversion
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// archiveCacheMeta is stored alongside each cached archive and records the
+// validators returned by the server when the archive was downloaded.
+type archiveCacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// fetchArchive downloads and extracts the gzipped tarball at url, returning
+// the path to the extracted tree. If the tarball contains a single top level
+// directory, the path to that directory is returned.
+func (st *state) fetchArchive(log logr.Logger, tmpdir, url, version string) (string, error) {
+	log = log.WithValues("url", url)
+	log.Info("Fetching archive")
+
+	archivePath, err := st.downloadArchive(log, tmpdir, url, version)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(tmpdir, "repo", version)
+	if err := extractTarGz(archivePath, dir); err != nil {
+		return "", fmt.Errorf("extracting archive %q: %v", url, err)
+	}
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(fds) == 1 && fds[0].IsDir() {
+		return filepath.Join(dir, fds[0].Name()), nil
+	}
+	return dir, nil
+}
+
+// downloadArchive downloads the archive at url, returning the path to the
+// downloaded file.
+// If --cache-dir is set, the archive is stored in the cache directory and
+// conditional requests are used so that the archive is only downloaded again
+// if it has changed on the server.
+func (st *state) downloadArchive(log logr.Logger, tmpdir, url, version string) (string, error) {
+	var path, metaPath string
+	var meta archiveCacheMeta
+	if st.opts.Fetch.CacheDir == "" {
+		path = filepath.Join(tmpdir, "archives", version+".tar.gz")
+	} else {
+		sum := sha256.Sum256([]byte(url))
+		key := hex.EncodeToString(sum[:])
+		path = filepath.Join(st.opts.Fetch.CacheDir, "archives", key+".tar.gz")
+		metaPath = filepath.Join(st.opts.Fetch.CacheDir, "archives", key+".json")
+		if data, err := ioutil.ReadFile(metaPath); err == nil {
+			if err := json.Unmarshal(data, &meta); err != nil {
+				log.Error(err, "Ignoring invalid archive cache metadata", "path", metaPath)
+				meta = archiveCacheMeta{}
+			}
+		}
+		if _, err := os.Stat(path); err != nil {
+			meta = archiveCacheMeta{}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(st.runCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Info("Archive has not changed, using cached copy", "path", path)
+		return path, nil
+	case http.StatusOK:
+	default:
+		return "", fmt.Errorf("unexpected status downloading archive %q: %s", url, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	// download to a temporary file first so that an interrupted download
+	// never replaces a good cached copy
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	log.Info("Downloaded archive", "path", path)
+
+	if metaPath == "" {
+		return path, nil
+	}
+	meta = archiveCacheMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(metaPath, data, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// extractTarGz extracts the gzipped tarball at src into the directory dst.
+func extractTarGz(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if target != filepath.Clean(dst) && !strings.HasPrefix(target, filepath.Clean(dst)+string(os.PathSeparator)) {
+			return fmt.Errorf("archive entry %q is outside of the destination directory", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)&os.ModePerm)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package multiversion
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-logr/logr"
+)
+
+// asOfLayouts are the layouts accepted by --as-of.
+var asOfLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"}
+
+// parseAsOf parses the value of --as-of. Dates without a time zone are in UTC,
+// and dates without a time refer to the end of that day.
+func parseAsOf(s string) (time.Time, error) {
+	for _, layout := range asOfLayouts {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date of the form 2006-01-02 or 2006-01-02T15:04:05Z07:00", s)
+}
+
+// validateAsOf returns an error if --as-of is not a valid date, or cannot be
+// used with the other flags.
+func (st *state) validateAsOf() error {
+	if st.opts.Fetch.AsOf == "" {
+		return nil
+	}
+	if _, err := parseAsOf(st.opts.Fetch.AsOf); err != nil {
+		return err
+	}
+	switch {
+	case st.opts.Watch.Enabled:
+		return fmt.Errorf("cannot be used with --watch")
+	case st.opts.Fetch.ReplayDir != "":
+		return fmt.Errorf("cannot be used with --replay, as the recorded commits are used")
+	}
+	return nil
+}
+
+// asOf returns the time versions are built as of, or the zero time if they
+// are built from the current head of their branch.
+func (st *state) asOf() time.Time {
+	if st.opts.Fetch.AsOf == "" {
+		return time.Time{}
+	}
+	// validated when the builder is created
+	t, _ := parseAsOf(st.opts.Fetch.AsOf)
+	return t
+}
+
+// buildTime returns the time the site is built as of, which is used to
+// determine which pages have expired and which versions have reached their
+// end of life.
+func (st *state) buildTime() time.Time {
+	if t := st.asOf(); !t.IsZero() {
+		return t
+	}
+	return time.Now()
+}
+
+// checkoutAsOf checks out the last commit before t in the history of the
+// branch checked out in the repository at dir, using the git binary.
+func (st *state) checkoutAsOf(log logr.Logger, dir, branch string, t time.Time) error {
+	sha, err := st.commandOutput(log, dir, "git", "rev-list", "-1", "--before="+t.Format(time.RFC3339), "HEAD")
+	if err != nil {
+		return err
+	}
+	if sha == "" {
+		return fmt.Errorf("%q has no commits before %s", branch, t.Format(time.RFC3339))
+	}
+	log.Info("Checking out commit as of date", "date", t.Format(time.RFC3339), "commit", sha)
+	_, err = st.commandOutput(log, dir, "git", "checkout", "--quiet", "--detach", sha)
+	return err
+}
+
+// goGitCheckoutAsOf checks out the last commit before t in the history of
+// the branch checked out in the repository r, using go-git.
+func goGitCheckoutAsOf(log logr.Logger, r *git.Repository, branch string, t time.Time) error {
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	iter, err := r.Log(&git.LogOptions{From: head.Hash(), Until: &t, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return err
+	}
+	c, err := iter.Next()
+	iter.Close()
+	if err != nil {
+		return fmt.Errorf("%q has no commits before %s", branch, t.Format(time.RFC3339))
+	}
+	log.Info("Checking out commit as of date", "date", t.Format(time.RFC3339), "commit", c.Hash.String())
+	wt, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	return wt.Checkout(&git.CheckoutOptions{Hash: c.Hash, Force: true})
+}
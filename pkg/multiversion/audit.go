@@ -0,0 +1,342 @@
+package multiversion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// auditLinkRE matches the target of links between pages, which may be
+// relative.
+var auditLinkRE = regexp.MustCompile(`href\s*=\s*["']([^"'#?]+)`)
+
+// auditReport is the structure of the report written by the audit command.
+type auditReport struct {
+	// Deployed is the URL or directory of the deployed site.
+	Deployed string         `json:"deployed"`
+	Versions []auditVersion `json:"versions"`
+}
+
+// auditVersion lists the differences between the deployed and expected
+// pages of a version. Paths are relative to the root of the version.
+type auditVersion struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Missing are the pages that have not been deployed.
+	Missing []string `json:"missing"`
+	// Extra are the deployed pages that are not expected, such as pages
+	// left behind by an older deployment.
+	Extra []string `json:"extra"`
+	// Stale are the deployed pages whose content differs from that expected.
+	Stale []string `json:"stale"`
+}
+
+// problems returns the number of differences found in the version.
+func (v *auditVersion) problems() int {
+	return len(v.Missing) + len(v.Extra) + len(v.Stale)
+}
+
+// deployedSite reads the pages of a deployed site.
+type deployedSite interface {
+	// pages returns the content of every page of the version served at
+	// versionURL, keyed by path relative to that URL, given the pages that
+	// are expected.
+	pages(ctx context.Context, versionURL string, expected map[string]bool) (map[string][]byte, error)
+}
+
+// validateDeployed returns an error if --deployed is neither an HTTP URL nor
+// a directory.
+func (st *state) validateDeployed() error {
+	if !strings.Contains(st.opts.Audit.Deployed, "://") {
+		return nil
+	}
+	u, err := url.Parse(st.opts.Audit.Deployed)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must be an http or https URL, or a directory")
+	}
+	return nil
+}
+
+// runAudit compares the pages of each version of the site deployed at
+// --deployed with those of the site built into --site-dir, logging pages that
+// are missing, extra or stale and writing them to --audit-report if it is
+// set. The deployed site is never modified.
+func (st *state) runAudit(ctx context.Context) error {
+	if st.opts.Audit.Deployed == "" {
+		return fmt.Errorf("--deployed must be specified")
+	}
+	versionMap := st.resolveVersions()
+	if st.opts.Jobs.ManifestDir != "" {
+		var err error
+		if versionMap, err = st.loadManifestVersions(st.opts.Jobs.ManifestDir); err != nil {
+			return err
+		}
+	}
+	if len(versionMap) == 0 {
+		return fmt.Errorf("no versions are configured")
+	}
+
+	var site deployedSite = deployedDir{st: st, dir: st.opts.Audit.Deployed}
+	if strings.Contains(st.opts.Audit.Deployed, "://") {
+		site = &deployedURL{st: st, base: strings.TrimSuffix(st.opts.Audit.Deployed, "/"), client: &http.Client{}}
+	}
+	report := auditReport{Deployed: st.opts.Audit.Deployed, Versions: []auditVersion{}}
+	total := 0
+	for _, vers := range sortedVersionNames(versionMap) {
+		log := st.log.WithValues("version", vers)
+		log.Info("Auditing deployed version", "url", st.versionURL(vers))
+		v, err := st.auditDeployedVersion(ctx, site, vers)
+		if err != nil {
+			return fmt.Errorf("auditing version %q: %v", vers, err)
+		}
+		for _, p := range v.Missing {
+			log.Info("WARNING: page has not been deployed", "page", p)
+		}
+		for _, p := range v.Extra {
+			log.Info("WARNING: deployed page is not expected", "page", p)
+		}
+		for _, p := range v.Stale {
+			log.Info("WARNING: deployed page is stale", "page", p)
+		}
+		total += v.problems()
+		report.Versions = append(report.Versions, *v)
+	}
+
+	if st.opts.Audit.ReportFile != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		st.log.Info("Writing audit report", "path", st.opts.Audit.ReportFile)
+		if err := ioutil.WriteFile(st.opts.Audit.ReportFile, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if total > 0 {
+		return fmt.Errorf("deployed site differs from --site-dir in %d pages", total)
+	}
+	st.log.Info("Deployed site matches --site-dir", "versions", len(report.Versions))
+	return nil
+}
+
+// auditDeployedVersion compares the deployed pages of the named version with
+// those built into --site-dir.
+func (st *state) auditDeployedVersion(ctx context.Context, site deployedSite, vers string) (*auditVersion, error) {
+	u := st.versionURL(vers)
+	dir := filepath.Join(st.opts.Preview.SiteDir, filepath.FromSlash(u))
+	expected, err := listHTMLPages(dir, st.nestedVersionURLDirs(u))
+	if err != nil {
+		return nil, err
+	}
+	if len(expected) == 0 {
+		return nil, fmt.Errorf("no pages found in %q, build the site before auditing it", dir)
+	}
+	deployed, err := site.pages(ctx, u, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &auditVersion{Name: vers, URL: u, Missing: []string{}, Extra: []string{}, Stale: []string{}}
+	for rel := range expected {
+		data, ok := deployed[rel]
+		if !ok {
+			v.Missing = append(v.Missing, rel)
+			continue
+		}
+		want, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(data, want) {
+			v.Stale = append(v.Stale, rel)
+		}
+	}
+	for rel := range deployed {
+		if !expected[rel] {
+			v.Extra = append(v.Extra, rel)
+		}
+	}
+	sort.Strings(v.Missing)
+	sort.Strings(v.Extra)
+	sort.Strings(v.Stale)
+	return v, nil
+}
+
+// listHTMLPages returns the paths of the HTML pages in dir, relative to dir,
+// skipping the directories in skip directly beneath dir.
+// It returns no pages if dir does not exist.
+func listHTMLPages(dir string, skip map[string]bool) (map[string]bool, error) {
+	pages := make(map[string]bool)
+	err := filepath.Walk(dir, skipVersionDirs(dir, skip, func(fp string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && fp == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(fp) != ".html" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		pages[filepath.ToSlash(rel)] = true
+		return nil
+	}))
+	return pages, err
+}
+
+// deployedDir is a deployed site that can be read from a directory, such as
+// a mounted bucket or a copy of the web server's document root.
+type deployedDir struct {
+	st  *state
+	dir string
+}
+
+func (d deployedDir) pages(_ context.Context, versionURL string, _ map[string]bool) (map[string][]byte, error) {
+	dir := filepath.Join(d.dir, filepath.FromSlash(versionURL))
+	rels, err := listHTMLPages(dir, d.st.nestedVersionURLDirs(versionURL))
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string][]byte, len(rels))
+	for rel := range rels {
+		if pages[rel], err = ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// deployedURL is a deployed site that is crawled over HTTP. Every expected
+// page is fetched, and pages linked to from the fetched pages are followed to
+// find pages that are not expected.
+type deployedURL struct {
+	st     *state
+	base   string
+	client *http.Client
+}
+
+func (d *deployedURL) pages(ctx context.Context, versionURL string, expected map[string]bool) (map[string][]byte, error) {
+	c := &crawl{
+		site:       d,
+		versionURL: versionURL,
+		visited:    make(map[string]bool),
+		pages:      make(map[string][]byte),
+		sem:        make(chan struct{}, d.st.opts.Audit.Concurrency),
+	}
+	c.visit(ctx, "index.html")
+	for rel := range expected {
+		c.visit(ctx, rel)
+	}
+	c.wg.Wait()
+	return c.pages, c.err
+}
+
+// crawl is the state of crawling a single version of a deployed site.
+type crawl struct {
+	site       *deployedURL
+	versionURL string
+	sem        chan struct{}
+	wg         sync.WaitGroup
+
+	mu      sync.Mutex
+	visited map[string]bool
+	pages   map[string][]byte
+	err     error
+}
+
+// visit fetches the page at rel, relative to the version's URL, and then
+// visits the pages it links to, unless it has already been visited.
+func (c *crawl) visit(ctx context.Context, rel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.visited[rel] || c.err != nil {
+		return
+	}
+	c.visited[rel] = true
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.sem <- struct{}{}
+		data, err := c.fetch(ctx, rel)
+		<-c.sem
+
+		c.mu.Lock()
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		if data != nil {
+			c.pages[rel] = data
+		}
+		c.mu.Unlock()
+		for _, link := range c.links(rel, data) {
+			c.visit(ctx, link)
+		}
+	}()
+}
+
+// fetch returns the content of the page at rel, or nil if it does not exist.
+func (c *crawl) fetch(ctx context.Context, rel string) ([]byte, error) {
+	u := c.site.base + c.versionURL + strings.TrimSuffix(rel, "index.html")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.site.st.log.V(4).Info("Fetching deployed page", "url", u)
+	resp, err := c.site.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching %q: unexpected status %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// links returns the pages within the version that the page at rel links to,
+// relative to the version's URL.
+func (c *crawl) links(rel string, data []byte) []string {
+	base, err := url.Parse(c.site.base + c.versionURL + rel)
+	if err != nil {
+		return nil
+	}
+	var links []string
+	for _, m := range auditLinkRE.FindAllSubmatch(data, -1) {
+		target, err := base.Parse(string(m[1]))
+		if err != nil || target.Host != base.Host || !strings.HasPrefix(target.Path, c.versionURL) {
+			continue
+		}
+		link := strings.TrimPrefix(target.Path, c.versionURL)
+		if c.site.st.nestedVersionURLDirs(c.versionURL)[strings.SplitN(link, "/", 2)[0]] {
+			continue
+		}
+		switch {
+		case link == "" || strings.HasSuffix(link, "/"):
+			link += "index.html"
+		case path.Ext(link) != ".html":
+			continue
+		}
+		links = append(links, link)
+	}
+	return links
+}
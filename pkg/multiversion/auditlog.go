@@ -0,0 +1,271 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditCreated  = "create"
+	auditModified = "modify"
+	auditDeleted  = "delete"
+)
+
+// auditLogEntry is a line of --audit-log, recording a change made to a file in
+// the output directory.
+type auditLogEntry struct {
+	Time string `json:"time"`
+	// Run identifies the build or rebuild that made the change.
+	Run string `json:"run"`
+	// Op is one of 'create', 'modify' or 'delete'.
+	Op string `json:"op"`
+	// Path is the path of the file, beneath --output-dir.
+	Path string `json:"path"`
+	// Version is the version the file belongs to, if any.
+	Version string `json:"version,omitempty"`
+	// Rule is the step of the build that made the change.
+	Rule string `json:"rule"`
+}
+
+// auditLog appends every change made to the output directory to
+// --audit-log. The steps of a build that change the output run one at a
+// time, and each sets the version and rule its changes are attributed to with
+// auditStep.
+type auditLog struct {
+	st      *state
+	mu      sync.Mutex
+	f       *os.File
+	run     string
+	version string
+	rule    string
+	// dirs maps the directory of each version, relative to the output
+	// directory, to its name.
+	dirs map[string]string
+}
+
+// openAuditLog opens --audit-log for appending, and records every change
+// made to the output from then on. The versions are used to attribute
+// changes made by steps that apply to every version.
+func (st *state) openAuditLog(versionMap map[string]string) error {
+	if st.opts.Output.AuditLog == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(st.opts.Output.AuditLog), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(st.opts.Output.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l := &auditLog{st: st, f: f, run: randomID(8), dirs: map[string]string{}}
+	for vers := range versionMap {
+		l.dirs[filepath.ToSlash(st.versionPath(vers))] = vers
+	}
+	st.outputAudit, st.output = l, st.auditOutput(st.output)
+	return nil
+}
+
+// closeAuditLog stops recording changes to the output.
+func (st *state) closeAuditLog() {
+	if st.outputAudit == nil {
+		return
+	}
+	st.outputAudit.f.Close()
+	st.outputAudit = nil
+	if a, ok := st.output.(auditLinkFS); ok {
+		st.output = a.outputFS
+	} else if a, ok := st.output.(auditFS); ok {
+		st.output = a.outputFS
+	}
+}
+
+// auditStep attributes the changes made from now on to the given version and
+// rule. An empty version attributes each change to the version whose
+// directory the file is in.
+func (st *state) auditStep(version, rule string) {
+	if st.outputAudit == nil {
+		return
+	}
+	st.outputAudit.mu.Lock()
+	defer st.outputAudit.mu.Unlock()
+	st.outputAudit.version, st.outputAudit.rule = version, rule
+}
+
+// newAuditRun gives the changes made from now on a new run ID, for rebuilds
+// in watch mode.
+func (st *state) newAuditRun() {
+	if st.outputAudit == nil {
+		return
+	}
+	st.outputAudit.mu.Lock()
+	defer st.outputAudit.mu.Unlock()
+	st.outputAudit.run = randomID(8)
+}
+
+// record appends a change to the file at fp to the log. Changes to the
+// temporary files that are renamed over the files they replace, and to files
+// outside the output directory such as those staged by --delta-sync, are not
+// recorded.
+func (l *auditLog) record(op, fp string) {
+	if l == nil || strings.HasSuffix(fp, ".multiversion-tmp") || strings.HasSuffix(fp, ".multiversion-link") {
+		return
+	}
+	rel, err := filepath.Rel(l.st.finalOutputDir(), fp)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	version := l.version
+	if version == "" {
+		version = l.versionOf(filepath.ToSlash(rel))
+	}
+	data, err := json.Marshal(auditLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Run:     l.run,
+		Op:      op,
+		Path:    filepath.ToSlash(fp),
+		Version: version,
+		Rule:    l.rule,
+	})
+	if err != nil {
+		return
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		l.st.log.Info("WARNING: failed to write to audit log", "path", l.st.opts.Output.AuditLog, "error", err.Error())
+	}
+}
+
+// recordRemoval records the deletion of every file beneath fp, which must be
+// called before they are removed.
+func (l *auditLog) recordRemoval(walk func(string, filepath.WalkFunc) error, fp string) {
+	if l == nil {
+		return
+	}
+	walk(fp, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			l.record(auditDeleted, p)
+		}
+		return nil
+	})
+}
+
+// versionOf returns the version whose directory contains the file at rel,
+// relative to the output directory. l.mu must be held.
+func (l *auditLog) versionOf(rel string) string {
+	version, longest := l.dirs[""], -1
+	for dir, vers := range l.dirs {
+		if dir != "" && len(dir) > longest && (rel == dir || strings.HasPrefix(rel, dir+"/")) {
+			version, longest = vers, len(dir)
+		}
+	}
+	return version
+}
+
+// changeOp returns the operation recorded for writing to the file at name.
+func changeOp(fs outputFS, name string) string {
+	if _, err := fs.Stat(name); err == nil {
+		return auditModified
+	}
+	return auditCreated
+}
+
+// auditFS is an outputFS recording the changes made through it to the audit
+// log.
+type auditFS struct {
+	outputFS
+	st *state
+}
+
+// auditLinkFS is an auditFS for an output that supports links.
+type auditLinkFS struct {
+	auditFS
+	links linkFS
+}
+
+// auditOutput returns fs wrapped so that changes made through it are recorded
+// to the audit log.
+func (st *state) auditOutput(fs outputFS) outputFS {
+	a := auditFS{outputFS: fs, st: st}
+	if l, ok := fs.(linkFS); ok {
+		return auditLinkFS{auditFS: a, links: l}
+	}
+	return a
+}
+
+func (a auditFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	op := changeOp(a.outputFS, name)
+	w, err := a.outputFS.Create(name, perm)
+	if err == nil {
+		a.st.outputAudit.record(op, name)
+	}
+	return w, err
+}
+
+func (a auditFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	op := changeOp(a.outputFS, name)
+	err := a.outputFS.WriteFile(name, data, perm)
+	if err == nil {
+		a.st.outputAudit.record(op, name)
+	}
+	return err
+}
+
+func (a auditFS) Rename(oldname, newname string) error {
+	op := changeOp(a.outputFS, newname)
+	err := a.outputFS.Rename(oldname, newname)
+	if err == nil {
+		a.st.outputAudit.record(auditDeleted, oldname)
+		a.st.outputAudit.record(op, newname)
+	}
+	return err
+}
+
+func (a auditFS) Remove(name string) error {
+	info, statErr := a.outputFS.Stat(name)
+	err := a.outputFS.Remove(name)
+	if err == nil && statErr == nil && !info.IsDir() {
+		a.st.outputAudit.record(auditDeleted, name)
+	}
+	return err
+}
+
+func (a auditFS) RemoveAll(name string) error {
+	var removed []string
+	a.outputFS.Walk(name, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			removed = append(removed, p)
+		}
+		return nil
+	})
+	err := a.outputFS.RemoveAll(name)
+	if err == nil {
+		for _, p := range removed {
+			a.st.outputAudit.record(auditDeleted, p)
+		}
+	}
+	return err
+}
+
+func (a auditLinkFS) Link(oldname, newname string) error {
+	op := changeOp(a.outputFS, newname)
+	err := a.links.Link(oldname, newname)
+	if err == nil {
+		a.st.outputAudit.record(op, newname)
+	}
+	return err
+}
+
+func (a auditLinkFS) Symlink(oldname, newname string) error {
+	op := changeOp(a.outputFS, newname)
+	err := a.links.Symlink(oldname, newname)
+	if err == nil {
+		a.st.outputAudit.record(op, newname)
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// backportResult is the outcome of backporting to a single version.
+type backportResult struct {
+	version string
+	branch  string
+	// backportBranch is the branch the commits were applied on.
+	backportBranch string
+	err            error
+}
+
+// runBackport cherry-picks the given commits onto the branch of every version
+// passed to --to-versions, or every configured version if it is not set.
+// Versions are only reported on unless --push or --create-prs is set.
+func (st *state) runBackport(commits []string) error {
+	if len(commits) == 0 {
+		return fmt.Errorf("at least one commit to backport must be specified")
+	}
+	if st.opts.Fetch.RepoURL == "" {
+		return fmt.Errorf("--repo-url must be specified")
+	}
+	versionMap := st.resolveVersions()
+	targets := versionMap
+	if len(st.opts.Backport.Versions) > 0 {
+		targets = make(map[string]string)
+		for _, vers := range st.opts.Backport.Versions {
+			branch, ok := versionMap[vers]
+			if !ok {
+				return fmt.Errorf("version %q passed to --to-versions is not configured", vers)
+			}
+			targets[vers] = branch
+		}
+	}
+
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(st.log, tmpdir)
+	dir := filepath.Join(tmpdir, "repo")
+	if err := st.runCommand(st.log, "git", "clone", "--no-checkout", st.opts.Fetch.RepoURL, dir); err != nil {
+		return err
+	}
+
+	var results []backportResult
+	seen := make(map[string]bool)
+	for _, vers := range sortedVersionNames(targets) {
+		branch := targets[vers]
+		// versions may share a branch, which only needs backporting once
+		if seen[branch] {
+			continue
+		}
+		seen[branch] = true
+		log := st.log.WithValues("version", vers, "branch", branch)
+		r := backportResult{version: vers, branch: branch, backportBranch: backportBranchName(commits, branch)}
+		r.err = st.backport(log, dir, r.backportBranch, branch, commits)
+		if r.err == nil && (st.opts.Backport.Push || st.opts.Backport.CreatePRs) {
+			r.err = st.runCommand(log, "git", "-C", dir, "push", "origin", r.backportBranch)
+		}
+		if r.err == nil && st.opts.Backport.CreatePRs {
+			var prURL string
+			if prURL, r.err = st.createPullRequest(log, r.backportBranch, branch, st.backportTitle(log, dir, commits, branch)); r.err == nil {
+				log.Info("Created pull request", "url", prURL)
+			}
+		}
+		results = append(results, r)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			st.log.Info("WARNING: failed to backport", "version", r.version, "branch", r.branch, "error", r.err.Error())
+			continue
+		}
+		st.log.Info("Backported cleanly", "version", r.version, "branch", r.branch, "backportBranch", r.backportBranch)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to backport to %d of %d branches", failed, len(results))
+	}
+	return nil
+}
+
+// backportBranchName returns the name of the branch the commits are applied
+// on for the given target branch.
+func backportBranchName(commits []string, branch string) string {
+	id := commits[0]
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return "backport/" + id + "/" + branch
+}
+
+// backport creates backportBranch from the target branch and cherry-picks the
+// commits onto it. The cherry-pick is aborted if it does not apply cleanly.
+func (st *state) backport(log logr.Logger, dir, backportBranch, branch string, commits []string) error {
+	if err := st.runCommand(log, "git", "-C", dir, "checkout", "-B", backportBranch, "origin/"+branch); err != nil {
+		return err
+	}
+	args := append([]string{"-C", dir, "cherry-pick", "-x"}, commits...)
+	out, err := st.processCombinedOutput(newCommand("git", args...))
+	if err == nil {
+		return nil
+	}
+	conflicts, _ := st.commandOutput(log, dir, "git", "diff", "--name-only", "--diff-filter=U")
+	// leave the repository clean for the next branch
+	st.runProcess(newCommand("git", "-C", dir, "cherry-pick", "--abort"))
+	if conflicts != "" {
+		return fmt.Errorf("cherry-pick conflicts in %s", strings.Join(strings.Fields(conflicts), ", "))
+	}
+	return fmt.Errorf("cherry-pick failed: %s", strings.TrimSpace(string(out)))
+}
+
+// backportTitle returns the title used for the pull request backporting the
+// commits to branch.
+func (st *state) backportTitle(log logr.Logger, dir string, commits []string, branch string) string {
+	subject, err := st.commandOutput(log, dir, "git", "log", "-1", "--format=%s", commits[0])
+	if err != nil || subject == "" {
+		subject = "Backport " + strings.Join(commits, ", ")
+	}
+	return fmt.Sprintf("[%s] %s", branch, subject)
+}
+
+// createPullRequest opens a pull request (or merge request) from head into
+// base using the API of the forge hosting --repo-url, returning its URL.
+// GitHub and GitLab are supported, authenticating with the GITHUB_TOKEN or
+// GITLAB_TOKEN environment variables.
+func (st *state) createPullRequest(log logr.Logger, head, base, title string) (string, error) {
+	web := repoWebURL(st.opts.Fetch.RepoURL)
+	if web == "" {
+		return "", fmt.Errorf("--repo-url %q is not hosted by a forge", st.opts.Fetch.RepoURL)
+	}
+	u, err := url.Parse(web)
+	if err != nil {
+		return "", err
+	}
+	project := strings.Trim(u.Path, "/")
+	body := "Automated backport created by hugo-multiversion."
+
+	var apiURL, token, authHeader, authValue string
+	var payload interface{}
+	switch {
+	case strings.Contains(u.Host, "gitlab"):
+		apiURL = fmt.Sprintf("%s/projects/%s/merge_requests", forgeAPIURL(forgeGitLab, u.Host), url.PathEscape(project))
+		token = os.Getenv("GITLAB_TOKEN")
+		authHeader, authValue = "PRIVATE-TOKEN", token
+		payload = map[string]string{"source_branch": head, "target_branch": base, "title": title, "description": body}
+	default:
+		apiURL = fmt.Sprintf("%s/repos/%s/pulls", forgeAPIURL(forgeGitHub, u.Host), project)
+		token = os.Getenv("GITHUB_TOKEN")
+		authHeader, authValue = "Authorization", "token "+token
+		payload = map[string]string{"head": head, "base": base, "title": title, "body": body}
+	}
+	if token == "" {
+		return "", fmt.Errorf("no API token set for %s", u.Host)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(st.runCtx, http.MethodPost, apiURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(authHeader, authValue)
+	req.Header.Set("Content-Type", "application/json")
+	log.V(4).Info("Creating pull request", "url", apiURL, "head", head, "base", base)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("creating pull request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	var created struct {
+		HTMLURL string `json:"html_url"`
+		WebURL  string `json:"web_url"`
+	}
+	if err := json.Unmarshal(respBody, &created); err != nil {
+		return "", err
+	}
+	if created.HTMLURL != "" {
+		return created.HTMLURL, nil
+	}
+	return created.WebURL, nil
+}
@@ -0,0 +1,160 @@
+package multiversion
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// bucketSyncer uploads a local directory to a prefix of an object storage
+// bucket, only uploading files that have changed.
+type bucketSyncer interface {
+	// bin returns the path of the CLI the syncer runs.
+	bin(o *BucketOptions) string
+	// sync returns the command that uploads dir to the prefix of the bucket
+	// at dst, deleting objects beneath it that are not in dir if o.Delete is
+	// set.
+	sync(o *BucketOptions, dir, dst string) (name string, args []string)
+}
+
+// bucketSyncers maps each supported bucket URL scheme to the syncer used to
+// upload to it. Each shells out to the storage provider's CLI, which reads
+// credentials from its usual configuration and environment variables.
+var bucketSyncers = map[string]bucketSyncer{
+	"s3":    s3Syncer{},
+	"gs":    gcsSyncer{},
+	"https": azureSyncer{},
+}
+
+// s3Syncer uploads to Amazon S3 with 'aws s3 sync'.
+type s3Syncer struct{}
+
+func (s3Syncer) bin(o *BucketOptions) string { return o.AWSBin }
+
+func (s s3Syncer) sync(o *BucketOptions, dir, dst string) (string, []string) {
+	args := []string{"s3", "sync", "--no-progress", dir, dst}
+	if o.Delete {
+		args = append(args, "--delete")
+	}
+	return s.bin(o), args
+}
+
+// gcsSyncer uploads to Google Cloud Storage with 'gcloud storage rsync'.
+type gcsSyncer struct{}
+
+func (gcsSyncer) bin(o *BucketOptions) string { return o.GCloudBin }
+
+func (s gcsSyncer) sync(o *BucketOptions, dir, dst string) (string, []string) {
+	args := []string{"storage", "rsync", "--recursive", dir, dst}
+	if o.Delete {
+		args = append(args, "--delete-unmatched-destination-objects")
+	}
+	return s.bin(o), args
+}
+
+// azureSyncer uploads to Azure Blob Storage with 'azcopy sync'. Bucket URLs
+// are the URLs of a container, optionally followed by a prefix.
+type azureSyncer struct{}
+
+func (azureSyncer) bin(o *BucketOptions) string { return o.AzCopyBin }
+
+func (s azureSyncer) sync(o *BucketOptions, dir, dst string) (string, []string) {
+	return s.bin(o), []string{"sync", dir, dst, "--recursive", fmt.Sprintf("--delete-destination=%t", o.Delete)}
+}
+
+// validateBucket returns an error if --bucket is not a supported bucket URL,
+// cannot be used with the other flags, or if the CLI used to upload to it is
+// not installed, so that a build does not fail only once it has completed.
+func (st *state) validateBucket() error {
+	if st.opts.Bucket.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(st.opts.Bucket.URL)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bucketSyncers[u.Scheme] == nil || u.Host == "":
+		return fmt.Errorf("must be an s3://, gs:// or Azure Blob Storage https:// URL of a bucket")
+	case u.Scheme == "https" && !strings.HasSuffix(u.Host, ".blob.core.windows.net"):
+		return fmt.Errorf("https:// URLs must be Azure Blob Storage URLs of the form https://<account>.blob.core.windows.net/<container>")
+	case st.opts.Watch.Enabled:
+		return fmt.Errorf("cannot be used with --watch")
+	case st.opts.Hugo.Run && st.isHugoServer():
+		return fmt.Errorf("cannot be used when running a Hugo server")
+	case st.opts.Output.Archive != "":
+		return fmt.Errorf("cannot be used with --output, as content is not written to disk")
+	case st.opts.Bucket.Dir == "" && !st.opts.Hugo.Run && (st.opts.Output.CopyMode == copyModeSymlink || st.opts.Output.CopyMode == copyModeMount):
+		return fmt.Errorf("cannot upload the output directory with --copy-mode=%s, as versions are not copied into it", st.opts.Output.CopyMode)
+	}
+	if _, err := exec.LookPath(bucketSyncers[u.Scheme].bin(&st.opts.Bucket)); err != nil {
+		return fmt.Errorf("the storage provider's CLI is required to upload to the bucket: %v", err)
+	}
+	return nil
+}
+
+// bucketSourceDir returns the directory uploaded to the bucket, chosen as for
+// container images, and whether versions are found in it at their URL, as in
+// Hugo's rendered site, rather than at their directory in the output
+// directory.
+func (st *state) bucketSourceDir() (string, bool) {
+	switch {
+	case st.opts.Bucket.Dir != "":
+		return st.opts.Bucket.Dir, st.opts.Hugo.Run
+	case st.opts.Hugo.Run:
+		return filepath.Join(st.opts.Hugo.SiteRoot, "public"), true
+	}
+	return st.opts.Output.Dir, false
+}
+
+// syncBucket uploads the assembled site to --bucket once the build has
+// completed. With --only-versions, each built version is uploaded to its own
+// prefix within the bucket and nothing else is touched, so that jobs building
+// different versions can upload in parallel. Otherwise the whole site is
+// uploaded in one go.
+func (st *state) syncBucket(log logr.Logger) error {
+	u, err := url.Parse(st.opts.Bucket.URL)
+	if err != nil {
+		return err
+	}
+	syncer := bucketSyncers[u.Scheme]
+	dir, rendered := st.bucketSourceDir()
+	// the prefix is joined to the path, as Azure URLs may be followed by a
+	// SAS token
+	prefix := func(rel string) string {
+		dst := *u
+		dst.Path = strings.TrimSuffix(path.Join("/", u.Path, rel), "/") + "/"
+		return dst.String()
+	}
+	if len(st.opts.Jobs.OnlyVersions) == 0 {
+		return st.runBucketSync(log, syncer, dir, prefix(""))
+	}
+	for _, vers := range st.opts.Jobs.OnlyVersions {
+		rel := st.versionPath(vers)
+		if rendered {
+			rel = strings.Trim(st.versionURL(vers), "/")
+		}
+		if rel == "" {
+			return fmt.Errorf("version %q is served from the root of the site, and cannot be uploaded to a prefix of its own", vers)
+		}
+		if err := st.runBucketSync(log.WithValues("version", vers), syncer, filepath.Join(dir, filepath.FromSlash(rel)), prefix(rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBucketSync uploads dir to dst with the syncer.
+func (st *state) runBucketSync(log logr.Logger, syncer bucketSyncer, dir, dst string) error {
+	name, args := syncer.sync(&st.opts.Bucket, dir, dst)
+	log.Info("Uploading to bucket", "directory", dir, "destination", dst, "delete", st.opts.Bucket.Delete)
+	if err := st.runCommand(log, name, args...); err != nil {
+		return fmt.Errorf("uploading %s to %s: %v", dir, dst, err)
+	}
+	return nil
+}
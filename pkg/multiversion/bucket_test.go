@@ -0,0 +1,39 @@
+package multiversion
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateBucketRequiresCLI(t *testing.T) {
+	installed, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip("no 'true' binary to stand in for the aws CLI")
+	}
+	tests := []struct {
+		name    string
+		bin     string
+		wantErr string
+	}{
+		{name: "installed", bin: installed},
+		{name: "missing", bin: filepath.Join(t.TempDir(), "aws"), wantErr: "--bucket is invalid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := testConfig(t, "https://github.com/org/repo.git", "v1.0=release-1.0")
+			c.Bucket.URL = "s3://docs-bucket/site"
+			c.Bucket.AWSBin = test.bin
+			var logged []string
+			c.Log = recordingLogger{testLogger{t: t}, &logged}
+			_, err := New(c)
+			if gotErr := err != nil; gotErr != (test.wantErr != "") {
+				t.Fatalf("got error %v, want error: %t", err, test.wantErr != "")
+			}
+			if test.wantErr != "" && !strings.Contains(strings.Join(logged, "\n"), test.wantErr) {
+				t.Errorf("got logs %q, want %q", logged, test.wantErr)
+			}
+		})
+	}
+}
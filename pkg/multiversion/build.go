@@ -0,0 +1,1141 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// validate logs each problem with the options of the builder, returning false
+// if there are any.
+func (st *state) validate() bool {
+	valid := true
+	if st.opts.Fetch.ReplayDir != "" && st.opts.Fetch.RecordDir != "" {
+		st.log.Info("--record and --replay cannot be used together")
+		valid = false
+	}
+	valid = st.notEmpty("repo-content-dir", st.opts.Fetch.RepoContentDir) && valid
+	valid = st.notEmpty("output-dir", st.opts.Output.Dir) && valid
+	if err := st.validateOutputCompat(); err != nil {
+		st.log.Info("--output-compat is invalid: " + err.Error())
+		valid = false
+	}
+	if err := validateDataFormatVersion(st.opts.Output.DataFormatVersion); err != nil {
+		st.log.Info("--data-format-version is invalid: " + err.Error())
+		valid = false
+	}
+	if err := validateChecks(st.opts.Checks.Enabled); err != nil {
+		st.log.Info("--checks is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateLanguages(); err != nil {
+		st.log.Info("--languages is invalid: " + err.Error())
+		valid = false
+	}
+	if st.opts.Fetch.FetchConcurrency < 1 {
+		st.log.Info("--fetch-concurrency must be at least 1")
+		valid = false
+	}
+	if st.opts.Output.CopyConcurrency < 1 {
+		st.log.Info("--copy-concurrency must be at least 1")
+		valid = false
+	}
+	if err := st.validateDeltaSync(); err != nil {
+		st.log.Info("--delta-sync is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateWatch(); err != nil {
+		st.log.Info("--watch is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateReviewRouting(); err != nil {
+		st.log.Info("--review-routing-file is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateMetrics(); err != nil {
+		st.log.Info("--metrics-listen is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateOutput(); err != nil {
+		st.log.Info("--output is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validatePublishBranch(); err != nil {
+		st.log.Info("--publish-branch is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateBucket(); err != nil {
+		st.log.Info("--bucket is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateOutputFormat(); err != nil {
+		st.log.Info("--output-format is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateOCI(); err != nil {
+		st.log.Info("--oci-repo is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateImage(); err != nil {
+		st.log.Info("--image is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateExtraDirs(); err != nil {
+		st.log.Info("--extra-dirs is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateAsOf(); err != nil {
+		st.log.Info("--as-of is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateKeepGoing(); err != nil {
+		st.log.Info("--keep-going is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateBuildReport(); err != nil {
+		st.log.Info("--build-report is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateSnapshotTag(); err != nil {
+		st.log.Info("--snapshot-tag is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateImportFrom(); err != nil {
+		st.log.Info("--import-from is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateDiffThreshold(); err != nil {
+		st.log.Info("--diff-threshold is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateDeployed(); err != nil {
+		st.log.Info("--deployed is invalid: " + err.Error())
+		valid = false
+	}
+	if st.opts.Audit.Concurrency < 1 {
+		st.log.Info("--audit-concurrency must be at least 1")
+		valid = false
+	}
+	if f := st.opts.Fetch.Fetcher; f != fetcherGit && f != fetcherGoGit {
+		st.log.Info("--fetcher must be one of 'git' or 'go-git'")
+		valid = false
+	}
+	if err := st.validateCopyMode(st.opts.Output.CopyMode); err != nil {
+		st.log.Info("--copy-mode is invalid: " + err.Error())
+		valid = false
+	}
+	if err := validateDedupeMode(st.opts.Output.DedupeMode); err != nil {
+		st.log.Info("--dedupe-assets is invalid: " + err.Error())
+		valid = false
+	}
+	if err := validateRedirectsFormat(st.opts.Output.RedirectsFormat); err != nil {
+		st.log.Info("--redirects-format is invalid: " + err.Error())
+		valid = false
+	}
+	if st.opts.Output.RedirectEOL && st.opts.Output.RedirectsFormat == "" {
+		st.log.Info("--redirect-eol requires --redirects-format to be set")
+		valid = false
+	}
+	if err := st.validateRewriteRefs(); err != nil {
+		st.log.Info("--rewrite-refs is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateNonLatestList(); err != nil {
+		st.log.Info("--non-latest-list is invalid: " + err.Error())
+		valid = false
+	}
+	if err := validateVersionAliasStrategy(st.opts.Output.VersionAliasStrategy); err != nil {
+		st.log.Info("--version-alias-strategy is invalid: " + err.Error())
+		valid = false
+	}
+	if st.opts.Fetch.MaxVersions < 0 {
+		st.log.Info("--max-versions is invalid: must not be negative")
+		valid = false
+	}
+	if err := st.validateMinVersion(); err != nil {
+		st.log.Info("--min-version is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateRootVersion(); err != nil {
+		st.log.Info("--root-version is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validatePreviewBuild(); err != nil {
+		st.log.Info("--preview-branch is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateOTLPEndpoint(); err != nil {
+		st.log.Info("--otlp-endpoint is invalid: " + err.Error())
+		valid = false
+	}
+	if _, err := st.otlpHeaders(); err != nil {
+		st.log.Info("--otlp-headers is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateAlgolia(); err != nil {
+		st.log.Info("--algolia-index is invalid: " + err.Error())
+		valid = false
+	}
+	if u := st.opts.Search.AlgoliaURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		st.log.Info("--algolia-url is invalid: " + fmt.Sprintf("%q must be an http:// or https:// URL", u))
+		valid = false
+	}
+	if st.opts.Search.Prune && st.opts.Search.AlgoliaIndex == "" {
+		st.log.Info("--search-prune requires --algolia-index to be set")
+		valid = false
+	}
+	if err := st.validateKeepBuilds(); err != nil {
+		st.log.Info("--keep-builds is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateStore(); err != nil {
+		st.log.Info("--store-dir is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateSitemaps(); err != nil {
+		st.log.Info("--base-url is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateInjectFailures(); err != nil {
+		st.log.Info("--inject-failure is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateNormalizeFilenames(); err != nil {
+		st.log.Info("--normalize-filenames is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateVersionsExport(); err != nil {
+		st.log.Info("--versions-format is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateDocsyVersionsFile(); err != nil {
+		st.log.Info("--docsy-versions-file is invalid: " + err.Error())
+		valid = false
+	}
+	if err := st.validateVersionRefs(); err != nil {
+		st.log.Info("--branches is invalid: " + err.Error())
+		valid = false
+	}
+	return valid
+}
+
+func (st *state) notEmpty(name, val string) bool {
+	if val == "" {
+		st.log.Info("--" + name + " must be specified")
+		return false
+	}
+	return true
+}
+
+// parseBranchesFlag converts a list of a=b mapping strings into a map.
+// If one of the elements of 'branches' does not contain an = sign, the string
+// value will be used as both the version name and branch name in the map.
+func parseBranchesFlag(branches []string) map[string]string {
+	out := make(map[string]string)
+	for _, b := range branches {
+		splitStr := strings.Split(b, "=")
+		// no = sign, use the string as the version number and branch name
+		if len(splitStr) == 1 {
+			out[b] = b
+			continue
+		}
+		out[splitStr[0]] = strings.Join(splitStr[1:], "")
+	}
+	return out
+}
+
+// fetchRepository will use the system installed git command to fetch a copy of
+// the repository at the specified revision
+func (st *state) fetchRepository(log logr.Logger, tmpdir string, remote *Remote, version, branchName string) (string, error) {
+	log.Info("Fetching repository at revision", "repo", remote.URL)
+	env, err := remote.env()
+	if err != nil {
+		return "", err
+	}
+	cloneDir := filepath.Join(tmpdir, "repo", version)
+	if refKind(branchName) != refBranch {
+		// 'clone -b' only accepts branch and tag names
+		return cloneDir, st.fetchRef(log, env, remote, cloneDir, branchName)
+	}
+	if st.opts.Fetch.CacheDir != "" {
+		return st.fetchCachedClone(log, env, remote, version, branchName)
+	}
+	if err := st.runCommandEnv(log, env, "git", "clone", "-b", branchName, remote.URL, cloneDir); err != nil {
+		return "", err
+	}
+	return cloneDir, nil
+}
+
+// fetchVersion fetches the source tree of a version with its fetcher,
+// returning the path to the root of the tree.
+func (st *state) fetchVersion(ctx context.Context, tmpdir, version, branchName string, vc *VersionConfig) (string, error) {
+	return st.fetcherFor(version, vc).Fetch(ctx, Version{Name: version, Branch: branchName, TempDir: tmpdir, AsOf: st.asOf(), st: st})
+}
+
+// configuredVersions returns the map of version name to branch name for every
+// version configured with flags and the config file.
+func (st *state) configuredVersions() map[string]string {
+	versionMap := parseBranchesFlag(st.opts.Fetch.Branches)
+	if st.opts.Fetch.LatestBranch != "" {
+		versionMap[latestVersion] = st.opts.Fetch.LatestBranch
+	}
+	for vers, dv := range st.discoveredVersions {
+		if _, ok := versionMap[vers]; !ok {
+			versionMap[vers] = dv.ref
+		}
+	}
+	for vers, vc := range st.opts.Versions {
+		if vc != nil && vc.Branch != "" {
+			versionMap[vers] = vc.Branch
+		} else if _, ok := versionMap[vers]; !ok {
+			versionMap[vers] = vers
+		}
+	}
+	return versionMap
+}
+
+// resolveVersions returns the versions to build, mapped to their branches,
+// excluding those removed by --max-versions and --min-version, and including
+// the version built from --preview-branch.
+func (st *state) resolveVersions() map[string]string {
+	versionMap := st.limitVersions(st.configuredVersions())
+	if vers := st.previewVersion(); vers != "" {
+		versionMap[vers] = st.opts.Fetch.PreviewBranch
+	}
+	return versionMap
+}
+
+func (st *state) run(ctx context.Context, res *Result) error {
+	resolve := st.runSpan.child("resolve")
+	defer resolve.finish(nil)
+	versionMap := st.resolveVersions()
+	st.useStore()
+	if err := st.openAuditLog(versionMap); err != nil {
+		st.log.Error(err, "Failed to open audit log", "path", st.opts.Output.AuditLog)
+		resolve.finish(err)
+		return err
+	}
+	defer st.closeAuditLog()
+	if len(st.opts.Languages.Languages) > 0 {
+		res.Versions = sortedVersionNames(versionMap)
+		return st.runLanguageMatrix(ctx, versionMap)
+	}
+	var rec *recording
+	switch {
+	case st.opts.Fetch.ReplayDir != "":
+		var err error
+		if rec, err = loadRecording(st.opts.Fetch.ReplayDir); err != nil {
+			st.log.Error(err, "Failed to load recording", "path", st.opts.Fetch.ReplayDir)
+			resolve.finish(err)
+			return err
+		}
+		versionMap = rec.versionMap()
+		st.opts.Fetch.RepoURL, st.opts.Fetch.RepoContentDir = rec.RepoURL, rec.RepoContentDir
+	case st.opts.Fetch.RecordDir != "":
+		if err := os.MkdirAll(st.opts.Fetch.RecordDir, 0755); err != nil {
+			return err
+		}
+		rec = &recording{RepoURL: st.opts.Fetch.RepoURL, RepoContentDir: st.opts.Fetch.RepoContentDir}
+	}
+
+	if st.opts.Jobs.FinalizeOnly {
+		if st.opts.Jobs.ManifestDir != "" {
+			var err error
+			if versionMap, err = st.loadManifestVersions(st.opts.Jobs.ManifestDir); err != nil {
+				st.log.Error(err, "Failed to load version manifests", "path", st.opts.Jobs.ManifestDir)
+				return err
+			}
+		}
+		res.Versions = sortedVersionNames(versionMap)
+		resolve.finish(nil)
+		return st.finalize(st.log, versionMap)
+	}
+
+	buildMap := versionMap
+	if len(st.opts.Jobs.OnlyVersions) > 0 {
+		buildMap = make(map[string]string)
+		for _, vers := range st.opts.Jobs.OnlyVersions {
+			branch, ok := versionMap[vers]
+			if !ok {
+				err := fmt.Errorf("version %q passed to --only-versions is not configured", vers)
+				resolve.finish(err)
+				return err
+			}
+			buildMap[vers] = branch
+		}
+	}
+	if len(buildMap) == 0 {
+		st.log.Info("Nothing to do!")
+		return nil
+	}
+	resolve.setAttr("versions", strings.Join(sortedVersionNames(buildMap), ","))
+	resolve.finish(nil)
+
+	var heads map[string]string
+	if st.opts.Watch.Enabled {
+		var err error
+		if st.opts.Watch.MetricsListenAddr != "" {
+			if err := st.serveMetrics(); err != nil {
+				st.log.Error(err, "Failed to serve metrics", "address", st.opts.Watch.MetricsListenAddr)
+				return err
+			}
+		}
+		if heads, err = st.remoteHeads(st.log, versionMap); err != nil {
+			st.log.Error(err, "Failed to resolve the commits of each branch")
+			return err
+		}
+	}
+
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(st.log, tmpdir)
+
+	if st.opts.Output.DeltaSync {
+		st.stageOutput(tmpdir)
+	}
+	st.setupStreamOutput()
+	if err := st.output.MkdirAll(st.opts.Output.Dir, 0755); err != nil {
+		st.log.Info("Error creating output directory")
+		return err
+	}
+
+	order := sortedVersionNames(buildMap)
+	var fetches *prefetcher
+	if st.opts.Fetch.FetchConcurrency > 1 {
+		fetches = st.prefetchVersions(ctx, st.log, tmpdir, rec, buildMap, order)
+		defer fetches.stop()
+	}
+	failed := make(map[string]error)
+	for _, vers := range order {
+		branch := buildMap[vers]
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		log := st.log.WithValues("version", vers, "branch", branch)
+		build := st.buildVersion
+		if fetches != nil {
+			build = fetches.buildVersion
+		}
+		if err := build(ctx, log, tmpdir, rec, vers, branch); err != nil {
+			if ctx.Err() != nil {
+				st.rollBackVersion(log, vers)
+				return err
+			}
+			if !st.opts.Jobs.KeepGoing {
+				return err
+			}
+			log.Error(err, "Failed to build version, continuing with the remaining versions")
+			st.discardFailedVersion(log, vers)
+			failed[vers] = err
+		}
+	}
+	if len(failed) == len(buildMap) {
+		return keepGoingResult(st.log, failed, nil)
+	}
+	buildMap, versionMap = withoutVersions(buildMap, failed), withoutVersions(versionMap, failed)
+	res.Versions = sortedVersionNames(buildMap)
+
+	if st.opts.Fetch.RecordDir != "" {
+		if err := st.writeRecording(rec); err != nil {
+			st.log.Error(err, "Failed to write recording")
+			return err
+		}
+	}
+	if st.opts.Output.CopyMode == copyModeMount {
+		if err := st.writeMounts(st.log); err != nil {
+			st.log.Error(err, "Failed to write Hugo module mounts")
+			return err
+		}
+	}
+	if st.opts.Review.RoutingFile != "" {
+		if err := st.writeReviewRouting(st.log); err != nil {
+			st.log.Error(err, "Failed to write review routing data")
+			return err
+		}
+	}
+
+	if len(st.opts.Jobs.OnlyVersions) > 0 {
+		if err := st.checkVersions(st.log, sortedVersionNames(buildMap)); err != nil {
+			st.log.Error(err, "Checks failed")
+			return err
+		}
+		if err := st.syncStagedOutput(st.log, buildMap); err != nil {
+			return err
+		}
+		if err := st.writeStreamOutput(st.log); err != nil {
+			return err
+		}
+		if err := st.pushSearchRecords(st.log, buildMap, versionMap); err != nil {
+			st.log.Error(err, "Failed to push search records to Algolia")
+			return err
+		}
+		st.log.Info("Built versions, run with --finalize-only once all versions have been built to generate the index", "versions", res.Versions)
+		return keepGoingResult(st.log, failed, res.Versions)
+	}
+	err = st.finalize(st.log, versionMap)
+	st.metrics.observeFinalize(err)
+	if err != nil {
+		return err
+	}
+	if err := st.syncStagedOutput(st.log, st.withCopiedAliases(buildMap)); err != nil {
+		return err
+	}
+	if err := st.writeStreamOutput(st.log); err != nil {
+		return err
+	}
+	if err := st.pushSearchRecords(st.log, buildMap, versionMap); err != nil {
+		st.log.Error(err, "Failed to push search records to Algolia")
+		return err
+	}
+	if err := st.keepOutput(st.log, versionMap, len(failed) == 0); err != nil {
+		st.log.Error(err, "Failed to keep output")
+		return err
+	}
+	if st.opts.Watch.Enabled {
+		st.metrics.setReady()
+		if err := st.writeBuildReport(st.log, nil); err != nil {
+			st.log.Error(err, "Failed to write build report")
+		}
+		st.cleanup(st.log, tmpdir)
+		// export the spans of the initial build, as watching never ends
+		st.finishRunSpan(st.log, nil)
+		if st.opts.Hugo.Run {
+			if err := st.startHugo(st.log); err != nil {
+				return err
+			}
+		}
+		return st.watchVersions(ctx, st.log, versionMap, heads)
+	}
+	return keepGoingResult(st.log, failed, res.Versions)
+}
+
+// buildVersion fetches a single version and copies its content into the
+// output directory, applying all per-version transforms.
+func (st *state) buildVersion(ctx context.Context, log logr.Logger, tmpdir string, rec *recording, vers, branch string) error {
+	report := st.startVersionReport(vers, branch)
+	log = report.logger(log)
+	log.Info("Adding version to list to generate")
+	start := time.Now()
+	fetch := report.span.child("fetch")
+	loc, source, err := st.fetchBuildSource(ctx, log, tmpdir, rec, vers, branch)
+	fetch.finish(err)
+	return st.finishVersion(log, report, start, rec, loc, source, vers, branch, err)
+}
+
+// finishVersion assembles a version fetched to loc, or records that it failed
+// to be fetched with fetchErr, and records the outcome of its build.
+func (st *state) finishVersion(log logr.Logger, report *versionReport, start time.Time, rec *recording, loc, source, vers, branch string, fetchErr error) error {
+	err := fetchErr
+	if err == nil {
+		var commit string
+		if st.opts.Fetch.ReplayDir != "" {
+			if rv, ok := rec.version(vers); ok {
+				commit = rv.Commit
+			}
+		} else {
+			commit, _ = st.resolveCommit(log, loc)
+		}
+		report.update(func(r *versionReport) { r.Commit = commit })
+		err = st.assembleVersion(log, loc, source, vers, branch)
+	}
+	st.metrics.observeBuild(vers, time.Since(start), err)
+	report.finish(time.Since(start), err)
+	return err
+}
+
+// rollBackVersion removes a version whose build was cancelled from the output
+// directory, so that it is not published half-written. Staged and mounted
+// versions are left as they are, as the output directory has not been
+// modified.
+func (st *state) rollBackVersion(log logr.Logger, vers string) {
+	if st.opts.Output.DeltaSync || st.opts.Output.CopyMode == copyModeMount {
+		return
+	}
+	dir := st.versionDir(vers)
+	st.auditStep(vers, "rollback")
+	if err := st.removeVersionDir(vers); err != nil {
+		log.Error(err, "Failed to remove partially built version", "path", dir)
+		return
+	}
+	log.Info("Removed partially built version from the output directory, it must be built again", "path", dir)
+}
+
+// fetchBuildSource fetches or replays the source tree of a version, recording
+// it if --record is set. It returns the path to the root of the tree and the
+// URL it was fetched from.
+func (st *state) fetchBuildSource(ctx context.Context, log logr.Logger, tmpdir string, rec *recording, vers, branch string) (string, string, error) {
+	vc := st.opts.versionConfig(vers)
+	tmpdir, err := st.sourcesDir(tmpdir, vers)
+	if err != nil {
+		return "", "", err
+	}
+	if err := st.injectedFailure(failureCloneTimeout, vers); err != nil {
+		log.Error(err, "Failed to fetch repository")
+		return "", "", err
+	}
+	var loc string
+	if st.opts.Fetch.ReplayDir != "" {
+		loc, err = st.replayVersion(rec, log, tmpdir, vers)
+	} else {
+		loc, err = st.fetchSharedVersion(ctx, log, tmpdir, vers, branch, vc)
+	}
+	if err != nil {
+		log.Error(err, "Failed to fetch repository")
+		return "", "", err
+	}
+	if st.opts.Fetch.ReplayDir == "" {
+		if err := st.applyPins(log, loc, vc.Pins); err != nil {
+			log.Error(err, "Failed to pin paths")
+			return "", "", err
+		}
+	}
+	source := vc.repoURL(st.opts)
+	if vc.Archive != "" {
+		source = vc.Archive
+	}
+	if st.opts.Fetch.RecordDir != "" {
+		if err := st.recordVersion(rec, log, vers, branch, source, loc); err != nil {
+			log.Error(err, "Failed to record version")
+			return "", "", err
+		}
+	}
+	log.Info("Fetched repository", "path", loc)
+	return loc, source, nil
+}
+
+// assembleVersion copies the content of a version fetched to loc into the
+// output directory, applying all per-version transforms.
+func (st *state) assembleVersion(log logr.Logger, loc, source, vers, branch string) error {
+	vc := st.opts.versionConfig(vers)
+	var err error
+	if st.opts.Fetch.VersionMetadataFile != "" {
+		if st.loadedVersionMetadata[vers], err = st.readVersionMetadata(log, loc); err != nil {
+			log.Error(err, "Failed to read version metadata file", "path", st.opts.Fetch.VersionMetadataFile)
+			return err
+		}
+	}
+	if len(st.opts.Fetch.GlossaryFiles) > 0 {
+		if st.loadedGlossaries[vers], err = st.readGlossary(log, loc); err != nil {
+			log.Error(err, "Failed to read glossary files", "paths", st.opts.Fetch.GlossaryFiles)
+			return err
+		}
+	}
+	hooks := vc.hooks(st.opts)
+	var env []string
+	if len(hooks.PreCopy) > 0 || len(hooks.PostCopy) > 0 {
+		if env, err = st.hookEnv(log, loc, vers, branch); err != nil {
+			return err
+		}
+	}
+	err = st.injectedFailure(failureHook, vers)
+	if err == nil {
+		err = st.runHooks(log, "preCopy", hooks.PreCopy, loc, env)
+	}
+	if err != nil {
+		log.Error(err, "Failed to run hooks")
+		return err
+	}
+	copySpan := st.reportFor(vers).span.child("copy")
+	if st.opts.Output.CopyMode == copyModeMount {
+		err = st.mountVersion(log, loc, vers, vc)
+	} else {
+		err = st.copyVersion(log, loc, vers, branch, vc)
+	}
+	copySpan.finish(err)
+	if err != nil {
+		return err
+	}
+	if err := st.runHooks(log, "postCopy", hooks.PostCopy, st.versionDir(vers), env); err != nil {
+		log.Error(err, "Failed to run hooks")
+		return err
+	}
+
+	if st.opts.Review.RoutingFile != "" {
+		if err := st.routeReviews(log, loc, vers, branch); err != nil {
+			log.Error(err, "Failed to generate review routing data")
+			return err
+		}
+	}
+
+	if st.opts.Jobs.ManifestDir != "" {
+		if err := st.writeVersionManifest(log, vers, branch, source, loc); err != nil {
+			log.Error(err, "Failed to write version manifest")
+			return err
+		}
+	}
+	return nil
+}
+
+// copyVersion copies the content of a version fetched to loc into the output
+// directory, and applies the transforms that modify its pages.
+func (st *state) copyVersion(log logr.Logger, loc, vers, branch string, vc *VersionConfig) error {
+	log.Info("Copying content to output directory")
+
+	checkContentTypeHelpers(log, vc.ContentTypes)
+	dst := st.versionDir(vers)
+	c := &copyContext{st: st, log: log, version: vers, branch: branch, vc: vc, srcRoot: loc, dstRoot: dst, report: st.reportFor(vers)}
+	st.auditStep(vers, "copy")
+	if st.gitMetadataEnabled() {
+		var err error
+		if c.history, err = st.readGitHistory(log, loc, rootSources(vc.roots(st.opts))...); err != nil {
+			log.Error(err, "Failed to read git history")
+			return err
+		}
+	}
+	err := st.injectedFailure(failureCopy, vers)
+	if err == nil {
+		err = st.copyRoots(log, c, loc)
+	}
+	if err != nil {
+		log.Error(err, "Failed to copy content from source repository to output directory")
+		return err
+	}
+	st.auditStep(vers, "extra-dirs")
+	if err := st.copyExtraDirs(log, c, loc); err != nil {
+		log.Error(err, "Failed to copy extra directories")
+		return err
+	}
+	st.auditStep(vers, "downloads")
+	if err := st.writeDownloads(log, c, loc); err != nil {
+		log.Error(err, "Failed to write download pages")
+		return err
+	}
+
+	if err := st.transformPages(c, dst); err != nil {
+		log.Error(err, "Failed to transform pages")
+		return err
+	}
+
+	if st.opts.Transform.OutdatedCascade && isOutdated(vers, vc) {
+		st.auditStep(vers, "outdated-cascade")
+		if err := st.writeOutdatedCascade(log, dst, vers); err != nil {
+			log.Error(err, "Failed to write outdated cascade")
+			return err
+		}
+	}
+
+	st.auditStep(vers, "version-cascade")
+	if err := st.writeVersionCascade(log, dst, vers, vc); err != nil {
+		log.Error(err, "Failed to write version cascade")
+		return err
+	}
+
+	if st.opts.Transform.PreserveMtimes {
+		if err := c.restoreMtimes(); err != nil {
+			log.Error(err, "Failed to preserve modification times")
+			return err
+		}
+	}
+	return nil
+}
+
+// finalize runs the steps that depend on the content of every version, once
+// all versions have been copied into the output directory.
+func (st *state) finalize(log logr.Logger, versionMap map[string]string) (err error) {
+	span := st.runSpan.child("finalize")
+	defer func() { span.finish(err) }()
+	if err := st.checkVersions(log, sortedVersionNames(versionMap)); err != nil {
+		log.Error(err, "Checks failed")
+		return err
+	}
+
+	if err := st.computeSupportStatus(versionMap, st.buildTime()); err != nil {
+		log.Error(err, "Failed to apply support policy")
+		return err
+	}
+
+	st.auditStep("", "seo-params")
+	if err := st.applySEOParams(log, versionMap); err != nil {
+		log.Error(err, "Failed to add search engine params to pages")
+		return err
+	}
+
+	if st.opts.Output.DedupeMode != "" {
+		st.auditStep("", "dedupe-assets")
+		if err := st.dedupeAssets(log, sortedVersionNames(versionMap)); err != nil {
+			log.Error(err, "Failed to deduplicate assets")
+			return err
+		}
+	}
+	if st.opts.Output.DuplicatesReport != "" {
+		st.auditStep("", "duplicates")
+		if err := st.writeDuplicatesReport(log, sortedVersionNames(versionMap)); err != nil {
+			log.Error(err, "Failed to write duplicate content report")
+			return err
+		}
+	}
+
+	if st.opts.Transform.SitemapHints {
+		st.auditStep("", "sitemap-hints")
+		if err := st.writeSitemapHints(log, versionMap); err != nil {
+			log.Error(err, "Failed to write sitemap hints")
+			return err
+		}
+	}
+
+	st.auditStep("", "index")
+	idx, err := st.buildContentIndex(versionMap)
+	if err != nil {
+		log.Error(err, "Failed to index built content")
+		return err
+	}
+	if err := st.writeDataFiles(log, versionMap, idx); err != nil {
+		log.Error(err, "Failed to write data files")
+		return err
+	}
+	if err := st.writeVersionsExport(log, versionMap); err != nil {
+		log.Error(err, "Failed to export versions file")
+		return err
+	}
+	if err := st.writeRTDAPI(log, versionMap, idx); err != nil {
+		log.Error(err, "Failed to write Read the Docs API")
+		return err
+	}
+	if err := st.writeDocsyVersions(log, versionMap); err != nil {
+		log.Error(err, "Failed to write Docsy versions params")
+		return err
+	}
+	if st.opts.Output.InstallThemeDir != "" {
+		if err := installTheme(log, st.opts.Output.InstallThemeDir); err != nil {
+			log.Error(err, "Failed to install theme component")
+			return err
+		}
+	}
+	st.auditStep("", "redirects")
+	if err := st.writeRedirects(log, idx); err != nil {
+		log.Error(err, "Failed to write redirects file")
+		return err
+	}
+	if err := st.writeSitemaps(log, idx); err != nil {
+		log.Error(err, "Failed to write sitemaps")
+		return err
+	}
+	if err := st.writeRobots(log, idx.versions); err != nil {
+		log.Error(err, "Failed to write robots.txt")
+		return err
+	}
+	if st.opts.Transform.RemovedPageAliases {
+		st.auditStep("", "removed-page-aliases")
+		if err := st.addRemovedPageAliases(log, idx); err != nil {
+			log.Error(err, "Failed to add aliases for removed pages")
+			return err
+		}
+	}
+	st.auditStep("", "version-aliases")
+	if err := st.applyVersionAliases(log, versionMap); err != nil {
+		log.Error(err, "Failed to apply version aliases")
+		return err
+	}
+
+	log.Info("Built content directory")
+	return nil
+}
+
+// copyBuffers holds buffers reused by copyFile.
+var copyBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 128*1024)
+	return &buf
+}}
+
+// copyFile copies a single file from src to dst
+func copyFile(src, dst string) error {
+	var err error
+	var srcfd *os.File
+	var dstfd *os.File
+	var srcinfo os.FileInfo
+
+	if srcfd, err = os.Open(src); err != nil {
+		return err
+	}
+	defer srcfd.Close()
+
+	if dstfd, err = os.Create(dst); err != nil {
+		return err
+	}
+	defer dstfd.Close()
+
+	// the buffer is only used if the OS does not support copying directly
+	// between the files
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	if _, err = io.CopyBuffer(dstfd, srcfd, *buf); err != nil {
+		return err
+	}
+	if srcinfo, err = os.Stat(src); err != nil {
+		return err
+	}
+	return os.Chmod(dst, srcinfo.Mode())
+}
+
+// copyContext holds the state used whilst copying the content of a single
+// version.
+type copyContext struct {
+	st      *state
+	log     logr.Logger
+	version string
+	branch  string
+	vc      *VersionConfig
+	// srcRoot is the root of the fetched source tree.
+	srcRoot string
+	// dstRoot is the version directory in the output.
+	dstRoot string
+	// history is the git history of each file, keyed by path relative to
+	// srcRoot.
+	history map[string]*fileHistory
+	// report is the build report of the version.
+	report *versionReport
+
+	// mu guards the fields below, which are updated by concurrent copies.
+	mu sync.Mutex
+	// sources are the paths of the source files of copied pages relative to
+	// srcRoot, keyed by path relative to dstRoot.
+	sources map[string]string
+	// mtimes are the modification times to set on copied files once all
+	// transforms have been applied, keyed by destination path.
+	mtimes map[string]time.Time
+	// linkFailed is true once a hard link has failed, so that the fallback to
+	// copying is only logged once.
+	linkFailed bool
+}
+
+// copyJob is a single file to be copied by copyDir.
+type copyJob struct {
+	src, dst string
+}
+
+// copyDir copies a whole directory recursively.
+// Files with a content type mapping configured for the version are converted
+// as they are copied. Directories are created up front, and files are then
+// copied by a pool of --copy-concurrency workers. If copying any file fails,
+// the error for the first such file in directory order is returned.
+func (st *state) copyDir(c *copyContext, src string, dst string) error {
+	var jobs []copyJob
+	if err := st.listCopyJobs(c.log, src, dst, &jobs); err != nil {
+		return err
+	}
+
+	errs := make([]error, len(jobs))
+	var failed int32
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < st.opts.Output.CopyConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				if errs[j] = c.copyEntry(jobs[j].src, jobs[j].dst); errs[j] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	// jobs are dispatched in order, so once a copy has failed every earlier
+	// job has already started and later jobs can be skipped
+	for j := range jobs {
+		if atomic.LoadInt32(&failed) != 0 || st.runCtx.Err() != nil {
+			break
+		}
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+	if err := st.runCtx.Err(); err != nil {
+		return err
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listCopyJobs creates the directory dst in the output and each of the
+// subdirectories of src within it, and appends every file beneath src to
+// jobs. Names are normalized with --normalize-filenames, and names that
+// would break on other platforms are reported.
+func (st *state) listCopyJobs(log logr.Logger, src, dst string, jobs *[]copyJob) error {
+	var err error
+	var fds []os.FileInfo
+	var srcinfo os.FileInfo
+
+	if srcinfo, err = os.Stat(src); err != nil {
+		return err
+	}
+
+	if err = st.output.MkdirAll(dst, srcinfo.Mode()); err != nil {
+		return err
+	}
+
+	if fds, err = ioutil.ReadDir(src); err != nil {
+		return err
+	}
+	names := make([]string, len(fds))
+	sources := make(map[string]string, len(fds))
+	for i, fd := range fds {
+		names[i] = st.normalizeFilename(fd.Name())
+		if other, ok := sources[names[i]]; ok {
+			return fmt.Errorf("%q and %q have the same name once normalized with --normalize-filenames", path.Join(src, other), path.Join(src, fd.Name()))
+		}
+		sources[names[i]] = fd.Name()
+	}
+	st.checkFilenames(log, dst, names)
+	for i, fd := range fds {
+		srcfp := path.Join(src, fd.Name())
+		dstfp := path.Join(dst, names[i])
+
+		if fd.IsDir() {
+			if err = st.listCopyJobs(log, srcfp, dstfp, jobs); err != nil {
+				return err
+			}
+			continue
+		}
+		*jobs = append(*jobs, copyJob{src: srcfp, dst: dstfp})
+	}
+	return nil
+}
+
+// copyEntry copies, converts or skips a single file according to the options
+// for the version.
+func (c *copyContext) copyEntry(srcfp, dstfp string) error {
+	log, vc := c.log, c.vc
+	if isPage(srcfp) && (vc.excludeDrafts(c.st.opts) || vc.excludeExpired(c.st.opts)) {
+		p, err := readSourcePage(srcfp)
+		if err != nil {
+			return err
+		}
+		if reason := c.st.excludedPageReason(vc, p, c.st.buildTime()); reason != "" {
+			log.Info("Skipping page", "file", srcfp, "reason", reason)
+			return nil
+		}
+	}
+
+	name := filepath.Base(srcfp)
+	ext := lowerExt(name)
+	if m, ok := vc.ContentTypes[ext]; ok {
+		switch m.policy() {
+		case ContentTypePolicyExclude:
+			log.V(4).Info("Excluding file", "file", srcfp)
+			return nil
+		case ContentTypePolicyConvert:
+			converted, err := c.st.convertFile(log, m, filepath.Ext(name), srcfp, dstfp)
+			if err != nil {
+				return err
+			}
+			return c.afterCopy(srcfp, converted)
+		}
+	} else if helper, ok := unsupportedContentTypes[ext]; ok {
+		log.Info("WARNING: content type requires an external helper to be rendered by Hugo, consider adding a content type mapping", "file", srcfp, "helper", helper)
+	}
+	if err := c.st.placeFile(c, srcfp, dstfp); err != nil {
+		return err
+	}
+	return c.afterCopy(srcfp, dstfp)
+}
+
+// afterCopy records the source file of the page copied from src to dst, so
+// that params derived from it can be injected by the transform pipeline, and
+// adds the copied file to the build report.
+func (c *copyContext) afterCopy(src, dst string) error {
+	rel, err := filepath.Rel(c.srcRoot, src)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	if info, err := c.st.output.Stat(dst); err == nil {
+		c.report.update(func(r *versionReport) {
+			r.FilesCopied++
+			r.BytesWritten += info.Size()
+		})
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isPage(dst) {
+		// pages copied by --extra-dirs are outside the version directory
+		if dstRel, err := filepath.Rel(c.dstRoot, dst); err == nil && !strings.HasPrefix(dstRel, "..") {
+			if c.sources == nil {
+				c.sources = make(map[string]string)
+			}
+			c.sources[filepath.ToSlash(dstRel)] = rel
+		}
+	}
+	if h := c.history[rel]; c.st.opts.Transform.PreserveMtimes && h != nil {
+		if c.mtimes == nil {
+			c.mtimes = make(map[string]time.Time)
+		}
+		c.mtimes[dst] = h.modified
+	}
+	return nil
+}
+
+func (st *state) cleanup(log logr.Logger, dir string) {
+	log = log.WithValues("directory", dir)
+	if st.opts.Debug {
+		log.Info("Skipping cleaning up temporary directory")
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Error(err, "Failed to cleanup temporary directory")
+		return
+	}
+	log.Info("Cleaned up temporary directory")
+}
+
+func (st *state) runCommand(log logr.Logger, name string, args ...string) error {
+	return st.runCommandEnv(log, nil, name, args...)
+}
+
+// runCommandEnv runs the named command with env added to the environment of
+// the process.
+func (st *state) runCommandEnv(log logr.Logger, env []string, name string, args ...string) error {
+	log = log.WithValues("cmd", name, "args", args)
+	cmd := newCommand(name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if st.opts.Debug {
+		log.Info("Running command")
+		cmd.Stdout = st.commandStdout
+		cmd.Stderr = os.Stderr
+	}
+	if err := st.runProcess(cmd); err != nil {
+		log.Error(err, "Error running command")
+		return err
+	}
+	return nil
+}
+
+// commandOutput runs the named command in dir and returns its trimmed stdout.
+func (st *state) commandOutput(log logr.Logger, dir, name string, args ...string) (string, error) {
+	return st.commandOutputEnv(log, nil, dir, name, args...)
+}
+
+// commandOutputEnv runs the named command in dir with env added to the
+// environment of the process, and returns its trimmed stdout.
+func (st *state) commandOutputEnv(log logr.Logger, env []string, dir, name string, args ...string) (string, error) {
+	log = log.WithValues("cmd", name, "args", args)
+	cmd := newCommand(name, args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	out, err := st.processOutput(cmd)
+	if err != nil {
+		log.Error(err, "Error running command")
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
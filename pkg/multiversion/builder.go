@@ -0,0 +1,253 @@
+// Package multiversion builds a Hugo content/ directory based on documents
+// contained in different branches of a single repository, and provides
+// additional utilities to make working with multi-version Hugo sites easier.
+package multiversion
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/klog/klogr"
+)
+
+// Builder builds the content directory of a multi-version Hugo site, and
+// runs the other commands of the tool.
+type Builder struct {
+	config Config
+	// discovered are the versions discovered with Config.Fetch.Discover
+	// when the Builder was created.
+	discovered map[string]*discoveredVersion
+}
+
+// Result describes a completed build.
+type Result struct {
+	// Versions are the names of the versions that were built, in order.
+	Versions []string
+}
+
+// New returns a Builder that uses the given options, or an error if they are
+// invalid. Problems with the options are logged.
+func New(c Config) (*Builder, error) {
+	if c.Log == nil {
+		c.Log = klogr.New()
+	}
+	b := &Builder{config: c}
+	err := b.do(context.Background(), func(st *state) error {
+		if !st.validateDiscovery() {
+			return fmt.Errorf("one or more options are invalid")
+		}
+		var err error
+		if b.discovered, err = st.discoverVersions(st.log); err != nil {
+			return fmt.Errorf("failed to discover versions: %v", err)
+		}
+		st.discoveredVersions = b.discovered
+		if !st.validate() {
+			return fmt.Errorf("one or more options are invalid")
+		}
+		return st.validateVersionOptions()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// do runs fn with a new state holding the options of the builder.
+func (b *Builder) do(ctx context.Context, fn func(st *state) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c := b.config
+	st := newState(ctx, &c)
+	st.discoveredVersions = b.discovered
+	return fn(st)
+}
+
+// Build fetches each version and assembles the content directory, then runs
+// Hugo, writes an archive of each version, uploads the site to a bucket,
+// commits it to a publish branch, invalidates the changed pages on CDNs,
+// pushes each version as an OCI artifact and pushes a container image if
+// configured to. With Config.Watch.Enabled, Build only returns once watching
+// fails.
+func (b *Builder) Build(ctx context.Context) (*Result, error) {
+	res := &Result{}
+	err := b.do(ctx, func(st *state) (err error) {
+		if st.opts.Fetch.RepoURL == "" && st.opts.Fetch.ReplayDir == "" && !st.opts.Jobs.FinalizeOnly {
+			return fmt.Errorf("--repo-url must be specified")
+		}
+		st.startRunSpan("build")
+		defer func() { st.finishRunSpan(st.log, err) }()
+		err = st.run(ctx, res)
+		if !st.opts.Watch.Enabled || err != nil {
+			if err := st.writeBuildReport(st.log, err); err != nil {
+				st.log.Error(err, "Failed to write build report")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if st.opts.Hugo.Run {
+			if err := st.runHugo(st.log); err != nil {
+				return err
+			}
+		}
+		if st.opts.Output.Format == outputFormatArchive {
+			if err := st.writeVersionArchives(st.log, res.Versions); err != nil {
+				return err
+			}
+		}
+		if st.opts.Bucket.URL != "" {
+			if err := st.syncBucket(st.log); err != nil {
+				return err
+			}
+		}
+		if st.opts.Pages.Branch != "" {
+			if err := st.pushPublishBranch(st.log); err != nil {
+				return err
+			}
+		}
+		if st.opts.CDN != nil {
+			if err := st.invalidateCDNs(st.log); err != nil {
+				return err
+			}
+		}
+		if st.opts.OCI.Repo != "" {
+			if err := st.pushOCIArtifacts(st.log, res.Versions); err != nil {
+				return err
+			}
+		}
+		if st.opts.Image.Ref != "" {
+			return st.pushImage(st.log)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Merge copies the versions built by separate jobs into the output
+// directory, and then runs the steps that depend on every version. Each
+// input is a job's output directory and manifest directory, separated by the
+// OS path list separator.
+func (b *Builder) Merge(ctx context.Context, inputs []string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runMerge(inputs)
+	})
+}
+
+// Preview serves the Hugo site built into Config.Preview.SiteDir until
+// interrupted.
+func (b *Builder) Preview(ctx context.Context) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runPreview()
+	})
+}
+
+// Backport cherry-picks the given commits onto the branch of each version.
+func (b *Builder) Backport(ctx context.Context, commits []string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runBackport(commits)
+	})
+}
+
+// Divergence reports the commits to the content directory of the default
+// branch that have not been backported to the latest version's branch.
+func (b *Builder) Divergence(ctx context.Context) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runDivergence()
+	})
+}
+
+// Try builds branch as a throwaway version named version, defaulting to the
+// name of the branch, and returns an error if it fails any check or, with
+// Config.Hugo.Run, fails to render. The output directory is not modified.
+func (b *Builder) Try(ctx context.Context, branch, version string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runTry(ctx, branch, version)
+	})
+}
+
+// Import inspects the versioned tree in the output directory, infers the
+// branch each version is built from and writes a config file building them to
+// configFile, along with a baseline manifest of the tree. With
+// Config.Import.Verify, it returns an error if the tree cannot be reproduced
+// from the inferred branches.
+func (b *Builder) Import(ctx context.Context, configFile string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runImport(ctx, configFile)
+	})
+}
+
+// Publish builds a single version into an existing output directory and
+// regenerates the data files, redirects and other outputs that depend on
+// every version recorded in Config.Jobs.ManifestDir, without building the
+// other versions.
+func (b *Builder) Publish(ctx context.Context, version string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runPublish(ctx, version)
+	})
+}
+
+// Unpublish removes a single version from an existing output directory and
+// regenerates the outputs that depend on every version for the versions that
+// remain in Config.Jobs.ManifestDir.
+func (b *Builder) Unpublish(ctx context.Context, version string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runUnpublish(version)
+	})
+}
+
+// Scaffold writes a version switcher partial and a 'version' shortcode that
+// read the generated data files into the site, for sites that do not use the
+// theme component.
+func (b *Builder) Scaffold(ctx context.Context) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runScaffold()
+	})
+}
+
+// Diff compares the pages of the from and to versions in the output
+// directory, reporting the pages that were added, removed or changed by at
+// least Config.Diff.Threshold.
+func (b *Builder) Diff(ctx context.Context, from, to string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runDiff(from, to)
+	})
+}
+
+// CheckLinks checks the links between the pages of each version in the
+// output directory, returning an error if any are broken or point into
+// another version and Config.Checks.Strict is set.
+func (b *Builder) CheckLinks(ctx context.Context) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runCheckLinks()
+	})
+}
+
+// Audit compares the site deployed at Config.Audit.Deployed with the site
+// built into Config.Preview.SiteDir, returning an error if any pages are
+// missing, extra or stale.
+func (b *Builder) Audit(ctx context.Context) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runAudit(ctx)
+	})
+}
+
+// Rollback restores the output of the build kept in Config.Output.BuildsDir
+// with the given ID, or if id is empty, of the build before the current one.
+func (b *Builder) Rollback(ctx context.Context, id string) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runRollback(id)
+	})
+}
+
+// Snapshot tags the commit each version of a build was built from, as read
+// from Config.Jobs.ManifestDir or Config.Fetch.ReplayDir, in the repository
+// it was fetched from.
+func (b *Builder) Snapshot(ctx context.Context) error {
+	return b.do(ctx, func(st *state) error {
+		return st.runSnapshot()
+	})
+}
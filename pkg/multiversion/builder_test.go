@@ -0,0 +1,53 @@
+package multiversion
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentBuilds(t *testing.T) {
+	var configs []Config
+	for _, product := range []string{"Foo", "Bar"} {
+		repo := newTestRepo(t, map[string]map[string]string{
+			"release-1.0": {"content/docs/install.md": testPage("Install", "Install "+product+".")},
+			"release-2.0": {"content/docs/install.md": testPage("Install", "Install "+product+" 2.")},
+		})
+		c := testConfig(t, repo, "v1.0=release-1.0", "v2.0=release-2.0")
+		c.Transform.RewriteLinks = true
+		configs = append(configs, c)
+	}
+	builders := make([]*Builder, len(configs))
+	for i, c := range configs {
+		b, err := New(c)
+		if err != nil {
+			t.Fatalf("invalid options: %v", err)
+		}
+		builders[i] = b
+	}
+
+	// each build keeps its own options and state, so neither build sees the
+	// output directory or versions of the other
+	errs := make([]error, len(builders))
+	var wg sync.WaitGroup
+	for i, b := range builders {
+		wg.Add(1)
+		go func(i int, b *Builder) {
+			defer wg.Done()
+			_, errs[i] = b.Build(context.Background())
+		}(i, b)
+	}
+	wg.Wait()
+
+	for i, product := range []string{"Foo", "Bar"} {
+		if errs[i] != nil {
+			t.Fatalf("build of %s failed: %v", product, errs[i])
+		}
+		got := readTestFile(t, filepath.Join(configs[i].Output.Dir, "v1.0", "docs", "install.md"))
+		if !strings.Contains(got, "Install "+product+".") {
+			t.Errorf("%s: got %q, want the page of %s", product, got, product)
+		}
+	}
+}
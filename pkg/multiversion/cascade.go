@@ -0,0 +1,126 @@
+package multiversion
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+)
+
+// buildListValues are the values of the '_build.list' front matter option,
+// which controls whether pages are included in Hugo's page collections.
+var buildListValues = map[string]bool{"always": true, "local": true, "never": true}
+
+// outputs returns the Hugo output formats the pages of the named version are
+// rendered in, or nil if they are left to the site's configuration.
+func (vc *VersionConfig) outputs(c *Config, version string) []string {
+	if vc.Outputs != nil {
+		return vc.Outputs
+	}
+	if version != latestVersion && len(c.Transform.NonLatestOutputs) > 0 {
+		return c.Transform.NonLatestOutputs
+	}
+	return nil
+}
+
+// list returns the '_build.list' option of the pages of the named version,
+// or an empty string if it is left to the pages. The pages of hidden
+// versions are never listed.
+func (vc *VersionConfig) list(c *Config, version string) string {
+	if vc.List != "" {
+		return vc.List
+	}
+	if vc.Hidden {
+		return "never"
+	}
+	if version != latestVersion {
+		return c.Transform.NonLatestList
+	}
+	return ""
+}
+
+// validateNonLatestList returns an error if --non-latest-list is not a valid
+// '_build.list' option.
+func (st *state) validateNonLatestList() error {
+	if st.opts.Transform.NonLatestList != "" && !buildListValues[st.opts.Transform.NonLatestList] {
+		return fmt.Errorf("must be one of 'always', 'local' or 'never'")
+	}
+	return nil
+}
+
+// validateVersionCascades returns an error if the cascade options of any
+// version are invalid, or cannot be written with the other options.
+func (c *Config) validateVersionCascades() error {
+	for name, vc := range c.Versions {
+		if vc == nil {
+			continue
+		}
+		if vc.List != "" && !buildListValues[vc.List] {
+			return fmt.Errorf("version %q: list must be one of 'always', 'local' or 'never'", name)
+		}
+		if vc.Hidden && vc.List != "" && vc.List != "never" {
+			return fmt.Errorf("version %q: list must be 'never' for hidden versions", name)
+		}
+		if vc.Hidden && (name == latestVersion || name == c.Output.RootVersion) {
+			return fmt.Errorf("version %q: the latest version and --root-version cannot be hidden", name)
+		}
+		if c.Output.CopyMode == copyModeMount && (vc.Outputs != nil || vc.List != "" || len(vc.Cascade) > 0 || vc.Hidden) {
+			return fmt.Errorf("version %q: outputs, list, cascade and hidden cannot be used with --copy-mode=%s, as mounted versions are not modified", name, copyModeMount)
+		}
+	}
+	return nil
+}
+
+// versionCascade returns the front matter fields cascaded to every page of
+// the named version, and the subset of them also set on the _index page at
+// the root of the version, as a cascade does not apply to the page that
+// declares it. It returns nil if there is nothing to cascade.
+func (st *state) versionCascade(version string, vc *VersionConfig) (cascade, index map[string]interface{}) {
+	cascade, index = map[string]interface{}{}, map[string]interface{}{}
+	if len(vc.Cascade) > 0 {
+		cascade = normalizeYAML(vc.Cascade).(map[string]interface{})
+	}
+	if outputs := vc.outputs(st.opts, version); outputs != nil {
+		formats := make([]interface{}, len(outputs))
+		for i, f := range outputs {
+			formats[i] = f
+		}
+		cascade["outputs"], index["outputs"] = formats, formats
+	}
+	if list := vc.list(st.opts, version); list != "" {
+		build, ok := cascade["_build"].(map[string]interface{})
+		if !ok {
+			build = map[string]interface{}{}
+		}
+		build["list"] = list
+		cascade["_build"], index["_build"] = build, map[string]interface{}{"list": list}
+	}
+	if st.opts.Transform.RelatedIsolation {
+		params := map[string]interface{}{"version": version}
+		st.setParams(cascade, params)
+		st.setParams(index, params)
+	}
+	if len(cascade) == 0 {
+		return nil, nil
+	}
+	return cascade, index
+}
+
+// writeVersionCascade merges the cascade of the named version into the
+// _index page at the root of the version directory dir, and sets the fields
+// that also apply to the _index page itself unless the page sets them. Pages
+// that set the cascaded fields themselves keep their own values.
+func (st *state) writeVersionCascade(log logr.Logger, dir, version string, vc *VersionConfig) error {
+	cascade, index := st.versionCascade(version, vc)
+	if cascade == nil {
+		return nil
+	}
+	indexPath, p, err := st.readOrCreateSectionIndex(dir, version)
+	if err != nil {
+		return err
+	}
+	mergeFields(p.frontMatter, index, false)
+	mergeCascadeFields(p.frontMatter, cascade)
+
+	log.V(4).Info("Writing version cascade", "path", indexPath)
+	return st.writePage(indexPath, p, 0644)
+}
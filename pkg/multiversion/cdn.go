@@ -0,0 +1,274 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// cloudFrontBatchSize is the number of paths invalidated in a single
+	// CloudFront invalidation.
+	cloudFrontBatchSize = 1000
+	// cloudflareBatchSize is the number of URLs Cloudflare purges in a single
+	// request.
+	cloudflareBatchSize = 30
+)
+
+// CDNConfig configures the CDNs whose caches are invalidated for the pages
+// that changed once the site has been deployed.
+type CDNConfig struct {
+	// BaseURL is the URL the site is served from, e.g.
+	// 'https://docs.example.com', used to build the URLs purged from
+	// Fastly and Cloudflare.
+	BaseURL string `yaml:"baseURL"`
+
+	// CloudFront invalidates the paths in an Amazon CloudFront
+	// distribution, using the aws binary set with --aws-bin.
+	CloudFront *CloudFrontConfig `yaml:"cloudfront"`
+
+	// Fastly purges the URLs from Fastly, authenticated with the
+	// FASTLY_API_TOKEN environment variable.
+	Fastly *FastlyConfig `yaml:"fastly"`
+
+	// Cloudflare purges the URLs from a Cloudflare zone, authenticated with
+	// the CLOUDFLARE_API_TOKEN environment variable.
+	Cloudflare *CloudflareConfig `yaml:"cloudflare"`
+}
+
+// CloudFrontConfig configures invalidating an Amazon CloudFront distribution.
+type CloudFrontConfig struct {
+	// DistributionID is the ID of the distribution.
+	DistributionID string `yaml:"distributionID"`
+}
+
+// FastlyConfig configures purging URLs from Fastly.
+type FastlyConfig struct {
+	// Soft marks the URLs as stale rather than removing them from the
+	// cache.
+	Soft bool `yaml:"soft"`
+}
+
+// CloudflareConfig configures purging URLs from Cloudflare.
+type CloudflareConfig struct {
+	// ZoneID is the ID of the zone the site is served from.
+	ZoneID string `yaml:"zoneID"`
+
+	// APIURL is the URL of the Cloudflare API. Defaults to
+	// 'https://api.cloudflare.com/client/v4'.
+	APIURL string `yaml:"apiURL"`
+}
+
+// cdnInvalidator invalidates the cached copies of paths on a CDN.
+type cdnInvalidator interface {
+	// name is the name of the CDN, as logged.
+	name() string
+	// invalidate invalidates the given URL paths, which start with a slash.
+	invalidate(log logr.Logger, paths []string) error
+}
+
+// invalidators returns the CDNs configured in the config file.
+func (c *CDNConfig) invalidators(st *state) []cdnInvalidator {
+	var cdns []cdnInvalidator
+	if c == nil {
+		return cdns
+	}
+	if c.CloudFront != nil {
+		cdns = append(cdns, &cloudFront{c.CloudFront, st})
+	}
+	if c.Fastly != nil {
+		cdns = append(cdns, &fastly{c.Fastly, st, c.BaseURL})
+	}
+	if c.Cloudflare != nil {
+		cdns = append(cdns, &cloudflare{c.Cloudflare, st, c.BaseURL})
+	}
+	return cdns
+}
+
+// validate returns an error if the CDNs cannot be invalidated with the
+// options given.
+func (c *CDNConfig) validate(opts *Config) error {
+	if c == nil {
+		return nil
+	}
+	switch {
+	case c.CloudFront == nil && c.Fastly == nil && c.Cloudflare == nil:
+		return fmt.Errorf("cdn: at least one of 'cloudfront', 'fastly' or 'cloudflare' must be set")
+	case !opts.Output.DeltaSync:
+		return fmt.Errorf("cdn: --delta-sync must be set, as the paths that changed are taken from the files it syncs")
+	case opts.Watch.Enabled:
+		return fmt.Errorf("cdn: cannot be used with --watch")
+	case c.CloudFront != nil && c.CloudFront.DistributionID == "":
+		return fmt.Errorf("cdn: cloudfront: distributionID must be set")
+	case c.Cloudflare != nil && c.Cloudflare.ZoneID == "":
+		return fmt.Errorf("cdn: cloudflare: zoneID must be set")
+	case c.Fastly != nil && os.Getenv("FASTLY_API_TOKEN") == "":
+		return fmt.Errorf("cdn: fastly: the FASTLY_API_TOKEN environment variable must be set")
+	case c.Cloudflare != nil && os.Getenv("CLOUDFLARE_API_TOKEN") == "":
+		return fmt.Errorf("cdn: cloudflare: the CLOUDFLARE_API_TOKEN environment variable must be set")
+	}
+	if c.Fastly != nil || c.Cloudflare != nil {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("cdn: baseURL must be the http:// or https:// URL the site is served from to purge URLs from Fastly or Cloudflare")
+		}
+	}
+	return nil
+}
+
+// changedPaths returns the escaped URL paths of the pages and files that
+// changed in the output directory during this run, sorted. Files that are
+// not pages are assumed to be published at their path within the version.
+func (st *state) changedPaths() []string {
+	seen := make(map[string]bool)
+	for vers, files := range st.syncedChanges {
+		for _, rel := range files {
+			p := st.versionURL(vers) + rel
+			if isPage(rel) {
+				p = st.pageURL(vers, rel)
+			}
+			seen[(&url.URL{Path: p}).EscapedPath()] = true
+		}
+	}
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// invalidateCDNs invalidates the paths that changed in this run on each CDN
+// configured in the config file. Nothing is invalidated if nothing changed.
+func (st *state) invalidateCDNs(log logr.Logger) error {
+	paths := st.changedPaths()
+	if len(paths) == 0 {
+		log.Info("No pages changed, skipping CDN invalidation")
+		return nil
+	}
+	for _, cdn := range st.opts.CDN.invalidators(st) {
+		log := log.WithValues("cdn", cdn.name(), "paths", len(paths))
+		log.Info("Invalidating changed paths")
+		if err := cdn.invalidate(log, paths); err != nil {
+			return fmt.Errorf("invalidating %s: %v", cdn.name(), err)
+		}
+	}
+	return nil
+}
+
+// batches splits paths into batches of at most n paths.
+func batches(paths []string, n int) [][]string {
+	var out [][]string
+	for len(paths) > n {
+		out = append(out, paths[:n])
+		paths = paths[n:]
+	}
+	return append(out, paths)
+}
+
+// cloudFront invalidates paths with 'aws cloudfront create-invalidation'.
+type cloudFront struct {
+	*CloudFrontConfig
+	st *state
+}
+
+func (cloudFront) name() string { return "cloudfront" }
+
+func (c *cloudFront) invalidate(log logr.Logger, paths []string) error {
+	for _, batch := range batches(paths, cloudFrontBatchSize) {
+		args := append([]string{"cloudfront", "create-invalidation", "--distribution-id", c.DistributionID, "--paths"}, batch...)
+		if err := c.st.runCommand(log, c.st.opts.Bucket.AWSBin, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fastly purges each URL by sending it a PURGE request.
+type fastly struct {
+	*FastlyConfig
+	st      *state
+	baseURL string
+}
+
+func (fastly) name() string { return "fastly" }
+
+func (f *fastly) invalidate(log logr.Logger, paths []string) error {
+	for _, p := range paths {
+		req, err := http.NewRequestWithContext(f.st.runCtx, "PURGE", strings.TrimSuffix(f.baseURL, "/")+p, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Fastly-Key", os.Getenv("FASTLY_API_TOKEN"))
+		if f.Soft {
+			req.Header.Set("Fastly-Soft-Purge", "1")
+		}
+		if err := cdnRequest(log, req); err != nil {
+			return fmt.Errorf("purging %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// cloudflare purges URLs with the Cloudflare API.
+type cloudflare struct {
+	*CloudflareConfig
+	st      *state
+	baseURL string
+}
+
+func (cloudflare) name() string { return "cloudflare" }
+
+func (c *cloudflare) invalidate(log logr.Logger, paths []string) error {
+	apiURL := c.APIURL
+	if apiURL == "" {
+		apiURL = "https://api.cloudflare.com/client/v4"
+	}
+	reqURL := strings.TrimSuffix(apiURL, "/") + "/zones/" + url.PathEscape(c.ZoneID) + "/purge_cache"
+	for _, batch := range batches(paths, cloudflareBatchSize) {
+		files := make([]string, len(batch))
+		for i, p := range batch {
+			files[i] = strings.TrimSuffix(c.baseURL, "/") + p
+		}
+		data, err := json.Marshal(map[string][]string{"files": files})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(c.st.runCtx, http.MethodPost, reqURL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+os.Getenv("CLOUDFLARE_API_TOKEN"))
+		req.Header.Set("Content-Type", "application/json")
+		if err := cdnRequest(log, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cdnRequest sends req and returns an error if it did not succeed.
+func cdnRequest(log logr.Logger, req *http.Request) error {
+	log.V(4).Info("Sending CDN request", "method", req.Method, "url", req.URL.String())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if len(msg) > 1024 {
+			msg = msg[:1024]
+		}
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
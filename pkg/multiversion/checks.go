@@ -0,0 +1,284 @@
+package multiversion
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// finding is a problem reported by a checker.
+type finding struct {
+	Checker string
+	Version string
+	// File is the path of the file the problem was found in, relative to the
+	// version directory.
+	File    string
+	Line    int
+	Message string
+}
+
+// checkTarget is a single file to be checked.
+type checkTarget struct {
+	version string
+	// rel is the path of the file relative to the version directory, using
+	// forward slashes.
+	rel string
+}
+
+// checker validates the files of a built site.
+// check is called concurrently from multiple goroutines, and must only share
+// state through the checkCache.
+type checker interface {
+	check(cache *checkCache, t checkTarget) []finding
+}
+
+// checkers maps the name of each checker that can be enabled with --checks to
+// the checker.
+var checkers = map[string]checker{
+	"frontmatter":        frontMatterChecker{},
+	"duplicate-url":      duplicateURLChecker{},
+	"version-references": versionReferenceChecker{},
+	"markdown":           markdownChecker{},
+	"links":              linkChecker{},
+}
+
+// validateChecks returns an error if any of the named checkers do not exist.
+func validateChecks(names []string) error {
+	for _, name := range names {
+		if _, ok := checkers[name]; !ok {
+			return fmt.Errorf("unknown checker %q", name)
+		}
+	}
+	return nil
+}
+
+// checkCache holds state that is shared between all checkers and workers, so
+// that each file is only read and parsed once regardless of how many checkers
+// inspect it.
+type checkCache struct {
+	st    *state
+	mu    sync.Mutex
+	pages map[string]*cachedPage
+	urls  map[string]*cachedURLs
+
+	prefixesOnce sync.Once
+	prefixes     []versionPrefix
+}
+
+type cachedPage struct {
+	once sync.Once
+	data []byte
+	page *page
+	err  error
+}
+
+type cachedURLs struct {
+	once sync.Once
+	urls map[string][]string
+	err  error
+}
+
+func newCheckCache(st *state) *checkCache {
+	return &checkCache{
+		st:    st,
+		pages: make(map[string]*cachedPage),
+		urls:  make(map[string]*cachedURLs),
+	}
+}
+
+// page returns the parsed page for the target, reading it at most once.
+func (c *checkCache) page(t checkTarget) (*page, error) {
+	_, p, err := c.source(t)
+	return p, err
+}
+
+// source returns the contents of the target file and the page parsed from
+// it, reading it at most once. The contents are returned even if the page
+// cannot be parsed.
+func (c *checkCache) source(t checkTarget) ([]byte, *page, error) {
+	key := t.version + "/" + t.rel
+	c.mu.Lock()
+	cp, ok := c.pages[key]
+	if !ok {
+		cp = &cachedPage{}
+		c.pages[key] = cp
+	}
+	c.mu.Unlock()
+
+	cp.once.Do(func() {
+		path := filepath.Join(c.st.versionDir(t.version), filepath.FromSlash(t.rel))
+		if cp.data, cp.err = c.st.output.ReadFile(path); cp.err != nil {
+			return
+		}
+		if cp.page, cp.err = parsePage(cp.data); cp.err != nil {
+			cp.err = fmt.Errorf("parsing front matter of %q: %v", path, cp.err)
+		}
+	})
+	return cp.data, cp.page, cp.err
+}
+
+// pageURLs returns a map of page path to the files that are published at that
+// page path for the named version.
+func (c *checkCache) pageURLs(version string) (map[string][]string, error) {
+	c.mu.Lock()
+	cu, ok := c.urls[version]
+	if !ok {
+		cu = &cachedURLs{}
+		c.urls[version] = cu
+	}
+	c.mu.Unlock()
+
+	cu.once.Do(func() {
+		var files map[string]bool
+		files, cu.err = c.st.listPages(c.st.versionDir(version))
+		cu.urls = make(map[string][]string)
+		for rel := range files {
+			pp := pagePath(rel)
+			cu.urls[pp] = append(cu.urls[pp], rel)
+		}
+	})
+	return cu.urls, cu.err
+}
+
+// runChecks runs the named checkers against every page in each of the given
+// versions using a pool of --check-concurrency workers, returning all
+// findings sorted by version and file.
+func (st *state) runChecks(log logr.Logger, names []string, versions []string) ([]finding, error) {
+	var enabled []checker
+	for _, name := range names {
+		enabled = append(enabled, checkers[name])
+	}
+	if len(enabled) == 0 {
+		return nil, nil
+	}
+
+	var targets []checkTarget
+	for _, vers := range versions {
+		pages, err := st.listPages(st.versionDir(vers))
+		if err != nil {
+			return nil, err
+		}
+		for rel := range pages {
+			targets = append(targets, checkTarget{version: vers, rel: rel})
+		}
+	}
+	log.Info("Running checks", "checks", names, "files", len(targets), "workers", st.opts.Checks.Concurrency)
+
+	cache := newCheckCache(st)
+	work := make(chan checkTarget)
+	results := make(chan []finding)
+	var wg sync.WaitGroup
+	workers := st.opts.Checks.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				var found []finding
+				for _, c := range enabled {
+					found = append(found, c.check(cache, t)...)
+				}
+				results <- found
+			}
+		}()
+	}
+	go func() {
+		for _, t := range targets {
+			work <- t
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+
+	var findings []finding
+	for found := range results {
+		findings = append(findings, found...)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Message < b.Message
+	})
+	return findings, nil
+}
+
+// checkVersions runs the checkers enabled with --checks and logs any
+// findings. An error is returned if there are findings and --strict-checks is
+// set.
+func (st *state) checkVersions(log logr.Logger, versions []string) error {
+	return st.reportChecks(log, st.opts.Checks.Enabled, versions)
+}
+
+// reportChecks runs the named checkers and logs any findings, returning an
+// error if there are findings and --strict-checks is set.
+func (st *state) reportChecks(log logr.Logger, names []string, versions []string) (err error) {
+	span := st.runSpan.child("validate", "checks", strings.Join(names, ","))
+	defer func() { span.finish(err) }()
+	findings, err := st.runChecks(log, names, versions)
+	if err != nil {
+		return err
+	}
+	span.setAttr("findings", strconv.Itoa(len(findings)))
+	for _, f := range findings {
+		log.Info("WARNING: "+f.Message, "check", f.Checker, "version", f.Version, "file", f.File, "line", f.Line)
+	}
+	if len(findings) > 0 && st.opts.Checks.Strict {
+		return fmt.Errorf("checks reported %d problems", len(findings))
+	}
+	return nil
+}
+
+// frontMatterChecker reports pages whose front matter cannot be parsed.
+type frontMatterChecker struct{}
+
+func (frontMatterChecker) check(cache *checkCache, t checkTarget) []finding {
+	if _, err := cache.page(t); err != nil {
+		return []finding{{Checker: "frontmatter", Version: t.version, File: t.rel, Message: err.Error()}}
+	}
+	return nil
+}
+
+// duplicateURLChecker reports pages that are published at the same URL as
+// another page in the same version, e.g. 'foo.md' and 'foo/_index.md'.
+type duplicateURLChecker struct{}
+
+func (duplicateURLChecker) check(cache *checkCache, t checkTarget) []finding {
+	urls, err := cache.pageURLs(t.version)
+	if err != nil {
+		return []finding{{Checker: "duplicate-url", Version: t.version, File: t.rel, Message: err.Error()}}
+	}
+	files := urls[pagePath(t.rel)]
+	if len(files) < 2 {
+		return nil
+	}
+	var others []string
+	for _, f := range files {
+		if f != t.rel {
+			others = append(others, f)
+		}
+	}
+	sort.Strings(others)
+	return []finding{{
+		Checker: "duplicate-url",
+		Version: t.version,
+		File:    t.rel,
+		Message: "page is published at the same URL as " + strings.Join(others, ", "),
+	}}
+}
@@ -0,0 +1,27 @@
+package multiversion
+
+import (
+	"testing"
+)
+
+func TestChecksWithRootVersion(t *testing.T) {
+	content := map[string]string{
+		"content/_index.md":       testPage("Home", "See the [install guide](docs/install/)."),
+		"content/docs/_index.md":  testPage("Docs", "Read the docs."),
+		"content/docs/install.md": testPage("Install", "Run the installer, then [upgrade](../upgrade/)."),
+		"content/docs/upgrade.md": testPage("Upgrade", "Upgrade the release."),
+	}
+	repo := newTestRepo(t, map[string]map[string]string{
+		"main":        content,
+		"release-1.0": content,
+	})
+	c := testConfig(t, repo, "v1.0=release-1.0")
+	c.Fetch.LatestBranch = "main"
+	c.Output.RootVersion = latestVersion
+	c.Checks.Enabled = []string{"frontmatter", "duplicate-url", "links", "markdown"}
+	c.Checks.Strict = true
+
+	// every page of the root version is read from the output directory, and
+	// the directories of the other versions are not checked as its pages
+	testBuild(t, c)
+}
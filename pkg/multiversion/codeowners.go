@@ -0,0 +1,245 @@
+package multiversion
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// codeownersPaths are the locations a CODEOWNERS file is read from, relative
+// to the root of the repository, in the order GitHub looks for them.
+var codeownersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// codeownersRule is a single line of a CODEOWNERS file.
+type codeownersRule struct {
+	re     *regexp.Regexp
+	owners []string
+}
+
+// codeowners is a parsed CODEOWNERS file. The last matching rule wins.
+type codeowners []codeownersRule
+
+// readCodeowners reads the CODEOWNERS file of the repository checked out at
+// loc, returning nil if it does not have one.
+func readCodeowners(loc string) (codeowners, error) {
+	for _, p := range codeownersPaths {
+		data, err := ioutil.ReadFile(filepath.Join(loc, filepath.FromSlash(p)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseCodeowners(string(data))
+	}
+	return nil, nil
+}
+
+// parseCodeowners parses the contents of a CODEOWNERS file. GitLab section
+// headers are ignored.
+func parseCodeowners(data string) (codeowners, error) {
+	var co codeowners
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "^[") {
+			continue
+		}
+		fields := strings.Fields(line)
+		re, err := codeownersPatternRE(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		co = append(co, codeownersRule{re: re, owners: fields[1:]})
+	}
+	return co, scanner.Err()
+}
+
+// codeownersPatternRE converts a CODEOWNERS pattern, which follows the same
+// rules as .gitignore, into a regular expression matching slash separated
+// paths relative to the root of the repository.
+func codeownersPatternRE(pattern string) (*regexp.Regexp, error) {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	p := strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return nil, fmt.Errorf("invalid pattern %q", pattern)
+	}
+
+	var b strings.Builder
+	if anchored {
+		b.WriteString("^")
+	} else {
+		b.WriteString("^(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case p[i] == '*':
+			b.WriteString("[^/]*")
+		case p[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	switch {
+	case dirOnly:
+		b.WriteString("/.*$")
+	case strings.HasSuffix(p, "/*"):
+		// 'dir/*' only matches files directly within dir
+		b.WriteString("$")
+	default:
+		b.WriteString("(?:/.*)?$")
+	}
+	return regexp.Compile(b.String())
+}
+
+// owners returns the owners of the file at the slash separated path p,
+// relative to the root of the repository.
+func (co codeowners) owners(p string) []string {
+	for i := len(co) - 1; i >= 0; i-- {
+		if co[i].re.MatchString(p) {
+			return co[i].owners
+		}
+	}
+	return nil
+}
+
+// reviewRoutingData is the structure of the file written by
+// --review-routing-file.
+type reviewRoutingData struct {
+	FormatVersion int                        `json:"formatVersion"`
+	Versions      map[string]*versionRouting `json:"versions"`
+}
+
+// versionRouting lists the pages of a version changed since --review-base,
+// and their owners.
+type versionRouting struct {
+	Branch string `json:"branch"`
+	// Base is the commit the pages were compared with.
+	Base  string       `json:"base"`
+	Pages []routedPage `json:"pages"`
+	// Owners maps each owner to the paths of the changed pages they own.
+	Owners map[string][]string `json:"owners"`
+}
+
+// routedPage is a changed page and its owners.
+type routedPage struct {
+	// Path is relative to the content directory.
+	Path   string   `json:"path"`
+	URL    string   `json:"url"`
+	Owners []string `json:"owners"`
+}
+
+// validateReviewRouting returns an error if --review-routing-file cannot be
+// used with the other flags.
+func (st *state) validateReviewRouting() error {
+	if st.opts.Review.RoutingFile == "" {
+		return nil
+	}
+	if st.opts.Review.Base == "" {
+		return fmt.Errorf("--review-base must be specified")
+	}
+	if len(st.opts.Languages.Languages) > 0 {
+		return fmt.Errorf("cannot be used with --languages")
+	}
+	return nil
+}
+
+// routeReviews records the pages of the version checked out at loc that have
+// changed since --review-base, along with their owners according to the
+// CODEOWNERS file of the version's branch.
+func (st *state) routeReviews(log logr.Logger, loc, version, branch string) error {
+	if _, err := os.Stat(filepath.Join(loc, ".git")); err != nil {
+		log.Info("WARNING: version was not fetched using git, review routing data will not be generated")
+		return nil
+	}
+	base, err := st.resolveReviewBase(loc)
+	if err != nil {
+		return err
+	}
+	co, err := readCodeowners(loc)
+	if err != nil {
+		return fmt.Errorf("failed to read CODEOWNERS: %v", err)
+	}
+	if co == nil {
+		log.Info("WARNING: branch has no CODEOWNERS file, changed pages will have no owners")
+	}
+
+	roots := st.opts.versionConfig(version).roots(st.opts)
+	args := append([]string{"-c", "core.quotePath=false", "diff",
+		"--name-only", "--no-renames", "--diff-filter=d", base + "...HEAD", "--"}, rootSources(roots)...)
+	out, err := st.commandOutput(log, loc, "git", args...)
+	if err != nil {
+		return err
+	}
+	r := &versionRouting{Branch: branch, Base: base, Pages: []routedPage{}, Owners: map[string][]string{}}
+	for _, p := range strings.Split(out, "\n") {
+		if p == "" || !isPage(p) {
+			continue
+		}
+		rel := contentRelPath(roots, p)
+		owners := co.owners(p)
+		if owners == nil {
+			owners = []string{}
+		}
+		r.Pages = append(r.Pages, routedPage{Path: rel, URL: st.pageURL(version, rel), Owners: owners})
+		for _, o := range owners {
+			r.Owners[o] = append(r.Owners[o], rel)
+		}
+	}
+	sort.Slice(r.Pages, func(i, j int) bool { return r.Pages[i].Path < r.Pages[j].Path })
+	for _, pages := range r.Owners {
+		sort.Strings(pages)
+	}
+	log.Info("Found pages changed since the review base", "base", base, "pages", len(r.Pages), "owners", len(r.Owners))
+	st.reviewRouting[version] = r
+	return nil
+}
+
+// resolveReviewBase returns the commit --review-base refers to in the
+// repository at loc, which may be a commit, a ref or the name of a branch in
+// the remote repository.
+func (st *state) resolveReviewBase(loc string) (string, error) {
+	for _, ref := range []string{st.opts.Review.Base, path.Join("origin", st.opts.Review.Base)} {
+		cmd := newCommand("git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+		cmd.Dir = loc
+		if out, err := st.processOutput(cmd); err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
+	}
+	return "", fmt.Errorf("--review-base %q does not exist in the repository", st.opts.Review.Base)
+}
+
+// writeReviewRouting writes the routing data of the versions built in this
+// run to --review-routing-file.
+func (st *state) writeReviewRouting(log logr.Logger) error {
+	data, err := json.MarshalIndent(reviewRoutingData{FormatVersion: st.opts.Output.DataFormatVersion, Versions: st.reviewRouting}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(st.opts.Review.RoutingFile, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Info("Wrote review routing data", "path", st.opts.Review.RoutingFile)
+	return nil
+}
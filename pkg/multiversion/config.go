@@ -0,0 +1,237 @@
+package multiversion
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// VersionConfig contains options for a single version.
+type VersionConfig struct {
+	// Branch is the name of the branch to fetch the version from.
+	// If not specified, the branch given with --branches is used, or the
+	// version name if the version is not listed there.
+	Branch string `yaml:"branch"`
+
+	// Archive is the URL of a gzipped tarball to fetch the version from
+	// instead of cloning the repository. If the tarball contains a single top
+	// level directory, --repo-content-dir is relative to that directory.
+	Archive string `yaml:"archive"`
+
+	// Remote is the name of an entry in 'remotes', or a fork of --repo-url
+	// on the same forge in the form 'owner/repo', to fetch the version from
+	// instead of --repo-url.
+	Remote string `yaml:"remote"`
+
+	// Fetcher overrides --fetcher for the version. One of 'git', 'go-git',
+	// 'archive' or 'local'. Defaults to 'archive' if Archive is set, and to
+	// 'local' if Path is set.
+	Fetcher string `yaml:"fetcher"`
+
+	// Path is a directory on the local filesystem, such as a working copy
+	// of the repository, used as the source tree of the version.
+	Path string `yaml:"path"`
+
+	// Roots override the top-level roots for the version, listing the
+	// directories of the repository copied for the version in order.
+	Roots []Root `yaml:"roots"`
+
+	// Downloads override the top-level download pages for the version.
+	Downloads []Download `yaml:"downloads"`
+
+	// Pins keep files or directories within the version at a different ref
+	// to the rest of the version.
+	Pins []Pin `yaml:"pins"`
+
+	// Hooks override the top-level hooks for the version.
+	Hooks *Hooks `yaml:"hooks"`
+
+	// ContentTypes maps lower-case file extensions (e.g. '.rst') to the
+	// policy used to handle files of that type, for example converting them
+	// into a type Hugo can render.
+	ContentTypes map[string]ContentTypeMapping `yaml:"contentTypes"`
+
+	// Outdated overrides whether the version is marked as outdated when
+	// --outdated-cascade is set. By default, all versions other than
+	// 'latest' are outdated.
+	Outdated *bool `yaml:"outdated"`
+
+	// Aliases are other names the version is reachable at, e.g. 'stable',
+	// served from the URL of the alias as determined by
+	// --version-alias-strategy.
+	Aliases []string `yaml:"aliases"`
+
+	// Outputs are the Hugo output formats, e.g. 'html', the pages of the
+	// version are rendered in. Overrides --non-latest-outputs for the version.
+	Outputs []string `yaml:"outputs"`
+
+	// List is the '_build.list' option cascaded to the pages of the version,
+	// which controls whether they are included in site-wide page lists. One
+	// of 'always', 'local' or 'never'. Overrides --non-latest-list for the
+	// version.
+	List string `yaml:"list"`
+
+	// Cascade are additional front matter fields cascaded to every page of
+	// the version from the _index page at its root, e.g. params controlling
+	// pagination.
+	Cascade map[string]interface{} `yaml:"cascade"`
+
+	// SEOPolicy overrides the top-level seoPolicy for the version, which
+	// determines whether its pages are indexed, their canonical URLs and how
+	// they are listed in sitemaps.
+	SEOPolicy *SEOPolicy `yaml:"seoPolicy"`
+
+	// Deprecated marks the version as deprecated. Pages in deprecated versions
+	// have the 'deprecated' param set, and are not indexed unless the
+	// version's seoPolicy says otherwise.
+	Deprecated bool `yaml:"deprecated"`
+
+	// ExcludeDrafts overrides --exclude-drafts for the version.
+	ExcludeDrafts *bool `yaml:"excludeDrafts"`
+
+	// ExcludeExpired overrides --exclude-expired for the version.
+	ExcludeExpired *bool `yaml:"excludeExpired"`
+
+	// EditURLTemplate overrides --edit-url-template for the version.
+	EditURLTemplate string `yaml:"editURLTemplate"`
+
+	// ReleaseDate is the date the version was released, in the form
+	// YYYY-MM-DD, used by the support policy.
+	ReleaseDate string `yaml:"releaseDate"`
+
+	// ProductVersion is the version of the product documented by the
+	// version, used by the 'version-references' checker. By default it is
+	// derived from the version name, e.g. 'v1.2' documents version '1.2'.
+	ProductVersion string `yaml:"productVersion"`
+
+	// EOL overrides whether the version has reached its end of life, as
+	// determined by the support policy.
+	EOL *bool `yaml:"eol"`
+
+	// EOLDate is the date the version reaches its end of life, in the form
+	// YYYY-MM-DD. It overrides the date computed by the support policy, and
+	// the version is EOL from that date unless EOL is set.
+	EOLDate string `yaml:"eolDate"`
+
+	// Hidden builds the version without listing it in the versions data
+	// file or the version switcher. Its pages are excluded from Hugo's page
+	// lists, and so from menus and sitemaps, and from search engine indexes,
+	// so it is only reachable by direct links.
+	Hidden bool `yaml:"hidden"`
+
+	// PinnedRef is the ref links matching the top-level 'pinnedURLs' are
+	// pinned to, e.g. the tag of the version's latest release. Defaults to
+	// the branch or tag the version is built from.
+	PinnedRef string `yaml:"pinnedRef"`
+
+	// Transforms overrides the top-level 'transforms' for the version, naming
+	// the transforms applied to its pages in order. Unlike the top-level
+	// list, enabled transforms may be left out to skip them for the version.
+	Transforms []string `yaml:"transforms"`
+}
+
+// LoadConfigFile reads the per-version options in the config file at the
+// given path into c. If path is empty, c is left unchanged.
+func LoadConfigFile(path string, c *Config) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, c)
+}
+
+// validateVersionOptions validates the per-version options and compiles the
+// patterns they contain.
+func (st *state) validateVersionOptions() error {
+	c := st.opts
+	if c.SupportPolicy != nil {
+		if err := c.SupportPolicy.validate(); err != nil {
+			return fmt.Errorf("supportPolicy: %v", err)
+		}
+	}
+	if c.VersionReferences != nil {
+		if err := c.VersionReferences.compile(); err != nil {
+			return fmt.Errorf("versionReferences: %v", err)
+		}
+	}
+	if err := c.validateRemotes(); err != nil {
+		return err
+	}
+	if err := st.validateRoots(c.Roots); err != nil {
+		return err
+	}
+	if err := st.validateDownloads(c.Downloads); err != nil {
+		return err
+	}
+	if err := c.CDN.validate(c); err != nil {
+		return err
+	}
+	if err := c.validatePinnedURLs(); err != nil {
+		return err
+	}
+	if err := c.validateTransforms(); err != nil {
+		return err
+	}
+	if err := c.validateHooks(); err != nil {
+		return err
+	}
+	if err := c.validateRedirects(); err != nil {
+		return err
+	}
+	if err := c.validateVersionCascades(); err != nil {
+		return err
+	}
+	if err := st.validateVersionAliases(); err != nil {
+		return err
+	}
+	versions := st.configuredVersions()
+	if err := c.SEOPolicy.validate(versions); err != nil {
+		return err
+	}
+	for name, vc := range c.Versions {
+		if vc == nil {
+			continue
+		}
+		if err := validateContentTypes(vc.ContentTypes); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+		if err := st.validateFetcher(vc); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+		if err := st.validateRoots(vc.Roots); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+		if err := st.validateDownloads(vc.Downloads); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+		if err := st.validatePins(vc); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+		if err := vc.SEOPolicy.validate(versions); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+		if _, err := vc.eolDate(); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+		if err := c.validateTransformList(vc.Transforms); err != nil {
+			return fmt.Errorf("version %q: transforms: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// versionConfig returns the options for the named version.
+// A non-nil value is always returned.
+func (c *Config) versionConfig(name string) *VersionConfig {
+	if vc, ok := c.Versions[name]; ok && vc != nil {
+		return vc
+	}
+	if name != "" && name == c.previewVersion() {
+		return &VersionConfig{Hidden: true}
+	}
+	return &VersionConfig{}
+}
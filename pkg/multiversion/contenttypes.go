@@ -0,0 +1,135 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// ContentTypePolicy controls how files of a particular type are handled
+// whilst being copied into the output directory.
+type ContentTypePolicy string
+
+const (
+	// ContentTypePolicyInclude copies files as-is.
+	ContentTypePolicyInclude ContentTypePolicy = "include"
+	// ContentTypePolicyExclude skips files entirely.
+	ContentTypePolicyExclude ContentTypePolicy = "exclude"
+	// ContentTypePolicyConvert runs files through a converter command.
+	ContentTypePolicyConvert ContentTypePolicy = "convert"
+)
+
+// ContentTypeMapping describes how files of a particular type should be
+// handled whilst being copied into the output directory.
+type ContentTypeMapping struct {
+	// Policy is one of 'include', 'exclude' or 'convert'.
+	// Defaults to 'convert' if a command is specified, otherwise 'include'.
+	Policy ContentTypePolicy `yaml:"policy"`
+
+	// Command is the converter command and its arguments, used when the
+	// policy is 'convert'.
+	// The source file is provided on stdin, and the converted document is
+	// read from stdout.
+	Command []string `yaml:"command"`
+
+	// Extension is the file extension given to the converted file.
+	// Defaults to '.md'.
+	Extension string `yaml:"extension"`
+}
+
+// unsupportedContentTypes is the set of file extensions that Hugo is only able
+// to render if an external helper is installed on the build host.
+var unsupportedContentTypes = map[string]string{
+	".rst":      "rst2html",
+	".adoc":     "asciidoctor",
+	".asciidoc": "asciidoctor",
+	".ad":       "asciidoctor",
+	".pandoc":   "pandoc",
+	".pdc":      "pandoc",
+}
+
+// policy returns the effective policy for the mapping.
+func (m ContentTypeMapping) policy() ContentTypePolicy {
+	if m.Policy != "" {
+		return m.Policy
+	}
+	if len(m.Command) > 0 {
+		return ContentTypePolicyConvert
+	}
+	return ContentTypePolicyInclude
+}
+
+// validateContentTypes checks the content type mappings for a version.
+func validateContentTypes(mappings map[string]ContentTypeMapping) error {
+	for ext, m := range mappings {
+		switch m.policy() {
+		case ContentTypePolicyInclude, ContentTypePolicyExclude:
+		case ContentTypePolicyConvert:
+			if len(m.Command) == 0 {
+				return fmt.Errorf("no converter command specified for content type %q", ext)
+			}
+		default:
+			return fmt.Errorf("unknown policy %q for content type %q", m.Policy, ext)
+		}
+	}
+	return nil
+}
+
+// checkContentTypeHelpers logs a warning for each content type that is
+// included as-is but whose external rendering helper is not installed on
+// this host, as Hugo will fail to render these pages.
+func checkContentTypeHelpers(log logr.Logger, mappings map[string]ContentTypeMapping) {
+	for ext, m := range mappings {
+		if m.policy() != ContentTypePolicyInclude {
+			continue
+		}
+		helper, ok := unsupportedContentTypes[ext]
+		if !ok {
+			continue
+		}
+		if _, err := exec.LookPath(helper); err != nil {
+			log.Info("WARNING: content type is included but its rendering helper is not installed on this host", "extension", ext, "helper", helper)
+		}
+	}
+}
+
+// convertFile converts the file at src using the given mapping, writing the
+// result to dst with its extension replaced. The path of the converted file
+// is returned.
+func (st *state) convertFile(log logr.Logger, m ContentTypeMapping, ext, src, dst string) (string, error) {
+	newExt := m.Extension
+	if newExt == "" {
+		newExt = ".md"
+	}
+	dst = strings.TrimSuffix(dst, ext) + newExt
+
+	log = log.WithValues("src", src, "dst", dst, "cmd", m.Command)
+	log.V(4).Info("Converting file")
+
+	srcfd, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer srcfd.Close()
+
+	dstfd, err := st.output.Create(dst, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer dstfd.Close()
+
+	var stderr bytes.Buffer
+	cmd := newCommand(m.Command[0], m.Command[1:]...)
+	cmd.Stdin = srcfd
+	cmd.Stdout = dstfd
+	cmd.Stderr = &stderr
+	if err := st.runProcess(cmd); err != nil {
+		log.Error(err, "Error running converter", "stderr", stderr.String())
+		return "", err
+	}
+	return dst, dstfd.Close()
+}
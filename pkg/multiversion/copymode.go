@@ -0,0 +1,81 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Modes supported by --copy-mode.
+const (
+	copyModeCopy     = "copy"
+	copyModeHardlink = "hardlink"
+	copyModeSymlink  = "symlink"
+	copyModeMount    = "mount"
+)
+
+// validateCopyMode returns an error if the given --copy-mode is not supported
+// or cannot be used with the other flags.
+func (st *state) validateCopyMode(mode string) error {
+	switch mode {
+	case copyModeCopy, copyModeHardlink:
+		return nil
+	case copyModeMount:
+		return st.validateMountMode()
+	case copyModeSymlink:
+		if st.opts.Fetch.CacheDir == "" {
+			return fmt.Errorf("--cache-dir must be set when using %q, as symlinks must point at a directory that is not removed", mode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported mode %q", mode)
+}
+
+// sourcesDir returns the directory that versions are fetched into. Sources
+// are fetched into the cache directory when --copy-mode is symlink or mount,
+// so that the targets of the symlinks or mounts are not removed once the build
+// completes.
+func (st *state) sourcesDir(tmpdir, version string) (string, error) {
+	if st.opts.Output.CopyMode != copyModeSymlink && st.opts.Output.CopyMode != copyModeMount {
+		return tmpdir, nil
+	}
+	dir := filepath.Join(st.opts.Fetch.CacheDir, "sources")
+	// remove the version's previous sources, as it is fetched from scratch
+	if err := os.RemoveAll(filepath.Join(dir, "repo", version)); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// placeFile places the file at src at dst according to --copy-mode. Hard
+// links fall back to copying if src and dst are on different filesystems, and
+// files are always copied if the output does not support links.
+// Pages that are later modified by transforms are replaced by writePage
+// rather than written through the link, and a file left at dst by a previous
+// build is removed first.
+func (st *state) placeFile(c *copyContext, src, dst string) error {
+	if err := st.removeOutputFile(dst); err != nil {
+		return err
+	}
+	lfs, ok := st.output.(linkFS)
+	switch {
+	case st.opts.Output.CopyMode == copyModeHardlink && ok:
+		err := lfs.Link(src, dst)
+		if err == nil {
+			return nil
+		}
+		c.mu.Lock()
+		if !c.linkFailed {
+			c.linkFailed = true
+			c.log.Info("WARNING: failed to hard link file, falling back to copying", "error", err.Error())
+		}
+		c.mu.Unlock()
+	case st.opts.Output.CopyMode == copyModeSymlink && ok:
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return err
+		}
+		return lfs.Symlink(abs, dst)
+	}
+	return st.copyToOutput(src, dst)
+}
@@ -0,0 +1,41 @@
+package multiversion
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHardlinkRebuildKeepsContent(t *testing.T) {
+	repo := newTestRepo(t, map[string]map[string]string{
+		"release-1.0": {
+			"content/docs/install.md": testPage("Install", "Run the installer."),
+			"content/docs/notes.txt":  "Release notes.\n",
+		},
+	})
+	c := testConfig(t, repo, "v1.0=release-1.0")
+	c.Output.CopyMode = copyModeHardlink
+	c.Fetch.CacheDir = t.TempDir()
+
+	// the second build replaces the files linked by the first, and updates
+	// the cached clone they were linked from in place
+	testBuild(t, c)
+	testBuild(t, c)
+
+	for _, fp := range []string{
+		filepath.Join(c.Output.Dir, "v1.0", "docs", "notes.txt"),
+		filepath.Join(c.Fetch.CacheDir, "git", "v1.0", "content", "docs", "notes.txt"),
+	} {
+		if got := readTestFile(t, fp); got != "Release notes.\n" {
+			t.Errorf("%s: got %q, want the original content", fp, got)
+		}
+	}
+	for _, fp := range []string{
+		filepath.Join(c.Output.Dir, "v1.0", "docs", "install.md"),
+		filepath.Join(c.Fetch.CacheDir, "git", "v1.0", "content", "docs", "install.md"),
+	} {
+		if got := readTestFile(t, fp); !strings.Contains(got, "Run the installer.") {
+			t.Errorf("%s: got %q, want the page's content", fp, got)
+		}
+	}
+}
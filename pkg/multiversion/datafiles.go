@@ -0,0 +1,212 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// currentDataFormatVersion is the newest format version of the generated data
+// files. It must be incremented whenever a backwards incompatible change is
+// made to the structure of any data file, and the previous format must remain
+// available via --data-format-version.
+const currentDataFormatVersion = 1
+
+// dataFileSchemas maps the name of each generated data file to the JSON
+// schema describing it, for each supported data format version.
+var dataFileSchemas = map[int]map[string]string{
+	1: {
+		"versions":     versionsSchemaV1,
+		"availability": availabilitySchemaV1,
+		"anchors":      anchorsSchemaV1,
+		"glossary":     glossarySchemaV1,
+	},
+}
+
+// versionsData is the structure of the versions data file.
+type versionsData struct {
+	FormatVersion int           `json:"formatVersion"`
+	Latest        string        `json:"latest,omitempty"`
+	Versions      []versionData `json:"versions"`
+}
+
+// versionData describes a single version in the versions data file.
+type versionData struct {
+	Name       string `json:"name"`
+	Branch     string `json:"branch"`
+	URL        string `json:"url"`
+	Latest     bool   `json:"latest"`
+	Outdated   bool   `json:"outdated"`
+	Deprecated bool   `json:"deprecated"`
+	EOL        bool   `json:"eol"`
+	EOLDate    string `json:"eolDate,omitempty"`
+	// Aliases are the other names the version is reachable at.
+	Aliases []string `json:"aliases,omitempty"`
+	// Root is set for the version served from the root of the site.
+	Root bool `json:"root,omitempty"`
+	// Archived is set for versions that are no longer built, which link to
+	// --archived-versions-url.
+	Archived bool `json:"archived,omitempty"`
+	// Prerelease and Published are set for versions discovered from a
+	// release with --discover.
+	Prerelease bool   `json:"prerelease,omitempty"`
+	Published  string `json:"published,omitempty"`
+
+	// The following fields are read from the version's metadata file.
+	DisplayName       string                 `json:"displayName,omitempty"`
+	MinProductVersion string                 `json:"minProductVersion,omitempty"`
+	DeprecationNote   string                 `json:"deprecationNote,omitempty"`
+	Params            map[string]interface{} `json:"params,omitempty"`
+}
+
+// availabilityData is the structure of the page availability data file.
+type availabilityData struct {
+	FormatVersion int `json:"formatVersion"`
+	// Pages maps the path of each page, relative to the root of its version,
+	// to the names of the versions containing that page.
+	Pages map[string][]string `json:"pages"`
+}
+
+// validateDataFormatVersion returns an error if the given data format version
+// cannot be generated.
+func validateDataFormatVersion(v int) error {
+	if _, ok := dataFileSchemas[v]; !ok {
+		return fmt.Errorf("unsupported data format version %d, the newest supported version is %d", v, currentDataFormatVersion)
+	}
+	return nil
+}
+
+// sortedVersionNames returns the names of the versions in the version map,
+// with 'latest' first and the remaining versions newest first, as ordered by
+// newerVersionName.
+func sortedVersionNames(versions map[string]string) []string {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		if name != latestVersion {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return newerVersionName(names[i], names[j]) })
+	if _, ok := versions[latestVersion]; ok {
+		names = append([]string{latestVersion}, names...)
+	}
+	return names
+}
+
+// buildVersionsData builds the contents of the versions data file, which
+// does not list hidden versions.
+func (st *state) buildVersionsData(versions map[string]string) *versionsData {
+	data := &versionsData{FormatVersion: st.opts.Output.DataFormatVersion, Versions: []versionData{}}
+	if _, ok := versions[latestVersion]; ok {
+		data.Latest = latestVersion
+	}
+	for _, name := range sortedVersionNames(versions) {
+		vc := st.opts.versionConfig(name)
+		if vc.Hidden {
+			continue
+		}
+		meta := st.metadataFor(name)
+		var eolDate, published string
+		if support := st.computedSupport[name]; !support.eolDate.IsZero() {
+			eolDate = support.eolDate.Format("2006-01-02")
+		}
+		dv := st.discoveredVersions[name]
+		if dv == nil {
+			dv = &discoveredVersion{}
+		}
+		if !dv.published.IsZero() {
+			published = dv.published.Format("2006-01-02")
+		}
+		data.Versions = append(data.Versions, versionData{
+			Name:              name,
+			Branch:            versions[name],
+			URL:               st.versionURL(name),
+			Latest:            name == latestVersion,
+			Outdated:          isOutdated(name, vc),
+			Deprecated:        st.isDeprecated(name),
+			EOL:               st.isEOL(name),
+			EOLDate:           eolDate,
+			Aliases:           vc.Aliases,
+			Root:              name == st.opts.Output.RootVersion,
+			Prerelease:        dv.prerelease,
+			Published:         published,
+			DisplayName:       meta.DisplayName,
+			MinProductVersion: meta.MinProductVersion,
+			DeprecationNote:   meta.DeprecationNote,
+			Params:            meta.Params,
+		})
+	}
+	data.Versions = append(data.Versions, st.archivedVersionsData()...)
+	return data
+}
+
+// buildAvailabilityData builds the contents of the page availability data
+// file. Hidden versions are not included.
+func (st *state) buildAvailabilityData(idx *contentIndex) *availabilityData {
+	data := &availabilityData{FormatVersion: st.opts.Output.DataFormatVersion, Pages: map[string][]string{}}
+	for _, vers := range idx.versions {
+		if st.opts.versionConfig(vers).Hidden {
+			continue
+		}
+		for pp := range idx.pages[vers] {
+			data.Pages[pp] = append(data.Pages[pp], vers)
+		}
+	}
+	return data
+}
+
+// writeDataFile writes v as JSON to <data-dir>/<name>.json, alongside the JSON
+// schema describing it in <data-dir>/<name>.schema.json.
+func (st *state) writeDataFile(log logr.Logger, name string, v interface{}) error {
+	if err := os.MkdirAll(st.opts.Output.DataDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(st.opts.Output.DataDir, name+".json")
+	log.Info("Writing data file", "path", path)
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	schema, ok := dataFileSchemas[st.opts.Output.DataFormatVersion][name]
+	if !ok {
+		return nil
+	}
+	schemaPath := strings.TrimSuffix(path, ".json") + ".schema.json"
+	return ioutil.WriteFile(schemaPath, []byte(schema), 0644)
+}
+
+// writeDataFiles writes all data files describing the built versions.
+func (st *state) writeDataFiles(log logr.Logger, versions map[string]string, idx *contentIndex) error {
+	if st.opts.Output.DataDir == "" {
+		return nil
+	}
+	if err := st.writeDataFile(log, "versions", st.buildVersionsData(versions)); err != nil {
+		return err
+	}
+	if err := st.writeDataFile(log, "availability", st.buildAvailabilityData(idx)); err != nil {
+		return err
+	}
+	anchors, err := st.buildAnchorsData(idx)
+	if err != nil {
+		return err
+	}
+	if err := st.writeDataFile(log, "anchors", anchors); err != nil {
+		return err
+	}
+	if len(st.opts.Fetch.GlossaryFiles) > 0 {
+		glossary := st.buildGlossaryData(versions)
+		logGlossaryChanges(log, glossary)
+		return st.writeDataFile(log, "glossary", glossary)
+	}
+	return nil
+}
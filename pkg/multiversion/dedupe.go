@@ -0,0 +1,264 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// Modes supported by --dedupe-assets.
+const (
+	// dedupeReport logs the space that could be saved by deduplicating assets.
+	dedupeReport = "report"
+	// dedupeHardlink replaces identical assets with hard links to one copy.
+	dedupeHardlink = "hardlink"
+	// dedupeShared moves identical assets into --shared-assets-dir and
+	// rewrites links to them.
+	dedupeShared = "shared"
+)
+
+// anyLinkPatterns match absolute and relative links in pages.
+var anyLinkPatterns = linkPatterns{
+	html:     []*regexp.Regexp{regexp.MustCompile(`((?:href|src)\s*=\s*["'])([^"'#?]+)`)},
+	markdown: []*regexp.Regexp{regexp.MustCompile(`(\]\(\s*<?)([^)\s>#?]+)`), regexp.MustCompile(`^(\s{0,3}\[[^\]]+\]:\s*<?)([^\s>#?]+)`)},
+}
+
+// assetFile is a non-page file in the content of a version.
+type assetFile struct {
+	version string
+	// rel is the path of the file relative to the version directory, using
+	// forward slashes.
+	rel string
+}
+
+// assetPath returns the path of the asset file in the output directory.
+func (st *state) assetPath(f assetFile) string {
+	return filepath.Join(st.versionDir(f.version), filepath.FromSlash(f.rel))
+}
+
+// duplicateAssets is a set of identical asset files.
+type duplicateAssets struct {
+	hash  string
+	size  int64
+	files []assetFile
+}
+
+// validateDedupeMode returns an error if the given --dedupe-assets mode is
+// not supported.
+func validateDedupeMode(mode string) error {
+	switch mode {
+	case "", dedupeReport, dedupeHardlink, dedupeShared:
+		return nil
+	}
+	return fmt.Errorf("unsupported mode %q", mode)
+}
+
+// findDuplicateAssets returns every set of identical asset files in the given
+// versions. Files are first grouped by size so that only files that may be
+// identical are hashed.
+func (st *state) findDuplicateAssets(versions []string) ([]duplicateAssets, error) {
+	bySize := make(map[int64][]assetFile)
+	for _, vers := range versions {
+		dir := st.versionDir(vers)
+		err := st.walkOutput(dir, func(fp string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || isPage(fp) {
+				return err
+			}
+			if info, err = st.followSymlink(fp, info); err != nil || info.Size() == 0 {
+				return err
+			}
+			rel, err := filepath.Rel(dir, fp)
+			if err != nil {
+				return err
+			}
+			bySize[info.Size()] = append(bySize[info.Size()], assetFile{version: vers, rel: filepath.ToSlash(rel)})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var groups []duplicateAssets
+	for size, files := range bySize {
+		if len(files) < 2 {
+			continue
+		}
+		byHash := make(map[string][]assetFile)
+		for _, f := range files {
+			sum, err := st.hashOutputFile(st.assetPath(f))
+			if err != nil {
+				return nil, err
+			}
+			byHash[sum] = append(byHash[sum], f)
+		}
+		for sum, files := range byHash {
+			if len(files) > 1 {
+				groups = append(groups, duplicateAssets{hash: sum, size: size, files: files})
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].hash < groups[j].hash })
+	return groups, nil
+}
+
+// dedupeAssets finds identical asset files across the built versions and
+// deduplicates them according to --dedupe-assets.
+func (st *state) dedupeAssets(log logr.Logger, versions []string) error {
+	groups, err := st.findDuplicateAssets(versions)
+	if err != nil {
+		return err
+	}
+	var duplicates int
+	var savings int64
+	for _, g := range groups {
+		duplicates += len(g.files) - 1
+		savings += g.size * int64(len(g.files)-1)
+		log.V(4).Info("Found identical assets", "sha256", g.hash, "size", g.size, "files", g.files)
+	}
+	log.Info("Found duplicate assets", "files", duplicates, "bytes", savings)
+
+	switch st.opts.Output.DedupeMode {
+	case dedupeHardlink:
+		for _, g := range groups {
+			if err := st.hardlinkAssets(g); err != nil {
+				return err
+			}
+		}
+	case dedupeShared:
+		if err := st.moveSharedAssets(log, groups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashOutputFile returns the hex encoded SHA256 of the file at path in the
+// output.
+func (st *state) hashOutputFile(path string) (string, error) {
+	f, err := st.output.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// hardlinkAssets replaces every file in the group with a hard link to the
+// first file.
+func (st *state) hardlinkAssets(g duplicateAssets) error {
+	lfs, ok := st.output.(linkFS)
+	if !ok {
+		return fmt.Errorf("the output does not support hard links")
+	}
+	src := st.assetPath(g.files[0])
+	for _, f := range g.files[1:] {
+		tmp := st.assetPath(f) + ".multiversion-link"
+		if err := lfs.Link(src, tmp); err != nil {
+			return err
+		}
+		if err := st.output.Rename(tmp, st.assetPath(f)); err != nil {
+			st.output.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedAssetPath returns the path of a shared asset relative to
+// --shared-assets-dir, using forward slashes.
+func sharedAssetPath(g duplicateAssets) string {
+	return g.hash[:16] + "/" + path.Base(g.files[0].rel)
+}
+
+// moveSharedAssets moves duplicate assets into --shared-assets-dir and
+// rewrites links to them in every page. Assets in leaf bundles are left in
+// place, as they may be accessed as page resources.
+func (st *state) moveSharedAssets(log logr.Logger, groups []duplicateAssets) error {
+	// moved maps each version to the paths of assets moved out of the version
+	// and their new URLs
+	moved := make(map[string]map[string]string)
+	for _, g := range groups {
+		var files []assetFile
+		for _, f := range g.files {
+			if !st.inLeafBundle(f) {
+				files = append(files, f)
+			}
+		}
+		if len(files) < 2 {
+			continue
+		}
+		dst := filepath.Join(st.opts.Output.SharedAssetsDir, filepath.FromSlash(sharedAssetPath(g)))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := st.copyFromOutput(st.assetPath(files[0]), dst); err != nil {
+			return err
+		}
+		url := strings.TrimSuffix(st.opts.Output.SharedAssetsURL, "/") + "/" + sharedAssetPath(g)
+		for _, f := range files {
+			if err := st.output.Remove(st.assetPath(f)); err != nil {
+				return err
+			}
+			// remove the directory containing the asset if it is now empty
+			st.output.Remove(filepath.Dir(st.assetPath(f)))
+			if moved[f.version] == nil {
+				moved[f.version] = make(map[string]string)
+			}
+			moved[f.version][f.rel] = url
+		}
+	}
+
+	for vers, assets := range moved {
+		log.Info("Rewriting links to shared assets", "version", vers, "assets", len(assets))
+		err := st.updatePages(st.versionDir(vers), func(rel string, p *page) (bool, error) {
+			body := mapLinks(p.body, lowerExt(rel), anyLinkPatterns, func(link string) string {
+				if url, ok := assets[st.resolveAssetLink(vers, rel, link)]; ok {
+					return url
+				}
+				return link
+			})
+			modified := string(body) != string(p.body)
+			p.body = body
+			return modified, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveAssetLink returns the path, relative to the version directory, of the
+// file targeted by a link in the page at rel. Absolute links are interpreted
+// relative to the root of the version, and relative links relative to the
+// directory containing the page.
+func (st *state) resolveAssetLink(version, rel, link string) string {
+	if strings.Contains(link, "://") || strings.HasPrefix(link, "//") {
+		return ""
+	}
+	if strings.HasPrefix(link, "/") {
+		return strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(link, st.versionURL(version))), "/")
+	}
+	return strings.TrimPrefix(path.Join("/", path.Dir(rel), link), "/")
+}
+
+// inLeafBundle returns true if the asset is in a directory containing an
+// index page, or one of its subdirectories.
+func (st *state) inLeafBundle(f assetFile) bool {
+	for dir := path.Dir(f.rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		matches, _ := st.globOutput(filepath.Join(st.versionDir(f.version), filepath.FromSlash(dir), "index.*"))
+		for _, m := range matches {
+			if isPage(m) {
+				return true
+			}
+		}
+	}
+	return false
+}
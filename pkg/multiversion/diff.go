@@ -0,0 +1,206 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// diffReport is the structure of the report written by the diff command.
+type diffReport struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Added are the pages of To that are not in From.
+	Added []diffPage `json:"added"`
+	// Removed are the pages of From that are not in To.
+	Removed []diffPage `json:"removed"`
+	// Changed are the pages of both versions whose content changed by at
+	// least --diff-threshold.
+	Changed []diffPage `json:"changed"`
+}
+
+// diffPage is a page listed in a diffReport.
+type diffPage struct {
+	// Path is the path of the page's source file, relative to the root of
+	// the version it is listed from.
+	Path  string `json:"path"`
+	URL   string `json:"url"`
+	Title string `json:"title"`
+	// Change is the proportion of the lines of a changed page that were added
+	// or removed, between 0 and 1.
+	Change float64 `json:"change,omitempty"`
+}
+
+// diffSide is a page of one of the compared versions.
+type diffSide struct {
+	rel   string
+	title string
+	lines []string
+}
+
+// validateDiffThreshold returns an error if --diff-threshold is not a
+// proportion.
+func (st *state) validateDiffThreshold() error {
+	if st.opts.Diff.Threshold < 0 || st.opts.Diff.Threshold > 1 {
+		return fmt.Errorf("must be between 0 and 1")
+	}
+	return nil
+}
+
+// runDiff compares the pages of two versions in the output directory,
+// matching pages by the URL they are published at within their version, and
+// logs the pages that were added, removed or substantially changed. The
+// comparison is written to --diff-report as JSON and to --diff-page as a
+// Markdown page, if they are set.
+func (st *state) runDiff(from, to string) error {
+	for _, vers := range []string{from, to} {
+		if _, err := st.output.Stat(st.versionDir(vers)); err != nil {
+			return fmt.Errorf("version %q has not been built in %s", vers, st.opts.Output.Dir)
+		}
+	}
+	fromPages, err := st.diffPages(from)
+	if err != nil {
+		return err
+	}
+	toPages, err := st.diffPages(to)
+	if err != nil {
+		return err
+	}
+
+	r := &diffReport{From: from, To: to, Added: []diffPage{}, Removed: []diffPage{}, Changed: []diffPage{}}
+	for pp, t := range toPages {
+		f, ok := fromPages[pp]
+		if !ok {
+			r.Added = append(r.Added, diffPage{Path: t.rel, URL: st.pageURL(to, t.rel), Title: t.title})
+			continue
+		}
+		if change := lineChange(f.lines, t.lines); change > 0 && change >= st.opts.Diff.Threshold {
+			r.Changed = append(r.Changed, diffPage{Path: t.rel, URL: st.pageURL(to, t.rel), Title: t.title, Change: change})
+		}
+	}
+	for pp, f := range fromPages {
+		if _, ok := toPages[pp]; !ok {
+			r.Removed = append(r.Removed, diffPage{Path: f.rel, URL: st.pageURL(from, f.rel), Title: f.title})
+		}
+	}
+	for _, pages := range [][]diffPage{r.Added, r.Removed, r.Changed} {
+		sort.Slice(pages, func(i, j int) bool { return pages[i].URL < pages[j].URL })
+	}
+
+	log := st.log.WithValues("from", from, "to", to)
+	for _, p := range r.Added {
+		log.Info("Page was added", "url", p.URL, "path", p.Path)
+	}
+	for _, p := range r.Removed {
+		log.Info("Page was removed", "url", p.URL, "path", p.Path)
+	}
+	for _, p := range r.Changed {
+		log.Info("Page was changed", "url", p.URL, "path", p.Path, "change", fmt.Sprintf("%.0f%%", p.Change*100))
+	}
+	log.Info("Compared versions", "added", len(r.Added), "removed", len(r.Removed), "changed", len(r.Changed))
+
+	if st.opts.Diff.ReportFile != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(st.opts.Diff.ReportFile, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		log.Info("Wrote diff report", "path", st.opts.Diff.ReportFile)
+	}
+	if st.opts.Diff.Page != "" {
+		data, err := r.page().bytes()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(st.opts.Diff.Page), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(st.opts.Diff.Page, data, 0644); err != nil {
+			return err
+		}
+		log.Info("Wrote diff page", "path", st.opts.Diff.Page)
+	}
+	return nil
+}
+
+// diffPages returns the pages of the version that have content, keyed by
+// the path they are published at within the version. Lines are compared with
+// surrounding whitespace and the URL of the version removed, so that pages
+// that only differ in the version they link within are unchanged.
+func (st *state) diffPages(version string) (map[string]*diffSide, error) {
+	pages := make(map[string]*diffSide)
+	err := st.updatePages(st.versionDir(version), func(rel string, p *page) (bool, error) {
+		body := p.body
+		if st.versionPath(version) != "" {
+			body = bytes.Replace(body, []byte(st.versionURL(version)), []byte(st.versionURL("")), -1)
+		}
+		s := &diffSide{rel: filepath.ToSlash(rel), title: filepath.ToSlash(rel)}
+		if title, ok := p.frontMatter["title"].(string); ok && title != "" {
+			s.title = title
+		}
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				s.lines = append(s.lines, line)
+			}
+		}
+		pages[pagePath(s.rel)] = s
+		return false, nil
+	})
+	return pages, err
+}
+
+// lineChange returns the proportion of the lines of a and b that are only in
+// one of them, counting repeated lines separately and ignoring their order.
+func lineChange(a, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 0
+	}
+	counts := make(map[string]int, len(a))
+	for _, line := range a {
+		counts[line]++
+	}
+	var common int
+	for _, line := range b {
+		if counts[line] > 0 {
+			counts[line]--
+			common++
+		}
+	}
+	return 1 - float64(2*common)/float64(len(a)+len(b))
+}
+
+// page returns a Markdown page listing the differences between the
+// versions, linking to each page.
+func (r *diffReport) page() *page {
+	var b strings.Builder
+	section := func(heading string, pages []diffPage) {
+		fmt.Fprintf(&b, "## %s\n\n", heading)
+		if len(pages) == 0 {
+			b.WriteString("None.\n\n")
+			return
+		}
+		for _, p := range pages {
+			fmt.Fprintf(&b, "* [%s](%s)", strings.NewReplacer("[", `\[`, "]", `\]`).Replace(p.Title), p.URL)
+			if p.Change > 0 {
+				fmt.Fprintf(&b, " (%.0f%% changed)", p.Change*100)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	section("Added pages", r.Added)
+	section("Removed pages", r.Removed)
+	section("Changed pages", r.Changed)
+	return &page{
+		format:      frontMatterYAML,
+		frontMatter: map[string]interface{}{"title": fmt.Sprintf("Changes from %s to %s", r.From, r.To)},
+		body:        []byte(strings.TrimSuffix(b.String(), "\n")),
+	}
+}
@@ -0,0 +1,253 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	forgeGitHub = "github"
+	forgeGitLab = "gitlab"
+
+	discoverBranches = "branches"
+	discoverTags     = "tags"
+	discoverReleases = "releases"
+)
+
+// discoverPageSize is the number of refs requested from the forge's API at a
+// time.
+const discoverPageSize = 100
+
+// discoveredVersion is a version discovered from the API of the forge hosting
+// --repo-url with --discover.
+type discoveredVersion struct {
+	// ref is the branch, or the full ref of the tag, the version is built
+	// from.
+	ref string
+	// prerelease is set for versions of pre-releases, and of GitLab releases
+	// that are not released yet.
+	prerelease bool
+	// published is the date the version's release was published, which is
+	// zero for versions not discovered from a release.
+	published time.Time
+}
+
+// forgeRef is a branch, tag or release listed by the GitHub or GitLab API.
+type forgeRef struct {
+	Name        string `json:"name"`
+	TagName     string `json:"tag_name"`
+	Draft       bool   `json:"draft"`
+	Prerelease  bool   `json:"prerelease"`
+	Upcoming    bool   `json:"upcoming_release"`
+	PublishedAt string `json:"published_at"`
+	ReleasedAt  string `json:"released_at"`
+}
+
+// validateDiscovery returns false if the options used to discover versions
+// are invalid, logging the problems.
+func (st *state) validateDiscovery() bool {
+	if st.opts.Fetch.Discover == "" {
+		return true
+	}
+	valid := true
+	if d := st.opts.Fetch.Discover; d != forgeGitHub && d != forgeGitLab {
+		st.log.Info("--discover must be one of 'github' or 'gitlab'")
+		valid = false
+	}
+	if st.opts.Fetch.RepoURL == "" {
+		st.log.Info("--discover requires --repo-url to be set")
+		valid = false
+	}
+	if len(st.opts.Fetch.DiscoverRefs) == 0 {
+		st.log.Info("--discover-refs is invalid: at least one kind of ref must be discovered")
+		valid = false
+	}
+	for _, kind := range st.opts.Fetch.DiscoverRefs {
+		if kind != discoverBranches && kind != discoverTags && kind != discoverReleases {
+			st.log.Info("--discover-refs is invalid: " + fmt.Sprintf("%q must be one of 'branches', 'tags' or 'releases'", kind))
+			valid = false
+		}
+	}
+	if _, err := regexp.Compile(st.opts.Fetch.DiscoverPattern); err != nil {
+		st.log.Info("--discover-pattern is invalid: " + err.Error())
+		valid = false
+	}
+	if u := st.opts.Fetch.DiscoverAPIURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		st.log.Info("--discover-api-url is invalid: " + fmt.Sprintf("%q must be an http:// or https:// URL", u))
+		valid = false
+	}
+	return valid
+}
+
+// forgeAPIURL returns the base URL of the API of the forge on host, which is
+// GitHub, GitHub Enterprise or GitLab.
+func forgeAPIURL(forge, host string) string {
+	switch {
+	case forge == forgeGitLab:
+		return "https://" + host + "/api/v4"
+	case host == "github.com":
+		return "https://api.github.com"
+	}
+	return "https://" + host + "/api/v3"
+}
+
+// discoverVersions lists the branches, tags and releases of --repo-url with
+// the API of the forge hosting it, without cloning the repository, and
+// returns a version for each ref matching --discover-pattern. If several refs
+// are named after the same version, the ref of the kind listed first in
+// --discover-refs is used. Releases also record the metadata of the version
+// discovered from their tag.
+func (st *state) discoverVersions(log logr.Logger) (map[string]*discoveredVersion, error) {
+	if st.opts.Fetch.Discover == "" {
+		return nil, nil
+	}
+	web := repoWebURL(st.opts.Fetch.RepoURL)
+	if web == "" {
+		return nil, fmt.Errorf("--repo-url %q is not hosted by a forge", st.opts.Fetch.RepoURL)
+	}
+	u, err := url.Parse(web)
+	if err != nil {
+		return nil, err
+	}
+	pattern := regexp.MustCompile(st.opts.Fetch.DiscoverPattern)
+	project := strings.Trim(u.Path, "/")
+	apiURL := st.opts.Fetch.DiscoverAPIURL
+	if apiURL == "" {
+		apiURL = forgeAPIURL(st.opts.Fetch.Discover, u.Host)
+	}
+
+	discovered := map[string]*discoveredVersion{}
+	byRef := map[string]*discoveredVersion{}
+	for _, kind := range st.opts.Fetch.DiscoverRefs {
+		refs, err := st.listForgeRefs(log, apiURL, project, kind)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s of %s: %v", kind, project, err)
+		}
+		for _, r := range refs {
+			name, ref := r.Name, r.Name
+			if kind != discoverBranches {
+				if kind == discoverReleases {
+					name = r.TagName
+				}
+				ref = "refs/tags/" + name
+			}
+			if r.Draft || name == "" {
+				continue
+			}
+			m := pattern.FindStringSubmatch(name)
+			if m == nil {
+				continue
+			}
+			vers := name
+			if len(m) > 1 && m[1] != "" {
+				vers = m[1]
+			}
+			if unsafeNameRE.MatchString(vers) || vers == "." || vers == ".." {
+				log.Info("WARNING: skipping discovered ref, as it is not a valid version name", "ref", ref, "version", vers)
+				continue
+			}
+
+			dv, ok := byRef[ref]
+			if !ok {
+				if _, taken := discovered[vers]; taken {
+					log.V(4).Info("Version already discovered from another ref", "version", vers, "ref", ref)
+					continue
+				}
+				dv = &discoveredVersion{ref: ref}
+				discovered[vers], byRef[ref] = dv, dv
+			}
+			if kind == discoverReleases {
+				dv.prerelease = r.Prerelease || r.Upcoming
+				published := r.PublishedAt
+				if published == "" {
+					published = r.ReleasedAt
+				}
+				if t, err := time.Parse(time.RFC3339, published); err == nil {
+					dv.published = t.UTC()
+				}
+			}
+		}
+	}
+	log.Info("Discovered versions", "forge", st.opts.Fetch.Discover, "project", project, "versions", sortedVersionNames(discoveredRefs(discovered)))
+	return discovered, nil
+}
+
+// listForgeRefs returns every ref of the given kind in the project, reading
+// each page of the forge's API in turn. Requests are authenticated with the
+// GITHUB_TOKEN or GITLAB_TOKEN environment variable if it is set.
+func (st *state) listForgeRefs(log logr.Logger, apiURL, project, kind string) ([]forgeRef, error) {
+	var endpoint, authHeader, authValue string
+	switch st.opts.Fetch.Discover {
+	case forgeGitLab:
+		endpoint = apiURL + "/projects/" + url.PathEscape(project)
+		if kind != discoverReleases {
+			endpoint += "/repository"
+		}
+		if token := os.Getenv("GITLAB_TOKEN"); token != "" {
+			authHeader, authValue = "PRIVATE-TOKEN", token
+		}
+	default:
+		endpoint = apiURL + "/repos/" + project
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			authHeader, authValue = "Authorization", "token "+token
+		}
+	}
+	endpoint += "/" + kind
+
+	var refs []forgeRef
+	for page := 1; ; page++ {
+		pageURL := endpoint + "?per_page=" + strconv.Itoa(discoverPageSize) + "&page=" + strconv.Itoa(page)
+		req, err := http.NewRequestWithContext(st.runCtx, http.MethodGet, pageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if authHeader != "" {
+			req.Header.Set(authHeader, authValue)
+		}
+		req.Header.Set("Accept", "application/json")
+		log.V(4).Info("Listing refs", "url", pageURL)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			if len(body) > 1024 {
+				body = body[:1024]
+			}
+			return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+		var pageRefs []forgeRef
+		if err := json.Unmarshal(body, &pageRefs); err != nil {
+			return nil, err
+		}
+		refs = append(refs, pageRefs...)
+		if len(pageRefs) < discoverPageSize {
+			return refs, nil
+		}
+	}
+}
+
+// discoveredRefs returns the refs of the discovered versions, keyed by
+// version name.
+func discoveredRefs(discovered map[string]*discoveredVersion) map[string]string {
+	refs := make(map[string]string, len(discovered))
+	for vers, dv := range discovered {
+		refs[vers] = dv.ref
+	}
+	return refs
+}
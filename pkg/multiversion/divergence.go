@@ -0,0 +1,209 @@
+package multiversion
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// cherryPickedFromRE matches the line added to commit messages by
+// 'git cherry-pick -x'.
+var cherryPickedFromRE = regexp.MustCompile(`\(cherry picked from commit ([0-9a-f]{7,40})\)`)
+
+// divergenceReport is the structure of the report written by the divergence
+// command.
+type divergenceReport struct {
+	DefaultBranch string `json:"defaultBranch"`
+	LatestBranch  string `json:"latestBranch"`
+	// Commits are the commits to the content directory on the default branch
+	// that have no equivalent on the latest branch, newest first.
+	Commits []divergentCommit `json:"commits"`
+	// Files are the content files that differ between the two branches.
+	Files []divergentFile `json:"files"`
+}
+
+// divergentCommit is a commit on the default branch that has not been
+// backported.
+type divergentCommit struct {
+	SHA     string `json:"sha"`
+	Subject string `json:"subject"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+	// Files are the content files modified by the commit, relative to the
+	// content directory.
+	Files []string `json:"files"`
+}
+
+// divergentFile is a content file that differs between the two branches.
+type divergentFile struct {
+	// Path is relative to the content directory.
+	Path string `json:"path"`
+	// Status is 'added' or 'deleted' if the file only exists on the default
+	// or latest branch respectively, and 'modified' otherwise.
+	Status string `json:"status"`
+}
+
+// runDivergence compares the content directory of --default-branch with that
+// of the latest version's branch, logging the commits that have not been
+// backported and writing them to --divergence-report if it is set.
+func (st *state) runDivergence() error {
+	if st.opts.Fetch.RepoURL == "" {
+		return fmt.Errorf("--repo-url must be specified")
+	}
+	latest, ok := st.resolveVersions()[latestVersion]
+	if !ok {
+		return fmt.Errorf("no branch is configured for the %q version", latestVersion)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(st.log, tmpdir)
+	dir := filepath.Join(tmpdir, "repo")
+	if err := st.runCommand(st.log, "git", "clone", "--no-checkout", st.opts.Fetch.RepoURL, dir); err != nil {
+		return err
+	}
+	def := st.opts.Divergence.DefaultBranch
+	if def == "" {
+		head, err := st.commandOutput(st.log, dir, "git", "symbolic-ref", "--short", "refs/remotes/origin/HEAD")
+		if err != nil {
+			return fmt.Errorf("failed to determine the default branch, set --default-branch: %v", err)
+		}
+		def = strings.TrimPrefix(head, "origin/")
+	}
+	log := st.log.WithValues("defaultBranch", def, "latestBranch", latest)
+	if def == latest {
+		log.Info("The latest version is built from the default branch, nothing to compare")
+		return nil
+	}
+
+	r := &divergenceReport{DefaultBranch: def, LatestBranch: latest}
+	roots := st.opts.versionConfig(latestVersion).roots(st.opts)
+	if r.Commits, err = st.divergentCommits(log, dir, roots, "origin/"+latest, "origin/"+def); err != nil {
+		return err
+	}
+	if r.Files, err = st.divergentFiles(log, dir, roots, "origin/"+latest, "origin/"+def); err != nil {
+		return err
+	}
+
+	for _, c := range r.Commits {
+		log.Info("Commit has not been backported to the latest branch", "commit", c.SHA, "subject", c.Subject, "author", c.Author, "files", c.Files)
+	}
+	log.Info("Compared content of the default and latest branches", "commits", len(r.Commits), "files", len(r.Files))
+	if st.opts.Divergence.ReportFile != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(st.opts.Divergence.ReportFile, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		log.Info("Wrote divergence report", "path", st.opts.Divergence.ReportFile)
+	}
+	return nil
+}
+
+// divergentCommits returns the commits to the roots of the version that are
+// reachable from def but not latest, excluding those with an equivalent patch
+// on latest and those cherry-picked onto latest with 'git cherry-pick -x'.
+func (st *state) divergentCommits(log logr.Logger, dir string, roots []Root, latest, def string) ([]divergentCommit, error) {
+	backported := make(map[string]bool)
+	bodies, err := st.commandOutput(log, dir, "git", "log", "--format=%B", def+".."+latest)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range cherryPickedFromRE.FindAllStringSubmatch(bodies, -1) {
+		backported[m[1]] = true
+	}
+
+	// each commit is printed as a header line starting with a NUL byte,
+	// followed by the list of files it modified
+	args := append([]string{"-c", "core.quotePath=false", "log",
+		"--cherry-pick", "--right-only", "--no-merges", "--no-renames", "--name-only",
+		"--format=%x00%H%x00%aN%x00%aI%x00%s", latest + "..." + def, "--"}, rootSources(roots)...)
+	out, err := st.commandOutput(log, dir, "git", args...)
+	if err != nil {
+		return nil, err
+	}
+	var commits []divergentCommit
+	var c *divergentCommit
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\x00") {
+			c = nil
+			fields := strings.SplitN(line[1:], "\x00", 4)
+			if len(fields) != 4 || isBackported(backported, fields[0]) {
+				continue
+			}
+			commits = append(commits, divergentCommit{SHA: fields[0], Author: fields[1], Date: fields[2], Subject: fields[3], Files: []string{}})
+			c = &commits[len(commits)-1]
+			continue
+		}
+		if line == "" || c == nil {
+			continue
+		}
+		c.Files = append(c.Files, contentRelPath(roots, line))
+	}
+	return commits, scanner.Err()
+}
+
+// isBackported returns true if sha, or an abbreviation of it, is in
+// backported.
+func isBackported(backported map[string]bool, sha string) bool {
+	for id := range backported {
+		if strings.HasPrefix(sha, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// divergentFiles returns the files in the roots of the version that differ
+// between latest and def.
+func (st *state) divergentFiles(log logr.Logger, dir string, roots []Root, latest, def string) ([]divergentFile, error) {
+	args := append([]string{"-c", "core.quotePath=false", "diff",
+		"--name-status", "--no-renames", latest, def, "--"}, rootSources(roots)...)
+	out, err := st.commandOutput(log, dir, "git", args...)
+	if err != nil {
+		return nil, err
+	}
+	files := []divergentFile{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		status := "modified"
+		switch fields[0] {
+		case "A":
+			status = "added"
+		case "D":
+			status = "deleted"
+		}
+		files = append(files, divergentFile{Path: contentRelPath(roots, fields[1]), Status: status})
+	}
+	return files, nil
+}
+
+// contentRelPath returns the path of a file in the repository relative to the
+// version's directory, if it is within one of the roots copied there.
+// Otherwise the path is returned unchanged.
+func contentRelPath(roots []Root, p string) string {
+	for _, r := range roots {
+		prefix := strings.Trim(path.Clean(filepath.ToSlash(r.Source)), "/") + "/"
+		if r.content() && strings.HasPrefix(p, prefix) {
+			return path.Join(filepath.ToSlash(r.Target), strings.TrimPrefix(p, prefix))
+		}
+	}
+	return p
+}
@@ -0,0 +1,77 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-logr/logr"
+)
+
+// docsyHeader is written at the top of --docsy-versions-file.
+const docsyHeader = "# The versions and url_latest_version params are generated by hugo-multiversion.\n"
+
+// validateDocsyVersionsFile returns an error if --docsy-versions-file is not
+// a TOML file.
+func (st *state) validateDocsyVersionsFile() error {
+	if st.opts.Output.DocsyVersionsFile != "" && filepath.Ext(st.opts.Output.DocsyVersionsFile) != ".toml" {
+		return fmt.Errorf("must be a .toml file")
+	}
+	return nil
+}
+
+// writeDocsyVersions writes the versions that are listed in the versions data
+// file to --docsy-versions-file as the 'versions' param read by the version
+// menu of the Docsy theme, along with 'url_latest_version'. Other keys in the
+// file are kept, although comments are not. If the file is named params.*,
+// the params are written at the top level, and otherwise within the 'params'
+// table.
+func (st *state) writeDocsyVersions(log logr.Logger, versions map[string]string) error {
+	path := st.opts.Output.DocsyVersionsFile
+	if path == "" {
+		return nil
+	}
+	cfg := map[string]interface{}{}
+	if _, err := toml.DecodeFile(path, &cfg); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	params := cfg
+	if !strings.HasPrefix(filepath.Base(path), "params.") {
+		p, ok := cfg["params"].(map[string]interface{})
+		if !ok {
+			p = map[string]interface{}{}
+			cfg["params"] = p
+		}
+		params = p
+	}
+
+	entries := []map[string]interface{}{}
+	data := st.buildVersionsData(versions)
+	for _, v := range data.Versions {
+		name := v.Name
+		if v.DisplayName != "" {
+			name = v.DisplayName
+		}
+		entries = append(entries, map[string]interface{}{"version": name, "url": v.URL})
+	}
+	params["versions"] = entries
+	delete(params, "url_latest_version")
+	if data.Latest != "" {
+		params["url_latest_version"] = st.versionURL(data.Latest)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(docsyHeader)
+	if err := toml.NewEncoder(&buf).Encode(cfg); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	log.Info("Writing Docsy versions params", "path", path, "versions", len(entries))
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
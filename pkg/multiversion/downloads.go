@@ -0,0 +1,236 @@
+package multiversion
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// checksumsFile is the name of the file listing the SHA-256 checksum of each
+// file in a download page, in the format read by 'sha256sum -c'.
+const checksumsFile = "SHA256SUMS"
+
+// Download is a page generated in each version from files in the
+// repository, such as release manifests or CRDs, which are published
+// alongside it as a Hugo leaf bundle.
+type Download struct {
+	// Page is the path of the page within the version, e.g.
+	// 'downloads/crds'.
+	Page string `yaml:"page"`
+
+	// Title is the title of the page. Defaults to the last element of Page.
+	Title string `yaml:"title"`
+
+	// Paths are glob patterns relative to the root of the repository
+	// matching the files offered for download, e.g. 'deploy/crds/*.yaml'.
+	// Matched directories offer each file directly within them.
+	Paths []string `yaml:"paths"`
+}
+
+// downloadFile is a file offered for download in a download page.
+type downloadFile struct {
+	Name   string
+	URL    string
+	Size   int64
+	SHA256 string
+}
+
+// downloads returns the download pages generated for the version, which are
+// those set for the version in the config file if any, and otherwise the
+// top-level download pages.
+func (vc *VersionConfig) downloads(c *Config) []Download {
+	if len(vc.Downloads) > 0 {
+		return vc.Downloads
+	}
+	return c.Downloads
+}
+
+// validateDownloads returns an error if the download pages are invalid or
+// cannot be used with the other flags.
+func (st *state) validateDownloads(downloads []Download) error {
+	if len(downloads) == 0 {
+		return nil
+	}
+	switch {
+	case st.opts.Output.CopyMode == copyModeMount:
+		return fmt.Errorf("downloads cannot be used with --copy-mode=mount")
+	case st.opts.Fetch.RecordDir != "" || st.opts.Fetch.ReplayDir != "":
+		return fmt.Errorf("downloads cannot be used with --record or --replay, as only the content directory is recorded")
+	}
+	pages := make(map[string]bool)
+	for _, d := range downloads {
+		p := path.Clean(d.Page)
+		switch {
+		case d.Page == "" || p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../"):
+			return fmt.Errorf("downloads: page %q must be a path within the version", d.Page)
+		case pages[p]:
+			return fmt.Errorf("downloads: page %q is listed more than once", d.Page)
+		case len(d.Paths) == 0:
+			return fmt.Errorf("downloads: page %q has no paths", d.Page)
+		}
+		pages[p] = true
+		for _, pattern := range d.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("downloads: page %q: invalid pattern %q: %v", d.Page, pattern, err)
+			}
+			if c := path.Clean(pattern); path.IsAbs(c) || c == ".." || strings.HasPrefix(c, "../") {
+				return fmt.Errorf("downloads: page %q: pattern %q must be relative to the root of the repository", d.Page, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// writeDownloads writes each download page of the version as a leaf bundle
+// in its directory, containing the files matched in the source tree at loc,
+// a SHA256SUMS file and an index page listing them. Pages that match no files
+// are not written.
+func (st *state) writeDownloads(log logr.Logger, c *copyContext, loc string) error {
+	for _, d := range c.vc.downloads(st.opts) {
+		log := log.WithValues("page", d.Page)
+		files, err := matchDownloads(loc, d.Paths)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			log.Info("WARNING: no files matched the paths of the download page, skipping it", "paths", d.Paths)
+			continue
+		}
+		dir := filepath.Join(c.dstRoot, filepath.FromSlash(path.Clean(d.Page)))
+		for _, name := range []string{"index.md", "_index.md"} {
+			if _, err := st.output.Stat(filepath.Join(dir, name)); err == nil {
+				return fmt.Errorf("download page %q already exists in the content of the version", d.Page)
+			}
+		}
+		log.Info("Writing download page", "files", len(files))
+		if err := st.output.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		u := st.versionURL(c.version) + path.Clean(d.Page) + "/"
+		var listed []downloadFile
+		var sums strings.Builder
+		for _, src := range files {
+			f, err := st.copyDownload(src, filepath.Join(dir, filepath.Base(src)))
+			if err != nil {
+				return err
+			}
+			f.URL = u + f.Name
+			listed = append(listed, f)
+			fmt.Fprintf(&sums, "%s  %s\n", f.SHA256, f.Name)
+		}
+		if err := st.output.WriteFile(filepath.Join(dir, checksumsFile), []byte(sums.String()), 0644); err != nil {
+			return err
+		}
+		if err := st.writePage(filepath.Join(dir, "index.md"), st.downloadPage(d, u, listed), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchDownloads returns the files in the source tree at loc matched by the
+// patterns, sorted by name. It returns an error if two files have the same
+// name, as they would be written to the same path.
+func matchDownloads(loc string, patterns []string) ([]string, error) {
+	byName := make(map[string]string)
+	add := func(fp string) error {
+		info, err := os.Stat(fp)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name := filepath.Base(fp)
+		if other, ok := byName[name]; ok && other != fp {
+			return fmt.Errorf("downloads %s and %s have the same name", other, fp)
+		}
+		if name == checksumsFile || isPage(name) {
+			return fmt.Errorf("download %s cannot be named %s or be a page, as it would clash with the download page", fp, name)
+		}
+		byName[name] = fp
+		return nil
+	}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(loc, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				if err := add(m); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			entries, err := ioutil.ReadDir(m)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if err := add(filepath.Join(m, e.Name())); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	var files []string
+	for _, fp := range byName {
+		files = append(files, fp)
+	}
+	sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i]) < filepath.Base(files[j]) })
+	return files, nil
+}
+
+// copyDownload copies the file at src on disk to dst in the output, and
+// returns its name, size and checksum.
+func (st *state) copyDownload(src, dst string) (downloadFile, error) {
+	f := downloadFile{Name: filepath.Base(src)}
+	in, err := os.Open(src)
+	if err != nil {
+		return f, err
+	}
+	defer in.Close()
+	out, err := st.output.Create(dst, 0644)
+	if err != nil {
+		return f, err
+	}
+	h := sha256.New()
+	f.Size, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, err
+}
+
+// downloadPage returns the index page of a download page published at u,
+// listing each file with its size and checksum. The files are also set as
+// the 'downloads' param, for themes that render the list themselves.
+func (st *state) downloadPage(d Download, u string, files []downloadFile) *page {
+	title := d.Title
+	if title == "" {
+		title = path.Base(path.Clean(d.Page))
+	}
+	var b strings.Builder
+	b.WriteString("| File | Size | SHA-256 |\n|---|---|---|\n")
+	params := make([]interface{}, 0, len(files))
+	for _, f := range files {
+		fmt.Fprintf(&b, "| [%s](%s) | %d bytes | `%s` |\n", strings.NewReplacer("[", `\[`, "]", `\]`, "|", `\|`).Replace(f.Name), f.URL, f.Size, f.SHA256)
+		params = append(params, map[string]interface{}{"name": f.Name, "url": f.URL, "size": f.Size, "sha256": f.SHA256})
+	}
+	fmt.Fprintf(&b, "\nChecksums of every file are listed in [%s](%s%s).", checksumsFile, u, checksumsFile)
+	fm := map[string]interface{}{"title": title}
+	st.setParams(fm, map[string]interface{}{"downloads": params})
+	return &page{format: frontMatterYAML, frontMatter: fm, body: []byte(b.String())}
+}
@@ -0,0 +1,92 @@
+package multiversion
+
+import (
+	"strings"
+	"time"
+)
+
+// expiryDateKeys are the front matter keys Hugo reads a page's expiry date
+// from, compared case-insensitively.
+var expiryDateKeys = []string{"expirydate", "unpublishdate"}
+
+// frontMatterDateFormats are the date formats accepted in front matter.
+var frontMatterDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// excludeDrafts returns true if draft pages should not be copied for the
+// version.
+func (vc *VersionConfig) excludeDrafts(c *Config) bool {
+	if vc.ExcludeDrafts != nil {
+		return *vc.ExcludeDrafts
+	}
+	return c.Transform.ExcludeDrafts
+}
+
+// excludeExpired returns true if expired pages should not be copied for the
+// version.
+func (vc *VersionConfig) excludeExpired(c *Config) bool {
+	if vc.ExcludeExpired != nil {
+		return *vc.ExcludeExpired
+	}
+	return c.Transform.ExcludeExpired
+}
+
+// excludedPageReason returns a description of why the page should not be
+// copied, or an empty string if it should be copied.
+func (st *state) excludedPageReason(vc *VersionConfig, p *page, now time.Time) string {
+	if vc.excludeDrafts(st.opts) && isDraft(p) {
+		return "page is a draft"
+	}
+	if vc.excludeExpired(st.opts) {
+		if expiry, ok := expiryDate(p); ok && expiry.Before(now) {
+			return "page expired at " + expiry.Format(time.RFC3339)
+		}
+	}
+	return ""
+}
+
+// isDraft returns true if the page has 'draft' set to true.
+func isDraft(p *page) bool {
+	switch v := lookupFold(p.frontMatter, "draft").(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+// expiryDate returns the expiry date set in the page's front matter.
+func expiryDate(p *page) (time.Time, bool) {
+	for _, key := range expiryDateKeys {
+		switch v := lookupFold(p.frontMatter, key).(type) {
+		case time.Time:
+			return v, true
+		case string:
+			for _, layout := range frontMatterDateFormats {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// lookupFold returns the value of the front matter key that is equal to key
+// under case-folding, as Hugo treats front matter keys case-insensitively.
+func lookupFold(fm map[string]interface{}, key string) interface{} {
+	if v, ok := fm[key]; ok {
+		return v
+	}
+	for k, v := range fm {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-logr/logr"
+)
+
+// duplicatesReport is the structure of the report written to
+// --duplicates-report.
+type duplicatesReport struct {
+	// Pages is the number of pages compared.
+	Pages int `json:"pages"`
+	// Duplicates is the number of pages whose content is identical to the
+	// canonical page of their group.
+	Duplicates int                  `json:"duplicates"`
+	Groups     []duplicatePageGroup `json:"groups"`
+}
+
+// duplicatePageGroup is a set of pages with identical content.
+type duplicatePageGroup struct {
+	SHA256 string `json:"sha256"`
+	// Canonical is the URL of the page in the newest version, which the
+	// other pages of the group may point their canonical URL at.
+	Canonical string          `json:"canonical"`
+	Pages     []duplicatePage `json:"pages"`
+}
+
+// duplicatePage is a page in a duplicatePageGroup.
+type duplicatePage struct {
+	Version string `json:"version"`
+	// Path is the path of the page's source file, relative to the root of
+	// its version.
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+// pageContentHash returns the hash of the content of a page in the named
+// version, ignoring its front matter, whitespace and the URL of the
+// version in links, so that pages that only differ in the version they link
+// within are identical.
+func (st *state) pageContentHash(version string, p *page) (string, error) {
+	body := bytes.Join(bytes.Fields(p.body), []byte(" "))
+	if st.versionPath(version) != "" {
+		body = bytes.Replace(body, []byte(st.versionURL(version)), []byte(st.versionURL("")), -1)
+	}
+	return hashReader(bytes.NewReader(body))
+}
+
+// findDuplicatePages returns every set of pages in the given versions whose
+// content is identical, whether or not they are at the same path. Pages
+// without content, such as section pages that only list their children, are
+// not compared. The pages of each group are ordered as the versions, so the
+// first page is in the newest version.
+func (st *state) findDuplicatePages(versions []string) (int, []duplicatePageGroup, error) {
+	var total int
+	byHash := make(map[string][]duplicatePage)
+	var hashes []string
+	for _, vers := range versions {
+		err := st.updatePages(st.versionDir(vers), func(rel string, p *page) (bool, error) {
+			if len(bytes.TrimSpace(p.body)) == 0 {
+				return false, nil
+			}
+			sum, err := st.pageContentHash(vers, p)
+			if err != nil {
+				return false, err
+			}
+			if _, ok := byHash[sum]; !ok {
+				hashes = append(hashes, sum)
+			}
+			byHash[sum] = append(byHash[sum], duplicatePage{Version: vers, Path: rel, URL: st.pageURL(vers, rel)})
+			total++
+			return false, nil
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	groups := []duplicatePageGroup{}
+	for _, sum := range hashes {
+		pages := byHash[sum]
+		if len(pages) < 2 {
+			continue
+		}
+		groups = append(groups, duplicatePageGroup{SHA256: sum, Canonical: pages[0].URL, Pages: pages})
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Canonical < groups[j].Canonical })
+	return total, groups, nil
+}
+
+// writeDuplicatesReport writes a report of the pages with identical content
+// across the built versions to --duplicates-report.
+func (st *state) writeDuplicatesReport(log logr.Logger, versions []string) error {
+	total, groups, err := st.findDuplicatePages(versions)
+	if err != nil {
+		return err
+	}
+	report := duplicatesReport{Pages: total, Groups: groups}
+	for _, g := range groups {
+		report.Duplicates += len(g.Pages) - 1
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(st.opts.Output.DuplicatesReport), 0755); err != nil {
+		return err
+	}
+	log.Info("Writing duplicate content report", "path", st.opts.Output.DuplicatesReport, "pages", total, "duplicates", report.Duplicates)
+	return ioutil.WriteFile(st.opts.Output.DuplicatesReport, append(data, '\n'), 0644)
+}
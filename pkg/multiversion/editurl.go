@@ -0,0 +1,83 @@
+package multiversion
+
+import (
+	"net/url"
+	"strings"
+)
+
+// editURLTemplate returns the template used to generate 'edit_url' params for
+// pages in the version, or an empty string if edit URLs are disabled.
+func (vc *VersionConfig) editURLTemplate(c *Config) string {
+	if vc.EditURLTemplate != "" {
+		return vc.EditURLTemplate
+	}
+	if c.Transform.EditURLTemplate != "" {
+		return c.Transform.EditURLTemplate
+	}
+	if c.Transform.EditURLs {
+		return defaultEditURLTemplate(vc.repoURL(c))
+	}
+	return ""
+}
+
+// defaultEditURLTemplate returns an edit URL template for the repository,
+// based on the conventions of the forge hosting it.
+func defaultEditURLTemplate(repo string) string {
+	base := repoWebURL(repo)
+	switch {
+	case strings.Contains(base, "gitlab"):
+		return "{repo}/-/edit/{branch}/{path}"
+	case strings.Contains(base, "bitbucket"):
+		return "{repo}/src/{branch}/{path}?mode=edit"
+	}
+	return "{repo}/edit/{branch}/{path}"
+}
+
+// repoWebURL converts a git repository URL, such as
+// 'git@github.com:org/repo.git', into the URL of the repository's web
+// interface, such as 'https://github.com/org/repo'. Only http(s), ssh and
+// scp-like URLs are converted, and an empty string is returned for others,
+// such as 'file://' URLs and local paths, which have no web interface.
+func repoWebURL(repo string) string {
+	repo = strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git")
+	if strings.Contains(repo, "://") {
+		u, err := url.Parse(repo)
+		if err != nil {
+			return ""
+		}
+		if u.Host == "" || u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ssh" {
+			return ""
+		}
+		if u.Scheme == "ssh" {
+			// the web interface is not served on the SSH port
+			u.Host = u.Hostname()
+		}
+		u.Scheme = "https"
+		u.User = nil
+		return u.String()
+	}
+	// scp-like syntax, e.g. git@github.com:org/repo, which git only uses if
+	// there is no slash before the colon. Windows drive letters are not hosts.
+	i := strings.Index(repo, ":")
+	if i <= 1 || strings.Contains(repo[:i], "/") || len(repo) == i+1 {
+		return ""
+	}
+	host := repo[:i]
+	if j := strings.LastIndex(host, "@"); j >= 0 {
+		host = host[j+1:]
+	}
+	return "https://" + host + "/" + strings.TrimPrefix(repo[i+1:], "/")
+}
+
+// editURL expands the placeholders in an edit URL template. The supported
+// placeholders are {repo}, {branch}, {version} and {path}, where {repo} is
+// the repository the version is fetched from and {path} is the path of the
+// source file relative to the root of the repository.
+func (st *state) editURL(tmpl, branch, version, path string) string {
+	return strings.NewReplacer(
+		"{repo}", repoWebURL(st.opts.versionConfig(version).repoURL(st.opts)),
+		"{branch}", branch,
+		"{version}", version,
+		"{path}", path,
+	).Replace(tmpl)
+}
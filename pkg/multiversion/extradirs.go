@@ -0,0 +1,94 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// versionPlaceholder is replaced with the version name in the destinations of
+// --extra-dirs.
+const versionPlaceholder = "{version}"
+
+// dirMapping maps a directory in the source repository to a directory that
+// it is copied to for each version.
+type dirMapping struct {
+	// source is relative to the root of the source repository.
+	source string
+	// target may contain the version placeholder.
+	target string
+}
+
+// parseExtraDirs parses the source=destination pairs passed with
+// --extra-dirs.
+func parseExtraDirs(dirs []string) ([]dirMapping, error) {
+	var mappings []dirMapping
+	for _, d := range dirs {
+		i := strings.Index(d, "=")
+		if i <= 0 || i == len(d)-1 {
+			return nil, fmt.Errorf("%q must be of the form source=destination", d)
+		}
+		m := dirMapping{source: filepath.Clean(d[:i]), target: d[i+1:]}
+		if filepath.IsAbs(m.source) || strings.HasPrefix(m.source, "..") {
+			return nil, fmt.Errorf("source %q must be relative to the root of the repository", m.source)
+		}
+		if !strings.Contains(m.target, versionPlaceholder) {
+			return nil, fmt.Errorf("destination %q must contain the %s placeholder, so that versions do not overwrite each other", m.target, versionPlaceholder)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// validateExtraDirs returns an error if --extra-dirs is invalid or cannot be
+// used with the other flags.
+func (st *state) validateExtraDirs() error {
+	if len(st.opts.Output.ExtraDirs) == 0 {
+		return nil
+	}
+	if _, err := parseExtraDirs(st.opts.Output.ExtraDirs); err != nil {
+		return err
+	}
+	switch {
+	case st.opts.Output.CopyMode == copyModeMount:
+		return fmt.Errorf("cannot be used with --copy-mode=mount")
+	case st.opts.Output.DeltaSync:
+		return fmt.Errorf("cannot be used with --delta-sync")
+	case st.opts.Output.Archive != "":
+		return fmt.Errorf("cannot be used with --output, as only the output directory is written")
+	case st.opts.Fetch.RecordDir != "" || st.opts.Fetch.ReplayDir != "":
+		return fmt.Errorf("cannot be used with --record or --replay, as only the content directory is recorded")
+	}
+	return nil
+}
+
+// copyExtraDirs copies the directories configured with --extra-dirs from the
+// source tree of the version into their destinations, replacing anything
+// previously copied there. Files are copied and converted in the same way as
+// content. Directories that do not exist in the version are skipped.
+func (st *state) copyExtraDirs(log logr.Logger, c *copyContext, loc string) error {
+	mappings, err := parseExtraDirs(st.opts.Output.ExtraDirs)
+	if err != nil {
+		return err
+	}
+	for _, m := range mappings {
+		src := filepath.Join(loc, m.source)
+		dst := strings.Replace(m.target, versionPlaceholder, c.version, -1)
+		log := log.WithValues("source", m.source, "destination", dst)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			log.V(4).Info("Directory does not exist in version, skipping")
+			continue
+		}
+		log.Info("Copying directory")
+		if err := st.output.RemoveAll(dst); err != nil {
+			return err
+		}
+		if err := st.copyDir(c, src, dst); err != nil {
+			return fmt.Errorf("copying %q: %v", m.source, err)
+		}
+	}
+	return nil
+}
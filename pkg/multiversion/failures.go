@@ -0,0 +1,64 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The points at which a failure can be injected with --inject-failure.
+const (
+	// failureCloneTimeout fails fetching a version as if it timed out.
+	failureCloneTimeout = "clone-timeout"
+	// failureCopy fails copying a version into the output directory.
+	failureCopy = "copy"
+	// failureHook fails the preCopy hooks of a version, whether or not any
+	// are configured.
+	failureHook = "hook"
+)
+
+var failurePoints = map[string]bool{failureCloneTimeout: true, failureCopy: true, failureHook: true}
+
+// validateInjectFailures returns an error if a failure passed with
+// --inject-failure is not of the form point or point=version.
+func (st *state) validateInjectFailures() error {
+	for _, f := range st.opts.InjectFailures {
+		point := strings.SplitN(f, "=", 2)[0]
+		if !failurePoints[point] {
+			var points []string
+			for p := range failurePoints {
+				points = append(points, p)
+			}
+			sort.Strings(points)
+			return fmt.Errorf("unknown failure point %q, must be one of %s", point, strings.Join(points, ", "))
+		}
+		if strings.HasSuffix(f, "=") {
+			return fmt.Errorf("%q must name a version after '='", f)
+		}
+	}
+	if len(st.opts.InjectFailures) > 0 {
+		st.log.Info("WARNING: injecting simulated failures", "failures", strings.Join(st.opts.InjectFailures, ","))
+	}
+	return nil
+}
+
+// injectedFailure returns an error if a failure was injected at point for the
+// version with --inject-failure, and nil otherwise. Failures injected without
+// a version apply to every version.
+func (st *state) injectedFailure(point, vers string) error {
+	for _, f := range st.opts.InjectFailures {
+		if f != point && f != point+"="+vers {
+			continue
+		}
+		switch point {
+		case failureCloneTimeout:
+			return fmt.Errorf("injected failure: fetching %s: %w", vers, context.DeadlineExceeded)
+		case failureHook:
+			return fmt.Errorf("injected failure: preCopy hook failed: exit status 1")
+		default:
+			return fmt.Errorf("injected failure: %s of %s failed", point, vers)
+		}
+	}
+	return nil
+}
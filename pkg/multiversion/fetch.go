@@ -0,0 +1,253 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// fetcherGit clones versions with the git binary.
+	fetcherGit = "git"
+	// fetcherGoGit clones versions with go-git, without a git binary.
+	fetcherGoGit = "go-git"
+	// fetcherArchive downloads versions from a gzipped tarball.
+	fetcherArchive = "archive"
+	// fetcherLocal uses a directory on the local filesystem as-is.
+	fetcherLocal = "local"
+)
+
+// Version identifies a version to be fetched.
+type Version struct {
+	// Name is the name of the version, e.g. 'v1.2'.
+	Name string
+	// Branch is the branch or tag the version is built from. Fetchers that
+	// clone from a remote also accept a full ref name such as
+	// 'refs/pull/123/head', or a commit SHA.
+	Branch string
+	// TempDir is a directory the fetcher may write the source tree and any
+	// other files to. It is shared between versions, so paths within it
+	// should include the name of the version.
+	TempDir string
+	// AsOf is the time the version is fetched as of, if not zero. The last
+	// commit to the branch before this time is fetched, and fetchers that
+	// cannot fetch historical commits return an error.
+	AsOf time.Time
+
+	// st is the state of the build fetching the version.
+	st *state
+}
+
+// log returns the logger used whilst fetching the version.
+func (v Version) log() logr.Logger {
+	return v.st.log.WithValues("version", v.Name, "branch", v.Branch)
+}
+
+// Fetcher fetches the source tree of a version.
+type Fetcher interface {
+	// Fetch fetches the version, returning the path to the root of its
+	// source tree, which contains --repo-content-dir.
+	Fetch(ctx context.Context, v Version) (string, error)
+}
+
+// GitFetcher clones versions from a remote with the git binary.
+type GitFetcher struct {
+	Remote *Remote
+}
+
+// Fetch clones the branch of the version into the temporary directory, or
+// fetches its ref or commit and checks it out with a detached HEAD.
+func (f *GitFetcher) Fetch(ctx context.Context, v Version) (string, error) {
+	dir, err := v.st.fetchRepository(v.log(), v.TempDir, f.Remote, v.Name, v.Branch)
+	if err != nil || v.AsOf.IsZero() {
+		return dir, err
+	}
+	return dir, v.st.checkoutAsOf(v.log(), dir, v.Branch, v.AsOf)
+}
+
+// GoGitFetcher clones versions from a remote with go-git, so that a git
+// binary is not required to fetch them.
+type GoGitFetcher struct {
+	Remote *Remote
+}
+
+// Fetch clones the branch or tag of the version into the temporary
+// directory, or fetches its ref or commit and checks it out with a detached
+// HEAD.
+func (f *GoGitFetcher) Fetch(ctx context.Context, v Version) (string, error) {
+	v.log().Info("Fetching repository at revision with go-git", "repo", f.Remote.URL)
+	auth, err := f.Remote.goGitAuth()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(v.TempDir, "repo", v.Name)
+	if refKind(v.Branch) != refBranch {
+		r, err := goGitFetchRef(ctx, v.log(), f.Remote, dir, v.Branch)
+		if err != nil || v.AsOf.IsZero() {
+			return dir, err
+		}
+		return dir, goGitCheckoutAsOf(v.log(), r, v.Branch, v.AsOf)
+	}
+	var cloneErr error
+	for _, ref := range []plumbing.ReferenceName{plumbing.NewBranchReferenceName(v.Branch), plumbing.NewTagReferenceName(v.Branch)} {
+		var r *git.Repository
+		r, cloneErr = git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+			URL:           f.Remote.URL,
+			Auth:          auth,
+			ReferenceName: ref,
+			SingleBranch:  true,
+		})
+		if cloneErr == nil {
+			if v.AsOf.IsZero() {
+				return dir, nil
+			}
+			return dir, goGitCheckoutAsOf(v.log(), r, v.Branch, v.AsOf)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("cloning %q at %q: %v", f.Remote.URL, v.Branch, cloneErr)
+}
+
+// goGitAuth returns the auth go-git authenticates to the remote with, or nil
+// if the remote does not configure any.
+func (r *Remote) goGitAuth() (transport.AuthMethod, error) {
+	switch {
+	case r.TokenEnv != "":
+		token := os.Getenv(r.TokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("environment variable %s containing the token for %q is not set", r.TokenEnv, r.URL)
+		}
+		return &http.BasicAuth{Username: r.tokenUsername(), Password: token}, nil
+	case r.SSHKeyFile != "":
+		return gitssh.NewPublicKeysFromFile("git", r.SSHKeyFile, "")
+	}
+	return nil, nil
+}
+
+// ArchiveFetcher downloads versions from a gzipped tarball.
+type ArchiveFetcher struct {
+	URL string
+}
+
+// Fetch downloads and extracts the tarball into the temporary directory.
+func (f *ArchiveFetcher) Fetch(ctx context.Context, v Version) (string, error) {
+	if !v.AsOf.IsZero() {
+		return "", fmt.Errorf("archives cannot be fetched as of a date")
+	}
+	return v.st.fetchArchive(v.log(), v.TempDir, f.URL, v.Name)
+}
+
+// LocalFetcher uses a directory on the local filesystem, such as a working
+// copy of the repository, as the source tree of versions. The directory is
+// used as-is and is never modified.
+type LocalFetcher struct {
+	Path string
+}
+
+// Fetch returns the absolute path to the directory.
+func (f *LocalFetcher) Fetch(ctx context.Context, v Version) (string, error) {
+	if !v.AsOf.IsZero() {
+		return "", fmt.Errorf("local directories cannot be fetched as of a date")
+	}
+	path, err := filepath.Abs(f.Path)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range v.st.opts.versionConfig(v.Name).roots(v.st.opts) {
+		if _, err := os.Stat(filepath.Join(path, r.Source)); err != nil && !r.Optional {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// validateFetcher returns an error if the fetcher of the version cannot be
+// used with its other options.
+func (st *state) validateFetcher(vc *VersionConfig) error {
+	switch vc.fetcher(st.opts) {
+	case fetcherGit, fetcherGoGit:
+		if vc.Archive != "" || vc.Path != "" {
+			return fmt.Errorf("'archive' and 'path' cannot be used with the %q fetcher", vc.fetcher(st.opts))
+		}
+	case fetcherArchive:
+		if vc.Archive == "" {
+			return fmt.Errorf("'archive' must be set to use the %q fetcher", fetcherArchive)
+		}
+		if st.opts.Fetch.AsOf != "" {
+			return fmt.Errorf("the %q fetcher cannot be used with --as-of", fetcherArchive)
+		}
+	case fetcherLocal:
+		if vc.Path == "" {
+			return fmt.Errorf("'path' must be set to use the %q fetcher", fetcherLocal)
+		}
+		if vc.Remote != "" || vc.Archive != "" {
+			return fmt.Errorf("'remote' and 'archive' cannot be used with the %q fetcher", fetcherLocal)
+		}
+		if st.opts.Fetch.AsOf != "" {
+			return fmt.Errorf("the %q fetcher cannot be used with --as-of", fetcherLocal)
+		}
+	default:
+		return fmt.Errorf("unknown fetcher %q, must be one of %q, %q, %q or %q", vc.fetcher(st.opts), fetcherGit, fetcherGoGit, fetcherArchive, fetcherLocal)
+	}
+	return nil
+}
+
+// fetcher returns the name of the fetcher used for the version. It defaults
+// to 'archive' if an archive is set, 'local' if a path is set, and otherwise
+// to --fetcher.
+func (vc *VersionConfig) fetcher(c *Config) string {
+	switch {
+	case vc.Fetcher != "":
+		return vc.Fetcher
+	case vc.Archive != "":
+		return fetcherArchive
+	case vc.Path != "":
+		return fetcherLocal
+	}
+	return c.Fetch.Fetcher
+}
+
+// fetcherFor returns the Fetcher used for the named version, which is the
+// one set in Config.Fetch.Fetchers if any.
+func (st *state) fetcherFor(name string, vc *VersionConfig) Fetcher {
+	if f, ok := st.opts.Fetch.Fetchers[name]; ok {
+		return f
+	}
+	switch vc.fetcher(st.opts) {
+	case fetcherGoGit:
+		return &GoGitFetcher{Remote: vc.remote(st.opts)}
+	case fetcherArchive:
+		return &ArchiveFetcher{URL: vc.Archive}
+	case fetcherLocal:
+		return &LocalFetcher{Path: vc.Path}
+	}
+	return &GitFetcher{Remote: vc.remote(st.opts)}
+}
+
+// fetchedFromRemote returns true if the named version is cloned from a
+// remote with git or go-git.
+func (st *state) fetchedFromRemote(name string, vc *VersionConfig) bool {
+	if _, ok := st.opts.Fetch.Fetchers[name]; ok {
+		return false
+	}
+	f := vc.fetcher(st.opts)
+	return f == fetcherGit || f == fetcherGoGit
+}
+
+// polled returns true if the branch of the named version can be polled for
+// changes in watch mode, which is only possible for versions cloned from a
+// remote at a branch, tag or ref rather than a fixed commit.
+func (st *state) polled(name, branch string, vc *VersionConfig) bool {
+	return st.fetchedFromRemote(name, vc) && refKind(branch) != refCommit
+}
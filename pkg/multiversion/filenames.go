@@ -0,0 +1,107 @@
+package multiversion
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The unicode normalization forms file names can be converted to with
+// --normalize-filenames. macOS may return file names in NFD whilst Linux
+// returns them as they were committed, so without normalization the same
+// translated content can be published at different URLs depending on where it
+// was built.
+const (
+	normalizeNFC = "nfc"
+	normalizeNFD = "nfd"
+)
+
+// windowsMaxPath is the default --max-path-length. Windows limits paths to
+// 260 characters unless long paths are enabled, and the output directory is
+// usually nested within the site.
+const windowsMaxPath = 200
+
+// maxFilenameBytes is the longest file name most filesystems support.
+const maxFilenameBytes = 255
+
+// windowsReservedNames are the file names, ignoring their extension, that
+// cannot be created on Windows.
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// validateNormalizeFilenames returns an error if --normalize-filenames is not
+// a supported normalization form.
+func (st *state) validateNormalizeFilenames() error {
+	switch st.opts.Output.NormalizeFilenames {
+	case "", normalizeNFC, normalizeNFD:
+	default:
+		return fmt.Errorf("unsupported normalization form %q, must be %s or %s", st.opts.Output.NormalizeFilenames, normalizeNFC, normalizeNFD)
+	}
+	if st.opts.Output.MaxPathLength < 0 {
+		return fmt.Errorf("--max-path-length must not be negative")
+	}
+	return nil
+}
+
+// normalizeFilename returns name in the normalization form of
+// --normalize-filenames.
+func (st *state) normalizeFilename(name string) string {
+	switch st.opts.Output.NormalizeFilenames {
+	case normalizeNFC:
+		return norm.NFC.String(name)
+	case normalizeNFD:
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// filenameProblems returns the reasons the file name would break when the
+// site is built or served on another platform.
+func (st *state) filenameProblems(name string) []string {
+	var problems []string
+	if len(name) > maxFilenameBytes {
+		problems = append(problems, fmt.Sprintf("file name is longer than %d bytes", maxFilenameBytes))
+	}
+	if windowsReservedNames[strings.ToLower(strings.SplitN(name, ".", 2)[0])] {
+		problems = append(problems, "file name is reserved on Windows")
+	}
+	if strings.ContainsAny(name, `<>:"\|?*`) || strings.IndexFunc(name, func(r rune) bool { return r < 0x20 }) >= 0 {
+		problems = append(problems, "file name contains characters that are not allowed on Windows")
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		problems = append(problems, "file name ends in a dot or space, which are removed on Windows")
+	}
+	if st.opts.Output.NormalizeFilenames == "" && !norm.NFC.IsNormalString(name) {
+		problems = append(problems, "file name is not in NFC form, and may be published at a different URL when built on macOS, consider setting --normalize-filenames")
+	}
+	return problems
+}
+
+// checkFilenames logs a warning for each name in the directory dst that would
+// break on another platform, or that collides with another name on
+// filesystems that ignore case or unicode normalization, such as those of
+// macOS and Windows. The names must already be normalized.
+func (st *state) checkFilenames(log logr.Logger, dst string, names []string) {
+	folded := make(map[string]string, len(names))
+	for _, name := range names {
+		file := path.Join(dst, name)
+		for _, problem := range st.filenameProblems(name) {
+			log.Info("WARNING: "+problem, "file", file)
+		}
+		if rel := strings.TrimPrefix(file, st.opts.Output.Dir+"/"); st.opts.Output.MaxPathLength > 0 && len(rel) > st.opts.Output.MaxPathLength {
+			log.Info(fmt.Sprintf("WARNING: path is longer than %d bytes", st.opts.Output.MaxPathLength), "file", file)
+		}
+		key := strings.ToLower(norm.NFC.String(name))
+		if other, ok := folded[key]; ok {
+			log.Info("WARNING: file name only differs from another in case or unicode normalization, and collides with it on macOS and Windows", "file", file, "other", path.Join(dst, other))
+			continue
+		}
+		folded[key] = name
+	}
+}
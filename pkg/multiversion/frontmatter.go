@@ -0,0 +1,323 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// frontMatterFormat is the format used to encode a page's front matter.
+type frontMatterFormat string
+
+const (
+	frontMatterYAML frontMatterFormat = "yaml"
+	frontMatterTOML frontMatterFormat = "toml"
+	frontMatterJSON frontMatterFormat = "json"
+)
+
+// page is a Hugo content file that has been split into its front matter and
+// body.
+type page struct {
+	format      frontMatterFormat
+	frontMatter map[string]interface{}
+	body        []byte
+}
+
+var (
+	yamlDelim = []byte("---")
+	tomlDelim = []byte("+++")
+)
+
+// readPage reads and parses the page at the given path in the output.
+func (st *state) readPage(path string) (*page, error) {
+	data, err := st.output.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePageAt(path, data)
+}
+
+// readSourcePage reads and parses the page at the given path on the local
+// filesystem.
+func readSourcePage(path string) (*page, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePageAt(path, data)
+}
+
+// parsePageAt parses the contents of the page read from path.
+func parsePageAt(path string, data []byte) (*page, error) {
+	p, err := parsePage(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing front matter of %q: %v", path, err)
+	}
+	return p, nil
+}
+
+// parsePage splits data into front matter and body.
+// If data does not begin with front matter, an empty YAML front matter is
+// assumed.
+func parsePage(data []byte) (*page, error) {
+	p := &page{format: frontMatterYAML, frontMatter: map[string]interface{}{}, body: data}
+
+	trimmed := bytes.TrimLeft(data, "\ufeff \t\r\n")
+	switch {
+	case bytes.HasPrefix(trimmed, yamlDelim):
+		fm, body, ok := splitDelimited(trimmed, yamlDelim)
+		if !ok {
+			return p, nil
+		}
+		var m map[string]interface{}
+		if err := yaml.Unmarshal(fm, &m); err != nil {
+			return nil, err
+		}
+		if m != nil {
+			p.frontMatter = normalizeYAML(m).(map[string]interface{})
+		}
+		p.body = body
+	case bytes.HasPrefix(trimmed, tomlDelim):
+		fm, body, ok := splitDelimited(trimmed, tomlDelim)
+		if !ok {
+			return p, nil
+		}
+		if _, err := toml.Decode(string(fm), &p.frontMatter); err != nil {
+			return nil, err
+		}
+		p.format = frontMatterTOML
+		p.body = body
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		if err := dec.Decode(&p.frontMatter); err != nil {
+			return nil, err
+		}
+		p.format = frontMatterJSON
+		p.body = bytes.TrimPrefix(trimmed[dec.InputOffset():], []byte("\n"))
+	}
+	return p, nil
+}
+
+// splitDelimited splits data that begins with a delimiter line into the
+// content between the first two delimiter lines, and everything after the
+// second delimiter line.
+func splitDelimited(data, delim []byte) ([]byte, []byte, bool) {
+	rest := data[len(delim):]
+	nl := bytes.IndexByte(rest, '\n')
+	if nl < 0 || len(bytes.TrimSpace(rest[:nl])) != 0 {
+		return nil, nil, false
+	}
+	rest = rest[nl+1:]
+	for i := 0; i < len(rest); {
+		end := bytes.IndexByte(rest[i:], '\n')
+		line := rest[i:]
+		if end >= 0 {
+			line = rest[i : i+end]
+		}
+		if bytes.Equal(bytes.TrimRight(line, " \t\r"), delim) {
+			body := rest[i+len(line):]
+			if len(body) > 0 && body[0] == '\n' {
+				body = body[1:]
+			}
+			return rest[:i], body, true
+		}
+		if end < 0 {
+			break
+		}
+		i += end + 1
+	}
+	return nil, nil, false
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values produced by
+// the YAML decoder into map[string]interface{} so they can be handled in the
+// same way as TOML and JSON front matter.
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[k] = normalizeYAML(val)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeYAML(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+// bytes returns the encoded page, including its front matter.
+func (p *page) bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	switch p.format {
+	case frontMatterTOML:
+		buf.Write(tomlDelim)
+		buf.WriteByte('\n')
+		if err := toml.NewEncoder(&buf).Encode(p.frontMatter); err != nil {
+			return nil, err
+		}
+		buf.Write(tomlDelim)
+		buf.WriteByte('\n')
+	case frontMatterJSON:
+		data, err := json.MarshalIndent(p.frontMatter, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	default:
+		data, err := yaml.Marshal(p.frontMatter)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(yamlDelim)
+		buf.WriteByte('\n')
+		buf.Write(data)
+		buf.Write(yamlDelim)
+		buf.WriteByte('\n')
+	}
+	buf.Write(p.body)
+	return buf.Bytes(), nil
+}
+
+// writePage writes the page to the given path in the output.
+func (st *state) writePage(path string, p *page, mode os.FileMode) error {
+	data, err := p.bytes()
+	if err != nil {
+		return err
+	}
+	// pages that are unchanged are left as they are, so that watchers such
+	// as a Hugo server only see the pages that changed
+	if existing, err := st.output.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	// write to a temporary file and rename it, so that files hard linked or
+	// symlinked into the output directory are replaced rather than modified
+	tmp := path + ".multiversion-tmp"
+	if err := st.output.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return st.output.Rename(tmp, path)
+}
+
+// lowerExt returns the lower-cased extension of the named file.
+func lowerExt(name string) string {
+	return strings.ToLower(filepath.Ext(name))
+}
+
+// isPage returns true if the named file is a content file that may contain
+// front matter.
+func isPage(name string) bool {
+	switch ext := lowerExt(name); ext {
+	case ".md", ".markdown", ".html", ".htm", ".adoc", ".asciidoc", ".ad", ".rst", ".org", ".pandoc", ".pdc":
+		return true
+	}
+	return false
+}
+
+// setParams injects each of the given params into the front matter.
+// Params are nested under the key given with --param-namespace, and are also
+// set at the top level if --param-namespace is empty or --flat-params is set.
+func (st *state) setParams(fm map[string]interface{}, params map[string]interface{}) {
+	if st.opts.Transform.ParamNamespace == "" || st.opts.Transform.FlatParams {
+		for k, v := range params {
+			fm[k] = v
+		}
+	}
+	if st.opts.Transform.ParamNamespace == "" {
+		return
+	}
+	ns, ok := fm[st.opts.Transform.ParamNamespace].(map[string]interface{})
+	if !ok {
+		ns = map[string]interface{}{}
+		fm[st.opts.Transform.ParamNamespace] = ns
+	}
+	for k, v := range params {
+		ns[k] = v
+	}
+}
+
+// mergeCascade merges params into the 'cascade' key of the front matter.
+// If the existing cascade is a list of cascade blocks, a new block is appended.
+func (st *state) mergeCascade(fm map[string]interface{}, params map[string]interface{}) {
+	mergeCascadeBlock(fm, func(block map[string]interface{}) {
+		st.setParams(block, params)
+	})
+}
+
+// mergeCascadeFields merges front matter fields, such as 'outputs', into the
+// 'cascade' key of the front matter in the same way as mergeCascade.
+func mergeCascadeFields(fm map[string]interface{}, fields map[string]interface{}) {
+	mergeCascadeBlock(fm, func(block map[string]interface{}) {
+		mergeFields(block, fields, true)
+	})
+}
+
+// mergeFields merges the front matter fields in src into dst, merging nested
+// maps. Other values already in dst are only replaced if replace is true.
+func mergeFields(dst, src map[string]interface{}, replace bool) {
+	for k, v := range src {
+		existing, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		em, eok := existing.(map[string]interface{})
+		vm, vok := v.(map[string]interface{})
+		switch {
+		case eok && vok:
+			mergeFields(em, vm, replace)
+		case replace:
+			dst[k] = v
+		}
+	}
+}
+
+// mergeCascadeBlock calls set with the cascade block of the front matter
+// that values should be merged into.
+func mergeCascadeBlock(fm map[string]interface{}, set func(block map[string]interface{})) {
+	switch cascade := fm["cascade"].(type) {
+	case map[string]interface{}:
+		set(cascade)
+	case []interface{}:
+		block := map[string]interface{}{}
+		set(block)
+		fm["cascade"] = append(cascade, block)
+	case []map[string]interface{}:
+		block := map[string]interface{}{}
+		set(block)
+		fm["cascade"] = append(cascade, block)
+	default:
+		block := map[string]interface{}{}
+		set(block)
+		fm["cascade"] = block
+	}
+}
+
+// getParam returns the value of a tool-specific param set in the front matter.
+// The param is looked up beneath --param-namespace, falling back to the top
+// level of the front matter.
+func (st *state) getParam(fm map[string]interface{}, key string) interface{} {
+	if ns, ok := fm[st.opts.Transform.ParamNamespace].(map[string]interface{}); ok && st.opts.Transform.ParamNamespace != "" {
+		if v, ok := ns[key]; ok {
+			return v
+		}
+	}
+	return fm[key]
+}
@@ -0,0 +1,171 @@
+package multiversion
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+)
+
+// localChangeDelay is how long the watcher waits for further changes to the
+// local sources after a change, so that a burst of changes, such as an editor
+// saving a file or switching branches in a working copy, triggers a single
+// resync.
+const localChangeDelay = 200 * time.Millisecond
+
+// localSourceDirs returns the root directories of each version in
+// versionMap fetched from a local directory with the 'local' fetcher, keyed
+// by version. Mounted versions are not included, as Hugo reads their sources
+// directly.
+func (st *state) localSourceDirs(versionMap map[string]string) map[string][]string {
+	dirs := make(map[string][]string)
+	if st.opts.Output.CopyMode == copyModeMount {
+		return dirs
+	}
+	for vers := range versionMap {
+		vc := st.opts.versionConfig(vers)
+		if _, custom := st.opts.Fetch.Fetchers[vers]; custom || vc.fetcher(st.opts) != fetcherLocal {
+			continue
+		}
+		path, err := filepath.Abs(vc.Path)
+		if err != nil {
+			continue
+		}
+		for _, r := range vc.roots(st.opts) {
+			if _, err := os.Stat(filepath.Join(path, r.Source)); err == nil {
+				dirs[vers] = append(dirs[vers], filepath.Join(path, r.Source))
+			}
+		}
+	}
+	return dirs
+}
+
+// watchLocalSources watches the root directories of each version fetched
+// from a local directory, and sends the versions whose sources changed on the
+// returned channel once the changes settle. It returns a nil channel if no
+// version is fetched from a local directory. Watching stops once ctx is
+// cancelled.
+func (st *state) watchLocalSources(ctx context.Context, log logr.Logger, versionMap map[string]string) (<-chan map[string]string, error) {
+	dirs := st.localSourceDirs(versionMap)
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for vers, roots := range dirs {
+		for _, dir := range roots {
+			if err := watchTree(w, dir); err != nil {
+				w.Close()
+				return nil, err
+			}
+			log.Info("Watching local sources for changes", "version", vers, "path", dir)
+		}
+	}
+
+	changes := make(chan map[string]string)
+	go func() {
+		defer w.Close()
+		pending := make(map[string]string)
+		var settled <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-w.Errors:
+				log.Error(err, "Error watching local sources")
+			case ev := <-w.Events:
+				vers := versionOfPath(dirs, ev.Name)
+				if vers == "" {
+					continue
+				}
+				log.V(4).Info("Local source changed", "version", vers, "path", ev.Name, "op", ev.Op.String())
+				// directories are not watched recursively, so new ones are
+				// added as they are created
+				if ev.Op&fsnotify.Create != 0 {
+					if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+						if err := watchTree(w, ev.Name); err != nil {
+							log.Error(err, "Failed to watch new directory", "path", ev.Name)
+						}
+					}
+				}
+				pending[vers] = versionMap[vers]
+				settled = time.After(localChangeDelay)
+			case <-settled:
+				select {
+				case changes <- pending:
+					pending, settled = make(map[string]string), nil
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// watchTree adds dir and every directory beneath it to the watcher.
+func watchTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		return w.Add(fp)
+	})
+}
+
+// versionOfPath returns the version with a root directory in dirs that
+// contains fp, or an empty string if there is none.
+func versionOfPath(dirs map[string][]string, fp string) string {
+	for vers, roots := range dirs {
+		for _, dir := range roots {
+			if rel, err := filepath.Rel(dir, fp); err == nil && !strings.HasPrefix(rel, "..") {
+				return vers
+			}
+		}
+	}
+	return ""
+}
+
+// resyncVersions rebuilds each version in changed into a staging directory
+// and syncs it into the output directory, so that only the files whose
+// content changed are written, before re-running the steps that depend on
+// every version.
+func (st *state) resyncVersions(ctx context.Context, log logr.Logger, versionMap, changed map[string]string) (err error) {
+	st.startRunSpan("resync").setAttr("versions", strings.Join(sortedVersionNames(changed), ","))
+	defer func() { st.finishRunSpan(log, err) }()
+	st.newAuditRun()
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(log, tmpdir)
+
+	st.stageOutput(tmpdir)
+	for _, vers := range sortedVersionNames(changed) {
+		log := log.WithValues("version", vers, "branch", changed[vers])
+		if err := st.buildVersion(ctx, log, tmpdir, nil, vers, changed[vers]); err != nil {
+			// point the output directory back at the published output
+			st.syncStagedOutput(log, nil)
+			return err
+		}
+	}
+	if err := st.syncStagedOutput(log, changed); err != nil {
+		return err
+	}
+	err = st.finalize(log, versionMap)
+	st.metrics.observeFinalize(err)
+	if err != nil {
+		return err
+	}
+	if err := st.pushSearchRecords(log, changed, versionMap); err != nil {
+		return err
+	}
+	return st.keepOutput(log, versionMap, true)
+}
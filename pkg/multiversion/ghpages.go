@@ -0,0 +1,188 @@
+package multiversion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/go-logr/logr"
+)
+
+// Strategies supported by --publish-strategy.
+const (
+	// publishFastForward adds a commit on top of the publish branch, and
+	// fails if the branch moved whilst the site was built.
+	publishFastForward = "fast-forward"
+	// publishForce replaces the publish branch with a single commit.
+	publishForce = "force"
+)
+
+// authorRE matches a git author of the form 'Name <email>'.
+var authorRE = regexp.MustCompile(`^\s*([^<>]+?)\s*<([^<>]+)>\s*$`)
+
+// validatePublishBranch returns an error if --publish-branch cannot be used
+// with the other flags.
+func (st *state) validatePublishBranch() error {
+	if st.opts.Pages.Branch == "" {
+		return nil
+	}
+	switch {
+	case st.opts.Pages.Strategy != publishFastForward && st.opts.Pages.Strategy != publishForce:
+		return fmt.Errorf("--publish-strategy must be %s or %s", publishFastForward, publishForce)
+	case !authorRE.MatchString(st.opts.Pages.Author):
+		return fmt.Errorf("--publish-author must be of the form 'Name <email>'")
+	case st.opts.Pages.Message == "":
+		return fmt.Errorf("--publish-message must be set")
+	case st.opts.Pages.Repo == "" && st.opts.Fetch.RepoURL == "":
+		return fmt.Errorf("--publish-repo or --repo-url must be set")
+	case validateRef(st.opts.Pages.Branch) != nil || refKind(st.opts.Pages.Branch) != refBranch:
+		return fmt.Errorf("%q is not a branch name", st.opts.Pages.Branch)
+	case st.opts.Watch.Enabled:
+		return fmt.Errorf("cannot be used with --watch")
+	case st.opts.Hugo.Run && st.isHugoServer():
+		return fmt.Errorf("cannot be used when running a Hugo server")
+	case st.opts.Output.Archive != "":
+		return fmt.Errorf("cannot be used with --output, as content is not written to disk")
+	case len(st.opts.Jobs.OnlyVersions) > 0:
+		return fmt.Errorf("cannot be used with --only-versions, as the branch would not contain every version")
+	case st.opts.Pages.Dir == "" && !st.opts.Hugo.Run && (st.opts.Output.CopyMode == copyModeSymlink || st.opts.Output.CopyMode == copyModeMount):
+		return fmt.Errorf("cannot publish the output directory with --copy-mode=%s, as versions are not copied into it", st.opts.Output.CopyMode)
+	}
+	return nil
+}
+
+// publishRemote returns the remote the publish branch is pushed to:
+// --publish-repo, which may name one of the remotes in the config file, or
+// otherwise --repo-url.
+func (st *state) publishRemote() *Remote {
+	if r, ok := st.opts.Remotes[st.opts.Pages.Repo]; ok {
+		return r
+	}
+	if st.opts.Pages.Repo != "" {
+		return &Remote{URL: st.opts.Pages.Repo}
+	}
+	return &Remote{URL: st.opts.Fetch.RepoURL}
+}
+
+// publishSourceDir returns the directory committed to the publish branch,
+// chosen as for container images.
+func (st *state) publishSourceDir() string {
+	switch {
+	case st.opts.Pages.Dir != "":
+		return st.opts.Pages.Dir
+	case st.opts.Hugo.Run:
+		return filepath.Join(st.opts.Hugo.SiteRoot, "public")
+	}
+	return st.opts.Output.Dir
+}
+
+// pushPublishBranch commits the assembled site to --publish-branch of the
+// publish remote and pushes it. A .nojekyll file is added so that GitHub
+// Pages serves directories starting with an underscore. Nothing is pushed if
+// the site has not changed.
+func (st *state) pushPublishBranch(log logr.Logger) error {
+	remote, branch, dir := st.publishRemote(), st.opts.Pages.Branch, st.publishSourceDir()
+	log = log.WithValues("repo", remote.URL, "branch", branch, "strategy", st.opts.Pages.Strategy)
+	env, err := remote.env()
+	if err != nil {
+		return err
+	}
+	author := authorRE.FindStringSubmatch(st.opts.Pages.Author)
+	env = append(env,
+		"GIT_AUTHOR_NAME="+author[1], "GIT_AUTHOR_EMAIL="+author[2],
+		"GIT_COMMITTER_NAME="+author[1], "GIT_COMMITTER_EMAIL="+author[2],
+	)
+	work, err := ioutil.TempDir("", "hugo-multiversion-publish-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(log, work)
+	git := func(args ...string) (string, error) {
+		return st.commandOutputEnv(log, env, work, "git", args...)
+	}
+
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", remote.URL},
+	} {
+		if _, err := git(args...); err != nil {
+			return err
+		}
+	}
+	exists := false
+	if st.opts.Pages.Strategy == publishFastForward {
+		out, err := git("ls-remote", "--heads", "origin", "refs/heads/"+branch)
+		if err != nil {
+			return err
+		}
+		exists = out != ""
+	}
+	if exists {
+		log.Info("Fetching publish branch")
+		if _, err := git("fetch", "--quiet", "--depth", "1", "origin", "refs/heads/"+branch); err != nil {
+			return err
+		}
+		if _, err := git("checkout", "--quiet", "-B", branch, "FETCH_HEAD"); err != nil {
+			return err
+		}
+		if _, err := git("rm", "--quiet", "-r", "--ignore-unmatch", "."); err != nil {
+			return err
+		}
+	} else if _, err := git("checkout", "--quiet", "--orphan", branch); err != nil {
+		return err
+	}
+
+	if err := copyLocalTree(dir, work); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(work, ".nojekyll"), nil, 0644); err != nil {
+		return err
+	}
+	if _, err := git("add", "--all"); err != nil {
+		return err
+	}
+	if exists {
+		if status, err := git("status", "--porcelain"); err != nil {
+			return err
+		} else if status == "" {
+			log.Info("Site has not changed, nothing to publish")
+			return nil
+		}
+	}
+	if _, err := git("commit", "--quiet", "--no-verify", "--message", st.opts.Pages.Message); err != nil {
+		return err
+	}
+	push := []string{"push", "--quiet", "origin", "HEAD:refs/heads/" + branch}
+	if st.opts.Pages.Strategy == publishForce {
+		push = append(push, "--force")
+	}
+	log.Info("Pushing publish branch", "directory", dir)
+	if _, err := git(push...); err != nil {
+		if exists {
+			return fmt.Errorf("pushing %s to %q, which may have moved whilst the site was built: %v", branch, remote.URL, err)
+		}
+		return fmt.Errorf("pushing %s to %q: %v", branch, remote.URL, err)
+	}
+	return nil
+}
+
+// copyLocalTree copies the files of the directory src on the local filesystem
+// into dst, following symlinks.
+func copyLocalTree(src, dst string) error {
+	return filepath.Walk(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(fp, target)
+	})
+}
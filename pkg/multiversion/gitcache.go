@@ -0,0 +1,135 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// cachedCloneDir returns the directory the clone of a version is kept in
+// between runs with --cache-dir.
+func (st *state) cachedCloneDir(version string) string {
+	return filepath.Join(st.opts.Fetch.CacheDir, "git", version)
+}
+
+// fetchCachedClone clones the branch or tag of a version into the cache
+// directory, or updates the clone kept there by a previous run, returning the
+// path to the clone. The clone is updated by fetching from the remote and
+// resetting to the fetched branch, so that only new objects are downloaded
+// and force-pushes are followed. If the clone cannot be updated it is cloned
+// again, unless the branch no longer exists in the remote.
+func (st *state) fetchCachedClone(log logr.Logger, env []string, remote *Remote, version, branch string) (string, error) {
+	dir := st.cachedCloneDir(version)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		err := st.breakHardLinks(dir)
+		if err == nil {
+			err = st.updateCachedClone(log, env, remote, dir, branch)
+		}
+		if err == nil {
+			return dir, nil
+		}
+		if _, deleted := err.(refDeletedError); deleted {
+			log.Info("Removing cached clone of deleted branch", "path", dir)
+			if rmErr := os.RemoveAll(dir); rmErr != nil {
+				return "", rmErr
+			}
+			return "", err
+		}
+		log.Info("WARNING: failed to update cached clone, cloning again", "path", dir, "error", err.Error())
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	if err := st.runCommandEnv(log, env, "git", "clone", "-b", branch, remote.URL, dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// breakHardLinks replaces each file in the clone at dir that has other hard
+// links, such as those made into the output by --copy-mode hardlink, with a
+// copy of itself, so that updating the clone in place cannot modify the
+// files of earlier builds.
+func (st *state) breakHardLinks(dir string) error {
+	if st.opts.Output.CopyMode != copyModeHardlink {
+		return nil
+	}
+	return filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || hardLinkCount(info) < 2 {
+			return nil
+		}
+		tmp := fp + ".multiversion-tmp"
+		if err := copyFile(fp, tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, fp)
+	})
+}
+
+// refDeletedError is returned by updateCachedClone if the branch or tag of
+// the clone no longer exists in the remote.
+type refDeletedError struct {
+	remote, branch string
+}
+
+func (e refDeletedError) Error() string {
+	return fmt.Sprintf("branch or tag %q no longer exists in %q", e.branch, e.remote)
+}
+
+// updateCachedClone fetches every branch and tag from the remote into the
+// clone at dir, pruning those that were deleted, and resets the working tree
+// to the fetched branch or tag, removing any files left behind by pins and
+// hooks.
+func (st *state) updateCachedClone(log logr.Logger, env []string, remote *Remote, dir, branch string) error {
+	log.Info("Updating cached clone", "path", dir)
+	for _, args := range [][]string{
+		{"remote", "set-url", "origin", remote.URL},
+		{"fetch", "--quiet", "--prune", "--tags", "--force", "origin", "+refs/heads/*:refs/remotes/origin/*"},
+	} {
+		if _, err := st.commandOutputEnv(log, env, dir, "git", args...); err != nil {
+			return err
+		}
+	}
+	out, err := st.commandOutputEnv(log, env, dir, "git", "for-each-ref", "--format=%(refname)", "refs/remotes/origin/"+branch, "refs/tags/"+branch)
+	if err != nil {
+		return err
+	}
+	var target string
+	for _, ref := range []string{"refs/remotes/origin/" + branch, "refs/tags/" + branch} {
+		for _, line := range strings.Split(out, "\n") {
+			if target == "" && line == ref {
+				target = ref
+			}
+		}
+	}
+	if target == "" {
+		return refDeletedError{remote: remote.URL, branch: branch}
+	}
+	for _, args := range [][]string{
+		{"reset", "--quiet", "--hard", target},
+		{"clean", "--quiet", "-ffdx"},
+	} {
+		if _, err := st.commandOutputEnv(log, env, dir, "git", args...); err != nil {
+			return err
+		}
+	}
+	sha, err := st.commandOutputEnv(log, env, dir, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	log.Info("Updated cached clone", "commit", sha)
+	return nil
+}
@@ -0,0 +1,126 @@
+package multiversion
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// fileHistory is the history of a single file derived from git log.
+type fileHistory struct {
+	// created is the date of the first commit that touched the file.
+	created time.Time
+	// modified is the date of the most recent commit that touched the file.
+	modified time.Time
+	// commits is the number of commits made to the file by each author.
+	commits map[string]int
+}
+
+// contributors returns the authors of commits to the file, ordered by the
+// number of commits they made.
+func (h *fileHistory) contributors() []string {
+	names := make([]string, 0, len(h.commits))
+	for name := range h.commits {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if h.commits[names[i]] != h.commits[names[j]] {
+			return h.commits[names[i]] > h.commits[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// gitMetadataEnabled returns true if any option that requires the history of
+// each file is set.
+func (st *state) gitMetadataEnabled() bool {
+	return st.opts.Transform.GitDates || st.opts.Transform.GitContributors || st.opts.Transform.PreserveMtimes
+}
+
+// readGitHistory returns the history of every file beneath dirs in the git
+// repository at loc, keyed by path relative to loc.
+// If loc is not a git repository, a warning is logged and nil is returned.
+func (st *state) readGitHistory(log logr.Logger, loc string, dirs ...string) (map[string]*fileHistory, error) {
+	if _, err := os.Stat(filepath.Join(loc, ".git")); err != nil {
+		log.Info("WARNING: version was not fetched using git, git metadata will not be injected")
+		return nil, nil
+	}
+	log.Info("Reading git history of content files")
+	// each commit is printed as a header line starting with a NUL byte,
+	// followed by the list of files it modified
+	args := append([]string{"-c", "core.quotePath=false", "log",
+		"--format=%x00%aI%x00%aN", "--name-only", "--no-renames", "--"}, dirs...)
+	out, err := st.commandOutput(log, loc, "git", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(map[string]*fileHistory)
+	var date time.Time
+	var author string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\x00") {
+			fields := strings.SplitN(line[1:], "\x00", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			if date, err = time.Parse(time.RFC3339, fields[0]); err != nil {
+				return nil, err
+			}
+			author = fields[1]
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		h, ok := history[line]
+		if !ok {
+			// commits are listed newest first
+			h = &fileHistory{modified: date, commits: map[string]int{}}
+			history[line] = h
+		}
+		h.created = date
+		h.commits[author]++
+	}
+	return history, scanner.Err()
+}
+
+// gitMetadataParams returns the front matter fields and params to inject into
+// a page with the given history. Fields that are already set in the page's
+// front matter are not overwritten.
+func (st *state) gitMetadataParams(fm map[string]interface{}, h *fileHistory) (fields, params map[string]interface{}) {
+	fields, params = map[string]interface{}{}, map[string]interface{}{}
+	if st.opts.Transform.GitDates {
+		if lookupFold(fm, "lastmod") == nil {
+			fields["lastmod"] = h.modified
+		}
+		if lookupFold(fm, "date") == nil {
+			fields["date"] = h.created
+		}
+	}
+	if st.opts.Transform.GitContributors {
+		params["contributors"] = h.contributors()
+	}
+	return fields, params
+}
+
+// restoreMtimes sets the modification time of every copied file to the date
+// of the most recent commit to its source file. It is called once all
+// transforms have been applied, as they may rewrite the files.
+func (c *copyContext) restoreMtimes() error {
+	for path, t := range c.mtimes {
+		if err := c.st.output.Chtimes(path, t, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// refBranch is a branch or tag name, e.g. 'release-1.2' or 'v1.2.0'.
+	refBranch = "branch"
+	// refFull is a full ref name, e.g. 'refs/pull/123/head'.
+	refFull = "ref"
+	// refCommit is a full or abbreviated commit SHA.
+	refCommit = "commit"
+)
+
+// commitSHARE matches full and abbreviated commit SHAs.
+var commitSHARE = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// refKind returns the kind of ref a version is fetched from. Branches whose
+// names look like commit SHAs can be fetched with their full ref name, e.g.
+// 'refs/heads/cafe123'.
+func refKind(ref string) string {
+	switch {
+	case strings.HasPrefix(ref, "refs/"):
+		return refFull
+	case commitSHARE.MatchString(ref):
+		return refCommit
+	}
+	return refBranch
+}
+
+// validateRef returns an error if ref cannot be fetched from a remote.
+// Revision expressions such as 'main~2' and symbolic refs such as 'HEAD' are
+// not supported, as they do not name a ref or commit in the remote.
+func validateRef(ref string) error {
+	switch {
+	case ref == "":
+		return fmt.Errorf("branch must not be empty")
+	case ref == "HEAD" || ref == "FETCH_HEAD" || ref == "ORIG_HEAD":
+		return fmt.Errorf("%q is a symbolic ref and is not supported, use the name of a branch, tag, ref or commit", ref)
+	case strings.ContainsAny(ref, "~^:?*[\\ ") || strings.Contains(ref, "..") || strings.Contains(ref, "@{"):
+		return fmt.Errorf("%q is a revision expression and is not supported, use the name of a branch, tag, ref or commit", ref)
+	case strings.HasPrefix(ref, "-") || strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".lock"):
+		return fmt.Errorf("%q is not a valid ref name", ref)
+	case refKind(ref) == refFull && len(strings.Split(ref, "/")) < 3:
+		return fmt.Errorf("%q is not a valid ref name, full ref names are of the form 'refs/<type>/<name>'", ref)
+	}
+	return nil
+}
+
+// validateVersionRefs returns an error if the branch of a version fetched
+// from a remote is not a ref that can be fetched.
+func (st *state) validateVersionRefs() error {
+	for vers, branch := range st.resolveVersions() {
+		vc := st.opts.versionConfig(vers)
+		if !st.fetchedFromRemote(vers, vc) {
+			continue
+		}
+		if err := validateRef(branch); err != nil {
+			return fmt.Errorf("version %q: %v", vers, err)
+		}
+		if vc.fetcher(st.opts) == fetcherGoGit && refKind(branch) == refCommit && len(branch) != 40 {
+			return fmt.Errorf("version %q: abbreviated commit %q is not supported by the %q fetcher, use the full commit SHA", vers, branch, fetcherGoGit)
+		}
+	}
+	return nil
+}
+
+// fetchRef fetches a full ref or commit from the remote into a new
+// repository at dir with the git binary, and checks it out with a detached
+// HEAD. Abbreviated commits cannot be fetched directly, so every branch and
+// tag is fetched and the commit is looked up amongst them.
+func (st *state) fetchRef(log logr.Logger, env []string, remote *Remote, dir, ref string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", remote.URL},
+	} {
+		if _, err := st.commandOutputEnv(log, env, dir, "git", args...); err != nil {
+			return err
+		}
+	}
+	rev := "FETCH_HEAD"
+	_, err := st.commandOutputEnv(log, env, dir, "git", "fetch", "--quiet", "origin", ref)
+	if err != nil && refKind(ref) == refCommit {
+		log.V(4).Info("Commit could not be fetched directly, fetching every branch and tag", "commit", ref)
+		if _, err = st.commandOutputEnv(log, env, dir, "git", "fetch", "--quiet", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"); err == nil {
+			rev = ref
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s %q does not exist in %q or cannot be fetched: %v", refKind(ref), ref, remote.URL, err)
+	}
+	sha, err := st.commandOutputEnv(log, env, dir, "git", "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("%s %q does not exist in %q", refKind(ref), ref, remote.URL)
+	}
+	log.Info("Checking out commit with a detached HEAD", "ref", ref, "commit", sha)
+	_, err = st.commandOutputEnv(log, env, dir, "git", "checkout", "--quiet", "--detach", sha)
+	return err
+}
+
+// goGitFetchRef fetches a full ref or commit from the remote into a new
+// repository at dir with go-git, and checks it out with a detached HEAD.
+// go-git cannot fetch a commit directly, so every branch and tag is fetched
+// and the commit is looked up amongst them. Abbreviated commits are not
+// supported.
+func goGitFetchRef(ctx context.Context, log logr.Logger, remote *Remote, dir, ref string) (*git.Repository, error) {
+	if refKind(ref) == refCommit && len(ref) != 40 {
+		return nil, fmt.Errorf("abbreviated commit %q is not supported by the %q fetcher, use the full commit SHA", ref, fetcherGoGit)
+	}
+	auth, err := remote.goGitAuth()
+	if err != nil {
+		return nil, err
+	}
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote.URL}}); err != nil {
+		return nil, err
+	}
+	fetch := &git.FetchOptions{Auth: auth, Tags: git.AllTags}
+	if refKind(ref) == refFull {
+		fetch.RefSpecs = []config.RefSpec{config.RefSpec("+" + ref + ":" + ref)}
+	} else {
+		fetch.RefSpecs = []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+	}
+	if err := r.FetchContext(ctx, fetch); err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, fmt.Errorf("%s %q does not exist in %q or cannot be fetched: %v", refKind(ref), ref, remote.URL, err)
+	}
+	rev := plumbing.Revision(ref)
+	hash, err := r.ResolveRevision(rev)
+	if err != nil {
+		return nil, fmt.Errorf("%s %q does not exist in %q", refKind(ref), ref, remote.URL)
+	}
+	if _, err := r.CommitObject(*hash); err != nil {
+		return nil, fmt.Errorf("%s %q does not point to a commit: %v", refKind(ref), ref, err)
+	}
+	log.Info("Checking out commit with a detached HEAD", "ref", ref, "commit", hash.String())
+	wt, err := r.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	return r, wt.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true})
+}
@@ -0,0 +1,131 @@
+package multiversion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/yaml.v2"
+)
+
+// glossaryData is the structure of the glossary data file.
+type glossaryData struct {
+	FormatVersion int `json:"formatVersion"`
+	// Terms maps each term defined by any version to its definitions.
+	Terms map[string]*glossaryTerm `json:"terms"`
+}
+
+// glossaryTerm describes a term in the glossary data file.
+type glossaryTerm struct {
+	// Versions are the names of the versions defining the term, latest
+	// first.
+	Versions []string `json:"versions"`
+	// Definitions are the distinct definitions of the term, each with the
+	// versions using it, ordered by the latest version using each.
+	Definitions []glossaryDefinition `json:"definitions"`
+	// ChangedIn are the versions whose definition differs from that of the
+	// next older version defining the term, latest first.
+	ChangedIn []string `json:"changedIn"`
+}
+
+// glossaryDefinition is a definition of a term, and the versions using it.
+type glossaryDefinition struct {
+	Definition string   `json:"definition"`
+	Versions   []string `json:"versions"`
+}
+
+// readGlossary reads each of --glossary-files from the version fetched to
+// loc, returning the terms they define. Files the version does not contain
+// are skipped. It returns an error if a term is defined differently by two
+// files.
+func (st *state) readGlossary(log logr.Logger, loc string) (map[string]string, error) {
+	terms := make(map[string]string)
+	for _, name := range st.opts.Fetch.GlossaryFiles {
+		data, err := ioutil.ReadFile(filepath.Join(loc, name))
+		if os.IsNotExist(err) {
+			log.V(4).Info("Version does not contain a glossary file", "path", name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var defs map[string]string
+		if err := yaml.UnmarshalStrict(data, &defs); err != nil {
+			return nil, fmt.Errorf("glossary file %s must map each term to its definition: %v", name, err)
+		}
+		for term, def := range defs {
+			def = strings.TrimSpace(def)
+			if existing, ok := terms[term]; ok && !sameDefinition(existing, def) {
+				return nil, fmt.Errorf("term %q is defined more than once with different definitions", term)
+			}
+			terms[term] = def
+		}
+	}
+	return terms, nil
+}
+
+// sameDefinition returns true if the definitions only differ in whitespace,
+// such as when a definition is reflowed.
+func sameDefinition(a, b string) bool {
+	return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+}
+
+// buildGlossaryData builds the contents of the glossary data file from the
+// glossaries of the versions. Hidden versions are not included.
+func (st *state) buildGlossaryData(versions map[string]string) *glossaryData {
+	data := &glossaryData{FormatVersion: st.opts.Output.DataFormatVersion, Terms: map[string]*glossaryTerm{}}
+	for _, vers := range sortedVersionNames(versions) {
+		if st.opts.versionConfig(vers).Hidden {
+			continue
+		}
+		for term, def := range st.loadedGlossaries[vers] {
+			t, ok := data.Terms[term]
+			if !ok {
+				t = &glossaryTerm{Versions: []string{}, Definitions: []glossaryDefinition{}, ChangedIn: []string{}}
+				data.Terms[term] = t
+			}
+			t.Versions = append(t.Versions, vers)
+			found := false
+			for i := range t.Definitions {
+				if sameDefinition(t.Definitions[i].Definition, def) {
+					t.Definitions[i].Versions = append(t.Definitions[i].Versions, vers)
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Definitions = append(t.Definitions, glossaryDefinition{Definition: def, Versions: []string{vers}})
+			}
+		}
+	}
+	// versions are visited latest first, so each version is compared with
+	// the version after it
+	for term, t := range data.Terms {
+		for i := 0; i+1 < len(t.Versions); i++ {
+			newer, older := t.Versions[i], t.Versions[i+1]
+			if !sameDefinition(st.loadedGlossaries[newer][term], st.loadedGlossaries[older][term]) {
+				t.ChangedIn = append(t.ChangedIn, newer)
+			}
+		}
+	}
+	return data
+}
+
+// logGlossaryChanges logs the terms whose definition changed between
+// versions, sorted by term.
+func logGlossaryChanges(log logr.Logger, data *glossaryData) {
+	terms := make([]string, 0, len(data.Terms))
+	for term := range data.Terms {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	for _, term := range terms {
+		if t := data.Terms[term]; len(t.ChangedIn) > 0 {
+			log.V(2).Info("Definition of term changed between versions", "term", term, "changedIn", t.ChangedIn)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+// testLogger is a logr.Logger that writes to the log of a test.
+type testLogger struct {
+	t      *testing.T
+	values []interface{}
+}
+
+func (l testLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.t.Helper()
+	l.t.Log(append([]interface{}{msg}, append(l.values, keysAndValues...)...)...)
+}
+func (l testLogger) Enabled() bool { return true }
+func (l testLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.t.Helper()
+	l.t.Log(append([]interface{}{msg, "error", err}, append(l.values, keysAndValues...)...)...)
+}
+func (l testLogger) V(level int) logr.InfoLogger { return l }
+func (l testLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return testLogger{t: l.t, values: append(append([]interface{}{}, l.values...), keysAndValues...)}
+}
+func (l testLogger) WithName(name string) logr.Logger { return l }
+
+// recordingLogger is a testLogger that also records the messages logged.
+type recordingLogger struct {
+	testLogger
+	messages *[]string
+}
+
+func (l recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.t.Helper()
+	*l.messages = append(*l.messages, msg)
+	l.testLogger.Info(msg, keysAndValues...)
+}
+
+// newTestRepo creates a git repository with a branch for each key of
+// branches, containing the given files keyed by path, and returns its URL.
+func newTestRepo(t *testing.T, branches map[string]map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "repo")
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		// commits are dated so that the same files always produce the same
+		// commits, and so the same output
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE=2021-03-01T12:00:00Z", "GIT_COMMITTER_DATE=2021-03-01T12:00:00Z")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "--quiet")
+	names := make([]string, 0, len(branches))
+	for name := range branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		git("checkout", "--quiet", "--orphan", name)
+		git("rm", "-r", "--quiet", "--force", "--ignore-unmatch", ".")
+		for p, content := range branches[name] {
+			writeTestFile(t, filepath.Join(dir, p), content)
+		}
+		git("add", "--all")
+		git("commit", "--quiet", "--message", "Update "+name)
+	}
+	return "file://" + filepath.ToSlash(dir)
+}
+
+// writeTestFile writes content to the file at fp, creating its directory.
+func writeTestFile(t *testing.T, fp, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the contents of the file at fp.
+func readTestFile(t *testing.T, fp string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// testConfig returns the default options for building the versions of repo
+// given as version=branch pairs into a temporary output directory.
+func testConfig(t *testing.T, repo string, branches ...string) Config {
+	c := DefaultConfig()
+	c.Log = testLogger{t: t}
+	c.Fetch.RepoURL = repo
+	c.Fetch.Branches = branches
+	c.Output.Dir = filepath.Join(t.TempDir(), "content")
+	c.Output.CopyConcurrency = 1
+	return c
+}
+
+// testBuild builds the site with the given options.
+func testBuild(t *testing.T, c Config) {
+	t.Helper()
+	b, err := New(c)
+	if err != nil {
+		t.Fatalf("invalid options: %v", err)
+	}
+	if _, err := b.Build(context.Background()); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+}
+
+// testPage returns the contents of a page with the given title and body.
+func testPage(title, body string) string {
+	return fmt.Sprintf("---\ntitle: %s\n---\n%s\n", title, body)
+}
@@ -0,0 +1,94 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/go-logr/logr"
+)
+
+// Hooks are shell commands run for each version whilst it is built.
+type Hooks struct {
+	// PreCopy commands are run in the root of the fetched source tree before
+	// its content is copied, e.g. to generate API reference docs.
+	PreCopy []string `yaml:"preCopy"`
+
+	// PostCopy commands are run in the version's directory in the output
+	// once its content has been copied and transformed.
+	PostCopy []string `yaml:"postCopy"`
+}
+
+// validateHooks returns an error if the hooks of any version cannot be run
+// with the other options.
+func (c *Config) validateHooks() error {
+	check := func(h *Hooks) error {
+		if h == nil || len(h.PostCopy) == 0 {
+			return nil
+		}
+		switch {
+		case c.Output.CopyMode == copyModeMount:
+			return fmt.Errorf("postCopy cannot be used with --copy-mode=%s, as content is not copied", copyModeMount)
+		case c.Output.Archive != "":
+			return fmt.Errorf("postCopy cannot be used with --output, as content is not written to disk")
+		}
+		return nil
+	}
+	if err := check(c.Hooks); err != nil {
+		return fmt.Errorf("hooks: %v", err)
+	}
+	for name, vc := range c.Versions {
+		if vc == nil {
+			continue
+		}
+		if err := check(vc.Hooks); err != nil {
+			return fmt.Errorf("version %q: hooks: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// hooks returns the hooks run for the version, which are those set for the
+// version in the config file if any, and otherwise the top-level hooks.
+func (vc *VersionConfig) hooks(c *Config) *Hooks {
+	if vc.Hooks != nil {
+		return vc.Hooks
+	}
+	if c.Hooks != nil {
+		return c.Hooks
+	}
+	return &Hooks{}
+}
+
+// hookEnv returns the environment variables hooks for the version fetched to
+// loc are run with, in addition to the environment of the process.
+func (st *state) hookEnv(log logr.Logger, loc, vers, branch string) ([]string, error) {
+	commit, err := st.resolveCommit(log, loc)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"MV_VERSION=" + vers,
+		"MV_BRANCH=" + branch,
+		"MV_COMMIT=" + commit,
+		"MV_SOURCE_DIR=" + loc,
+		"MV_OUTPUT_DIR=" + st.versionDir(vers),
+	}, nil
+}
+
+// runHooks runs each of the commands with 'sh -c' in dir, returning an error
+// if any command fails. Their output is written to stderr, so that it does
+// not interfere with content streamed to stdout.
+func (st *state) runHooks(log logr.Logger, stage string, commands []string, dir string, env []string) error {
+	for _, command := range commands {
+		log.Info("Running hook", "stage", stage, "command", command, "dir", dir)
+		cmd := newCommand("sh", "-c", command)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := st.runProcess(cmd); err != nil {
+			return fmt.Errorf("%s hook %q failed: %v", stage, command, err)
+		}
+	}
+	return nil
+}
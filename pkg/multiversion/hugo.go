@@ -0,0 +1,57 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/go-logr/logr"
+)
+
+// isHugoServer returns true if Hugo is run as a server, rather than building
+// the site once.
+func (st *state) isHugoServer() bool {
+	return len(st.opts.Hugo.Args) > 0 && (st.opts.Hugo.Args[0] == "server" || st.opts.Hugo.Args[0] == "serve")
+}
+
+// hugoCommand returns the command used to run Hugo in --site-root.
+func (st *state) hugoCommand() *exec.Cmd {
+	cmd := newCommand(st.opts.Hugo.Bin, st.opts.Hugo.Args...)
+	cmd.Dir = st.opts.Hugo.SiteRoot
+	cmd.Stdout = st.commandStdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// runHugo runs Hugo once the content directory has been assembled, returning
+// an error if it fails. If Hugo is run as a server, runHugo returns once the
+// server exits.
+func (st *state) runHugo(log logr.Logger) (err error) {
+	log.Info("Running Hugo", "path", st.opts.Hugo.SiteRoot, "args", st.opts.Hugo.Args)
+	span := st.runSpan.child("hugo")
+	defer func() { span.finish(err) }()
+	if err := st.runProcess(st.hugoCommand()); err != nil {
+		return fmt.Errorf("running hugo: %v", err)
+	}
+	return nil
+}
+
+// startHugo runs Hugo after the initial build in watch mode. A Hugo server is
+// started in the background, where it reloads pages as rebuilt versions are
+// written to the content directory, and exits are sent to hugoServerExited.
+// Otherwise, Hugo is run once to build the site.
+func (st *state) startHugo(log logr.Logger) error {
+	if !st.isHugoServer() {
+		return st.runHugo(log)
+	}
+	log.Info("Starting Hugo server", "path", st.opts.Hugo.SiteRoot, "args", st.opts.Hugo.Args)
+	wait, err := st.startProcess(st.hugoCommand())
+	if err != nil {
+		return fmt.Errorf("starting hugo server: %v", err)
+	}
+	st.hugoServerExited = make(chan error, 1)
+	go func() {
+		st.hugoServerExited <- wait()
+	}()
+	return nil
+}
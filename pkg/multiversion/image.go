@@ -0,0 +1,71 @@
+package multiversion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+)
+
+// validateImage returns an error if --image cannot be used with the other
+// flags.
+func (st *state) validateImage() error {
+	if st.opts.Image.Ref == "" {
+		return nil
+	}
+	switch {
+	case st.opts.Image.Base == "":
+		return fmt.Errorf("--image-base must be set")
+	case st.opts.Image.Path == "":
+		return fmt.Errorf("--image-path must be set")
+	case st.opts.Watch.Enabled:
+		return fmt.Errorf("cannot be used with --watch")
+	case len(st.opts.Jobs.OnlyVersions) > 0:
+		return fmt.Errorf("cannot be used with --only-versions, as the image would not contain every version")
+	case st.opts.Hugo.Run && st.isHugoServer():
+		return fmt.Errorf("cannot be used when running a Hugo server")
+	case st.opts.Image.Dir == "" && !st.opts.Hugo.Run && (st.opts.Output.CopyMode == copyModeSymlink || st.opts.Output.CopyMode == copyModeMount):
+		return fmt.Errorf("cannot package the output directory with --copy-mode=%s, as versions are not copied into it", st.opts.Output.CopyMode)
+	}
+	return nil
+}
+
+// imageSourceDir returns the directory packaged into the image: --image-dir
+// if set, Hugo's 'public' directory if Hugo is run with --run-hugo, and
+// otherwise the output directory.
+func (st *state) imageSourceDir() string {
+	switch {
+	case st.opts.Image.Dir != "":
+		return st.opts.Image.Dir
+	case st.opts.Hugo.Run:
+		return filepath.Join(st.opts.Hugo.SiteRoot, "public")
+	}
+	return st.opts.Output.Dir
+}
+
+// pushImage packages the assembled site as a single layer at --image-path on
+// top of --image-base, and pushes the resulting image to --image using crane.
+// Credentials for the registries are read from the Docker config file.
+func (st *state) pushImage(log logr.Logger) error {
+	dir := st.imageSourceDir()
+	log = log.WithValues("image", st.opts.Image.Ref, "base", st.opts.Image.Base, "directory", dir)
+	f, err := ioutil.TempFile("", "hugo-multiversion-layer-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := st.writeTar(f, dir, st.opts.Image.Path, nil); err != nil {
+		f.Close()
+		return fmt.Errorf("writing image layer: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Info("Pushing container image")
+	if err := st.runCommand(log, st.opts.Image.CraneBin, "append", "--base", st.opts.Image.Base, "--new_layer", f.Name(), "--new_tag", st.opts.Image.Ref); err != nil {
+		return fmt.Errorf("pushing image %q: %v", st.opts.Image.Ref, err)
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package multiversion
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/yaml.v2"
+)
+
+// importVersionRE matches the names of the directories of an imported tree
+// that are versions other than 'latest', capturing the version number, e.g.
+// '1.2' for 'v1.2' or 'v1.2.x'.
+var importVersionRE = regexp.MustCompile(`^v?(\d+(?:\.\d+)*)(?:\.x)?$`)
+
+// importBranchTemplates are the names of the branches and tags a version is
+// looked for on, in order, with {version} replaced by the name of its
+// directory and {number} by its version number.
+var importBranchTemplates = []string{
+	"release-{number}",
+	"release-v{number}",
+	"release/{number}",
+	"release/v{number}",
+	"{version}",
+	"v{number}",
+	"{number}",
+}
+
+// importBaseline is the baseline manifest written by the import command. It
+// records the tree as it was before it was built by hugo-multiversion, and
+// how it differs from the tree built from the inferred branches.
+type importBaseline struct {
+	// Dir is the imported directory.
+	Dir string `json:"dir"`
+	// From is the tool that built the imported tree, if it was not built by
+	// hand (--import-from).
+	From           string `json:"from,omitempty"`
+	RepoURL        string `json:"repoURL"`
+	RepoContentDir string `json:"repoContentDir"`
+	// Verified is set if each version was built and compared with the tree.
+	Verified bool              `json:"verified"`
+	Versions []importedVersion `json:"versions"`
+	// Unversioned are the files and directories at the top of the tree that
+	// are not versions, and are not built by hugo-multiversion.
+	Unversioned []string `json:"unversioned,omitempty"`
+	// Redirects are the redirects from the URLs of the imported tree that
+	// are not served by the versions built from it.
+	Redirects []Redirect `json:"redirects,omitempty"`
+}
+
+// importedVersion is a version found in the imported tree.
+type importedVersion struct {
+	Name string `json:"name"`
+	// Dir is the directory of the version in the imported tree, if it is not
+	// named after the version.
+	Dir string `json:"dir,omitempty"`
+	// Aliases are the other names the version is reachable at.
+	Aliases []string `json:"aliases,omitempty"`
+	// Branch is the inferred branch, or the name of the version if none of
+	// the repository's branches matched.
+	Branch string `json:"branch"`
+	// Commit is the commit the branch pointed to when it was imported.
+	Commit string `json:"commit,omitempty"`
+	// Files maps the slash-separated path of each file of the version to the
+	// SHA256 of its content.
+	Files map[string]string `json:"files"`
+	// Differences are the files that differ between the tree and the version
+	// built from Branch.
+	Differences []importDifference `json:"differences,omitempty"`
+	// Error is the reason the version could not be built from Branch.
+	Error string `json:"error,omitempty"`
+}
+
+// dir returns the directory of the version in the imported tree.
+func (v *importedVersion) dir() string {
+	if v.Dir != "" {
+		return v.Dir
+	}
+	return v.Name
+}
+
+// importDifference is a file that differs between the imported tree and the
+// version built from its branch.
+type importDifference struct {
+	Path string `json:"path"`
+	// Status is 'missing' if the file is only in the imported tree, 'added'
+	// if it is only in the built version, 'front-matter' if only the front
+	// matter of a page differs, and 'modified' otherwise.
+	Status string `json:"status"`
+}
+
+// runImport adopts a hand-built versioned tree in the output directory. Each
+// directory at its top that is named 'latest' or after a version number is
+// a version, whose branch is inferred from the branches and tags of
+// --repo-url. A config file building the versions from those branches is
+// written to configFile, and a baseline manifest of the tree to
+// --import-baseline. With --import-verify, each version is built into a
+// temporary directory and compared with the tree, returning an error if any
+// version cannot be reproduced. With --import-from, the tree is instead one
+// rendered by another tool, whose versions are read from its own metadata.
+func (st *state) runImport(ctx context.Context, configFile string) error {
+	switch {
+	case st.opts.Fetch.RepoURL == "":
+		return fmt.Errorf("--repo-url must be specified")
+	case len(st.opts.Languages.Languages) > 0:
+		return fmt.Errorf("cannot be used with --languages")
+	case st.opts.Fetch.ReplayDir != "":
+		return fmt.Errorf("cannot be used with --replay")
+	}
+	if _, err := os.Stat(configFile); err == nil {
+		return fmt.Errorf("config file %s already exists", configFile)
+	}
+	baselineFile := st.opts.Import.BaselineFile
+	if baselineFile == "" {
+		baselineFile = strings.TrimSuffix(configFile, filepath.Ext(configFile)) + "-baseline.json"
+	}
+
+	heads, err := st.lsRemote(st.log, &Remote{URL: st.opts.Fetch.RepoURL}, nil)
+	if err != nil {
+		return fmt.Errorf("listing branches of %s: %v", st.opts.Fetch.RepoURL, err)
+	}
+	var baseline *importBaseline
+	switch st.opts.Import.From {
+	case importFromMike:
+		baseline, err = st.inspectMikeTree(st.log, st.opts.Output.Dir)
+	case importFromSphinx:
+		baseline, err = st.inspectSphinxTree(st.log, st.opts.Output.Dir, heads)
+	default:
+		baseline, err = st.inspectImportTree(st.log, st.opts.Output.Dir)
+	}
+	if err != nil {
+		return err
+	}
+	if len(baseline.Versions) == 0 {
+		return fmt.Errorf("no version directories found in %s", st.opts.Output.Dir)
+	}
+	var unresolved []string
+	for i := range baseline.Versions {
+		v := &baseline.Versions[i]
+		if v.Branch == "" {
+			branch, ok := st.inferImportBranch(v, heads)
+			if !ok {
+				st.log.Info("WARNING: no branch or tag matches the version, it is built from the branch named after it", "version", v.Name)
+				unresolved = append(unresolved, v.Name)
+				branch = v.Name
+			}
+			v.Branch = branch
+		}
+		v.Commit = heads[v.Branch]
+		st.log.Info("Inferred branch of version", "version", v.Name, "branch", v.Branch, "commit", v.Commit, "files", len(v.Files))
+	}
+	if baseline.From != "" {
+		if baseline.Redirects, err = st.migrationRedirects(baseline); err != nil {
+			return err
+		}
+	}
+	if err := writeImportConfig(configFile, baseline); err != nil {
+		return err
+	}
+	st.log.Info("Wrote config file", "path", configFile)
+
+	var failed []string
+	switch {
+	case st.opts.Import.Verify && baseline.From != "":
+		st.log.Info("Not verifying the versions, as the imported tree was rendered by " + baseline.From)
+	case st.opts.Import.Verify:
+		if failed, err = st.verifyImport(ctx, st.log, baseline); err != nil {
+			return err
+		}
+		baseline.Verified = true
+	}
+	data, err := json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(baselineFile, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	st.log.Info("Wrote baseline manifest", "path", baselineFile)
+
+	switch {
+	case len(failed) > 0:
+		return fmt.Errorf("the tree could not be reproduced from the inferred branches of versions %s, see the differences in %s", strings.Join(failed, ", "), baselineFile)
+	case len(unresolved) > 0:
+		return fmt.Errorf("no branch was found for versions %s, set their 'branch' in %s", strings.Join(unresolved, ", "), configFile)
+	}
+	if st.opts.Import.Verify && baseline.From == "" {
+		st.log.Info("Every version was reproduced from its branch")
+	}
+	return nil
+}
+
+// inspectImportTree returns the baseline manifest of the versions in the
+// tree at dir, without their branches.
+func (st *state) inspectImportTree(log logr.Logger, dir string) (*importBaseline, error) {
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	baseline := &importBaseline{Dir: dir, RepoURL: st.opts.Fetch.RepoURL, RepoContentDir: st.opts.Fetch.RepoContentDir}
+	served := make(map[string]bool)
+	for _, fd := range fds {
+		if !fd.IsDir() || (fd.Name() != latestVersion && !importVersionRE.MatchString(fd.Name())) {
+			continue
+		}
+		files, err := hashTree(filepath.Join(dir, fd.Name()))
+		if err != nil {
+			return nil, err
+		}
+		served[fd.Name()] = true
+		baseline.Versions = append(baseline.Versions, importedVersion{Name: fd.Name(), Files: files})
+	}
+	baseline.Unversioned, err = unversionedEntries(log, dir, served)
+	return baseline, err
+}
+
+// hashTree returns the SHA256 of each file beneath dir, keyed by its
+// slash-separated path relative to dir.
+func hashTree(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		files[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	return files, err
+}
+
+// inferImportBranch returns the branch or tag in heads the version is built
+// from. Versions that are already configured keep their branch, and otherwise
+// the version in the 'latest' directory is built from the branch HEAD points
+// to, and other versions from a branch named after their directory.
+func (st *state) inferImportBranch(v *importedVersion, heads map[string]string) (string, bool) {
+	if configured, ok := st.configuredVersions()[v.Name]; ok {
+		return configured, true
+	}
+	if v.dir() == latestVersion {
+		return headBranch(heads)
+	}
+	m := importVersionRE.FindStringSubmatch(v.dir())
+	if m == nil {
+		return v.dir(), heads[v.dir()] != ""
+	}
+	r := strings.NewReplacer("{version}", v.dir(), "{number}", m[1])
+	for _, tmpl := range importBranchTemplates {
+		if name := r.Replace(tmpl); heads[name] != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// headBranch returns the branch HEAD points to in heads, preferring 'main'
+// and 'master' if several branches point to the same commit.
+func headBranch(heads map[string]string) (string, bool) {
+	head, ok := heads["HEAD"]
+	if !ok {
+		return "", false
+	}
+	var matches []string
+	for name, sha := range heads {
+		if sha == head && name != "HEAD" && !strings.HasPrefix(name, "refs/") {
+			matches = append(matches, name)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		pi, pj := matches[i] == "main" || matches[i] == "master", matches[j] == "main" || matches[j] == "master"
+		if pi != pj {
+			return pi
+		}
+		return matches[i] < matches[j]
+	})
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[0], true
+}
+
+// importConfig is the config file written by the import command.
+type importConfig struct {
+	Versions  map[string]importVersionConfig `yaml:"versions"`
+	Redirects []Redirect                     `yaml:"redirects,omitempty"`
+}
+
+type importVersionConfig struct {
+	Branch  string   `yaml:"branch"`
+	Aliases []string `yaml:"aliases,omitempty"`
+}
+
+// writeImportConfig writes a config file building each imported version from
+// its inferred branch, preceded by a comment giving the flags it is used
+// with.
+func writeImportConfig(path string, baseline *importBaseline) error {
+	c := importConfig{Versions: make(map[string]importVersionConfig, len(baseline.Versions)), Redirects: baseline.Redirects}
+	for _, v := range baseline.Versions {
+		c.Versions[v.Name] = importVersionConfig{Branch: v.Branch, Aliases: v.Aliases}
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	outputDir := baseline.Dir
+	if baseline.From != "" {
+		// the tree rendered by the other tool is replaced by the site Hugo
+		// renders, so the versions are written to its content directory
+		outputDir = "<content directory>"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated by the import command from %s, and used with:\n", baseline.Dir)
+	fmt.Fprintf(&b, "#   --config %s --repo-url %s --repo-content-dir %s --output-dir %s\n", path, baseline.RepoURL, baseline.RepoContentDir, outputDir)
+	if len(baseline.Redirects) > 0 {
+		b.WriteString("# The redirects are only written with --redirects-format.\n")
+	}
+	b.Write(data)
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
+
+// verifyImport builds each imported version from its branch into a temporary
+// directory and records how it differs from the imported tree, returning the
+// names of the versions that differ or failed to build.
+func (st *state) verifyImport(ctx context.Context, log logr.Logger, baseline *importBaseline) ([]string, error) {
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return nil, err
+	}
+	defer st.cleanup(log, tmpdir)
+	if err := st.useThrowawayOutput(tmpdir); err != nil {
+		return nil, err
+	}
+
+	var failed []string
+	for i := range baseline.Versions {
+		v := &baseline.Versions[i]
+		log := log.WithValues("version", v.Name, "branch", v.Branch)
+		if err := st.buildVersion(ctx, log, tmpdir, nil, v.Name, v.Branch); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Info("WARNING: failed to build version from its inferred branch", "error", err.Error())
+			v.Error = err.Error()
+			failed = append(failed, v.Name)
+			continue
+		}
+		built, err := hashTree(st.versionDir(v.Name))
+		if err != nil {
+			return nil, err
+		}
+		v.Differences = importDifferences(filepath.Join(baseline.Dir, v.dir()), st.versionDir(v.Name), v.Files, built)
+		if len(v.Differences) > 0 {
+			for _, d := range v.Differences {
+				log.V(2).Info("File differs from imported tree", "path", d.Path, "status", d.Status)
+			}
+			log.Info("WARNING: version built from its inferred branch differs from the imported tree", "differences", len(v.Differences))
+			failed = append(failed, v.Name)
+			continue
+		}
+		log.Info("Version reproduced from its inferred branch")
+	}
+	return failed, nil
+}
+
+// importDifferences compares the files of an imported version at dir with
+// those built at builtDir, given the hashes of each.
+func importDifferences(dir, builtDir string, files, built map[string]string) []importDifference {
+	var diffs []importDifference
+	for rel, sum := range files {
+		builtSum, ok := built[rel]
+		switch {
+		case !ok:
+			diffs = append(diffs, importDifference{Path: rel, Status: "missing"})
+		case builtSum != sum:
+			status := "modified"
+			if sameBody(filepath.Join(dir, filepath.FromSlash(rel)), filepath.Join(builtDir, filepath.FromSlash(rel))) {
+				status = "front-matter"
+			}
+			diffs = append(diffs, importDifference{Path: rel, Status: status})
+		}
+	}
+	for rel := range built {
+		if _, ok := files[rel]; !ok {
+			diffs = append(diffs, importDifference{Path: rel, Status: "added"})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+	return diffs
+}
+
+// sameBody returns true if the files at a and b are pages with the same body,
+// which differ only in their front matter, as is the case where a transform
+// adds fields.
+func sameBody(a, b string) bool {
+	if !isPage(a) {
+		return false
+	}
+	pa, err := readSourcePage(a)
+	if err != nil {
+		return false
+	}
+	pb, err := readSourcePage(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(bytes.TrimSpace(pa.body), bytes.TrimSpace(pb.body))
+}
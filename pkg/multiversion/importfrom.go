@@ -0,0 +1,186 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// importFromMike imports a site deployed by mike, which lists its
+	// versions and their aliases in versions.json.
+	importFromMike = "mike"
+	// importFromSphinx imports a site built by sphinx-multiversion, which
+	// renders each branch and tag into a directory named after it.
+	importFromSphinx = "sphinx-multiversion"
+)
+
+// mikeVersionsFile is the file mike lists the deployed versions in.
+const mikeVersionsFile = "versions.json"
+
+// importGeneratedPages are the pages rendered by MkDocs and Sphinx that have
+// no equivalent content file, and so are not redirected.
+var importGeneratedPages = map[string]bool{"404.html": true, "search.html": true, "genindex.html": true, "py-modindex.html": true}
+
+// mikeVersion is an entry of mike's versions.json.
+type mikeVersion struct {
+	Version string   `json:"version"`
+	Title   string   `json:"title"`
+	Aliases []string `json:"aliases"`
+}
+
+// validateImportFrom returns an error if --import-from names a tool that
+// cannot be imported from.
+func (st *state) validateImportFrom() error {
+	switch st.opts.Import.From {
+	case "", importFromMike, importFromSphinx:
+		return nil
+	}
+	return fmt.Errorf("must be one of '%s' or '%s'", importFromMike, importFromSphinx)
+}
+
+// inspectMikeTree returns the baseline manifest of the versions deployed by
+// mike to the tree at dir. The version with the 'latest' alias becomes the
+// latest version, reachable at its previous name as an alias, and the other
+// aliases of each version are kept.
+func (st *state) inspectMikeTree(log logr.Logger, dir string) (*importBaseline, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, mikeVersionsFile))
+	if err != nil {
+		return nil, fmt.Errorf("reading mike's versions: %v", err)
+	}
+	var versions []mikeVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", mikeVersionsFile, err)
+	}
+	baseline := &importBaseline{Dir: dir, From: importFromMike, RepoURL: st.opts.Fetch.RepoURL, RepoContentDir: st.opts.Fetch.RepoContentDir}
+	served := map[string]bool{mikeVersionsFile: true}
+	for _, mv := range versions {
+		v := importedVersion{Name: mv.Version}
+		for _, alias := range mv.Aliases {
+			served[alias] = true
+			if alias == latestVersion {
+				v.Name, v.Dir = latestVersion, mv.Version
+				continue
+			}
+			v.Aliases = append(v.Aliases, alias)
+		}
+		if v.Dir != "" {
+			v.Aliases = append([]string{v.Dir}, v.Aliases...)
+		}
+		if v.Files, err = hashTree(filepath.Join(dir, mv.Version)); err != nil {
+			return nil, err
+		}
+		served[mv.Version] = true
+		baseline.Versions = append(baseline.Versions, v)
+	}
+	baseline.Unversioned, err = unversionedEntries(log, dir, served)
+	return baseline, err
+}
+
+// inspectSphinxTree returns the baseline manifest of the versions rendered
+// by sphinx-multiversion to the tree at dir, each of which is a directory
+// named after the branch or tag it was rendered from. The version rendered
+// from --latest-branch, or otherwise the branch HEAD points to, becomes the
+// latest version, reachable at its previous name as an alias.
+func (st *state) inspectSphinxTree(log logr.Logger, dir string, heads map[string]string) (*importBaseline, error) {
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	latest := st.opts.Fetch.LatestBranch
+	if latest == "" {
+		latest, _ = headBranch(heads)
+	}
+	baseline := &importBaseline{Dir: dir, From: importFromSphinx, RepoURL: st.opts.Fetch.RepoURL, RepoContentDir: st.opts.Fetch.RepoContentDir}
+	served := make(map[string]bool)
+	for _, fd := range fds {
+		name := fd.Name()
+		if !fd.IsDir() || strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, name, "index.html")); err != nil {
+			continue
+		}
+		v := importedVersion{Name: name}
+		if heads[name] != "" {
+			v.Branch = name
+		}
+		if name == latest {
+			v.Name, v.Dir, v.Branch, v.Aliases = latestVersion, name, name, []string{name}
+		}
+		if v.Files, err = hashTree(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+		served[name] = true
+		baseline.Versions = append(baseline.Versions, v)
+	}
+	baseline.Unversioned, err = unversionedEntries(log, dir, served)
+	return baseline, err
+}
+
+// unversionedEntries returns the names of the entries at the top of the tree
+// at dir that are not served by the imported versions.
+func unversionedEntries(log logr.Logger, dir string, served map[string]bool) ([]string, error) {
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var unversioned []string
+	for _, fd := range fds {
+		if !served[fd.Name()] && !strings.HasPrefix(fd.Name(), ".") {
+			unversioned = append(unversioned, fd.Name())
+		}
+	}
+	if len(unversioned) > 0 {
+		log.Info("WARNING: files and directories that are not versions are not built by hugo-multiversion", "paths", unversioned)
+	}
+	return unversioned, nil
+}
+
+// migrationRedirects returns a redirect from the URL of each page rendered by
+// the other tool to the URL Hugo publishes the page at, for the pages whose
+// URL changes, e.g. 'install.html' to 'install/'. Versions keep the URL of
+// their directory in the tree, either as their own or as an alias.
+func (st *state) migrationRedirects(baseline *importBaseline) ([]Redirect, error) {
+	var redirects []Redirect
+	for _, v := range baseline.Versions {
+		root := filepath.Join(baseline.Dir, v.dir())
+		base := path.Join("/", st.opts.Transform.URLPrefix, v.dir())
+		err := filepath.Walk(root, func(fp string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || lowerExt(fp) != ".html" || importGeneratedPages[info.Name()] {
+				return err
+			}
+			rel, err := filepath.Rel(root, fp)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			for _, seg := range strings.Split(path.Dir(rel), "/") {
+				// assets, and the sources and search pages of Sphinx and MkDocs
+				if strings.HasPrefix(seg, "_") || seg == "assets" || seg == "search" {
+					return nil
+				}
+			}
+			from := path.Join(base, rel)
+			if path.Base(rel) == "index.html" {
+				from = strings.TrimSuffix(path.Dir(from), "/") + "/"
+			}
+			if to := base + "/" + pagePath(rel); to != from {
+				redirects = append(redirects, Redirect{From: from, To: to, Status: 301})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(redirects, func(i, j int) bool { return redirects[i].From < redirects[j].From })
+	return redirects, nil
+}
@@ -0,0 +1,67 @@
+package multiversion
+
+import (
+	"path"
+)
+
+// contentIndex records the pages present in each built version.
+type contentIndex struct {
+	// versions is the list of built versions, ordered as by
+	// sortedVersionNames.
+	versions []string
+	// pages maps a version name to the page paths (as returned by pagePath)
+	// of each page in that version, and the file each page is built from.
+	// File paths are relative to the version directory and use forward
+	// slashes.
+	pages map[string]map[string]string
+	// titles maps a version name to the title of each page in that version,
+	// keyed by page path.
+	titles map[string]map[string]string
+}
+
+// buildContentIndex indexes the pages of every version in the output
+// directory.
+func (st *state) buildContentIndex(versionMap map[string]string) (*contentIndex, error) {
+	idx := &contentIndex{
+		versions: sortedVersionNames(versionMap),
+		pages:    make(map[string]map[string]string),
+		titles:   make(map[string]map[string]string),
+	}
+	for _, vers := range idx.versions {
+		pages := make(map[string]string)
+		titles := make(map[string]string)
+		err := st.updatePages(st.versionDir(vers), func(rel string, p *page) (bool, error) {
+			pp := pagePath(rel)
+			pages[pp] = rel
+			if title, ok := p.frontMatter["title"].(string); ok {
+				titles[pp] = title
+			}
+			return false, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		idx.pages[vers] = pages
+		idx.titles[vers] = titles
+	}
+	return idx, nil
+}
+
+// hasPage returns true if the named version contains a page published at the
+// given page path.
+func (idx *contentIndex) hasPage(version, pp string) bool {
+	_, ok := idx.pages[version][pp]
+	return ok
+}
+
+// nearestAncestor returns the page path of the closest page in the named
+// version that is a parent of the given page path, falling back to the root of
+// the version.
+func (idx *contentIndex) nearestAncestor(version, pp string) string {
+	for dir := path.Dir(path.Clean(pp)); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if idx.hasPage(version, dir+"/") {
+			return dir + "/"
+		}
+	}
+	return ""
+}
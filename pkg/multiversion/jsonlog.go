@@ -0,0 +1,134 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// NewJSONLogger returns a logr.Logger that writes each message to w as a
+// single line JSON object, with the 'ts', 'level' and 'msg' keys followed by
+// the key/value pairs of the message. Messages logged at a verbosity greater
+// than verbosity are discarded. Messages starting with 'WARNING: ' are logged
+// with the 'warning' level, without the prefix.
+func NewJSONLogger(w io.Writer, verbosity int) logr.Logger {
+	return &jsonLogger{out: &jsonOutput{w: w}, verbosity: verbosity}
+}
+
+// jsonOutput serialises the writes of a jsonLogger and the loggers derived
+// from it.
+type jsonOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type jsonLogger struct {
+	out       *jsonOutput
+	name      string
+	values    []interface{}
+	level     int
+	verbosity int
+}
+
+func (l *jsonLogger) Enabled() bool {
+	return l.level <= l.verbosity
+}
+
+func (l *jsonLogger) Info(msg string, keysAndValues ...interface{}) {
+	if !l.Enabled() {
+		return
+	}
+	level := "info"
+	if strings.HasPrefix(msg, warningPrefix) {
+		level, msg = "warning", strings.TrimPrefix(msg, warningPrefix)
+	}
+	l.write(level, msg, nil, keysAndValues)
+}
+
+func (l *jsonLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.write("error", msg, err, keysAndValues)
+}
+
+func (l *jsonLogger) V(level int) logr.InfoLogger {
+	c := *l
+	c.level += level
+	return &c
+}
+
+func (l *jsonLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	c := *l
+	c.values = append(append([]interface{}{}, l.values...), keysAndValues...)
+	return &c
+}
+
+func (l *jsonLogger) WithName(name string) logr.Logger {
+	c := *l
+	if c.name != "" {
+		name = c.name + "." + name
+	}
+	c.name = name
+	return &c
+}
+
+// write writes a single message.
+func (l *jsonLogger) write(level, msg string, err error, keysAndValues []interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	writeJSONField(&buf, "ts", time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(",")
+	writeJSONField(&buf, "level", level)
+	if l.level > 0 {
+		buf.WriteString(",")
+		writeJSONField(&buf, "v", l.level)
+	}
+	if l.name != "" {
+		buf.WriteString(",")
+		writeJSONField(&buf, "logger", l.name)
+	}
+	buf.WriteString(",")
+	writeJSONField(&buf, "msg", msg)
+	if err != nil {
+		buf.WriteString(",")
+		writeJSONField(&buf, "error", err)
+	}
+	kvs := append(append([]interface{}{}, l.values...), keysAndValues...)
+	for i := 0; i < len(kvs); i += 2 {
+		var v interface{} = "(missing)"
+		if i+1 < len(kvs) {
+			v = kvs[i+1]
+		}
+		buf.WriteString(",")
+		writeJSONField(&buf, fmt.Sprint(kvs[i]), v)
+	}
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+// writeJSONField writes "key":value to buf. Errors and values implementing
+// fmt.Stringer are written as strings, and values that cannot be encoded as
+// JSON are formatted with fmt.
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	k, _ := json.Marshal(key)
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(k)
+	buf.WriteString(":")
+	buf.Write(data)
+}
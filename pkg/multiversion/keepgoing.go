@@ -0,0 +1,86 @@
+package multiversion
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// BuildError is returned by Builder.Build with Config.Jobs.KeepGoing if one
+// or more versions failed to build. The versions that were built have been
+// assembled into the output directory without the failed versions.
+type BuildError struct {
+	// Failed maps the name of each version that failed to build to the
+	// error it failed with.
+	Failed map[string]error
+	// Built are the names of the versions that were built, in order.
+	Built []string
+}
+
+func (e *BuildError) Error() string {
+	var failures []string
+	for _, vers := range sortedVersionNames(versionSet(e.Failed)) {
+		failures = append(failures, fmt.Sprintf("%s: %v", vers, e.Failed[vers]))
+	}
+	return fmt.Sprintf("%d of %d versions failed to build (%s)", len(e.Failed), len(e.Failed)+len(e.Built), strings.Join(failures, "; "))
+}
+
+// Partial returns true if some of the versions were built.
+func (e *BuildError) Partial() bool {
+	return len(e.Built) > 0
+}
+
+// versionSet returns a map with the same keys as m, for use with
+// sortedVersionNames.
+func versionSet(m map[string]error) map[string]string {
+	out := make(map[string]string, len(m))
+	for vers := range m {
+		out[vers] = vers
+	}
+	return out
+}
+
+// validateKeepGoing returns an error if --keep-going cannot be used with the
+// other flags.
+func (st *state) validateKeepGoing() error {
+	if st.opts.Jobs.KeepGoing && st.opts.Watch.Enabled {
+		return fmt.Errorf("cannot be used with --watch, which keeps running when a version fails to rebuild")
+	}
+	return nil
+}
+
+// discardFailedVersion removes a version that failed to build with
+// --keep-going from the output, so that the remaining versions are published
+// without it.
+func (st *state) discardFailedVersion(log logr.Logger, vers string) {
+	if st.opts.Output.CopyMode == copyModeMount {
+		delete(st.mountedOutput().versionMounts, vers)
+		return
+	}
+	st.rollBackVersion(log, vers)
+}
+
+// withoutVersions returns a copy of versionMap without the versions in
+// failed.
+func withoutVersions(versionMap map[string]string, failed map[string]error) map[string]string {
+	out := make(map[string]string, len(versionMap))
+	for vers, branch := range versionMap {
+		if _, ok := failed[vers]; !ok {
+			out[vers] = branch
+		}
+	}
+	return out
+}
+
+// keepGoingResult logs a summary of the versions that failed to build with
+// --keep-going, and returns a *BuildError if any did.
+func keepGoingResult(log logr.Logger, failed map[string]error, built []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	for _, vers := range sortedVersionNames(versionSet(failed)) {
+		log.Error(failed[vers], "Version failed to build", "version", vers)
+	}
+	return &BuildError{Failed: failed, Built: built}
+}
@@ -0,0 +1,202 @@
+package multiversion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// languagePlaceholder is replaced with the name of each language in flags that
+// differ between languages when --languages is set.
+const languagePlaceholder = "{lang}"
+
+// allLanguages may be passed to --languages to build every language found in
+// each version.
+const allLanguages = "*"
+
+// languageMatrix describes which languages each version was built for. It is
+// the structure of the file written by --matrix-report.
+type languageMatrix struct {
+	Languages []string `json:"languages"`
+	Versions  []string `json:"versions"`
+	// Coverage maps each version name to the languages it was built for.
+	Coverage map[string][]string `json:"coverage"`
+}
+
+// validateLanguages returns an error if --languages is used with flags that
+// do not support it.
+func (st *state) validateLanguages() error {
+	if len(st.opts.Languages.Languages) == 0 {
+		return nil
+	}
+	for _, lang := range st.opts.Languages.Languages {
+		if lang == allLanguages && len(st.opts.Languages.Languages) > 1 {
+			return fmt.Errorf("%q cannot be combined with other languages", allLanguages)
+		}
+	}
+	if !strings.Contains(st.opts.Fetch.RepoContentDir, languagePlaceholder) || !strings.Contains(st.opts.Output.Dir, languagePlaceholder) {
+		return fmt.Errorf("--repo-content-dir and --output-dir must contain the %s placeholder", languagePlaceholder)
+	}
+	if st.opts.Fetch.RecordDir != "" || st.opts.Fetch.ReplayDir != "" || st.opts.Jobs.FinalizeOnly || len(st.opts.Jobs.OnlyVersions) > 0 {
+		return fmt.Errorf("cannot be used with --record, --replay, --finalize-only or --only-versions")
+	}
+	return nil
+}
+
+// expandLanguage replaces the language placeholder in s with lang.
+func expandLanguage(s, lang string) string {
+	return strings.Replace(s, languagePlaceholder, lang, -1)
+}
+
+// withLanguage calls fn with the flags that may contain the language
+// placeholder expanded for the given language, restoring them afterwards.
+// The placeholder is removed from --url-prefix for --default-language, as Hugo
+// does not serve the default language from a subdirectory by default.
+func (st *state) withLanguage(lang string, fn func() error) error {
+	flags := []*string{&st.opts.Output.Dir, &st.opts.Fetch.RepoContentDir, &st.opts.Hugo.ContentDir, &st.opts.Output.DataDir, &st.opts.Output.RedirectsFile, &st.opts.Output.DuplicatesReport, &st.opts.Output.SearchIndexDir, &st.opts.Output.SitemapDir, &st.opts.Output.RobotsFile, &st.opts.Transform.URLPrefix}
+	orig := make([]string, len(flags))
+	for i, f := range flags {
+		orig[i] = *f
+		*f = expandLanguage(*f, lang)
+	}
+	if lang == st.opts.Languages.Default {
+		st.opts.Transform.URLPrefix = expandLanguage(orig[len(orig)-1], "")
+	}
+	defer func() {
+		for i, f := range flags {
+			*f = orig[i]
+		}
+	}()
+	return fn()
+}
+
+// versionLanguages returns the languages to build for the version fetched to
+// loc, which are those passed to --languages that have a content directory in
+// the version, or every language with a content directory if --languages is
+// set to '*'.
+func (st *state) versionLanguages(loc string) ([]string, error) {
+	if st.opts.Languages.Languages[0] != allLanguages {
+		var langs []string
+		for _, lang := range st.opts.Languages.Languages {
+			if _, err := os.Stat(filepath.Join(loc, expandLanguage(st.opts.Fetch.RepoContentDir, lang))); err == nil {
+				langs = append(langs, lang)
+			}
+		}
+		return langs, nil
+	}
+
+	pattern := filepath.Join(loc, expandLanguage(st.opts.Fetch.RepoContentDir, "*"))
+	prefix := filepath.Join(loc, st.opts.Fetch.RepoContentDir[:strings.Index(st.opts.Fetch.RepoContentDir, languagePlaceholder)])
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var langs []string
+	for _, m := range matches {
+		if info, err := os.Stat(m); err != nil || !info.IsDir() {
+			continue
+		}
+		lang := strings.TrimPrefix(strings.TrimPrefix(m, prefix), string(filepath.Separator))
+		if i := strings.IndexRune(lang, filepath.Separator); i >= 0 {
+			lang = lang[:i]
+		}
+		langs = append(langs, lang)
+	}
+	return langs, nil
+}
+
+// runLanguageMatrix builds every version for each language it is available
+// in, and then runs the steps that depend on every version separately for
+// each language. Each version is only fetched once.
+func (st *state) runLanguageMatrix(ctx context.Context, versionMap map[string]string) error {
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(st.log, tmpdir)
+
+	matrix := &languageMatrix{Versions: sortedVersionNames(versionMap), Coverage: map[string][]string{}}
+	built := make(map[string]map[string]string)
+	for _, vers := range matrix.Versions {
+		branch := versionMap[vers]
+		log := st.log.WithValues("version", vers, "branch", branch)
+		log.Info("Adding version to list to generate")
+		loc, source, err := st.fetchBuildSource(ctx, log, tmpdir, nil, vers, branch)
+		if err != nil {
+			return err
+		}
+		langs, err := st.versionLanguages(loc)
+		if err != nil {
+			return err
+		}
+		if len(langs) == 0 {
+			log.Info("WARNING: version does not contain content for any language")
+		}
+		for _, lang := range langs {
+			log := log.WithValues("language", lang)
+			err := st.withLanguage(lang, func() error {
+				return st.assembleVersion(log, loc, source, vers, branch)
+			})
+			if err != nil {
+				return err
+			}
+			if built[lang] == nil {
+				built[lang] = make(map[string]string)
+			}
+			built[lang][vers] = branch
+			matrix.Coverage[vers] = append(matrix.Coverage[vers], lang)
+		}
+	}
+
+	for lang := range built {
+		matrix.Languages = append(matrix.Languages, lang)
+	}
+	sort.Strings(matrix.Languages)
+	for _, lang := range matrix.Languages {
+		log := st.log.WithValues("language", lang)
+		if err := st.withLanguage(lang, func() error { return st.finalize(log, built[lang]) }); err != nil {
+			return err
+		}
+	}
+	return st.writeLanguageMatrix(st.log, matrix)
+}
+
+// writeLanguageMatrix logs the languages each version was built for, and
+// writes the matrix to --matrix-report if set.
+func (st *state) writeLanguageMatrix(log logr.Logger, matrix *languageMatrix) error {
+	for _, vers := range matrix.Versions {
+		var missing []string
+		for _, lang := range matrix.Languages {
+			if !containsString(matrix.Coverage[vers], lang) {
+				missing = append(missing, lang)
+			}
+		}
+		log.Info("Language coverage", "version", vers, "languages", matrix.Coverage[vers], "missing", missing)
+	}
+	if st.opts.Languages.MatrixReport == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(matrix, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Info("Writing language matrix report", "path", st.opts.Languages.MatrixReport)
+	return ioutil.WriteFile(st.opts.Languages.MatrixReport, append(data, '\n'), 0644)
+}
+
+// containsString returns true if s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+)
+
+// validateLifecycle returns an error if the publish and unpublish commands
+// cannot be used with the other flags. The version manifests in
+// --manifest-dir record which versions are published in the output
+// directory, so that the steps that depend on every version can be run
+// without building them.
+func (st *state) validateLifecycle(command string) error {
+	switch {
+	case st.opts.Jobs.ManifestDir == "":
+		return fmt.Errorf("--manifest-dir must be set, as it records the versions published in the output directory")
+	case st.opts.Output.CopyMode == copyModeMount:
+		return fmt.Errorf("%s cannot be used with --copy-mode=mount", command)
+	case st.opts.Output.DeltaSync:
+		return fmt.Errorf("%s cannot be used with --delta-sync", command)
+	case st.opts.Output.Archive != "":
+		return fmt.Errorf("%s cannot be used with --output", command)
+	case len(st.opts.Languages.Languages) > 0:
+		return fmt.Errorf("%s cannot be used with --languages", command)
+	}
+	return nil
+}
+
+// runPublish builds a single configured version into an existing output
+// directory, replacing it if it was already published, and then runs the
+// steps that depend on every version for the versions recorded in
+// --manifest-dir. If the version fails to build it is unpublished, so that
+// the output directory is left consistent.
+func (st *state) runPublish(ctx context.Context, vers string) error {
+	if err := st.validateLifecycle("publish"); err != nil {
+		return err
+	}
+	branch, ok := st.resolveVersions()[vers]
+	if !ok {
+		return fmt.Errorf("version %q is not configured", vers)
+	}
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(st.log, tmpdir)
+
+	vlog := st.log.WithValues("version", vers, "branch", branch)
+	if err := st.output.MkdirAll(st.opts.Output.Dir, 0755); err != nil {
+		return err
+	}
+	if err := st.removeVersionDir(vers); err != nil {
+		return err
+	}
+	buildErr := st.buildVersion(ctx, vlog, tmpdir, nil, vers, branch)
+	if buildErr == nil {
+		buildErr = st.checkVersions(vlog, []string{vers})
+	}
+	if buildErr != nil {
+		vlog.Error(buildErr, "Failed to build version, unpublishing it")
+		if err := st.unpublishVersion(vlog, vers); err != nil {
+			return err
+		}
+	}
+	versionMap, err := st.loadManifestVersions(st.opts.Jobs.ManifestDir)
+	if err != nil {
+		return err
+	}
+	if err := st.finalize(st.log, versionMap); err != nil {
+		return err
+	}
+	if buildErr != nil {
+		return buildErr
+	}
+	vlog.Info("Published version", "versions", sortedVersionNames(versionMap))
+	return nil
+}
+
+// runUnpublish removes a published version from the output directory and
+// --manifest-dir, and then runs the steps that depend on every version for
+// the versions that remain.
+func (st *state) runUnpublish(vers string) error {
+	if err := st.validateLifecycle("unpublish"); err != nil {
+		return err
+	}
+	versionMap, err := st.loadManifestVersions(st.opts.Jobs.ManifestDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := versionMap[vers]; !ok {
+		return fmt.Errorf("version %q is not published, it has no manifest in %s", vers, st.opts.Jobs.ManifestDir)
+	}
+	vlog := st.log.WithValues("version", vers)
+	if err := st.unpublishVersion(vlog, vers); err != nil {
+		return err
+	}
+	delete(versionMap, vers)
+	if err := st.finalize(st.log, versionMap); err != nil {
+		return err
+	}
+	vlog.Info("Unpublished version", "versions", sortedVersionNames(versionMap))
+	return nil
+}
+
+// unpublishVersion removes the directory of a version, the directories of
+// its aliases copied with --version-alias-strategy=copy, and its manifest.
+func (st *state) unpublishVersion(log logr.Logger, vers string) error {
+	st.auditStep(vers, "unpublish")
+	log.Info("Removing version from the output directory", "path", st.versionDir(vers))
+	if err := st.removeVersionDir(vers); err != nil {
+		return err
+	}
+	if st.opts.Output.VersionAliasStrategy == aliasStrategyCopy {
+		for _, alias := range st.opts.versionConfig(vers).Aliases {
+			if err := st.output.RemoveAll(filepath.Join(st.opts.Output.Dir, alias)); err != nil {
+				return err
+			}
+		}
+	}
+	err := os.Remove(filepath.Join(st.opts.Jobs.ManifestDir, vers+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
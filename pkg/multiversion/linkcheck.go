@@ -0,0 +1,297 @@
+package multiversion
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// linkTargetREs match the target of every Markdown inline link, Markdown
+	// link reference definition and HTML link or image, capturing it in their
+	// first group.
+	markdownLinkTargetREs = []*regexp.Regexp{
+		regexp.MustCompile(`\]\(\s*<?([^)\s>]+)`),
+		regexp.MustCompile(`^\s{0,3}\[[^\]]+\]:\s*<?([^\s>]+)`),
+	}
+	htmlLinkTargetRE = regexp.MustCompile(`(?:href|src)\s*=\s*["']([^"']*)`)
+	// linkSchemeRE matches links with a scheme, such as https: or mailto:.
+	linkSchemeRE = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+)
+
+// versionPrefix is the URL of a version or of one of its aliases.
+type versionPrefix struct {
+	url     string
+	version string
+}
+
+// versionPrefixes returns the URLs of the configured versions and their
+// aliases, longest first, so that the URLs of versions nested beneath
+// --root-version are matched before it.
+func (c *checkCache) versionPrefixes() []versionPrefix {
+	c.prefixesOnce.Do(func() {
+		for vers := range c.st.resolveVersions() {
+			c.prefixes = append(c.prefixes, versionPrefix{url: c.st.versionURL(vers), version: vers})
+			for _, alias := range c.st.opts.versionConfig(vers).Aliases {
+				c.prefixes = append(c.prefixes, versionPrefix{url: c.st.versionURL(alias), version: vers})
+			}
+		}
+		sort.Slice(c.prefixes, func(i, j int) bool {
+			if len(c.prefixes[i].url) != len(c.prefixes[j].url) {
+				return len(c.prefixes[i].url) > len(c.prefixes[j].url)
+			}
+			return c.prefixes[i].url < c.prefixes[j].url
+		})
+	})
+	return c.prefixes
+}
+
+// versionOfURL returns the version the URL path u is published in, and the
+// path of u within that version. It returns false if u is not within any
+// version.
+func (c *checkCache) versionOfURL(u string) (string, string, bool) {
+	for _, p := range c.versionPrefixes() {
+		if u+"/" == p.url || strings.HasPrefix(u, p.url) {
+			return p.version, strings.TrimPrefix(strings.TrimPrefix(u, p.url), "/"), true
+		}
+	}
+	return "", "", false
+}
+
+// linkChecker reports links and 'ref' and 'relref' shortcodes whose targets
+// do not exist within the version of the page, and those that point into
+// another version.
+type linkChecker struct{}
+
+func (linkChecker) check(cache *checkCache, t checkTarget) []finding {
+	data, _, err := cache.source(t)
+	if data == nil && err != nil {
+		return []finding{{Checker: "links", Version: t.version, File: t.rel, Message: err.Error()}}
+	}
+	markdown := lowerExt(t.rel) == ".md" || lowerExt(t.rel) == ".markdown"
+
+	var findings []finding
+	report := func(line int, format string, args ...interface{}) {
+		findings = append(findings, finding{Checker: "links", Version: t.version, File: t.rel, Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	var fence string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if markdown {
+			if m := fenceRE.FindStringSubmatch(text); m != nil {
+				switch fence {
+				case "":
+					fence = m[1]
+				case m[1]:
+					fence = ""
+				}
+				continue
+			}
+		}
+		if fence != "" {
+			continue
+		}
+
+		var targets []string
+		for _, m := range htmlLinkTargetRE.FindAllStringSubmatch(text, -1) {
+			targets = append(targets, m[1])
+		}
+		if markdown {
+			for _, re := range markdownLinkTargetREs {
+				for _, m := range re.FindAllStringSubmatch(text, -1) {
+					targets = append(targets, m[1])
+				}
+			}
+		}
+		for _, target := range targets {
+			if msg := cache.checkLink(t, target); msg != "" {
+				report(line, "%s", msg)
+			}
+		}
+		for _, m := range refShortcodeRE.FindAllStringSubmatch(text, -1) {
+			target := m[2][1 : len(m[2])-1]
+			if msg := cache.checkRef(t, target); msg != "" {
+				report(line, "%s", msg)
+			}
+		}
+	}
+	return findings
+}
+
+// checkLink returns a description of the problem with a link from the page
+// t to target, or an empty string if there is none. Links to other sites,
+// fragments within the page and templated links are not checked, nor are
+// absolute links outside of every version.
+func (c *checkCache) checkLink(t checkTarget, target string) string {
+	if target == "" || strings.HasPrefix(target, "#") || strings.HasPrefix(target, "//") || linkSchemeRE.MatchString(target) || strings.Contains(target, "{{") {
+		return ""
+	}
+	link := target
+	if i := strings.IndexAny(link, "?#"); i >= 0 {
+		link = link[:i]
+	}
+	if link == "" {
+		return ""
+	}
+
+	// links to Markdown files are resolved against the file's directory, as
+	// render hooks do, and other links against the URL of the page
+	if ext := lowerExt(link); !strings.HasPrefix(link, "/") && (ext == ".md" || ext == ".markdown") {
+		rel := path.Clean(path.Join(path.Dir(t.rel), link))
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Sprintf("link to %q leaves the version", target)
+		}
+		if !c.exists(t.version, rel) {
+			return fmt.Sprintf("broken link to %q: no such file in the version", target)
+		}
+		return ""
+	}
+	base, err := url.Parse(c.st.versionURL(t.version) + pagePath(t.rel))
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return fmt.Sprintf("invalid link %q: %v", target, err)
+	}
+	resolved := base.ResolveReference(ref).Path
+	vers, rest, ok := c.versionOfURL(resolved)
+	switch {
+	case !ok:
+		return ""
+	case vers != t.version:
+		return fmt.Sprintf("link to %q points into version %q", target, vers)
+	case !c.urlExists(vers, rest):
+		return fmt.Sprintf("broken link to %q: no such page or file in the version", target)
+	}
+	return ""
+}
+
+// checkRef returns a description of the problem with the target of a 'ref'
+// or 'relref' shortcode in the page t, or an empty string if there is none.
+func (c *checkCache) checkRef(t checkTarget, target string) string {
+	ref := target
+	if i := strings.Index(ref, "#"); i >= 0 {
+		ref = ref[:i]
+	}
+	switch {
+	case ref == "":
+		return ""
+	case strings.HasPrefix(ref, "/"):
+		// absolute refs are relative to Hugo's content directory
+		for _, p := range c.versionPrefixes() {
+			prefix, err := c.st.versionRefPrefix(p.version)
+			if err != nil || (ref != prefix && !strings.HasPrefix(ref, prefix+"/")) {
+				continue
+			}
+			if p.version != t.version {
+				return fmt.Sprintf("ref to %q points into version %q", target, p.version)
+			}
+			if !c.refExists(t.version, strings.TrimPrefix(strings.TrimPrefix(ref, prefix), "/")) {
+				return fmt.Sprintf("broken ref to %q: no such page in the version", target)
+			}
+			return ""
+		}
+		// refs that were not rewritten into the version resolve outside of it
+		return ""
+	case !strings.Contains(ref, "/"):
+		names, err := c.pageNames(t.version)
+		if err == nil && !names[ref] {
+			return fmt.Sprintf("broken ref to %q: no page with that name in the version", target)
+		}
+		return ""
+	}
+	// like Hugo, refs are resolved relative to the page first, and then
+	// relative to the root of the version
+	rel := path.Clean(path.Join(path.Dir(t.rel), ref))
+	if rel != ".." && !strings.HasPrefix(rel, "../") && c.refExists(t.version, rel) {
+		return ""
+	}
+	root := path.Clean(ref)
+	if root == ".." || strings.HasPrefix(root, "../") {
+		return fmt.Sprintf("ref to %q leaves the version", target)
+	}
+	if !c.refExists(t.version, root) {
+		return fmt.Sprintf("broken ref to %q: no such page in the version", target)
+	}
+	return ""
+}
+
+// exists returns true if the file at rel exists in the version.
+func (c *checkCache) exists(version, rel string) bool {
+	_, err := c.st.output.Stat(filepath.Join(c.st.versionDir(version), filepath.FromSlash(rel)))
+	return err == nil
+}
+
+// urlExists returns true if a page or file is published at the URL path rest
+// within the version.
+func (c *checkCache) urlExists(version, rest string) bool {
+	if rest == "" {
+		return true
+	}
+	urls, err := c.pageURLs(version)
+	if err != nil {
+		return true
+	}
+	pp := strings.ToLower(strings.TrimSuffix(rest, "/")) + "/"
+	if _, ok := urls[pp]; ok {
+		return true
+	}
+	return c.exists(version, strings.TrimSuffix(rest, "/"))
+}
+
+// refExists returns true if the page at rel, with or without its extension,
+// or the section at rel exists in the version.
+func (c *checkCache) refExists(version, rel string) bool {
+	if rel == "" || rel == "." {
+		return true
+	}
+	urls, err := c.pageURLs(version)
+	if err != nil {
+		return true
+	}
+	if _, ok := urls[pagePath(rel)]; ok {
+		return true
+	}
+	return c.exists(version, rel)
+}
+
+// pageNames returns the file names of the pages of the version, with and
+// without their extension, which 'ref' targets without a directory match.
+func (c *checkCache) pageNames(version string) (map[string]bool, error) {
+	urls, err := c.pageURLs(version)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, files := range urls {
+		for _, rel := range files {
+			name := path.Base(rel)
+			names[name], names[strings.TrimSuffix(name, path.Ext(name))] = true, true
+		}
+	}
+	return names, nil
+}
+
+// runCheckLinks runs the 'links' checker against each configured version
+// found in the output directory, without building anything.
+func (st *state) runCheckLinks() error {
+	var versions []string
+	for _, vers := range sortedVersionNames(st.resolveVersions()) {
+		if _, err := st.output.Stat(st.versionDir(vers)); err == nil {
+			versions = append(versions, vers)
+		}
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("none of the configured versions exist in %s", st.opts.Output.Dir)
+	}
+	return st.reportChecks(st.log, []string{"links"}, versions)
+}
@@ -0,0 +1,41 @@
+package multiversion
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckRefsFromVersionRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		wantErr bool
+	}{
+		{name: "relative to page", ref: "upgrade.md"},
+		{name: "relative to version root", ref: "docs/upgrade.md"},
+		{name: "relative to version root with anchor", ref: "docs/upgrade.md#rollback"},
+		{name: "missing page", ref: "docs/missing.md", wantErr: true},
+		{name: "outside of version", ref: "../../upgrade.md", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, map[string]map[string]string{
+				"release-1.0": {
+					"content/docs/install.md": testPage("Install", `Then [upgrade]({{< ref "`+test.ref+`" >}}).`),
+					"content/docs/upgrade.md": testPage("Upgrade", "Upgrade the release."),
+				},
+			})
+			c := testConfig(t, repo, "v1.0=release-1.0")
+			c.Checks.Enabled = []string{"links"}
+			c.Checks.Strict = true
+			b, err := New(c)
+			if err != nil {
+				t.Fatalf("invalid options: %v", err)
+			}
+			_, err = b.Build(context.Background())
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("got error %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package multiversion
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinkCount returns the number of hard links to the file described by
+// info.
+func hardLinkCount(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
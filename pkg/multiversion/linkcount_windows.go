@@ -0,0 +1,11 @@
+package multiversion
+
+import (
+	"os"
+)
+
+// hardLinkCount returns 2 on Windows, where the number of hard links is not
+// reported by os.Stat, so that every file is treated as linked.
+func hardLinkCount(info os.FileInfo) uint64 {
+	return 2
+}
@@ -0,0 +1,117 @@
+package multiversion
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// noRewriteMarker may be placed on a line to prevent links on that line from
+// being rewritten.
+const noRewriteMarker = "<!-- multiversion:no-rewrite -->"
+
+var (
+	markdownInlineLinkRE = regexp.MustCompile(`(\]\(\s*<?)(/[^)\s>]*)`)
+	markdownRefLinkRE    = regexp.MustCompile(`^(\s{0,3}\[[^\]]+\]:\s*<?)(/[^\s>]*)`)
+	htmlLinkRE           = regexp.MustCompile(`((?:href|src)\s*=\s*["'])(/[^"']*)`)
+)
+
+// linkRewriter rewrites absolute links in the pages of a single version so
+// that they point into the version directory.
+type linkRewriter struct {
+	st      *state
+	version string
+	dir     string
+	pages   map[string]bool
+}
+
+// rewrite rewrites the links in the body of a page with the given extension.
+func (r *linkRewriter) rewrite(body []byte, ext string) []byte {
+	return mapLinks(body, ext, absoluteLinkPatterns, r.rewriteLink)
+}
+
+// linkPatterns are the regular expressions used to find links in pages. The
+// second group of each expression must capture the link target.
+type linkPatterns struct {
+	html     []*regexp.Regexp
+	markdown []*regexp.Regexp
+}
+
+// absoluteLinkPatterns match absolute links in pages.
+var absoluteLinkPatterns = linkPatterns{
+	html:     []*regexp.Regexp{htmlLinkRE},
+	markdown: []*regexp.Regexp{markdownInlineLinkRE, markdownRefLinkRE},
+}
+
+// mapLinks replaces the target of every link in the body of a page with the
+// given extension that is matched by patterns with the result of fn.
+// Links in fenced code blocks and on lines containing noRewriteMarker are left
+// unchanged.
+func mapLinks(body []byte, ext string, patterns linkPatterns, fn func(string) string) []byte {
+	markdown := ext == ".md" || ext == ".markdown"
+	replace := func(re *regexp.Regexp) func(string) string {
+		return func(match string) string {
+			m := re.FindStringSubmatch(match)
+			return m[1] + fn(m[2]) + match[len(m[1])+len(m[2]):]
+		}
+	}
+
+	var out bytes.Buffer
+	var fence string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if markdown {
+			if m := fenceRE.FindStringSubmatch(line); m != nil {
+				switch fence {
+				case "":
+					fence = m[1]
+				case m[1]:
+					fence = ""
+				}
+			}
+		}
+		if fence == "" && !strings.Contains(line, noRewriteMarker) {
+			for _, re := range patterns.html {
+				line = re.ReplaceAllStringFunc(line, replace(re))
+			}
+			if markdown {
+				for _, re := range patterns.markdown {
+					line = re.ReplaceAllStringFunc(line, replace(re))
+				}
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if out.Len() > 0 && !bytes.HasSuffix(body, []byte("\n")) {
+		out.Truncate(out.Len() - 1)
+	}
+	return out.Bytes()
+}
+
+// rewriteLink returns the link prefixed with the URL of the version, if it is
+// an absolute link to a page or file in the version.
+func (r *linkRewriter) rewriteLink(link string) string {
+	if strings.HasPrefix(link, "//") || strings.HasPrefix(link, r.st.versionURL(r.version)) {
+		return link
+	}
+	target := link
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		target = target[:i]
+	}
+	target = strings.TrimPrefix(path.Clean(target), "/")
+	if target == "" || target == "." {
+		return link
+	}
+	if !r.pages[strings.ToLower(target)+"/"] {
+		if _, err := r.st.output.Stat(filepath.Join(r.dir, filepath.FromSlash(target))); err != nil {
+			return link
+		}
+	}
+	return r.st.versionURL(r.version) + strings.TrimPrefix(link, "/")
+}
@@ -0,0 +1,112 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// versionManifest describes a single built version. A manifest is written
+// for each version built when --manifest-dir is set, so that versions built by
+// separate jobs can be combined with --finalize-only.
+type versionManifest struct {
+	FormatVersion int    `json:"formatVersion"`
+	Name          string `json:"name"`
+	Branch        string `json:"branch"`
+	// Source is the repository or archive URL the version was fetched from.
+	Source string `json:"source"`
+	// Commit is the commit SHA that was built, if the version was fetched
+	// using git.
+	Commit string `json:"commit,omitempty"`
+	// Metadata is the metadata read from the version's metadata file.
+	Metadata *versionMetadata `json:"metadata,omitempty"`
+	// Glossary is the terms read from the version's glossary files.
+	Glossary map[string]string `json:"glossary,omitempty"`
+	// OutputVersion is the --output-compat the version was built with.
+	OutputVersion int `json:"outputVersion,omitempty"`
+}
+
+// resolveCommit returns the commit SHA checked out in the repository at loc,
+// or an empty string if loc is not a git repository.
+func (st *state) resolveCommit(log logr.Logger, loc string) (string, error) {
+	if _, err := os.Stat(filepath.Join(loc, ".git")); err != nil {
+		return "", nil
+	}
+	return st.commandOutput(log, loc, "git", "rev-parse", "HEAD")
+}
+
+// writeVersionManifest writes the manifest for a built version to
+// <manifest-dir>/<version>.json.
+func (st *state) writeVersionManifest(log logr.Logger, version, branch, source, loc string) error {
+	commit, err := st.resolveCommit(log, loc)
+	if err != nil {
+		return err
+	}
+	m := versionManifest{
+		FormatVersion: st.opts.Output.DataFormatVersion,
+		Name:          version,
+		Branch:        branch,
+		Source:        source,
+		Commit:        commit,
+		Metadata:      st.loadedVersionMetadata[version],
+		Glossary:      st.loadedGlossaries[version],
+		OutputVersion: st.opts.Output.Compat,
+	}
+	if err := os.MkdirAll(st.opts.Jobs.ManifestDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(st.opts.Jobs.ManifestDir, version+".json")
+	log.Info("Writing version manifest", "path", path)
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// loadManifests reads every version manifest in dir.
+func (st *state) loadManifests(dir string) ([]versionManifest, error) {
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []versionManifest
+	for _, fd := range fds {
+		if fd.IsDir() || !strings.HasSuffix(fd.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fd.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var m versionManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		if err := st.checkManifestOutputVersion(m); err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+// loadManifestVersions returns the map of version name to branch name for
+// every version manifest in dir.
+func (st *state) loadManifestVersions(dir string) (map[string]string, error) {
+	manifests, err := st.loadManifests(dir)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]string, len(manifests))
+	for _, m := range manifests {
+		versions[m.Name] = m.Branch
+		st.loadedVersionMetadata[m.Name] = m.Metadata
+		st.loadedGlossaries[m.Name] = m.Glossary
+	}
+	return versions, nil
+}
@@ -0,0 +1,179 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// markdownParser parses pages with goldmark and the extensions Hugo enables
+// by default.
+var markdownParser = goldmark.New(goldmark.WithExtensions(
+	extension.GFM,
+	extension.DefinitionList,
+	extension.Footnote,
+)).Parser()
+
+var (
+	// htmlTagRE matches an opening, closing or self-closing HTML tag,
+	// capturing the slash of a closing tag, the tag name and the slash of a
+	// self-closing tag.
+	htmlTagRE = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9-]*)(?:\s[^<>]*?)?(/?)>`)
+	// htmlCommentRE matches an HTML comment.
+	htmlCommentRE = regexp.MustCompile(`(?s)<!--.*?-->`)
+)
+
+// unpairedHTMLTags are the HTML elements that have no closing tag, or whose
+// closing tag may be omitted, so they are not required to be balanced.
+var unpairedHTMLTags = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+	"p": true, "li": true, "dt": true, "dd": true, "option": true,
+	"tr": true, "td": true, "th": true, "thead": true, "tbody": true,
+}
+
+// markdownChecker parses Markdown pages with goldmark, the parser Hugo
+// uses, and reports fenced code blocks that are never closed and raw HTML
+// whose tags are not balanced, both of which change how the rest of the page
+// is rendered.
+type markdownChecker struct{}
+
+func (markdownChecker) check(cache *checkCache, t checkTarget) []finding {
+	if ext := strings.ToLower(path.Ext(t.rel)); ext != ".md" && ext != ".markdown" {
+		return nil
+	}
+	data, p, err := cache.source(t)
+	if err != nil {
+		// reported by the frontmatter checker
+		return nil
+	}
+	// line numbers are relative to the file, which begins with front matter
+	bodyLine := 1
+	if bytes.HasSuffix(data, p.body) {
+		bodyLine += bytes.Count(data[:len(data)-len(p.body)], []byte("\n"))
+	}
+	lineOf := func(offset int) int {
+		return bodyLine + bytes.Count(p.body[:offset], []byte("\n"))
+	}
+
+	var findings []finding
+	report := func(offset int, format string, args ...interface{}) {
+		findings = append(findings, finding{Checker: "markdown", Version: t.version, File: t.rel, Line: lineOf(offset), Message: fmt.Sprintf(format, args...)})
+	}
+	tags := &htmlTagStack{report: report}
+	doc := markdownParser.Parse(text.NewReader(p.body))
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.FencedCodeBlock:
+			if start, ok := unclosedFence(p.body, n); ok {
+				report(start, "fenced code block is never closed, so the rest of the page is rendered as code")
+			}
+		case *ast.HTMLBlock:
+			// scan the block at once, as comments may span several lines
+			if lines := n.Lines(); lines.Len() > 0 {
+				stop := lines.At(lines.Len() - 1).Stop
+				if n.HasClosure() {
+					stop = n.ClosureLine.Stop
+				}
+				tags.scan(p.body, lines.At(0).Start, stop)
+			}
+		case *ast.RawHTML:
+			for i := 0; i < n.Segments.Len(); i++ {
+				seg := n.Segments.At(i)
+				tags.scan(p.body, seg.Start, seg.Stop)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	tags.finish()
+	return findings
+}
+
+// unclosedFence returns the offset of the opening fence of the fenced code
+// block n if it is never closed, in which case goldmark ends the block at the
+// end of the page.
+func unclosedFence(body []byte, n *ast.FencedCodeBlock) (int, bool) {
+	var start, end int
+	switch {
+	case n.Lines().Len() > 0:
+		start, end = n.Lines().At(0).Start, n.Lines().At(n.Lines().Len()-1).Stop
+	case n.Info != nil:
+		start, end = n.Info.Segment.Start, n.Info.Segment.Stop
+	default:
+		return 0, false
+	}
+	// a closed block is followed by its closing fence
+	if len(bytes.TrimSpace(body[end:])) > 0 {
+		return 0, false
+	}
+	// point at the opening fence rather than the first line of code
+	if i := bytes.LastIndexByte(body[:start], '\n'); i >= 0 && n.Lines().Len() > 0 {
+		start = bytes.LastIndexByte(body[:i], '\n') + 1
+	}
+	return start, true
+}
+
+// htmlTagStack tracks the HTML tags opened by the raw HTML of a page.
+type htmlTagStack struct {
+	report func(offset int, format string, args ...interface{})
+	open   []htmlTag
+}
+
+// htmlTag is an opened HTML tag.
+type htmlTag struct {
+	name   string
+	offset int
+}
+
+// scan reads the tags in body[start:stop], reporting closing tags that do
+// not close an open tag, and tags that are implicitly closed by a closing
+// tag for a tag opened before them.
+func (s *htmlTagStack) scan(body []byte, start, stop int) {
+	src := htmlCommentRE.ReplaceAllFunc(body[start:stop], func(c []byte) []byte {
+		// keep the offsets of the tags after the comment
+		return bytes.Repeat([]byte(" "), len(c))
+	})
+	for _, m := range htmlTagRE.FindAllSubmatchIndex(src, -1) {
+		closing, selfClosing := m[3] > m[2], m[7] > m[6]
+		name := strings.ToLower(string(src[m[4]:m[5]]))
+		offset := start + m[0]
+		if selfClosing || unpairedHTMLTags[name] {
+			continue
+		}
+		if !closing {
+			s.open = append(s.open, htmlTag{name: name, offset: offset})
+			continue
+		}
+		i := len(s.open) - 1
+		for i >= 0 && s.open[i].name != name {
+			i--
+		}
+		if i < 0 {
+			s.report(offset, "closing tag </%s> does not close an open <%s> tag", name, name)
+			continue
+		}
+		for _, t := range s.open[i+1:] {
+			s.report(t.offset, "tag <%s> is not closed before </%s>", t.name, name)
+		}
+		s.open = s.open[:i]
+	}
+}
+
+// finish reports the tags that are still open at the end of the page.
+func (s *htmlTagStack) finish() {
+	for _, t := range s.open {
+		s.report(t.offset, "tag <%s> is never closed", t.name)
+	}
+	s.open = nil
+}
@@ -0,0 +1,124 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+)
+
+// mergeInput is the output of a single job that built a subset of versions.
+type mergeInput struct {
+	// outputDir is the --output-dir the job wrote its versions to.
+	outputDir string
+	// manifestDir is the --manifest-dir the job wrote its manifests to.
+	manifestDir string
+}
+
+// parseMergeInputs parses the arguments to the merge command. Each argument is
+// a job's output directory and manifest directory, separated by the OS
+// path list separator, e.g. 'job-1/content:job-1/manifests'.
+func parseMergeInputs(args []string) ([]mergeInput, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("at least one input must be specified")
+	}
+	var inputs []mergeInput
+	for _, arg := range args {
+		parts := filepath.SplitList(arg)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("input %q must be of the form <output-dir>%c<manifest-dir>", arg, os.PathListSeparator)
+		}
+		inputs = append(inputs, mergeInput{outputDir: parts[0], manifestDir: parts[1]})
+	}
+	return inputs, nil
+}
+
+// runMerge copies the versions built by each input into the output directory,
+// and then runs the steps that depend on every version.
+// If --manifest-dir is set, the manifests of every input are combined into it.
+func (st *state) runMerge(args []string) error {
+	inputs, err := parseMergeInputs(args)
+	if err != nil {
+		return err
+	}
+	if err := st.output.MkdirAll(st.opts.Output.Dir, 0755); err != nil {
+		st.log.Info("Error creating output directory")
+		return err
+	}
+
+	versionMap := make(map[string]string)
+	for _, in := range inputs {
+		log := st.log.WithValues("input", in.outputDir)
+		manifests, err := st.loadManifests(in.manifestDir)
+		if err != nil {
+			log.Error(err, "Failed to load version manifests", "path", in.manifestDir)
+			return err
+		}
+		if len(manifests) == 0 {
+			log.Info("WARNING: input contains no version manifests", "path", in.manifestDir)
+		}
+		for _, m := range manifests {
+			if _, ok := versionMap[m.Name]; ok {
+				return fmt.Errorf("version %q is contained in more than one input", m.Name)
+			}
+			versionMap[m.Name] = m.Branch
+			st.loadedVersionMetadata[m.Name] = m.Metadata
+			st.loadedGlossaries[m.Name] = m.Glossary
+			if err := st.mergeVersion(log.WithValues("version", m.Name), in, m); err != nil {
+				return err
+			}
+		}
+	}
+	return st.finalize(st.log, versionMap)
+}
+
+// mergeVersion copies a single version built by a job into the output
+// directory.
+func (st *state) mergeVersion(log logr.Logger, in mergeInput, m versionManifest) error {
+	src := filepath.Join(in.outputDir, st.versionPath(m.Name))
+	dst := st.versionDir(m.Name)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("version %q has a manifest but was not found in the output directory: %v", m.Name, err)
+	}
+	log.Info("Merging version into output directory", "commit", m.Commit)
+	st.auditStep(m.Name, "merge")
+	if err := st.removeVersionDir(m.Name); err != nil {
+		return err
+	}
+	if err := st.copyTree(src, dst); err != nil {
+		return err
+	}
+	if st.opts.Jobs.ManifestDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(st.opts.Jobs.ManifestDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(st.opts.Jobs.ManifestDir, m.Name+".json"), append(data, '\n'), 0644)
+}
+
+// copyTree copies the directory src on the local filesystem to dst in the
+// output as-is, without applying any of the transforms applied by copyDir.
+func (st *state) copyTree(src, dst string) error {
+	return filepath.Walk(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return st.output.MkdirAll(target, info.Mode())
+		}
+		return st.copyToOutput(fp, target)
+	})
+}
@@ -0,0 +1,71 @@
+package multiversion
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	"gopkg.in/yaml.v2"
+)
+
+// versionMetadata is the structure of the metadata file that may be committed
+// to each branch, and is merged into the versions data file.
+type versionMetadata struct {
+	// DisplayName is a human readable name for the version.
+	DisplayName string `yaml:"displayName" json:"displayName,omitempty"`
+	// MinProductVersion is the oldest version of the product documented by
+	// the version.
+	MinProductVersion string `yaml:"minProductVersion" json:"minProductVersion,omitempty"`
+	// DeprecationNote explains why the version is deprecated.
+	DeprecationNote string `yaml:"deprecationNote" json:"deprecationNote,omitempty"`
+	// Deprecated marks the version as deprecated, in the same way as the
+	// 'deprecated' option in the config file.
+	Deprecated bool `yaml:"deprecated" json:"deprecated,omitempty"`
+	// ReleaseDate is the date the version was released, in the form
+	// YYYY-MM-DD, used by the support policy.
+	ReleaseDate string `yaml:"releaseDate" json:"releaseDate,omitempty"`
+	// Params are arbitrary values passed through to the versions data file.
+	Params map[string]interface{} `yaml:"params" json:"params,omitempty"`
+}
+
+// readVersionMetadata reads --version-metadata-file from the version fetched
+// to loc. nil is returned if the version does not contain the file.
+func (st *state) readVersionMetadata(log logr.Logger, loc string) (*versionMetadata, error) {
+	path := filepath.Join(loc, st.opts.Fetch.VersionMetadataFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.V(4).Info("Version does not contain a metadata file", "path", st.opts.Fetch.VersionMetadataFile)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &versionMetadata{}
+	if err := yaml.UnmarshalStrict(data, m); err != nil {
+		return nil, err
+	}
+	if m.Params != nil {
+		m.Params = normalizeYAML(m.Params).(map[string]interface{})
+	}
+	return m, nil
+}
+
+// metadataFor returns the metadata read from the named version, which is
+// empty if the version does not contain a metadata file.
+func (st *state) metadataFor(version string) *versionMetadata {
+	if m, ok := st.loadedVersionMetadata[version]; ok && m != nil {
+		return m
+	}
+	return &versionMetadata{}
+}
+
+// isDeprecated returns true if the named version is marked as deprecated in
+// the config file or its metadata file, or is EOL and the support policy
+// deprecates EOL versions.
+func (st *state) isDeprecated(version string) bool {
+	if st.opts.SupportPolicy != nil && st.opts.SupportPolicy.DeprecateEOL && st.isEOL(version) {
+		return true
+	}
+	return st.opts.versionConfig(version).Deprecated || st.metadataFor(version).Deprecated
+}
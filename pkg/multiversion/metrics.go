@@ -0,0 +1,176 @@
+package multiversion
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// buildMetrics records the outcome of builds for the metrics endpoint served
+// with --metrics-listen.
+type buildMetrics struct {
+	mu sync.Mutex
+	// ready is true once the initial build has completed.
+	ready bool
+	// builds counts the builds of each version, keyed by version then
+	// result.
+	builds map[string]map[string]int
+	// durationSum and durationCount summarise the duration of the builds of
+	// each version.
+	durationSum   map[string]float64
+	durationCount map[string]int
+	// lastSuccess is the time each version was last built successfully.
+	lastSuccess map[string]time.Time
+	// finalizes counts runs of the steps that depend on every version, keyed
+	// by result.
+	finalizes map[string]int
+	// polls counts polls of the remote repository in watch mode, keyed by
+	// result.
+	polls map[string]int
+}
+
+// newBuildMetrics returns empty metrics.
+func newBuildMetrics() *buildMetrics {
+	return &buildMetrics{
+		builds:        map[string]map[string]int{},
+		durationSum:   map[string]float64{},
+		durationCount: map[string]int{},
+		lastSuccess:   map[string]time.Time{},
+		finalizes:     map[string]int{},
+		polls:         map[string]int{},
+	}
+}
+
+// validateMetrics returns an error if --metrics-listen cannot be used with
+// the other flags.
+func (st *state) validateMetrics() error {
+	if st.opts.Watch.MetricsListenAddr != "" && !st.opts.Watch.Enabled {
+		return fmt.Errorf("can only be used with --watch")
+	}
+	return nil
+}
+
+// result returns the value of the 'result' label for err.
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeBuild records a build of version that took d and failed if err is
+// not nil.
+func (m *buildMetrics) observeBuild(version string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.builds[version] == nil {
+		m.builds[version] = map[string]int{}
+	}
+	m.builds[version][result(err)]++
+	m.durationSum[version] += d.Seconds()
+	m.durationCount[version]++
+	if err == nil {
+		m.lastSuccess[version] = time.Now()
+	}
+}
+
+// observeFinalize records a run of the steps that depend on every version.
+func (m *buildMetrics) observeFinalize(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finalizes[result(err)]++
+}
+
+// observePoll records a poll of the remote repository.
+func (m *buildMetrics) observePoll(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.polls[result(err)]++
+}
+
+// setReady marks the initial build as complete.
+func (m *buildMetrics) setReady() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ready = true
+}
+
+// write writes the metrics in the Prometheus text exposition format.
+func (m *buildMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	versions := make([]string, 0, len(m.builds))
+	for vers := range m.builds {
+		versions = append(versions, vers)
+	}
+	sort.Strings(versions)
+
+	fmt.Fprintln(w, "# HELP hugo_multiversion_builds_total Number of builds of each version.")
+	fmt.Fprintln(w, "# TYPE hugo_multiversion_builds_total counter")
+	for _, vers := range versions {
+		for _, r := range []string{"success", "failure"} {
+			fmt.Fprintf(w, "hugo_multiversion_builds_total{version=%q,result=%q} %d\n", vers, r, m.builds[vers][r])
+		}
+	}
+	fmt.Fprintln(w, "# HELP hugo_multiversion_build_duration_seconds Duration of builds of each version.")
+	fmt.Fprintln(w, "# TYPE hugo_multiversion_build_duration_seconds summary")
+	for _, vers := range versions {
+		fmt.Fprintf(w, "hugo_multiversion_build_duration_seconds_sum{version=%q} %g\n", vers, m.durationSum[vers])
+		fmt.Fprintf(w, "hugo_multiversion_build_duration_seconds_count{version=%q} %d\n", vers, m.durationCount[vers])
+	}
+	fmt.Fprintln(w, "# HELP hugo_multiversion_last_successful_build_timestamp_seconds Time each version was last built successfully.")
+	fmt.Fprintln(w, "# TYPE hugo_multiversion_last_successful_build_timestamp_seconds gauge")
+	for _, vers := range versions {
+		if t, ok := m.lastSuccess[vers]; ok {
+			fmt.Fprintf(w, "hugo_multiversion_last_successful_build_timestamp_seconds{version=%q} %d\n", vers, t.Unix())
+		}
+	}
+	fmt.Fprintln(w, "# HELP hugo_multiversion_finalize_total Number of runs of the steps that depend on every version.")
+	fmt.Fprintln(w, "# TYPE hugo_multiversion_finalize_total counter")
+	for _, r := range []string{"success", "failure"} {
+		fmt.Fprintf(w, "hugo_multiversion_finalize_total{result=%q} %d\n", r, m.finalizes[r])
+	}
+	fmt.Fprintln(w, "# HELP hugo_multiversion_polls_total Number of polls of the remote repository for changed branches.")
+	fmt.Fprintln(w, "# TYPE hugo_multiversion_polls_total counter")
+	for _, r := range []string{"success", "failure"} {
+		fmt.Fprintf(w, "hugo_multiversion_polls_total{result=%q} %d\n", r, m.polls[r])
+	}
+}
+
+// serveMetrics serves /metrics, /healthz and /readyz on --metrics-listen.
+// /readyz only succeeds once the initial build has completed.
+func (st *state) serveMetrics() error {
+	l, err := net.Listen("tcp", st.opts.Watch.MetricsListenAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		st.metrics.write(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		st.metrics.mu.Lock()
+		ready := st.metrics.ready
+		st.metrics.mu.Unlock()
+		if !ready {
+			http.Error(w, "initial build has not completed", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	st.log.Info("Serving metrics and health endpoints", "address", l.Addr().String())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			st.log.Error(err, "Metrics server failed")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,294 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// hugoMount is a Hugo module mount, as written to --mounts-file.
+type hugoMount struct {
+	source       string
+	target       string
+	excludeFiles []string
+}
+
+// mountsFS is the output used with --copy-mode=mount. Versions are not
+// copied, so the directory of each version in the output resolves to the
+// content directory of its fetched sources, which may not be modified.
+type mountsFS struct {
+	localFS
+	// mounts maps the directory of each version in the output to the content
+	// directory it is mounted from.
+	mounts map[string]string
+	// versionMounts are the mounts written to --mounts-file, keyed by
+	// version.
+	versionMounts map[string]hugoMount
+}
+
+// validateMountMode returns an error if --copy-mode=mount cannot be used with
+// the other flags. Versions are mounted as-is, so none of the options that
+// modify pages are supported.
+func (st *state) validateMountMode() error {
+	if st.opts.Output.CopyMode != copyModeMount {
+		return nil
+	}
+	if st.opts.Fetch.CacheDir == "" {
+		return fmt.Errorf("--cache-dir must be set, as mounts must point at a directory that is not removed")
+	}
+	unsupported := map[string]bool{
+		"--rewrite-links":        st.opts.Transform.RewriteLinks,
+		"--rewrite-refs":         st.opts.Transform.RewriteRefs,
+		"--outdated-cascade":     st.opts.Transform.OutdatedCascade,
+		"--non-latest-outputs":   len(st.opts.Transform.NonLatestOutputs) > 0,
+		"--non-latest-list":      st.opts.Transform.NonLatestList != "",
+		"--related-isolation":    st.opts.Transform.RelatedIsolation,
+		"--canonical-latest":     st.opts.Transform.CanonicalLatest,
+		"--removed-page-aliases": st.opts.Transform.RemovedPageAliases,
+		"--edit-urls":            st.opts.Transform.EditURLs || st.opts.Transform.EditURLTemplate != "",
+		"--git-dates":            st.opts.Transform.GitDates,
+		"--git-contributors":     st.opts.Transform.GitContributors,
+		"--preserve-mtimes":      st.opts.Transform.PreserveMtimes,
+		"--search-index":         st.opts.Transform.SearchIndex,
+		"--algolia-index":        st.opts.Search.AlgoliaIndex != "",
+		"--sitemap-hints":        st.opts.Transform.SitemapHints,
+		"--dedupe-assets":        st.opts.Output.DedupeMode != "",
+		"--exclude-drafts":       st.opts.Transform.ExcludeDrafts,
+		"--exclude-expired":      st.opts.Transform.ExcludeExpired,
+		"--delta-sync":           st.opts.Output.DeltaSync,
+		"--normalize-filenames":  st.opts.Output.NormalizeFilenames != "",
+		"--languages":            len(st.opts.Languages.Languages) > 0,
+		"--only-versions":        len(st.opts.Jobs.OnlyVersions) > 0,
+		"--finalize-only":        st.opts.Jobs.FinalizeOnly,
+	}
+	var flags []string
+	for name, set := range unsupported {
+		if set {
+			flags = append(flags, name)
+		}
+	}
+	if len(flags) > 0 {
+		sort.Strings(flags)
+		return fmt.Errorf("cannot be used with %s, as mounted versions are not modified", strings.Join(flags, ", "))
+	}
+	return nil
+}
+
+// mountedOutput returns the output used with --copy-mode=mount, creating it
+// on first use.
+func (st *state) mountedOutput() *mountsFS {
+	m, ok := st.output.(*mountsFS)
+	if !ok {
+		m = &mountsFS{mounts: map[string]string{}, versionMounts: map[string]hugoMount{}}
+		st.output = m
+	}
+	return m
+}
+
+// mountVersion adds a mount for the content directory of the version fetched
+// to loc, in place of copying it into the output directory. Files excluded by
+// the version's content type mappings are excluded from the mount.
+func (st *state) mountVersion(log logr.Logger, loc, vers string, vc *VersionConfig) error {
+	src, err := filepath.Abs(filepath.Join(loc, st.opts.Fetch.RepoContentDir))
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(st.opts.Output.Dir, vers)
+	target, err := filepath.Rel(st.opts.Hugo.ContentDir, dst)
+	if err != nil {
+		return err
+	}
+	target = path.Join("content", filepath.ToSlash(target))
+	if strings.HasPrefix(target, "../") {
+		return fmt.Errorf("output directory %q is not within the Hugo content directory %q", st.opts.Output.Dir, st.opts.Hugo.ContentDir)
+	}
+
+	if vc.excludeDrafts(st.opts) || vc.excludeExpired(st.opts) {
+		return fmt.Errorf("draft and expired pages cannot be excluded, as versions are mounted rather than copied")
+	}
+	mount := hugoMount{source: src, target: target}
+	for ext, m := range vc.ContentTypes {
+		switch m.policy() {
+		case ContentTypePolicyExclude:
+			mount.excludeFiles = append(mount.excludeFiles, "**"+ext)
+		case ContentTypePolicyConvert:
+			return fmt.Errorf("files with extension %q cannot be converted, as versions are mounted rather than copied", ext)
+		}
+	}
+	sort.Strings(mount.excludeFiles)
+	checkContentTypeHelpers(log, vc.ContentTypes)
+
+	if _, err := os.Stat(dst); err == nil {
+		log.Info("WARNING: version also exists in the output directory, remove it so that it does not conflict with the mount", "path", dst)
+	}
+	log.Info("Mounting content rather than copying it", "source", src, "target", target)
+	m := st.mountedOutput()
+	m.mounts[filepath.Clean(dst)] = src
+	m.versionMounts[vers] = mount
+	return nil
+}
+
+// writeMounts writes the module mounts of every version to --mounts-file.
+// As adding a mount for the content directory replaces Hugo's default
+// content mount, the site's own content directory is mounted too.
+// If the file is named module.*, mounts are written at the top level,
+// and otherwise within the 'module' table.
+func (st *state) writeMounts(log logr.Logger) error {
+	m := st.mountedOutput()
+	content, err := filepath.Rel(st.opts.Hugo.SiteRoot, st.opts.Hugo.ContentDir)
+	if err != nil {
+		return err
+	}
+	versions := make([]string, 0, len(m.versionMounts))
+	for vers := range m.versionMounts {
+		versions = append(versions, vers)
+	}
+	sort.Strings(versions)
+	mounts := []hugoMount{{source: filepath.ToSlash(content), target: "content"}}
+	for _, vers := range versions {
+		mounts = append(mounts, m.versionMounts[vers])
+	}
+
+	table := "[[mounts]]"
+	if !strings.HasPrefix(filepath.Base(st.opts.Output.MountsFile), "module.") {
+		table = "[[module.mounts]]"
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by hugo-multiversion. Do not edit.\n")
+	for _, mount := range mounts {
+		fmt.Fprintf(&buf, "\n%s\n  source = %s\n  target = %s\n", table, strconv.Quote(mount.source), strconv.Quote(mount.target))
+		if len(mount.excludeFiles) > 0 {
+			quoted := make([]string, len(mount.excludeFiles))
+			for i, f := range mount.excludeFiles {
+				quoted[i] = strconv.Quote(f)
+			}
+			fmt.Fprintf(&buf, "  excludeFiles = [%s]\n", strings.Join(quoted, ", "))
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(st.opts.Output.MountsFile), 0755); err != nil {
+		return err
+	}
+	log.Info("Writing Hugo module mounts", "path", st.opts.Output.MountsFile, "versions", len(m.versionMounts))
+	return ioutil.WriteFile(st.opts.Output.MountsFile, buf.Bytes(), 0644)
+}
+
+// resolve returns the path of name on the local filesystem, and true if it is
+// within a mounted version.
+func (m *mountsFS) resolve(name string) (string, bool) {
+	name = filepath.Clean(name)
+	for dst, src := range m.mounts {
+		if name == dst {
+			return src, true
+		}
+		if strings.HasPrefix(name, dst+string(filepath.Separator)) {
+			return filepath.Join(src, strings.TrimPrefix(name, dst)), true
+		}
+	}
+	return name, false
+}
+
+// readOnly returns an error if name is within a mounted version.
+func (m *mountsFS) readOnly(op, name string) error {
+	if _, ok := m.resolve(name); ok {
+		return &os.PathError{Op: op, Path: name, Err: fmt.Errorf("versions are mounted rather than copied with --copy-mode=mount, and cannot be modified")}
+	}
+	return nil
+}
+
+func (m *mountsFS) Open(name string) (io.ReadCloser, error) {
+	p, _ := m.resolve(name)
+	return os.Open(p)
+}
+
+func (m *mountsFS) ReadFile(name string) ([]byte, error) {
+	p, _ := m.resolve(name)
+	return ioutil.ReadFile(p)
+}
+
+func (m *mountsFS) Stat(name string) (os.FileInfo, error) {
+	p, _ := m.resolve(name)
+	return os.Stat(p)
+}
+
+func (m *mountsFS) ReadDir(name string) ([]os.FileInfo, error) {
+	p, _ := m.resolve(name)
+	return ioutil.ReadDir(p)
+}
+
+func (m *mountsFS) Walk(root string, fn filepath.WalkFunc) error {
+	p, ok := m.resolve(root)
+	if !ok {
+		return filepath.Walk(root, fn)
+	}
+	// report paths within the output directory rather than the sources
+	return filepath.Walk(p, func(fp string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(p, fp)
+		if relErr != nil {
+			return relErr
+		}
+		return fn(filepath.Join(root, rel), info, err)
+	})
+}
+
+func (m *mountsFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if err := m.readOnly("open", name); err != nil {
+		return nil, err
+	}
+	return m.localFS.Create(name, perm)
+}
+
+func (m *mountsFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := m.readOnly("open", name); err != nil {
+		return err
+	}
+	return m.localFS.WriteFile(name, data, perm)
+}
+
+func (m *mountsFS) MkdirAll(name string, perm os.FileMode) error {
+	if err := m.readOnly("mkdir", name); err != nil {
+		return err
+	}
+	return m.localFS.MkdirAll(name, perm)
+}
+
+func (m *mountsFS) Rename(oldname, newname string) error {
+	if err := m.readOnly("rename", oldname); err != nil {
+		return err
+	}
+	if err := m.readOnly("rename", newname); err != nil {
+		return err
+	}
+	return m.localFS.Rename(oldname, newname)
+}
+
+func (m *mountsFS) Remove(name string) error {
+	if err := m.readOnly("remove", name); err != nil {
+		return err
+	}
+	return m.localFS.Remove(name)
+}
+
+func (m *mountsFS) RemoveAll(name string) error {
+	if err := m.readOnly("remove", name); err != nil {
+		return err
+	}
+	return m.localFS.RemoveAll(name)
+}
+
+func (m *mountsFS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := m.readOnly("chtimes", name); err != nil {
+		return err
+	}
+	return m.localFS.Chtimes(name, atime, mtime)
+}
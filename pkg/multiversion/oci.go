@@ -0,0 +1,138 @@
+package multiversion
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// ociArtifactType is the artifact type of the OCI artifact of a version.
+	ociArtifactType = "application/vnd.hugo-multiversion.version.v1"
+	// ociContentMediaType is the media type of the layer containing the
+	// files of a version, as a gzipped tar archive.
+	ociContentMediaType = "application/vnd.hugo-multiversion.version.content.v1.tar+gzip"
+)
+
+// ociTagInvalidRE matches the characters that are not allowed in OCI tags.
+var ociTagInvalidRE = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// validateOCI returns an error if --oci-repo cannot be used with the other
+// flags.
+func (st *state) validateOCI() error {
+	if st.opts.OCI.Repo == "" {
+		return nil
+	}
+	switch {
+	case strings.Contains(st.opts.OCI.Repo, "@") || strings.Contains(st.opts.OCI.Repo[strings.LastIndex(st.opts.OCI.Repo, "/")+1:], ":"):
+		return fmt.Errorf("must be a repository without a tag or digest, as each version is pushed with its own tag")
+	case st.opts.Watch.Enabled:
+		return fmt.Errorf("cannot be used with --watch")
+	case st.opts.Hugo.Run && st.isHugoServer():
+		return fmt.Errorf("cannot be used when running a Hugo server")
+	case st.opts.Output.Archive != "":
+		return fmt.Errorf("cannot be used with --output, as content is not written to disk")
+	case st.opts.OCI.Dir == "" && !st.opts.Hugo.Run && (st.opts.Output.CopyMode == copyModeSymlink || st.opts.Output.CopyMode == copyModeMount):
+		return fmt.Errorf("cannot package the output directory with --copy-mode=%s, as versions are not copied into it", st.opts.Output.CopyMode)
+	}
+	return nil
+}
+
+// ociSourceDir returns the directory the versions are packaged from, chosen
+// as for container images, and whether versions are found in it at their
+// URL, as in Hugo's rendered site, rather than at their directory in the
+// output directory.
+func (st *state) ociSourceDir() (string, bool) {
+	switch {
+	case st.opts.OCI.Dir != "":
+		return st.opts.OCI.Dir, st.opts.Hugo.Run
+	case st.opts.Hugo.Run:
+		return filepath.Join(st.opts.Hugo.SiteRoot, "public"), true
+	}
+	return st.opts.Output.Dir, false
+}
+
+// ociTags returns the tags the artifact of the version is pushed with: the
+// version name followed by its aliases, with characters that are not allowed
+// in tags replaced with dashes.
+func (st *state) ociTags(version string) []string {
+	tags := []string{version}
+	tags = append(tags, st.opts.versionConfig(version).Aliases...)
+	for i, t := range tags {
+		t = ociTagInvalidRE.ReplaceAllString(t, "-")
+		if strings.HasPrefix(t, ".") || strings.HasPrefix(t, "-") {
+			t = "_" + t[1:]
+		}
+		if len(t) > 128 {
+			t = t[:128]
+		}
+		tags[i] = t
+	}
+	return tags
+}
+
+// pushOCIArtifacts packages each of the versions as a gzipped tar archive and
+// pushes it to --oci-repo as an OCI artifact tagged with the version name and
+// its aliases, using oras. Credentials for the registry are read from the
+// Docker config file. The versions nested beneath the root version are left
+// out of its artifact.
+func (st *state) pushOCIArtifacts(log logr.Logger, versions []string) error {
+	dir, rendered := st.ociSourceDir()
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	for _, vers := range versions {
+		rel := st.versionPath(vers)
+		if rendered {
+			rel = strings.Trim(st.versionURL(vers), "/")
+		}
+		var skip map[string]bool
+		if st.versionPath(vers) == "" {
+			skip = st.nestedVersionDirs()
+		}
+		tags := st.ociTags(vers)
+		ref := st.opts.OCI.Repo + ":" + strings.Join(tags, ",")
+		log := log.WithValues("version", vers, "ref", ref)
+		src := filepath.Join(dir, filepath.FromSlash(rel))
+		if _, err := st.output.Stat(src); os.IsNotExist(err) {
+			log.Info("WARNING: version was not found in the packaged directory, skipping its artifact", "path", src)
+			continue
+		}
+
+		name := tags[0] + ".tar.gz"
+		f, err := os.Create(filepath.Join(tmpdir, name))
+		if err != nil {
+			return err
+		}
+		gw := gzip.NewWriter(f)
+		err = st.writeTar(gw, src, "", skip)
+		if err == nil {
+			err = gw.Close()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("packaging version %q: %v", vers, err)
+		}
+
+		log.Info("Pushing OCI artifact")
+		// the file is pushed by its name relative to tmpdir, which oras
+		// records as the title of the layer
+		if _, err := st.commandOutput(log, tmpdir, st.opts.OCI.ORASBin, "push", ref,
+			"--artifact-type", ociArtifactType,
+			"--annotation", "org.opencontainers.image.version="+vers,
+			name+":"+ociContentMediaType); err != nil {
+			return fmt.Errorf("pushing version %q to %q: %v", vers, st.opts.OCI.Repo, err)
+		}
+	}
+	return nil
+}
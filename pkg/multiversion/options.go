@@ -0,0 +1,721 @@
+package multiversion
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Config contains all of the options used by a Builder. Each option
+// corresponds to a command line flag of the hugo-multiversion tool, named in
+// its comment. The per-version options are read from the config file passed
+// with --config by LoadConfigFile.
+type Config struct {
+	// Log receives all log output. If nil, output is logged with klog.
+	Log logr.Logger `yaml:"-"`
+	// Debug keeps the temporary directory used for building the output and
+	// prints the output of commands (--debug).
+	Debug bool `yaml:"-"`
+	// InjectFailures are simulated failures injected whilst building, of the
+	// form point or point=version, for testing how pipelines handle failed
+	// builds (--inject-failure).
+	InjectFailures []string `yaml:"-"`
+
+	Fetch      FetchOptions      `yaml:"-"`
+	Transform  TransformOptions  `yaml:"-"`
+	Output     OutputOptions     `yaml:"-"`
+	Checks     CheckOptions      `yaml:"-"`
+	Jobs       JobOptions        `yaml:"-"`
+	Languages  LanguageOptions   `yaml:"-"`
+	Watch      WatchOptions      `yaml:"-"`
+	Hugo       HugoOptions       `yaml:"-"`
+	Image      ImageOptions      `yaml:"-"`
+	Archives   ArchiveOptions    `yaml:"-"`
+	OCI        OCIOptions        `yaml:"-"`
+	Bucket     BucketOptions     `yaml:"-"`
+	Pages      PagesOptions      `yaml:"-"`
+	Preview    PreviewOptions    `yaml:"-"`
+	Backport   BackportOptions   `yaml:"-"`
+	Divergence DivergenceOptions `yaml:"-"`
+	Review     ReviewOptions     `yaml:"-"`
+	Audit      AuditOptions      `yaml:"-"`
+	Snapshot   SnapshotOptions   `yaml:"-"`
+	Tracing    TracingOptions    `yaml:"-"`
+	Search     SearchOptions     `yaml:"-"`
+	Import     ImportOptions     `yaml:"-"`
+	Diff       DiffOptions       `yaml:"-"`
+
+	// Versions is a map of version name to the options for that version.
+	// Versions listed here are built in addition to those passed with
+	// --branches and --latest-branch.
+	Versions map[string]*VersionConfig `yaml:"versions"`
+
+	// Roots are the directories of the repository copied for each version,
+	// in order, overridden by the roots of each version. If unset,
+	// --repo-content-dir is copied to the version's directory.
+	Roots []Root `yaml:"roots"`
+
+	// Downloads are pages generated in each version from files in the
+	// repository, overridden by the downloads of each version.
+	Downloads []Download `yaml:"downloads"`
+
+	// CDN configures the CDNs whose caches are invalidated for the pages
+	// that changed once the site has been deployed.
+	CDN *CDNConfig `yaml:"cdn"`
+
+	// PinnedURLs are URL templates whose links in the content of each
+	// version are pinned to the ref the version was built from.
+	PinnedURLs []PinnedURL `yaml:"pinnedURLs"`
+
+	// Transforms are the names of the transforms applied to the pages of
+	// each version, in order. If unset, the enabled built-in transforms are
+	// applied followed by Transform.Transformers in name order.
+	Transforms []string `yaml:"transforms"`
+
+	// Hooks are commands run for each version whilst it is built.
+	Hooks *Hooks `yaml:"hooks"`
+
+	// Remotes are repositories in the fork network of --repo-url that
+	// versions may be fetched from, keyed by name.
+	Remotes map[string]*Remote `yaml:"remotes"`
+
+	// SupportPolicy contains rules used to determine which versions have
+	// reached their end of life.
+	SupportPolicy *SupportPolicy `yaml:"supportPolicy"`
+
+	// SEOPolicy is the search engine policy of every version, overridden
+	// by the seoPolicy of each version.
+	SEOPolicy *SEOPolicy `yaml:"seoPolicy"`
+
+	// VersionReferences configures the 'version-references' checker.
+	VersionReferences *VersionReferencesConfig `yaml:"versionReferences"`
+
+	// Redirects are written to the redirects file alongside those computed
+	// from the versions, e.g. from the URLs of a site migrated from another
+	// tool.
+	Redirects []Redirect `yaml:"redirects"`
+}
+
+// FetchOptions control where the content of each version is fetched from.
+type FetchOptions struct {
+	// RepoURL is the URL of the git repository containing the content
+	// (--repo-url).
+	RepoURL string
+	// RepoContentDir is the path to the content directory in the repository,
+	// which must be the same on all branches (--repo-content-dir).
+	RepoContentDir string
+	// LatestBranch is the branch the 'latest' version is fetched from, if set
+	// (--latest-branch).
+	LatestBranch string
+	// Branches are version=branch pairs of the versions to build
+	// (--branches).
+	Branches []string
+	// MaxVersions builds only the newest versions, including 'latest', if
+	// greater than zero (--max-versions).
+	MaxVersions int
+	// MinVersion excludes versions older than this version number from the
+	// build, if set (--min-version).
+	MinVersion string
+	// PreviewBranch is a branch, such as that of a pull request, built as a
+	// hidden version beneath the 'preview' directory alongside the other
+	// versions, if set (--preview-branch).
+	PreviewBranch string
+	// PreviewName is the name of the directory beneath 'preview' that
+	// PreviewBranch is built into. Defaults to 'pr-<number>' for pull and
+	// merge request refs, and otherwise to the branch name (--preview-name).
+	PreviewName string
+	// Discover is the API of the forge hosting RepoURL that versions are
+	// discovered from, in addition to the configured versions. One of
+	// 'github' or 'gitlab' (--discover).
+	Discover string
+	// DiscoverRefs are the kinds of ref discovered, any of 'branches',
+	// 'tags' and 'releases' (--discover-refs).
+	DiscoverRefs []string
+	// DiscoverPattern is a regular expression the names of discovered refs
+	// must match. If it contains a capture group, the version is named after
+	// the first group rather than the ref (--discover-pattern).
+	DiscoverPattern string
+	// DiscoverAPIURL is the base URL of the forge's API, for self-hosted
+	// instances that do not serve it from the default location
+	// (--discover-api-url).
+	DiscoverAPIURL string
+	// FetchConcurrency is the number of versions fetched in parallel, ahead
+	// of being copied into the output directory one at a time
+	// (--fetch-concurrency).
+	FetchConcurrency int
+	// CacheDir caches fetched sources between runs, if set (--cache-dir).
+	CacheDir string
+	// RecordDir records all inputs to the build so that it can be replayed
+	// (--record).
+	RecordDir string
+	// ReplayDir re-executes a build recorded with RecordDir, without
+	// fetching any sources (--replay).
+	ReplayDir string
+	// Fetcher is the name of the fetcher used for versions that do not set
+	// one in the config file (--fetcher).
+	Fetcher string
+	// Fetchers override the fetcher used for each version, keyed by version
+	// name.
+	Fetchers map[string]Fetcher
+	// AsOf builds each version from the last commit to its branch before
+	// this date, if set (--as-of).
+	AsOf string
+	// VersionMetadataFile is the path to a YAML file in each branch
+	// containing metadata about the version (--version-metadata-file).
+	VersionMetadataFile string
+	// GlossaryFiles are the paths to YAML files in each branch mapping
+	// terms to their definitions (--glossary-files).
+	GlossaryFiles []string
+}
+
+// TransformOptions control the transforms applied to the pages of each
+// version.
+type TransformOptions struct {
+	// URLPrefix is the URL path the output directory is served from
+	// (--url-prefix).
+	URLPrefix string
+	// ParamNamespace is the front matter key injected params are nested
+	// under. If empty, params are set at the top level (--param-namespace).
+	ParamNamespace string
+	// FlatParams also sets injected params at the top level of the front
+	// matter (--flat-params).
+	FlatParams bool
+	// OutdatedCascade writes a cascade marking pages as outdated into the
+	// _index page of each non-latest version (--outdated-cascade).
+	OutdatedCascade bool
+	// NonLatestOutputs are the Hugo output formats the pages of versions
+	// other than 'latest' are rendered in, if set (--non-latest-outputs).
+	NonLatestOutputs []string
+	// RelatedIsolation injects a 'version' param into every page, so that
+	// related content can be limited to the same version
+	// (--related-isolation).
+	RelatedIsolation bool
+	// NonLatestList is the '_build.list' option of the pages of versions
+	// other than 'latest', if set (--non-latest-list).
+	NonLatestList string
+	// CanonicalLatest points the 'canonical' param of pages in older
+	// versions at the latest version of the page, unless their seoPolicy
+	// sets another canonical version (--canonical-latest).
+	CanonicalLatest bool
+	// RemovedPageAliases adds pages removed or moved between adjacent
+	// versions to the aliases of their replacement (--removed-page-aliases).
+	RemovedPageAliases bool
+	// RewriteLinks rewrites absolute links within a version to include the
+	// version's path (--rewrite-links).
+	RewriteLinks bool
+	// RewriteRefs rewrites the targets of 'ref' and 'relref' shortcodes to
+	// resolve within the same version (--rewrite-refs).
+	RewriteRefs bool
+	// ExcludeDrafts skips draft pages (--exclude-drafts).
+	ExcludeDrafts bool
+	// ExcludeExpired skips pages whose expiry date has passed
+	// (--exclude-expired).
+	ExcludeExpired bool
+	// EditURLs injects an 'edit_url' param into every page (--edit-urls).
+	EditURLs bool
+	// EditURLTemplate is the template used to generate 'edit_url' params,
+	// and implies EditURLs (--edit-url-template).
+	EditURLTemplate string
+	// GitDates sets the 'lastmod' and 'date' of pages from git history
+	// (--git-dates).
+	GitDates bool
+	// GitContributors injects a 'contributors' param into every page
+	// (--git-contributors).
+	GitContributors bool
+	// PreserveMtimes sets the modification time of copied files from git
+	// history (--preserve-mtimes).
+	PreserveMtimes bool
+	// SitemapHints cascades Hugo's 'sitemap' front matter to the pages of
+	// each version, from the _index page at its root (--sitemap-hints).
+	SitemapHints bool
+	// SearchIndex writes a search index of the pages of each version to
+	// Output.SearchIndexDir (--search-index).
+	SearchIndex bool
+	// Transformers are additional transforms applied to the pages of each
+	// version, keyed by the name used to order them in 'transforms'.
+	Transformers map[string]Transformer
+}
+
+// OutputOptions control where and how the output is written.
+type OutputOptions struct {
+	// Dir is the output content directory (--output-dir).
+	Dir string
+	// CopyMode is how files are placed into the output directory
+	// (--copy-mode).
+	CopyMode string
+	// CopyConcurrency is the number of files copied in parallel
+	// (--copy-concurrency).
+	CopyConcurrency int
+	// NormalizeFilenames converts the names of copied files to the unicode
+	// normalization form 'nfc' or 'nfd', if set (--normalize-filenames).
+	NormalizeFilenames string
+	// MaxPathLength is the length, in bytes, of the longest path within the
+	// output directory that is not reported as too long, or 0 to not
+	// report long paths (--max-path-length).
+	MaxPathLength int
+	// DeltaSync only writes files that have changed to the output directory
+	// (--delta-sync).
+	DeltaSync bool
+	// DataDir is the directory data files are written to, if set
+	// (--data-dir).
+	DataDir string
+	// Compat is the output version the pages and other files of each
+	// version are written in, so that upgrading the tool does not change
+	// the output for unchanged inputs (--output-compat).
+	Compat int
+	// DataFormatVersion is the format version of the data files
+	// (--data-format-version).
+	DataFormatVersion int
+	// RedirectsFormat is the format of the redirects file, if one is
+	// written (--redirects-format).
+	RedirectsFormat string
+	// RedirectsFile is the path of the redirects file (--redirects-file).
+	RedirectsFile string
+	// RedirectEOL redirects the pages of EOL versions to the latest version
+	// in the redirects file (--redirect-eol).
+	RedirectEOL bool
+	// ArchivedVersionsURL is the URL the versions excluded by MaxVersions
+	// and MinVersion are linked to from the versions data file, with
+	// '{version}' replaced by the version name. Excluded versions are not
+	// listed if it is empty (--archived-versions-url).
+	ArchivedVersionsURL string
+	// RootVersion is the version written directly to the output directory
+	// and served from the root of the site, rather than from a directory
+	// named after the version, if set (--root-version).
+	RootVersion string
+	// VersionAliasStrategy is how versions are made reachable at the URLs
+	// of their aliases. One of 'aliases', 'redirect' or 'copy'
+	// (--version-alias-strategy).
+	VersionAliasStrategy string
+	// InstallThemeDir is the directory the theme component is written to,
+	// if set (--install-theme-dir).
+	InstallThemeDir string
+	// DedupeMode deduplicates identical assets across versions, if set
+	// (--dedupe-assets).
+	DedupeMode string
+	// SharedAssetsDir is the directory shared assets are moved into
+	// (--shared-assets-dir).
+	SharedAssetsDir string
+	// SharedAssetsURL is the URL SharedAssetsDir is served from
+	// (--shared-assets-url).
+	SharedAssetsURL string
+	// SearchIndexDir is the directory the search index of each version is
+	// written to with Transform.SearchIndex (--search-index-dir).
+	SearchIndexDir string
+	// SitemapDir is the directory a sitemap of each version and a sitemap
+	// index are written to, if set (--sitemap-dir).
+	SitemapDir string
+	// SitemapURL is the URL SitemapDir is served from (--sitemap-url).
+	SitemapURL string
+	// RobotsFile is the robots.txt file a section disallowing crawling of
+	// deprecated and hidden versions is written to, if set (--robots-file).
+	RobotsFile string
+	// BaseURL is the absolute URL the site is served from, used in sitemaps
+	// and robots.txt (--base-url).
+	BaseURL string
+	// VersionsFormat is the format the versions are exported in to
+	// VersionsFile, one of 'mike', 'docusaurus' or 'template', if set
+	// (--versions-format).
+	VersionsFormat string
+	// VersionsFile is the path the versions are exported to
+	// (--versions-file).
+	VersionsFile string
+	// VersionsTemplate is the Go template rendered with the versions data
+	// file when VersionsFormat is 'template' (--versions-template).
+	VersionsTemplate string
+	// RTDAPIDir is the directory a static API describing the versions is
+	// written to for flyout menus written for Read the Docs, if set
+	// (--rtd-api-dir).
+	RTDAPIDir string
+	// DocsyVersionsFile is a TOML config file the built versions are written
+	// to as the 'versions' param read by the Docsy theme, if set
+	// (--docsy-versions-file).
+	DocsyVersionsFile string
+	// MountsFile is the file Hugo module mounts are written to with the
+	// 'mount' copy mode (--mounts-file).
+	MountsFile string
+	// Format is the format the output is written in, one of 'directory' or
+	// 'archive' to also write an archive of each version (--output-format).
+	Format string
+	// Archive streams the output directory as a tar archive to stdout if set
+	// to '-' (--output).
+	Archive string
+	// ExtraDirs are source=destination pairs of directories outside the
+	// content directory copied for each version (--extra-dirs).
+	ExtraDirs []string
+	// BuildReport is the path a JSON report describing the build of each
+	// version is written to, if set (--build-report).
+	BuildReport string
+	// AuditLog is the path of a JSON Lines file every change made to the
+	// output directory is appended to, if set (--audit-log).
+	AuditLog string
+	// KeepBuilds is the number of successful builds whose output is kept in
+	// BuildsDir, to be restored by the rollback command (--keep-builds).
+	KeepBuilds int
+	// BuildsDir is the directory builds are kept in (--builds-dir).
+	BuildsDir string
+	// StoreDir is a content-addressed store the files of the output
+	// directory are hard linked to, if set (--store-dir).
+	StoreDir string
+	// DuplicatesReport is the path a JSON report of the pages with identical
+	// content across versions is written to, if set (--duplicates-report).
+	DuplicatesReport string
+}
+
+// CheckOptions control the checks run against the built content.
+type CheckOptions struct {
+	// Enabled lists the checks to run (--checks).
+	Enabled []string
+	// Concurrency is the number of files checked in parallel
+	// (--check-concurrency).
+	Concurrency int
+	// Strict fails the build if any check reports a problem
+	// (--strict-checks).
+	Strict bool
+}
+
+// JobOptions control building versions across separate jobs.
+type JobOptions struct {
+	// OnlyVersions builds only the listed versions, skipping the steps that
+	// depend on every version (--only-versions).
+	OnlyVersions []string
+	// FinalizeOnly only runs the steps that depend on every version
+	// (--finalize-only).
+	FinalizeOnly bool
+	// ManifestDir is the directory version manifests are written to and
+	// read from (--manifest-dir).
+	ManifestDir string
+	// KeepGoing continues building the remaining versions when a version
+	// fails, and publishes the site without the failed versions
+	// (--keep-going).
+	KeepGoing bool
+}
+
+// LanguageOptions control building each version for multiple languages.
+type LanguageOptions struct {
+	// Languages to build each version for (--languages).
+	Languages []string
+	// Default is the language served without a language prefix
+	// (--default-language).
+	Default string
+	// MatrixReport is the path a report of the languages built for each
+	// version is written to, if set (--matrix-report).
+	MatrixReport string
+}
+
+// WatchOptions control rebuilding versions as their branches change.
+type WatchOptions struct {
+	// Enabled keeps running after the initial build and rebuilds versions
+	// whenever their branch changes (--watch).
+	Enabled bool
+	// PollInterval is how often branches are polled (--poll-interval).
+	PollInterval time.Duration
+	// MetricsListenAddr is the address metrics and health checks are served
+	// on, if set (--metrics-listen).
+	MetricsListenAddr string
+}
+
+// HugoOptions control running Hugo once content has been assembled.
+type HugoOptions struct {
+	// Run runs Hugo in SiteRoot once content has been assembled
+	// (--run-hugo).
+	Run bool
+	// Args are the arguments passed to Hugo.
+	Args []string
+	// Bin is the path to the Hugo binary (--hugo-bin).
+	Bin string
+	// SiteRoot is the root directory of the Hugo site (--site-root).
+	SiteRoot string
+	// ContentDir is the Hugo site's content directory, which must contain
+	// the output directory (--hugo-content-dir).
+	ContentDir string
+}
+
+// ArchiveOptions control writing an archive of each version with
+// --output-format=archive.
+type ArchiveOptions struct {
+	// Dir is the directory the archives are written to (--archive-dir).
+	Dir string
+	// SourceDir is the directory the versions are archived from
+	// (--archive-source-dir).
+	SourceDir string
+	// Type is the type of the archives, one of 'tar.gz' or 'zip'
+	// (--archive-type).
+	Type string
+}
+
+// OCIOptions control pushing each version to a registry as an OCI artifact.
+type OCIOptions struct {
+	// Repo is the repository the artifacts are pushed to, tagged with the
+	// name of each version, if set (--oci-repo).
+	Repo string
+	// Dir is the directory the versions are packaged from (--oci-dir).
+	Dir string
+	// ORASBin is the path to the oras binary (--oras-bin).
+	ORASBin string
+}
+
+// ImageOptions control packaging the site into a container image.
+type ImageOptions struct {
+	// Ref is the reference the image is pushed to, if set (--image).
+	Ref string
+	// Base is the base image the site is added to (--image-base).
+	Base string
+	// Path is the directory in the image the site is placed at
+	// (--image-path).
+	Path string
+	// Dir is the directory packaged into the image (--image-dir).
+	Dir string
+	// CraneBin is the path to the crane binary (--crane-bin).
+	CraneBin string
+}
+
+// BucketOptions control uploading the assembled site to an object storage
+// bucket.
+type BucketOptions struct {
+	// URL is the URL of the bucket, and optionally a prefix within it, the
+	// site is uploaded to, if set (--bucket).
+	URL string
+	// Dir is the directory uploaded to the bucket (--bucket-dir).
+	Dir string
+	// Delete removes objects that are not in Dir from the bucket
+	// (--bucket-delete).
+	Delete bool
+	// AWSBin is the path to the aws binary used to upload to S3
+	// (--aws-bin).
+	AWSBin string
+	// GCloudBin is the path to the gcloud binary used to upload to Google
+	// Cloud Storage (--gcloud-bin).
+	GCloudBin string
+	// AzCopyBin is the path to the azcopy binary used to upload to Azure
+	// Blob Storage (--azcopy-bin).
+	AzCopyBin string
+}
+
+// PagesOptions control committing the assembled site to a branch of
+// a git repository, as served by GitHub Pages.
+type PagesOptions struct {
+	// Branch is the branch the site is committed to, if set
+	// (--publish-branch).
+	Branch string
+	// Repo is the URL of the repository, or the name of one of Remotes,
+	// the branch is pushed to. Defaults to Fetch.RepoURL (--publish-repo).
+	Repo string
+	// Dir is the directory committed to the branch (--publish-dir).
+	Dir string
+	// Message is the commit message (--publish-message).
+	Message string
+	// Author is the author and committer of the commit, of the form
+	// 'Name <email>' (--publish-author).
+	Author string
+	// Strategy is how the branch is updated, 'fast-forward' or 'force'
+	// (--publish-strategy).
+	Strategy string
+}
+
+// PreviewOptions control the preview command.
+type PreviewOptions struct {
+	// SiteDir is the directory containing the site built by Hugo
+	// (--site-dir).
+	SiteDir string
+	// ListenAddr is the address the preview server listens on (--listen).
+	ListenAddr string
+	// Overlay injects a version switch overlay into every HTML page
+	// (--preview-overlay).
+	Overlay bool
+}
+
+// BackportOptions control the backport command.
+type BackportOptions struct {
+	// Versions are the versions commits are applied to (--to-versions).
+	Versions []string
+	// Push pushes a branch for each version the commits apply cleanly to
+	// (--push).
+	Push bool
+	// CreatePRs also opens a pull request for each pushed branch
+	// (--create-prs).
+	CreatePRs bool
+}
+
+// DivergenceOptions control the divergence command.
+type DivergenceOptions struct {
+	// DefaultBranch is the branch the latest version's branch is compared
+	// with (--default-branch).
+	DefaultBranch string
+	// ReportFile is the path a JSON report is written to, if set
+	// (--divergence-report).
+	ReportFile string
+}
+
+// ReviewOptions control generating review routing data.
+type ReviewOptions struct {
+	// RoutingFile is the path review routing data is written to, if set
+	// (--review-routing-file).
+	RoutingFile string
+	// Base is the commit, ref or branch pages are compared with
+	// (--review-base).
+	Base string
+}
+
+// AuditOptions control the audit command.
+type AuditOptions struct {
+	// Deployed is the URL or directory of the deployed site (--deployed).
+	Deployed string
+	// Concurrency is the number of deployed pages fetched in parallel
+	// (--audit-concurrency).
+	Concurrency int
+	// ReportFile is the path a JSON report is written to, if set
+	// (--audit-report).
+	ReportFile string
+}
+
+// SnapshotOptions control the snapshot command.
+type SnapshotOptions struct {
+	// TagTemplate is the name of the tag created for each version, supporting
+	// the {version} and {date} placeholders (--snapshot-tag).
+	TagTemplate string
+}
+
+// TracingOptions control the export of trace spans for the phases of a
+// build.
+type TracingOptions struct {
+	// OTLPEndpoint is the URL of an OTLP/HTTP collector that trace spans are
+	// exported to. Defaults to the OTEL_EXPORTER_OTLP_ENDPOINT environment
+	// variable, and tracing is disabled if neither is set (--otlp-endpoint).
+	OTLPEndpoint string
+	// OTLPHeaders are key=value headers sent with exported spans, e.g. to
+	// authenticate. Defaults to OTEL_EXPORTER_OTLP_HEADERS (--otlp-headers).
+	OTLPHeaders []string
+	// ServiceName is the service name spans are exported with. Defaults to
+	// OTEL_SERVICE_NAME, or otherwise 'hugo-multiversion'
+	// (--otlp-service-name).
+	ServiceName string
+}
+
+// ImportOptions control the import command.
+type ImportOptions struct {
+	// BaselineFile is the path the baseline manifest of the imported tree is
+	// written to. Defaults to the path of the generated config file with a
+	// '-baseline.json' suffix in place of its extension (--import-baseline).
+	BaselineFile string
+	// Verify builds each inferred version into a temporary directory and
+	// compares it with the imported tree (--import-verify).
+	Verify bool
+	// From is the tool that rendered the imported tree, 'mike' or
+	// 'sphinx-multiversion', if it was not built by hand (--import-from).
+	From string
+}
+
+// DiffOptions control the diff command.
+type DiffOptions struct {
+	// Threshold is the proportion of the lines of a page, between 0 and 1,
+	// that must be added or removed for it to be listed as changed
+	// (--diff-threshold).
+	Threshold float64
+	// ReportFile is the path a JSON report is written to, if set
+	// (--diff-report).
+	ReportFile string
+	// Page is the path a Markdown page listing the differences is written
+	// to, if set, e.g. within the Hugo content directory so that it is
+	// rendered into the site (--diff-page).
+	Page string
+}
+
+// SearchOptions control pushing the search index of each version to Algolia.
+// The Algolia application ID and an API key with write access are read from
+// the ALGOLIA_APP_ID and ALGOLIA_API_KEY environment variables.
+type SearchOptions struct {
+	// AlgoliaIndex is the name of the Algolia index the pages of each built
+	// version are pushed to, which also enables Transform.SearchIndex
+	// (--algolia-index).
+	AlgoliaIndex string
+	// AlgoliaURL overrides the URL of the Algolia API, which defaults to
+	// https://$ALGOLIA_APP_ID.algolia.net (--algolia-url).
+	AlgoliaURL string
+	// Prune deletes the records of versions that are no longer built from
+	// the index (--search-prune).
+	Prune bool
+}
+
+// DefaultConfig returns a Config with the defaults of the command line
+// flags.
+func DefaultConfig() Config {
+	return Config{
+		Fetch: FetchOptions{
+			RepoContentDir:   "content",
+			Fetcher:          fetcherGit,
+			FetchConcurrency: 1,
+			DiscoverRefs:     []string{discoverBranches},
+		},
+		Transform: TransformOptions{
+			URLPrefix:      "/",
+			ParamNamespace: "multiversion",
+		},
+		Output: OutputOptions{
+			Dir:                  "content",
+			CopyMode:             copyModeCopy,
+			CopyConcurrency:      runtime.NumCPU(),
+			MaxPathLength:        windowsMaxPath,
+			DataFormatVersion:    currentDataFormatVersion,
+			Compat:               currentOutputVersion,
+			Format:               outputFormatDirectory,
+			SharedAssetsDir:      "static/_shared",
+			SearchIndexDir:       "static/search",
+			SitemapURL:           "/sitemaps/",
+			SharedAssetsURL:      "/_shared/",
+			MountsFile:           "config/_default/module.toml",
+			VersionAliasStrategy: aliasStrategyAliases,
+		},
+		Checks: CheckOptions{
+			Concurrency: runtime.NumCPU(),
+		},
+		Watch: WatchOptions{
+			PollInterval: 2 * time.Minute,
+		},
+		Hugo: HugoOptions{
+			Bin:        "hugo",
+			SiteRoot:   ".",
+			ContentDir: "content",
+		},
+		Image: ImageOptions{
+			Base:     "nginx:alpine",
+			Path:     "/usr/share/nginx/html",
+			CraneBin: "crane",
+		},
+		Archives: ArchiveOptions{
+			Dir:  "archives",
+			Type: archiveTypeTarGz,
+		},
+		OCI: OCIOptions{
+			ORASBin: "oras",
+		},
+		Pages: PagesOptions{
+			Message:  "Publish documentation",
+			Author:   "hugo-multiversion <hugo-multiversion@users.noreply.github.com>",
+			Strategy: publishFastForward,
+		},
+		Bucket: BucketOptions{
+			AWSBin:    "aws",
+			GCloudBin: "gcloud",
+			AzCopyBin: "azcopy",
+		},
+		Preview: PreviewOptions{
+			SiteDir:    "public",
+			ListenAddr: "localhost:8080",
+			Overlay:    true,
+		},
+		Audit: AuditOptions{
+			Concurrency: 8,
+		},
+		Snapshot: SnapshotOptions{
+			TagTemplate: "docs-published/{version}/{date}",
+		},
+		Import: ImportOptions{
+			Verify: true,
+		},
+		Diff: DiffOptions{
+			Threshold: 0.2,
+		},
+	}
+}
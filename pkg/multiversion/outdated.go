@@ -0,0 +1,86 @@
+package multiversion
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// latestVersion is the name of the version built from --latest-branch.
+const latestVersion = "latest"
+
+// versionURL returns the URL path that the root of the named version is
+// served from.
+func (st *state) versionURL(version string) string {
+	u := path.Join("/", st.opts.Transform.URLPrefix, st.versionPath(version))
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	return u
+}
+
+// isOutdated returns true if the named version should be marked as outdated.
+func isOutdated(version string, vc *VersionConfig) bool {
+	if vc.Outdated != nil {
+		return *vc.Outdated
+	}
+	return version != latestVersion
+}
+
+// findSectionIndex returns the path to the _index file in dir, or the path a
+// new _index.md file should be written to if one does not exist.
+func (st *state) findSectionIndex(dir string) (string, error) {
+	matches, err := st.globOutput(filepath.Join(dir, "_index.*"))
+	if err != nil {
+		return "", err
+	}
+	for _, m := range matches {
+		if isPage(m) {
+			return m, nil
+		}
+	}
+	return filepath.Join(dir, "_index.md"), nil
+}
+
+// readOrCreateSectionIndex reads the _index page in dir.
+// If the page does not exist, a new page with the given title is returned.
+func (st *state) readOrCreateSectionIndex(dir, title string) (string, *page, error) {
+	indexPath, err := st.findSectionIndex(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	p, err := st.readPage(indexPath)
+	if os.IsNotExist(err) {
+		return indexPath, &page{
+			format:      frontMatterYAML,
+			frontMatter: map[string]interface{}{"title": title},
+		}, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return indexPath, p, nil
+}
+
+// writeOutdatedCascade writes or merges a cascade into the _index page at the
+// root of the version directory dir, marking every page in the version as
+// outdated and linking to the latest version.
+func (st *state) writeOutdatedCascade(log logr.Logger, dir, version string) error {
+	indexPath, p, err := st.readOrCreateSectionIndex(dir, version)
+	if err != nil {
+		return err
+	}
+
+	params := map[string]interface{}{
+		"outdated":   true,
+		"latest_url": st.versionURL(latestVersion),
+	}
+	st.setParams(p.frontMatter, params)
+	st.mergeCascade(p.frontMatter, params)
+
+	log.V(4).Info("Writing outdated cascade", "path", indexPath)
+	return st.writePage(indexPath, p, 0644)
+}
@@ -0,0 +1,453 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputFS is the storage versions are copied into and transformed in.
+// Paths are the paths the files would have on the local filesystem, beneath
+// --output-dir.
+type outputFS interface {
+	Open(name string) (io.ReadCloser, error)
+	ReadFile(name string) ([]byte, error)
+	// Create creates or truncates the named file.
+	Create(name string, perm os.FileMode) (io.WriteCloser, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	// Stat returns information about the named file, following symlinks.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of the named directory, sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Walk walks the tree rooted at root in lexical order, in the same way as
+	// filepath.Walk.
+	Walk(root string, fn filepath.WalkFunc) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// linkFS is implemented by an outputFS that supports links. oldname may be a
+// path on the local filesystem outside of the output.
+type linkFS interface {
+	Link(oldname, newname string) error
+	Symlink(oldname, newname string) error
+}
+
+// localFS is an outputFS backed by the local filesystem.
+type localFS struct{}
+
+func (localFS) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+func (localFS) ReadFile(name string) ([]byte, error)    { return ioutil.ReadFile(name) }
+func (localFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+func (localFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+func (localFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (localFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (localFS) ReadDir(name string) ([]os.FileInfo, error)   { return ioutil.ReadDir(name) }
+func (localFS) Walk(root string, fn filepath.WalkFunc) error { return filepath.Walk(root, fn) }
+func (localFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+func (localFS) Remove(name string) error                     { return os.Remove(name) }
+func (localFS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (localFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+func (localFS) Link(oldname, newname string) error    { return os.Link(oldname, newname) }
+func (localFS) Symlink(oldname, newname string) error { return os.Symlink(oldname, newname) }
+
+// memFS is an outputFS that holds files in memory.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+// memFile is a file or directory in a memFS.
+type memFile struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *memFile) Name() string       { return f.name }
+func (f *memFile) Size() int64        { return int64(len(f.data)) }
+func (f *memFile) Mode() os.FileMode  { return f.mode }
+func (f *memFile) ModTime() time.Time { return f.modTime }
+func (f *memFile) IsDir() bool        { return f.mode.IsDir() }
+func (f *memFile) Sys() interface{}   { return nil }
+
+// newMemFS returns an empty memFS.
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memFile{}}
+}
+
+// memKey returns the key a path is stored under.
+func memKey(name string) string {
+	return filepath.ToSlash(filepath.Clean(name))
+}
+
+// memParent returns the key of the directory containing key.
+func memParent(key string) string {
+	return filepath.ToSlash(filepath.Dir(filepath.FromSlash(key)))
+}
+
+// stat returns a copy of the file stored under key. m.mu must be held.
+func (m *memFS) stat(op, name string) (*memFile, error) {
+	f, ok := m.files[memKey(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	c := *f
+	return &c, nil
+}
+
+// checkParent returns an error if the directory containing name does not
+// exist. m.mu must be held.
+func (m *memFS) checkParent(op, name string) error {
+	parent := memParent(memKey(name))
+	if parent == memKey(name) {
+		return nil
+	}
+	if f, ok := m.files[parent]; !ok || !f.IsDir() {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *memFS) Open(name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	return append([]byte{}, f.data...), nil
+}
+
+// memWriter buffers the content of a file created in a memFS, storing it
+// when closed.
+type memWriter struct {
+	bytes.Buffer
+	fs   *memFS
+	name string
+	perm os.FileMode
+}
+
+func (w *memWriter) Close() error {
+	return w.fs.write(w.name, w.Bytes(), w.perm, true)
+}
+
+func (m *memFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent("open", name); err != nil {
+		return nil, err
+	}
+	return &memWriter{fs: m, name: name, perm: perm}, nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return m.write(name, data, perm, false)
+}
+
+// write stores data as the content of the named file. As with
+// ioutil.WriteFile, the permissions of an existing file are only changed if
+// chmod is true.
+func (m *memFS) write(name string, data []byte, perm os.FileMode, chmod bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkParent("open", name); err != nil {
+		return err
+	}
+	key := memKey(name)
+	if f, ok := m.files[key]; ok {
+		if f.IsDir() {
+			return &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("is a directory")}
+		}
+		if !chmod {
+			perm = f.mode
+		}
+	}
+	m.files[key] = &memFile{name: filepath.Base(name), data: append([]byte{}, data...), mode: perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (m *memFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := memKey(name); ; key = memParent(key) {
+		if f, ok := m.files[key]; ok {
+			if !f.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: name, Err: fmt.Errorf("not a directory")}
+			}
+		} else {
+			m.files[key] = &memFile{name: filepath.Base(filepath.FromSlash(key)), mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+		}
+		if memParent(key) == key {
+			return nil
+		}
+	}
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// children returns the keys of the direct children of the directory stored
+// under key, sorted by name. m.mu must be held.
+func (m *memFS) children(key string) []string {
+	var out []string
+	for k := range m.files {
+		if k != key && memParent(k) == key {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (m *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := m.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !f.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	var infos []os.FileInfo
+	for _, k := range m.children(memKey(name)) {
+		c := *m.files[k]
+		infos = append(infos, &c)
+	}
+	return infos, nil
+}
+
+func (m *memFS) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := m.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = m.walk(root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walk calls fn for path and, if it is a directory, everything beneath it.
+// The lock is not held whilst fn is called, so that fn may modify files.
+func (m *memFS) walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+	infos, err := m.ReadDir(path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, child := range infos {
+		if err := m.walk(filepath.Join(path, child.Name()), child, fn); err != nil {
+			if !child.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldKey, newKey := memKey(oldname), memKey(newname)
+	f, ok := m.files[oldKey]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if err := m.checkParent("rename", newname); err != nil {
+		return err
+	}
+	if existing, ok := m.files[newKey]; ok && existing.IsDir() != f.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	for k, child := range m.files {
+		if k == oldKey || strings.HasPrefix(k, oldKey+"/") {
+			delete(m.files, k)
+			k = newKey + strings.TrimPrefix(k, oldKey)
+			if k == newKey {
+				c := *child
+				c.name = filepath.Base(newname)
+				child = &c
+			}
+			m.files[k] = child
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memKey(name)
+	if _, ok := m.files[key]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(m.children(key)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+	}
+	delete(m.files, key)
+	return nil
+}
+
+func (m *memFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memKey(name)
+	for k := range m.files {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.files, k)
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[memKey(name)]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	f.modTime = mtime
+	return nil
+}
+
+// globOutput returns the paths in the output matching pattern, which may
+// only contain wildcards in its final element.
+func (st *state) globOutput(pattern string) ([]string, error) {
+	dir, base := filepath.Split(pattern)
+	infos, err := st.output.ReadDir(filepath.Clean(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, info := range infos {
+		ok, err := filepath.Match(base, info.Name())
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, filepath.Join(dir, info.Name()))
+		}
+	}
+	return matches, nil
+}
+
+// removeOutputFile removes the named file from the output if it exists.
+// Files are removed before they are written again, as a file hard linked
+// into the output by a previous build would otherwise be truncated through
+// the link, along with its source.
+func (st *state) removeOutputFile(name string) error {
+	if info, err := st.output.Stat(name); err != nil || info.IsDir() {
+		return nil
+	}
+	return st.output.Remove(name)
+}
+
+// copyToOutput copies the file at src on the local filesystem to dst in the
+// output, replacing any file already at dst.
+func (st *state) copyToOutput(src, dst string) error {
+	srcfd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcfd.Close()
+	info, err := srcfd.Stat()
+	if err != nil {
+		return err
+	}
+	if err := st.removeOutputFile(dst); err != nil {
+		return err
+	}
+	dstfd, err := st.output.Create(dst, info.Mode())
+	if err != nil {
+		return err
+	}
+	// the buffer is only used if the OS does not support copying directly
+	// between the files
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	if _, err := io.CopyBuffer(dstfd, srcfd, *buf); err != nil {
+		dstfd.Close()
+		return err
+	}
+	return dstfd.Close()
+}
+
+// copyFromOutput copies the file at src in the output to dst on the local
+// filesystem.
+func (st *state) copyFromOutput(src, dst string) error {
+	info, err := st.output.Stat(src)
+	if err != nil {
+		return err
+	}
+	srcfd, err := st.output.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcfd.Close()
+	dstfd, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstfd.Close()
+	if _, err := io.Copy(dstfd, srcfd); err != nil {
+		return err
+	}
+	if err := dstfd.Chmod(info.Mode()); err != nil {
+		return err
+	}
+	return dstfd.Close()
+}
@@ -0,0 +1,39 @@
+package multiversion
+
+import (
+	"fmt"
+)
+
+// currentOutputVersion identifies the bytes written to the output directory
+// for unchanged inputs. It must be incremented whenever a change alters the
+// content of the pages, cascades or other files written for a version that
+// has not changed, such as the formatting of front matter or a new injected
+// param, and the previous output must remain available via --output-compat so
+// that upgrading does not rewrite every published page. The changes made in
+// each output version are listed in the README.
+const currentOutputVersion = 1
+
+// validateOutputCompat returns an error if --output-compat is not an output
+// version this release can produce.
+func (st *state) validateOutputCompat() error {
+	if st.opts.Output.Compat < 1 || st.opts.Output.Compat > currentOutputVersion {
+		return fmt.Errorf("unsupported output version %d, must be between 1 and %d", st.opts.Output.Compat, currentOutputVersion)
+	}
+	return nil
+}
+
+// checkManifestOutputVersion returns an error if a version's manifest was
+// written with a different output version than this run produces, as the
+// output of versions built by separate jobs or runs would then differ in
+// ways unrelated to their content. Manifests written before output versions
+// were recorded are assumed to use output version 1.
+func (st *state) checkManifestOutputVersion(m versionManifest) error {
+	built := m.OutputVersion
+	if built == 0 {
+		built = 1
+	}
+	if built != st.opts.Output.Compat {
+		return fmt.Errorf("version %q was built with output version %d rather than %d, rebuild it or pass --output-compat=%d", m.Name, built, st.opts.Output.Compat, built)
+	}
+	return nil
+}
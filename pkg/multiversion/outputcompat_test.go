@@ -0,0 +1,150 @@
+package multiversion
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "write the output of the golden tests to testdata/golden, rather than comparing it")
+
+// goldenRepo returns the repository built by TestGoldenOutput.
+func goldenRepo(t *testing.T) string {
+	return newTestRepo(t, map[string]map[string]string{
+		"main": {
+			"content/_index.md":            testPage("Home", "Welcome to the docs."),
+			"content/docs/_index.md":       testPage("Docs", "Read the [install guide](/docs/install/)."),
+			"content/docs/install.md":      testPage("Install", "Run `install.sh`, then [configure](../configure/) it."),
+			"content/docs/configure.md":    "+++\ntitle = \"Configure\"\nweight = 2\n+++\nEdit the config file.\n",
+			"content/docs/diagram.svg":     "<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>\n",
+			"content/docs/bundle/index.md": testPage("Bundle", "A page bundle."),
+		},
+		"release-1.1": {
+			"content/_index.md":         testPage("Home", "Welcome to the v1.1 docs."),
+			"content/docs/_index.md":    testPage("Docs", "Read the [install guide](/docs/install/)."),
+			"content/docs/install.md":   testPage("Install", "Run `install.sh`."),
+			"content/docs/configure.md": "+++\ntitle = \"Configure\"\n+++\nEdit the config file.\n",
+			"content/docs/legacy.md":    testPage("Legacy", "Removed in later versions."),
+		},
+		"release-1.0": {
+			"content/_index.md":       testPage("Home", "Welcome to the v1.0 docs."),
+			"content/docs/install.md": testPage("Install", "Run `setup.sh`."),
+			"content/docs/legacy.md":  testPage("Legacy", "Removed in later versions."),
+		},
+	})
+}
+
+// TestGoldenOutput builds the same site with every output version and
+// compares the files written with those in testdata/golden, so that changes
+// to the bytes written for unchanged inputs are caught. If this test fails
+// because of an intended change to the output, add a new output version
+// rather than updating the golden files of an existing one.
+func TestGoldenOutput(t *testing.T) {
+	repo := goldenRepo(t)
+	for v := 1; v <= currentOutputVersion; v++ {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			dir := t.TempDir()
+			c := testConfig(t, repo, "v1.0=release-1.0", "v1.1=release-1.1")
+			c.Fetch.LatestBranch = "main"
+			c.Output.Compat = v
+			c.Output.Dir = filepath.Join(dir, "content")
+			c.Output.DataDir = filepath.Join(dir, "data")
+			c.Output.RedirectsFormat = "netlify"
+			c.Output.RedirectsFile = filepath.Join(dir, "static", "_redirects")
+			c.Transform.OutdatedCascade = true
+			c.Transform.CanonicalLatest = true
+			c.Transform.RemovedPageAliases = true
+			c.Transform.RewriteLinks = true
+			c.Transform.GitDates = true
+			c.Transform.SitemapHints = true
+			testBuild(t, c)
+
+			golden := filepath.Join("testdata", "golden", fmt.Sprintf("v%d", v))
+			if *updateGolden {
+				if err := os.RemoveAll(golden); err != nil {
+					t.Fatal(err)
+				}
+				if err := copyLocalTree(dir, golden); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			compareTrees(t, golden, dir)
+		})
+	}
+}
+
+// compareTrees reports each file that differs between the want and got
+// directories, or that is only in one of them.
+func compareTrees(t *testing.T, want, got string) {
+	t.Helper()
+	wantFiles, gotFiles := readTree(t, want), readTree(t, got)
+	for rel, data := range wantFiles {
+		gotData, ok := gotFiles[rel]
+		switch {
+		case !ok:
+			t.Errorf("%s: missing from the output", rel)
+		case !bytes.Equal(data, gotData):
+			t.Errorf("%s: got\n%s\nwant\n%s", rel, gotData, data)
+		}
+	}
+	for rel := range gotFiles {
+		if _, ok := wantFiles[rel]; !ok {
+			t.Errorf("%s: unexpected file in the output", rel)
+		}
+	}
+}
+
+// readTree returns the contents of every file beneath dir, keyed by path
+// relative to dir using forward slashes.
+func readTree(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(fp)
+		files[filepath.ToSlash(rel)] = data
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestManifestOutputVersionMismatch(t *testing.T) {
+	repo := newTestRepo(t, map[string]map[string]string{
+		"release-1.0": {"content/docs/install.md": testPage("Install", "Run the installer.")},
+	})
+	c := testConfig(t, repo, "v1.0=release-1.0")
+	c.Jobs.ManifestDir = t.TempDir()
+	testBuild(t, c)
+
+	// a manifest written by a later output version cannot be finalized with
+	// the current one
+	manifest := filepath.Join(c.Jobs.ManifestDir, "v1.0.json")
+	data := bytes.Replace([]byte(readTestFile(t, manifest)), []byte(`"outputVersion": 1`), []byte(`"outputVersion": 2`), 1)
+	if err := ioutil.WriteFile(manifest, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.Jobs.FinalizeOnly = true
+	b, err := New(c)
+	if err != nil {
+		t.Fatalf("invalid options: %v", err)
+	}
+	if _, err := b.Build(context.Background()); err == nil || !strings.Contains(err.Error(), "output version 2") {
+		t.Errorf("got error %v, want an output version mismatch", err)
+	}
+}
@@ -0,0 +1,94 @@
+package multiversion
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pageFunc is called for each page found by updatePages with the page's path
+// relative to the directory being walked, using forward slashes.
+// It returns true if the page has been modified and should be written back.
+type pageFunc func(rel string, p *page) (bool, error)
+
+// updatePages calls fn for every page beneath dir, writing back each page
+// that fn modifies.
+func (st *state) updatePages(dir string, fn pageFunc) error {
+	return st.walkOutput(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isPage(fp) {
+			return nil
+		}
+		if info, err = st.followSymlink(fp, info); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		p, err := st.readPage(fp)
+		if err != nil {
+			return err
+		}
+		modified, err := fn(filepath.ToSlash(rel), p)
+		if err != nil || !modified {
+			return err
+		}
+		return st.writePage(fp, p, info.Mode())
+	})
+}
+
+// listPages returns the set of page paths beneath dir, relative to dir and
+// using forward slashes.
+func (st *state) listPages(dir string) (map[string]bool, error) {
+	pages := make(map[string]bool)
+	err := st.walkOutput(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isPage(fp) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		pages[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	return pages, err
+}
+
+// pagePath returns the URL path, relative to the root of its version, that
+// Hugo will publish the page at rel at, assuming the page does not override
+// its URL. The root of a version has an empty page path.
+func pagePath(rel string) string {
+	rel = strings.TrimSuffix(rel, path.Ext(rel))
+	switch path.Base(rel) {
+	case "_index", "index":
+		rel = path.Dir(rel)
+	}
+	if rel == "." {
+		return ""
+	}
+	return strings.ToLower(rel) + "/"
+}
+
+// pageURL returns the URL path Hugo will publish the page at rel in the named
+// version at, assuming the page does not override its URL.
+func (st *state) pageURL(version, rel string) string {
+	return st.versionURL(version) + pagePath(rel)
+}
+
+// followSymlink returns information about the target of the file at fp if
+// info describes a symlink, as placed into the output directory by
+// --copy-mode=symlink, and info otherwise.
+func (st *state) followSymlink(fp string, info os.FileInfo) (os.FileInfo, error) {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return info, nil
+	}
+	return st.output.Stat(fp)
+}
@@ -0,0 +1,77 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// Pin keeps a file or directory within a version at a different ref to the
+// rest of the version, such as a page that must not pick up changes made to
+// the branch.
+type Pin struct {
+	// Path is the path of the file or directory, relative to the root of the
+	// repository.
+	Path string `yaml:"path"`
+
+	// Ref is the commit, tag or branch the path is taken from.
+	Ref string `yaml:"ref"`
+}
+
+// validatePins returns an error if the pins of the version are invalid.
+func (st *state) validatePins(vc *VersionConfig) error {
+	if len(vc.Pins) == 0 {
+		return nil
+	}
+	if f := vc.fetcher(st.opts); f != fetcherGit && f != fetcherGoGit {
+		return fmt.Errorf("pins cannot be used with the %q fetcher", f)
+	}
+	for _, p := range vc.Pins {
+		switch {
+		case p.Path == "" || p.Ref == "":
+			return fmt.Errorf("pins: path and ref must be set")
+		case path.IsAbs(p.Path) || path.Clean(p.Path) == "." || strings.HasPrefix(path.Clean(p.Path), "../") || path.Clean(p.Path) == "..":
+			return fmt.Errorf("pins: path %q must be within the repository", p.Path)
+		}
+	}
+	return nil
+}
+
+// applyPins replaces each pinned path in the repository cloned to loc with
+// its content at the pinned ref. Files within a pinned directory that do not
+// exist at the ref are removed.
+func (st *state) applyPins(log logr.Logger, loc string, pins []Pin) error {
+	for _, p := range pins {
+		rev, err := st.resolvePinRef(log, loc, p.Ref)
+		if err != nil {
+			return err
+		}
+		log.Info("Pinning path to ref", "path", p.Path, "ref", p.Ref, "commit", rev)
+		if err := os.RemoveAll(filepath.Join(loc, filepath.FromSlash(p.Path))); err != nil {
+			return err
+		}
+		if _, err := st.commandOutput(log, loc, "git", "checkout", rev, "--", p.Path); err != nil {
+			return fmt.Errorf("path %q does not exist at %q", p.Path, p.Ref)
+		}
+	}
+	return nil
+}
+
+// resolvePinRef returns the commit the ref refers to in the repository at
+// loc, fetching it from the remote if it is not a branch or tag that was
+// cloned.
+func (st *state) resolvePinRef(log logr.Logger, loc, ref string) (string, error) {
+	for _, r := range []string{ref, "origin/" + ref} {
+		if sha, err := st.commandOutput(log, loc, "git", "rev-parse", "--verify", "--quiet", r+"^{commit}"); err == nil {
+			return sha, nil
+		}
+	}
+	if _, err := st.commandOutput(log, loc, "git", "fetch", "--quiet", "origin", ref); err != nil {
+		return "", fmt.Errorf("pinned ref %q does not exist in the repository", ref)
+	}
+	return st.commandOutput(log, loc, "git", "rev-parse", "FETCH_HEAD")
+}
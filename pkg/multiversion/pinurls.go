@@ -0,0 +1,116 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// transformPinURLs pins links to files in the default branch to the ref of
+// the version.
+const transformPinURLs = "pin-urls"
+
+// refPlaceholder is replaced with the ref of a link in a PinnedURL template.
+const refPlaceholder = "{ref}"
+
+// defaultPinnedFrom are the refs of links that are pinned if a PinnedURL
+// does not list any.
+var defaultPinnedFrom = []string{"main", "master"}
+
+// PinnedURL is a URL template whose links in the content of each version are
+// pinned to the ref the version was built from, so that, for example, the
+// install instructions of an old version do not link to manifests in the
+// default branch.
+type PinnedURL struct {
+	// Template is the URL of the links with the {ref} placeholder in place of
+	// the ref, e.g. 'https://raw.githubusercontent.com/example/project/{ref}/'.
+	// Links beginning with the template are rewritten.
+	Template string `yaml:"template"`
+
+	// From are the refs of the links that are rewritten. Defaults to 'main'
+	// and 'master', so links that are already pinned are left unchanged.
+	From []string `yaml:"from"`
+}
+
+// pattern returns the regular expression matching the links of the template
+// with one of its From refs.
+func (u PinnedURL) pattern() (*regexp.Regexp, error) {
+	parts := strings.Split(u.Template, refPlaceholder)
+	switch {
+	case len(parts) != 2:
+		return nil, fmt.Errorf("template %q must contain the %s placeholder once", u.Template, refPlaceholder)
+	case parts[0] == "" || parts[1] == "":
+		return nil, fmt.Errorf("template %q must not begin or end with the %s placeholder", u.Template, refPlaceholder)
+	}
+	from := u.From
+	if len(from) == 0 {
+		from = defaultPinnedFrom
+	}
+	refs := make([]string, len(from))
+	for i, ref := range from {
+		if ref == "" {
+			return nil, fmt.Errorf("template %q: from must not contain empty refs", u.Template)
+		}
+		refs[i] = regexp.QuoteMeta(ref)
+	}
+	return regexp.Compile(regexp.QuoteMeta(parts[0]) + "(?:" + strings.Join(refs, "|") + ")" + regexp.QuoteMeta(parts[1]))
+}
+
+// validatePinnedURLs returns an error if 'pinnedURLs' is invalid.
+func (c *Config) validatePinnedURLs() error {
+	for _, u := range c.PinnedURLs {
+		if _, err := u.pattern(); err != nil {
+			return fmt.Errorf("pinnedURLs: %v", err)
+		}
+	}
+	return nil
+}
+
+// pinnedRef returns the ref the links matching 'pinnedURLs' are pinned to in
+// the version: its pinnedRef if set, and otherwise the branch or tag it was
+// built from.
+func (vc *VersionConfig) pinnedRef(branch string) string {
+	if vc.PinnedRef != "" {
+		return vc.PinnedRef
+	}
+	return branch
+}
+
+// beginPinURLs returns a PageTransform rewriting links in each page that
+// match 'pinnedURLs' to the ref of the version. Links in pages with the
+// 'pin_urls' param set to false are left unchanged.
+func (st *state) beginPinURLs(v *TransformVersion) (PageTransform, error) {
+	log := v.copy.log
+	ref := v.copy.vc.pinnedRef(v.Branch)
+	if ref == "" {
+		return nil, nil
+	}
+	type pin struct {
+		re          *regexp.Regexp
+		replacement []byte
+	}
+	var pins []pin
+	for _, u := range st.opts.PinnedURLs {
+		re, err := u.pattern()
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin{re, []byte(strings.Replace(u.Template, refPlaceholder, ref, 1))})
+	}
+	return func(p *Page) (bool, error) {
+		if v, ok := st.getParam(p.FrontMatter, "pin_urls").(bool); ok && !v {
+			log.V(4).Info("Skipping pinning URLs in page", "page", p.Path)
+			return false, nil
+		}
+		body := p.Body
+		for _, pin := range pins {
+			body = pin.re.ReplaceAllLiteral(body, pin.replacement)
+		}
+		if bytes.Equal(body, p.Body) {
+			return false, nil
+		}
+		p.Body = body
+		return true, nil
+	}, nil
+}
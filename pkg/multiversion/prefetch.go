@@ -0,0 +1,93 @@
+package multiversion
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// prefetcher fetches versions with --fetch-concurrency fetches in parallel,
+// so that the network is kept busy whilst fetched versions are copied into
+// the output directory one at a time.
+type prefetcher struct {
+	st      *state
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	fetches map[string]*prefetch
+}
+
+// prefetch is a version being fetched by a prefetcher.
+type prefetch struct {
+	done   chan struct{}
+	log    logr.Logger
+	report *versionReport
+	start  time.Time
+	loc    string
+	source string
+	err    error
+}
+
+// prefetchVersions starts fetching the versions in buildMap in the given
+// order.
+func (st *state) prefetchVersions(ctx context.Context, log logr.Logger, tmpdir string, rec *recording, buildMap map[string]string, order []string) *prefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &prefetcher{st: st, cancel: cancel, fetches: make(map[string]*prefetch, len(order))}
+	for _, vers := range order {
+		p.fetches[vers] = &prefetch{done: make(chan struct{})}
+	}
+	log.Info("Fetching versions in parallel", "concurrency", st.opts.Fetch.FetchConcurrency)
+
+	sem := make(chan struct{}, st.opts.Fetch.FetchConcurrency)
+	p.wg.Add(len(order))
+	go func() {
+		for _, vers := range order {
+			f, branch := p.fetches[vers], buildMap[vers]
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				f.err = ctx.Err()
+				close(f.done)
+				p.wg.Done()
+				continue
+			}
+			go func(vers string) {
+				defer p.wg.Done()
+				defer func() { <-sem }()
+				defer close(f.done)
+				f.report = st.startVersionReport(vers, branch)
+				f.log = f.report.logger(log.WithValues("version", vers, "branch", branch))
+				f.log.Info("Adding version to list to generate")
+				f.start = time.Now()
+				fetch := f.report.span.child("fetch")
+				f.loc, f.source, f.err = st.fetchBuildSource(ctx, f.log, tmpdir, rec, vers, branch)
+				fetch.finish(f.err)
+			}(vers)
+		}
+	}()
+	return p
+}
+
+// buildVersion waits for the named version to be fetched, and assembles it
+// in the same way as buildVersion.
+func (p *prefetcher) buildVersion(ctx context.Context, _ logr.Logger, _ string, rec *recording, vers, branch string) error {
+	f := p.fetches[vers]
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if f.report == nil {
+		// the fetch was never started
+		return f.err
+	}
+	return p.st.finishVersion(f.log, f.report, f.start, rec, f.loc, f.source, vers, branch, f.err)
+}
+
+// stop cancels the fetches that are still running, and waits for them to
+// return so that their temporary directories can be removed.
+func (p *prefetcher) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
@@ -0,0 +1,423 @@
+package multiversion
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// redirectRule is a redirect rule parsed from a generated redirects file.
+type redirectRule struct {
+	re *regexp.Regexp
+	// groups maps the group numbers used in the rule's target to the group
+	// numbers in re, which may differ if re contains lookahead markers.
+	groups []int
+	// lookaheads are negative lookaheads that could not be expressed in re.
+	// The text following each marker group in re must not match the
+	// corresponding expression.
+	lookaheads map[int]*regexp.Regexp
+	// expand returns the target of the redirect from the submatches of re.
+	expand func(m []string) string
+	status int
+	// shadowed is true if the rule only applies to paths that do not exist.
+	shadowed bool
+}
+
+// lookaheadRE matches a negative lookahead group containing no nested groups.
+var lookaheadRE = regexp.MustCompile(`\(\?!([^()]*)\)`)
+
+// compileRule compiles a regular expression that may contain negative
+// lookaheads, which are not supported by Go's regexp package. Each lookahead
+// is replaced with an empty marker group, and checked separately when the
+// rule is matched.
+func compileRule(pattern string) (*redirectRule, error) {
+	r := &redirectRule{lookaheads: map[int]*regexp.Regexp{}}
+	var lookaheads []string
+	pattern = lookaheadRE.ReplaceAllStringFunc(pattern, func(m string) string {
+		lookaheads = append(lookaheads, lookaheadRE.FindStringSubmatch(m)[1])
+		return "(?P<mvlookahead" + strconv.Itoa(len(lookaheads)-1) + ">)"
+	})
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	r.re = re
+	for i, name := range re.SubexpNames() {
+		if !strings.HasPrefix(name, "mvlookahead") {
+			r.groups = append(r.groups, i)
+			continue
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(name, "mvlookahead"))
+		if r.lookaheads[i], err = regexp.Compile("^(?:" + lookaheads[n] + ")"); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// match returns the target to redirect p to, if the rule matches p.
+func (r *redirectRule) match(p string) (string, bool) {
+	idx := r.re.FindStringSubmatchIndex(p)
+	if idx == nil {
+		return "", false
+	}
+	for group, la := range r.lookaheads {
+		if la.MatchString(p[idx[2*group]:]) {
+			return "", false
+		}
+	}
+	m := make([]string, len(r.groups))
+	for i, group := range r.groups {
+		if idx[2*group] >= 0 {
+			m[i] = p[idx[2*group]:idx[2*group+1]]
+		}
+	}
+	return r.expand(m), true
+}
+
+// namedPlaceholderRE matches placeholders such as ':splat' in redirect
+// targets.
+var namedPlaceholderRE = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+// expandNamed returns a function expanding ':name' placeholders in target with
+// the submatches of the named groups of re.
+func expandNamed(re *regexp.Regexp, groups []int, target string) func(m []string) string {
+	return func(m []string) string {
+		return namedPlaceholderRE.ReplaceAllStringFunc(target, func(ph string) string {
+			for i, group := range groups {
+				if re.SubexpNames()[group] == ph[1:] {
+					return m[i]
+				}
+			}
+			return ph
+		})
+	}
+}
+
+// parseRedirectRules parses a redirects file in the given format.
+func parseRedirectRules(format string, data []byte) ([]*redirectRule, error) {
+	switch format {
+	case "netlify":
+		return parseNetlifyRules(data)
+	case "vercel":
+		return parseVercelRules(data)
+	case "nginx":
+		return parseNginxRules(data)
+	}
+	return nil, fmt.Errorf("unsupported redirects format %q", format)
+}
+
+// parseNetlifyRules parses a Netlify _redirects file. Rules only apply to
+// paths that do not exist unless their status is suffixed with '!'.
+func parseNetlifyRules(data []byte) ([]*redirectRule, error) {
+	var rules []*redirectRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid redirect rule %q", scanner.Text())
+		}
+		status, shadowed := 301, true
+		if len(fields) > 2 {
+			s := fields[2]
+			if strings.HasSuffix(s, "!") {
+				s, shadowed = strings.TrimSuffix(s, "!"), false
+			}
+			var err error
+			if status, err = strconv.Atoi(s); err != nil {
+				return nil, fmt.Errorf("invalid status in redirect rule %q", scanner.Text())
+			}
+		}
+		var pattern strings.Builder
+		pattern.WriteString("^")
+		for i, seg := range strings.Split(fields[0], "/") {
+			if i > 0 {
+				pattern.WriteString("/")
+			}
+			switch {
+			case seg == "*":
+				pattern.WriteString("(?P<splat>.*)")
+			case strings.HasPrefix(seg, ":"):
+				pattern.WriteString("(?P<" + seg[1:] + ">[^/]+)")
+			default:
+				pattern.WriteString(regexp.QuoteMeta(seg))
+			}
+		}
+		pattern.WriteString("$")
+		r, err := compileRule(pattern.String())
+		if err != nil {
+			return nil, err
+		}
+		r.expand, r.status, r.shadowed = expandNamed(r.re, r.groups, fields[1]), status, shadowed
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// vercelParamRE matches a parameter in a Vercel source path, with an optional
+// regular expression.
+var vercelParamRE = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)(\((?:[^()]|\([^()]*\))*\))?`)
+
+// parseVercelRules parses the redirects in a vercel.json file.
+func parseVercelRules(data []byte) ([]*redirectRule, error) {
+	var cfg vercelConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	var rules []*redirectRule
+	for _, vr := range cfg.Redirects {
+		var pattern strings.Builder
+		pattern.WriteString("^")
+		last := 0
+		for _, m := range vercelParamRE.FindAllStringSubmatchIndex(vr.Source, -1) {
+			pattern.WriteString(regexp.QuoteMeta(vr.Source[last:m[0]]))
+			expr := "[^/]+"
+			if m[4] >= 0 {
+				expr = vr.Source[m[4]+1 : m[5]-1]
+			}
+			pattern.WriteString("(?P<" + vr.Source[m[2]:m[3]] + ">" + expr + ")")
+			last = m[1]
+		}
+		pattern.WriteString(regexp.QuoteMeta(vr.Source[last:]) + "$")
+		r, err := compileRule(pattern.String())
+		if err != nil {
+			return nil, err
+		}
+		r.expand, r.status = expandNamed(r.re, r.groups, vr.Destination), vr.StatusCode
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+var (
+	nginxRewriteRE = regexp.MustCompile(`^\s*rewrite\s+(\S+)\s+(\S+)(?:\s+(\S+))?\s*;`)
+	nginxGroupRE   = regexp.MustCompile(`\$([0-9])`)
+)
+
+// parseNginxRules parses a file containing nginx rewrite directives.
+func parseNginxRules(data []byte) ([]*redirectRule, error) {
+	var rules []*redirectRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		m := nginxRewriteRE.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		r, err := compileRule(m[1])
+		if err != nil {
+			return nil, err
+		}
+		target := m[2]
+		r.expand = func(groups []string) string {
+			return nginxGroupRE.ReplaceAllStringFunc(target, func(g string) string {
+				n, _ := strconv.Atoi(g[1:])
+				if n < len(groups) {
+					return groups[n]
+				}
+				return ""
+			})
+		}
+		r.status = 302
+		if m[3] == "permanent" {
+			r.status = 301
+		}
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// previewServer serves a site built by Hugo, simulating the generated
+// redirects.
+type previewServer struct {
+	st      *state
+	dir     string
+	rules   []*redirectRule
+	files   http.Handler
+	overlay []byte
+}
+
+// runPreview serves the Hugo site built into --site-dir until interrupted.
+func (st *state) runPreview() error {
+	s := &previewServer{st: st, dir: st.opts.Preview.SiteDir, files: http.FileServer(http.Dir(st.opts.Preview.SiteDir))}
+	if st.opts.Output.RedirectsFormat != "" {
+		file := st.opts.Output.RedirectsFile
+		if file == "" {
+			file = defaultRedirectFiles[st.opts.Output.RedirectsFormat]
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			st.log.Error(err, "Failed to read redirects file", "path", file)
+			return err
+		}
+		if s.rules, err = parseRedirectRules(st.opts.Output.RedirectsFormat, data); err != nil {
+			st.log.Error(err, "Failed to parse redirects file", "path", file)
+			return err
+		}
+		st.log.Info("Loaded redirects", "path", file, "redirects", len(s.rules))
+	}
+	if st.opts.Preview.Overlay {
+		var err error
+		if s.overlay, err = st.buildPreviewOverlay(); err != nil {
+			st.log.Error(err, "Failed to build version switch overlay")
+			return err
+		}
+	}
+	st.log.Info("Serving site", "path", st.opts.Preview.SiteDir, "url", "http://"+st.opts.Preview.ListenAddr+st.versionURL(""))
+	srv := &http.Server{Addr: st.opts.Preview.ListenAddr, Handler: s}
+	go func() {
+		<-st.runCtx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return st.runCtx.Err()
+}
+
+func (s *previewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	exists := s.exists(r.URL.Path)
+	for _, rule := range s.rules {
+		if rule.shadowed && exists {
+			continue
+		}
+		if target, ok := rule.match(r.URL.Path); ok {
+			if rule.status == http.StatusNotFound {
+				// Netlify serves the target of a 404 rule rather than
+				// redirecting to it
+				s.notFound(w, target)
+				return
+			}
+			s.st.log.V(4).Info("Redirecting request", "path", r.URL.Path, "target", target, "status", rule.status)
+			http.Redirect(w, r, target, rule.status)
+			return
+		}
+	}
+	if !exists {
+		s.notFound(w, "/404.html")
+		return
+	}
+	if s.overlay == nil || !strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(r.URL.Path, ".html") {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	s.serveWithOverlay(w, r)
+}
+
+// exists returns true if a file, or a directory containing an index.html
+// file, exists at the given URL path.
+func (s *previewServer) exists(p string) bool {
+	fp := filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+p)))
+	info, err := os.Stat(fp)
+	if err != nil {
+		return false
+	}
+	if info.IsDir() {
+		_, err = os.Stat(filepath.Join(fp, "index.html"))
+		return err == nil
+	}
+	return true
+}
+
+// notFound serves the page at the given URL path with a 404 status, or a
+// plain error if the page does not exist.
+func (s *previewServer) notFound(w http.ResponseWriter, page string) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+page))))
+	if err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(data)
+}
+
+// serveWithOverlay serves an HTML page with the version switch overlay
+// injected before the closing body tag.
+func (s *previewServer) serveWithOverlay(w http.ResponseWriter, r *http.Request) {
+	fp := filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	if strings.HasSuffix(r.URL.Path, "/") {
+		fp = filepath.Join(fp, "index.html")
+	}
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	if i := bytes.LastIndex(bytes.ToLower(data), []byte("</body>")); i >= 0 {
+		data = append(append(append([]byte{}, data[:i]...), s.overlay...), data[i:]...)
+	} else {
+		data = append(data, s.overlay...)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(data)
+}
+
+// previewOverlayTemplate renders a fixed position dropdown that switches to
+// the current page in other versions.
+var previewOverlayTemplate = template.Must(template.New("overlay").Parse(`
+<div id="multiversion-preview" style="position:fixed;bottom:1em;right:1em;z-index:2147483647;padding:.5em;background:#fff;border:1px solid #999;font:14px sans-serif">
+preview: <select id="multiversion-preview-switch"></select>
+</div>
+<script>
+(function() {
+  var versions = {{.Versions}};
+  var pages = {{.Pages}};
+  var path = window.location.pathname, current = null, rel = "";
+  versions.forEach(function(v) {
+    if (path.indexOf(v.url) === 0 && (!current || v.url.length > current.url.length)) {
+      current = v;
+      rel = path.slice(v.url.length);
+    }
+  });
+  var select = document.getElementById("multiversion-preview-switch");
+  versions.forEach(function(v) {
+    var available = (pages[rel] || []).indexOf(v.name) >= 0;
+    var opt = document.createElement("option");
+    opt.value = v.url + (available ? rel : "");
+    opt.text = (v.displayName || v.name) + (available ? "" : " (page not available)");
+    opt.selected = current && current.name === v.name;
+    select.appendChild(opt);
+  });
+  select.onchange = function() { window.location = select.value; };
+})();
+</script>
+`))
+
+// buildPreviewOverlay renders the version switch overlay from the data files
+// in --data-dir.
+func (st *state) buildPreviewOverlay() ([]byte, error) {
+	if st.opts.Output.DataDir == "" {
+		st.log.Info("WARNING: --data-dir is not set, the version switch overlay will not be shown")
+		return nil, nil
+	}
+	var versions versionsData
+	var availability availabilityData
+	for name, v := range map[string]interface{}{"versions": &versions, "availability": &availability} {
+		data, err := ioutil.ReadFile(filepath.Join(st.opts.Output.DataDir, name+".json"))
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	err := previewOverlayTemplate.Execute(&buf, map[string]interface{}{
+		"Versions": versions.Versions,
+		"Pages":    availability.Pages,
+	})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,76 @@
+package multiversion
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// previewDir is the directory of the output that --preview-branch is built
+// into.
+const previewDir = "preview"
+
+var (
+	// reviewRefRE matches the refs of GitHub pull requests and GitLab merge
+	// requests, capturing their number.
+	reviewRefRE = regexp.MustCompile(`^refs/(?:pull|merge-requests)/([0-9]+)/(?:head|merge)$`)
+	// unsafeNameRE matches the characters replaced in the default preview
+	// name.
+	unsafeNameRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// previewVersion returns the name of the version built from --preview-branch,
+// being its path in the output, e.g. 'preview/pr-1234', or an empty string if
+// no preview is built.
+func (st *state) previewVersion() string {
+	return st.opts.previewVersion()
+}
+
+func (c *Config) previewVersion() string {
+	name := c.previewName()
+	if name == "" {
+		return ""
+	}
+	return path.Join(previewDir, name)
+}
+
+// previewName returns the name of the directory beneath 'preview' that
+// --preview-branch is built into.
+func (c *Config) previewName() string {
+	branch := c.Fetch.PreviewBranch
+	switch {
+	case branch == "":
+		return ""
+	case c.Fetch.PreviewName != "":
+		return c.Fetch.PreviewName
+	}
+	if m := reviewRefRE.FindStringSubmatch(branch); m != nil {
+		return "pr-" + m[1]
+	}
+	return strings.Trim(unsafeNameRE.ReplaceAllString(branch, "-"), "-.")
+}
+
+// validatePreviewBuild returns an error if --preview-branch or
+// --preview-name cannot be used.
+func (st *state) validatePreviewBuild() error {
+	if st.opts.Fetch.PreviewBranch == "" {
+		if st.opts.Fetch.PreviewName != "" {
+			return fmt.Errorf("--preview-name requires --preview-branch to be set")
+		}
+		return nil
+	}
+	if name := st.opts.Fetch.PreviewName; name != "" && (unsafeNameRE.MatchString(name) || name == "." || name == "..") {
+		return fmt.Errorf("--preview-name %q must only contain letters, numbers, '.', '_' and '-'", name)
+	}
+	if st.opts.previewName() == "" {
+		return fmt.Errorf("a preview name cannot be derived from %q, set --preview-name", st.opts.Fetch.PreviewBranch)
+	}
+	if st.opts.Output.CopyMode == copyModeMount {
+		return fmt.Errorf("cannot be used with --copy-mode=%s, as the preview is hidden by modifying its pages", copyModeMount)
+	}
+	if _, ok := st.configuredVersions()[previewDir]; ok {
+		return fmt.Errorf("version %q is built into the %q directory", previewDir, previewDir)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package multiversion
+
+import (
+	"bytes"
+	"os/exec"
+)
+
+// newCommand returns a command that is started in its own process group, so
+// that it and any processes it starts can be killed together if the build is
+// cancelled. It must be run with runProcess or startProcess.
+func newCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	setProcessGroup(cmd)
+	return cmd
+}
+
+// startProcess starts cmd, returning a function that waits for it to exit.
+// If the running build is cancelled before cmd exits, cmd and every process
+// in its process group are killed, and wait returns the cancellation error.
+func (st *state) startProcess(cmd *exec.Cmd) (wait func() error, err error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-st.runCtx.Done():
+			killProcessGroup(cmd)
+		case <-exited:
+		}
+	}()
+	return func() error {
+		err := cmd.Wait()
+		close(exited)
+		if ctxErr := st.runCtx.Err(); err != nil && ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}, nil
+}
+
+// runProcess runs cmd until it exits or the running build is cancelled.
+func (st *state) runProcess(cmd *exec.Cmd) error {
+	wait, err := st.startProcess(cmd)
+	if err != nil {
+		return err
+	}
+	return wait()
+}
+
+// processOutput runs cmd until it exits or the running build is cancelled,
+// returning its stdout.
+func (st *state) processOutput(cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := st.runProcess(cmd)
+	return stdout.Bytes(), err
+}
+
+// processCombinedOutput runs cmd until it exits or the running build is
+// cancelled, returning its stdout and stderr.
+func (st *state) processCombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := st.runProcess(cmd)
+	return out.Bytes(), err
+}
@@ -0,0 +1,14 @@
+package multiversion
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on Windows, where only the process itself is
+// killed.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
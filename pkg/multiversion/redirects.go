@@ -0,0 +1,306 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// redirect is a single server-side redirect.
+type redirect struct {
+	From   string
+	To     string
+	Status int
+	// Force applies the redirect even if a file exists at From, for hosts
+	// that only redirect paths that do not exist by default.
+	Force bool
+}
+
+// Redirect is a redirect listed in the config file.
+type Redirect struct {
+	// From is the URL path that is redirected.
+	From string `yaml:"from" json:"from"`
+	// To is the URL path or absolute URL From is redirected to.
+	To string `yaml:"to" json:"to"`
+	// Status is the HTTP status of the redirect, 301 by default.
+	Status int `yaml:"status" json:"status"`
+}
+
+// validateRedirects returns an error if a redirect in the config file is
+// invalid.
+func (c *Config) validateRedirects() error {
+	for _, r := range c.Redirects {
+		switch {
+		case !strings.HasPrefix(r.From, "/"):
+			return fmt.Errorf("redirects: from %q must be a URL path beginning with /", r.From)
+		case r.To == "":
+			return fmt.Errorf("redirects: the redirect from %q has no destination", r.From)
+		case r.Status != 0 && r.Status != 301 && r.Status != 302 && r.Status != 307 && r.Status != 308:
+			return fmt.Errorf("redirects: the status of the redirect from %q must be 301, 302, 307 or 308", r.From)
+		}
+	}
+	return nil
+}
+
+// redirectWriter renders redirects into the file format of a particular
+// hosting provider or web server.
+// splatExclude is the list of version URLs that must not be matched by the
+// catch-all redirect to the latest version. If latest is empty, no catch-all
+// redirect should be rendered.
+type redirectWriter func(st *state, redirects []redirect, latest string, splatExclude []string) ([]byte, error)
+
+var redirectFormats = map[string]redirectWriter{
+	"netlify": (*state).writeNetlifyRedirects,
+	"vercel":  (*state).writeVercelRedirects,
+	"nginx":   (*state).writeNginxRedirects,
+}
+
+var defaultRedirectFiles = map[string]string{
+	"netlify": "static/_redirects",
+	"vercel":  "vercel.json",
+	"nginx":   "redirects.conf",
+}
+
+// validateRedirectsFormat returns an error if the given redirects format is not
+// supported.
+func validateRedirectsFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	if _, ok := redirectFormats[format]; !ok {
+		return fmt.Errorf("unsupported redirects format %q", format)
+	}
+	return nil
+}
+
+// buildRedirects computes redirects for the aliases declared by pages, and for
+// pages that have been removed from a version since an older version, both
+// beneath the version and beneath each of its aliases, and adds those listed
+// in the config file.
+func (st *state) buildRedirects(log logr.Logger, idx *contentIndex) ([]redirect, error) {
+	var redirects []redirect
+	for _, r := range st.opts.Redirects {
+		status := r.Status
+		if status == 0 {
+			status = 301
+		}
+		redirects = append(redirects, redirect{From: r.From, To: r.To, Status: status})
+	}
+	for _, vers := range idx.versions {
+		aliases, err := st.aliasRedirects(vers)
+		if err != nil {
+			return nil, err
+		}
+		redirects = append(redirects, aliases...)
+	}
+	redirects = append(redirects, st.versionAliasRedirects(idx)...)
+	redirects = append(redirects, st.eolRedirects(idx)...)
+
+	for _, r := range findRemovedPages(idx) {
+		log.V(4).Info("Page removed between versions", "version", r.version, "page", r.path, "redirect", r.target, "renamed", r.renamed)
+		status := 302
+		if r.renamed {
+			status = 301
+		}
+		to := st.versionURL(r.version) + r.target
+		redirects = append(redirects, redirect{From: st.versionURL(r.version) + r.path, To: to, Status: status})
+		for _, alias := range st.opts.versionConfig(r.version).Aliases {
+			redirects = append(redirects, redirect{From: st.versionURL(alias) + r.path, To: to, Status: status})
+		}
+	}
+
+	sort.SliceStable(redirects, func(i, j int) bool { return redirects[i].From < redirects[j].From })
+	return redirects, nil
+}
+
+// eolRedirects returns a permanent redirect from each page of every EOL
+// version to the same page in the latest version, or to the root of the
+// latest version if the page no longer exists, with --redirect-eol.
+func (st *state) eolRedirects(idx *contentIndex) []redirect {
+	latest, ok := idx.pages[latestVersion]
+	if !st.opts.Output.RedirectEOL || !ok {
+		return nil
+	}
+	var redirects []redirect
+	for _, vers := range idx.versions {
+		if vers == latestVersion || !st.isEOL(vers) {
+			continue
+		}
+		redirects = append(redirects, redirect{From: st.versionURL(vers), To: st.versionURL(latestVersion), Status: 301, Force: true})
+		for pp := range idx.pages[vers] {
+			if pp == "" {
+				continue
+			}
+			to := st.versionURL(latestVersion)
+			if _, ok := latest[pp]; ok {
+				to += pp
+			}
+			redirects = append(redirects, redirect{From: st.versionURL(vers) + pp, To: to, Status: 301, Force: true})
+		}
+	}
+	return redirects
+}
+
+// aliasRedirects returns a permanent redirect for every alias declared in the
+// front matter of pages in the named version.
+// Absolute aliases are interpreted relative to the root of the version unless
+// they already begin with the URL of the version or one of its aliases, and
+// relative aliases are interpreted relative to the directory containing the
+// page.
+func (st *state) aliasRedirects(version string) ([]redirect, error) {
+	var redirects []redirect
+	err := st.updatePages(st.versionDir(version), func(rel string, p *page) (bool, error) {
+		aliases, _ := p.frontMatter["aliases"].([]interface{})
+		for _, a := range aliases {
+			alias, ok := a.(string)
+			if !ok || alias == "" {
+				continue
+			}
+			from := path.Join(st.versionURL(version), alias)
+			if strings.HasPrefix(alias, st.versionURL(version)) || st.isVersionAliasURL(version, alias) {
+				from = path.Clean(alias)
+			} else if !strings.HasPrefix(alias, "/") {
+				from = path.Join(st.pageURL(version, path.Dir(rel)+"/_index.md"), alias)
+			}
+			if strings.HasSuffix(alias, "/") {
+				from += "/"
+			}
+			redirects = append(redirects, redirect{From: from, To: st.pageURL(version, rel), Status: 301})
+		}
+		return false, nil
+	})
+	return redirects, err
+}
+
+// writeRedirects writes a redirects file in the format given by
+// --redirects-format.
+func (st *state) writeRedirects(log logr.Logger, idx *contentIndex) error {
+	if st.opts.Output.RedirectsFormat == "" {
+		return nil
+	}
+	redirects, err := st.buildRedirects(log, idx)
+	if err != nil {
+		return err
+	}
+
+	// the catch-all redirect to latest is not written when a version is
+	// served from the root of the site, as it would capture its pages
+	var latest string
+	var exclude []string
+	if _, ok := idx.pages[latestVersion]; ok && st.opts.Output.RootVersion == "" {
+		latest = st.versionURL(latestVersion)
+		for _, vers := range idx.versions {
+			exclude = append(exclude, st.versionURL(vers))
+			for _, alias := range st.opts.versionConfig(vers).Aliases {
+				exclude = append(exclude, st.versionURL(alias))
+			}
+		}
+	}
+	data, err := redirectFormats[st.opts.Output.RedirectsFormat](st, redirects, latest, exclude)
+	if err != nil {
+		return err
+	}
+
+	file := st.opts.Output.RedirectsFile
+	if file == "" {
+		file = defaultRedirectFiles[st.opts.Output.RedirectsFormat]
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	log.Info("Writing redirects file", "path", file, "format", st.opts.Output.RedirectsFormat, "redirects", len(redirects))
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// writeNetlifyRedirects renders a Netlify _redirects file.
+// Netlify patterns cannot exclude paths, so missing pages beneath each version
+// URL in splatExclude are answered with the site's 404 page before they reach
+// the catch-all redirect, which would otherwise redirect them into the latest
+// version again and again.
+func (st *state) writeNetlifyRedirects(redirects []redirect, latest string, splatExclude []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range redirects {
+		force := ""
+		if r.Force {
+			force = "!"
+		}
+		fmt.Fprintf(&buf, "%s %s %d%s\n", r.From, r.To, r.Status, force)
+	}
+	if latest != "" {
+		for _, u := range splatExclude {
+			fmt.Fprintf(&buf, "%s* %s404.html 404\n", u, st.versionURL(""))
+		}
+		fmt.Fprintf(&buf, "%s* %s:splat 302\n", st.versionURL(""), latest)
+	}
+	return buf.Bytes(), nil
+}
+
+type vercelConfig struct {
+	Redirects []vercelRedirect `json:"redirects"`
+}
+
+type vercelRedirect struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	StatusCode  int    `json:"statusCode"`
+}
+
+// writeVercelRedirects renders a vercel.json file containing the redirects.
+func (st *state) writeVercelRedirects(redirects []redirect, latest string, splatExclude []string) ([]byte, error) {
+	cfg := vercelConfig{Redirects: []vercelRedirect{}}
+	for _, r := range redirects {
+		cfg.Redirects = append(cfg.Redirects, vercelRedirect{Source: r.From, Destination: r.To, StatusCode: r.Status})
+	}
+	if latest != "" {
+		cfg.Redirects = append(cfg.Redirects, vercelRedirect{
+			Source:      st.versionURL("") + ":path(" + st.excludeVersionsPattern(splatExclude) + ".*)",
+			Destination: latest + ":path",
+			StatusCode:  302,
+		})
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writeNginxRedirects renders nginx rewrite directives that can be included
+// into a server block.
+func (st *state) writeNginxRedirects(redirects []redirect, latest string, splatExclude []string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, r := range redirects {
+		flag := "redirect"
+		if r.Status == 301 {
+			flag = "permanent"
+		}
+		fmt.Fprintf(&buf, "rewrite ^%s$ %s %s;\n", regexp.QuoteMeta(r.From), r.To, flag)
+	}
+	if latest != "" {
+		fmt.Fprintf(&buf, "rewrite ^%s(%s.*)$ %s$1 redirect;\n", regexp.QuoteMeta(st.versionURL("")), st.excludeVersionsPattern(splatExclude), latest)
+	}
+	return buf.Bytes(), nil
+}
+
+// excludeVersionsPattern returns a negative lookahead regular expression that
+// prevents paths beneath any of the given version URLs from matching.
+func (st *state) excludeVersionsPattern(versionURLs []string) string {
+	var names []string
+	prefix := st.versionURL("")
+	for _, u := range versionURLs {
+		names = append(names, regexp.QuoteMeta(strings.TrimPrefix(u, prefix)))
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return "(?!" + strings.Join(names, "|") + ")"
+}
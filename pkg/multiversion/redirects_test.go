@@ -0,0 +1,128 @@
+package multiversion
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemovedPageRedirects(t *testing.T) {
+	guide := map[string]string{
+		"content/docs/_index.md":  testPage("Docs", "Read the docs."),
+		"content/docs/install.md": testPage("Install", "Run the installer."),
+		"content/docs/guide.md":   testPage("Guide", "Follow the guide."),
+	}
+	noGuide := map[string]string{
+		"content/docs/_index.md":  testPage("Docs", "Read the docs."),
+		"content/docs/install.md": testPage("Install", "Run the installer."),
+	}
+	tests := []struct {
+		name     string
+		branches []string
+		latest   string
+		aliases  map[string][]string
+		want     []string
+	}{
+		{
+			name:     "removed before latest",
+			branches: []string{"v1.0=release-1.0", "v1.1=release-1.1"},
+			latest:   "main",
+			want: []string{
+				"/v1.1/docs/guide/ /v1.1/docs/ 302",
+				"/latest/docs/guide/ /latest/docs/ 302",
+			},
+		},
+		{
+			name:     "latest alias",
+			branches: []string{"v1.0=release-1.0", "v1.1=release-1.1"},
+			aliases:  map[string][]string{"v1.1": {"latest"}},
+			want: []string{
+				"/v1.1/docs/guide/ /v1.1/docs/ 302",
+				"/latest/docs/guide/ /v1.1/docs/ 302",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, map[string]map[string]string{
+				"release-1.0": guide,
+				"release-1.1": noGuide,
+				"main":        noGuide,
+			})
+			c := testConfig(t, repo, test.branches...)
+			c.Fetch.LatestBranch = test.latest
+			c.Output.RedirectsFormat = "netlify"
+			c.Output.RedirectsFile = filepath.Join(t.TempDir(), "_redirects")
+			c.Versions = map[string]*VersionConfig{}
+			for vers, aliases := range test.aliases {
+				c.Versions[vers] = &VersionConfig{Aliases: aliases}
+			}
+			testBuild(t, c)
+
+			got := strings.Split(readTestFile(t, c.Output.RedirectsFile), "\n")
+			for _, want := range test.want {
+				if !containsLine(got, want) {
+					t.Errorf("redirect %q is missing from the redirects file:\n%s", want, strings.Join(got, "\n"))
+				}
+			}
+		})
+	}
+}
+
+func TestCatchAllSkipsVersions(t *testing.T) {
+	repo := newTestRepo(t, map[string]map[string]string{
+		"release-1.0": {"content/docs/_index.md": testPage("Docs", "Read the docs.")},
+		"main":        {"content/docs/_index.md": testPage("Docs", "Read the docs.")},
+	})
+	tests := []struct {
+		path string
+		// want is the URL the missing path is redirected to, or empty if it
+		// must not be redirected
+		want string
+	}{
+		{path: "/docs/install/", want: "/latest/docs/install/"},
+		{path: "/latest/nope/"},
+		{path: "/v1.0/nope/"},
+		{path: "/stable/nope/"},
+	}
+	for _, format := range []string{"netlify", "vercel", "nginx"} {
+		t.Run(format, func(t *testing.T) {
+			c := testConfig(t, repo, "v1.0=release-1.0")
+			c.Fetch.LatestBranch = "main"
+			c.Output.RedirectsFormat = format
+			c.Output.RedirectsFile = filepath.Join(t.TempDir(), defaultRedirectFiles[format])
+			c.Versions = map[string]*VersionConfig{"v1.0": {Aliases: []string{"stable"}}}
+			testBuild(t, c)
+
+			rules, err := parseRedirectRules(format, []byte(readTestFile(t, c.Output.RedirectsFile)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, test := range tests {
+				got := ""
+				for _, rule := range rules {
+					if target, ok := rule.match(test.path); ok {
+						if rule.status != http.StatusNotFound {
+							got = target
+						}
+						break
+					}
+				}
+				if got != test.want {
+					t.Errorf("%s: redirected to %q, want %q", test.path, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+// containsLine returns true if lines contains line.
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
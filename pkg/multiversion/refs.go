@@ -0,0 +1,85 @@
+package multiversion
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// refShortcodeRE matches the target of a 'ref' or 'relref' shortcode, which
+// may be given positionally or using the 'path' parameter, and quoted with
+// double quotes or backticks.
+var refShortcodeRE = regexp.MustCompile("(\\{\\{[<%]\\s*(?:ref|relref)\\s+(?:path\\s*=\\s*)?)(\"[^\"]*\"|`[^`]*`)")
+
+// versionRefPrefix returns the path of the named version's directory relative
+// to the root of Hugo's content directory, as used by 'ref' and 'relref'.
+func (st *state) versionRefPrefix(version string) (string, error) {
+	rel, err := filepath.Rel(st.opts.Hugo.ContentDir, filepath.Join(st.finalOutputDir(), version))
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("output directory %q is not within the Hugo content directory %q", st.finalOutputDir(), st.opts.Hugo.ContentDir)
+	}
+	return "/" + rel, nil
+}
+
+// validateRewriteRefs returns an error if --rewrite-refs is set but the
+// output directory is not within --hugo-content-dir, as the targets of refs
+// could not be rewritten to point into the version directories.
+func (st *state) validateRewriteRefs() error {
+	if !st.opts.Transform.RewriteRefs {
+		return nil
+	}
+	if st.opts.Hugo.ContentDir == "" {
+		return fmt.Errorf("--hugo-content-dir must be set")
+	}
+	_, err := st.versionRefPrefix("")
+	return err
+}
+
+// rewriteRefTargets rewrites the targets of 'ref' and 'relref' shortcodes in
+// the body of the page at rel, given the path of the version directory
+// relative to Hugo's content directory and the pages of the version keyed by
+// file name with and without extension. It returns true if any target was
+// rewritten.
+func rewriteRefTargets(log logr.Logger, rel string, body []byte, prefix string, byName map[string][]string) ([]byte, bool) {
+	modified := false
+	body = refShortcodeRE.ReplaceAllFunc(body, func(match []byte) []byte {
+		m := refShortcodeRE.FindSubmatch(match)
+		quoted := string(m[2])
+		quote, target := quoted[:1], quoted[1:len(quoted)-1]
+
+		ref, fragment := target, ""
+		if i := strings.Index(ref, "#"); i >= 0 {
+			ref, fragment = ref[:i], ref[i:]
+		}
+		switch {
+		case ref == "":
+			return match
+		case strings.HasPrefix(ref, "/"):
+			if ref == prefix || strings.HasPrefix(ref, prefix+"/") {
+				return match
+			}
+			ref = prefix + ref
+		case !strings.Contains(ref, "/"):
+			candidates := byName[ref]
+			if len(candidates) != 1 {
+				if len(candidates) > 1 {
+					log.Info("WARNING: ambiguous ref target matches multiple pages", "page", rel, "target", target, "matches", candidates)
+				}
+				return match
+			}
+			ref = prefix + "/" + candidates[0]
+		default:
+			return match
+		}
+		modified = true
+		return append(append([]byte{}, m[1]...), quote+ref+fragment+quote...)
+	})
+	return body, modified
+}
@@ -0,0 +1,36 @@
+package multiversion
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRewriteRefsRequiresOutputInContentDir(t *testing.T) {
+	site := t.TempDir()
+	tests := []struct {
+		name       string
+		contentDir string
+		valid      bool
+	}{
+		{name: "output within content dir", contentDir: filepath.Join(site, "content"), valid: true},
+		{name: "output outside content dir", contentDir: filepath.Join(site, "other")},
+		{name: "no content dir"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the repository does not exist, so the options must be rejected
+			// before anything is fetched
+			c := testConfig(t, "file://"+filepath.Join(site, "missing"), "v1.0=release-1.0")
+			c.Output.Dir = filepath.Join(site, "content", "docs")
+			c.Transform.RewriteRefs = true
+			c.Hugo.ContentDir = test.contentDir
+			_, err := New(c)
+			if test.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("expected the options to be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package multiversion
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Remote is a repository in the fork network of --repo-url that versions may
+// be fetched from instead, such as a community fork hosting translated docs.
+type Remote struct {
+	// URL is the git URL of the repository.
+	URL string `yaml:"url"`
+
+	// TokenEnv is the name of an environment variable containing a token used
+	// to authenticate to the remote over HTTPS.
+	TokenEnv string `yaml:"tokenEnv"`
+
+	// TokenUsername is the username sent with the token. Defaults to
+	// 'x-access-token', as expected by GitHub; GitLab expects 'oauth2'.
+	TokenUsername string `yaml:"tokenUsername"`
+
+	// SSHKeyFile is the path to a private key used to authenticate to the
+	// remote over SSH.
+	SSHKeyFile string `yaml:"sshKeyFile"`
+}
+
+// forkRE matches the 'owner/repo' form of a remote that is not listed in
+// 'remotes'.
+var forkRE = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// validateRemotes returns an error if a remote or the remote of a version is
+// invalid.
+func (c *Config) validateRemotes() error {
+	for name, r := range c.Remotes {
+		if r == nil || r.URL == "" {
+			return fmt.Errorf("remote %q: url must be set", name)
+		}
+		if r.TokenEnv != "" && r.SSHKeyFile != "" {
+			return fmt.Errorf("remote %q: only one of tokenEnv and sshKeyFile may be set", name)
+		}
+		if _, err := r.tokenScope(); r.TokenEnv != "" && err != nil {
+			return fmt.Errorf("remote %q: %v", name, err)
+		}
+	}
+	for name, vc := range c.Versions {
+		if vc == nil || vc.Remote == "" {
+			continue
+		}
+		if vc.Archive != "" {
+			return fmt.Errorf("version %q: only one of remote and archive may be set", name)
+		}
+		if _, err := c.resolveRemote(vc.Remote); err != nil {
+			return fmt.Errorf("version %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveRemote returns the remote with the given name. Names that are not
+// listed in 'remotes' are of the form 'owner/repo', and refer to the
+// repository of that name on the forge hosting --repo-url.
+func (c *Config) resolveRemote(name string) (*Remote, error) {
+	if r, ok := c.Remotes[name]; ok {
+		return r, nil
+	}
+	if !forkRE.MatchString(name) {
+		return nil, fmt.Errorf("remote %q is not listed in 'remotes' and is not of the form owner/repo", name)
+	}
+	u, err := forkURL(c.Fetch.RepoURL, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Remote{URL: u}, nil
+}
+
+// forkURL returns the URL of the repository named 'owner/repo' on the same
+// host, and using the same protocol, as repo.
+func forkURL(repo, fork string) (string, error) {
+	suffix := ""
+	if strings.HasSuffix(repo, ".git") {
+		suffix = ".git"
+	}
+	if u, err := url.Parse(repo); err == nil && strings.Contains(repo, "://") {
+		u.Path = "/" + fork + suffix
+		return u.String(), nil
+	}
+	// scp-like syntax, e.g. git@github.com:org/repo
+	if i := strings.Index(repo, ":"); i > 0 {
+		return repo[:i+1] + fork + suffix, nil
+	}
+	return "", fmt.Errorf("cannot derive the URL of fork %q from --repo-url %q", fork, repo)
+}
+
+// remote returns the remote the version is fetched from, which is
+// --repo-url unless the version sets 'remote'.
+func (vc *VersionConfig) remote(c *Config) *Remote {
+	if vc.Remote == "" {
+		return &Remote{URL: c.Fetch.RepoURL}
+	}
+	// remotes are validated when the builder is created
+	r, _ := c.resolveRemote(vc.Remote)
+	return r
+}
+
+// repoURL returns the URL of the repository the version is fetched from.
+func (vc *VersionConfig) repoURL(c *Config) string {
+	return vc.remote(c).URL
+}
+
+// tokenUsername returns the username sent with the remote's token.
+func (r *Remote) tokenUsername() string {
+	if r.TokenUsername != "" {
+		return r.TokenUsername
+	}
+	return "x-access-token"
+}
+
+// tokenScope returns the URL that the remote's token is sent to, being its
+// URL without credentials. Git only sends the token with requests to URLs
+// beneath it, and not to the other hosts or repositories that submodules and
+// LFS objects may be fetched from.
+func (r *Remote) tokenScope() (string, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("tokens can only be sent to http(s) URLs, not %q", r.URL)
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String(), nil
+}
+
+// env returns the environment variables that git is run with to
+// authenticate to the remote, in addition to the environment of the process.
+// Tokens are passed through git's environment config rather than on the
+// command line, so they are not visible in the process list or logs.
+func (r *Remote) env() ([]string, error) {
+	var env []string
+	switch {
+	case r.TokenEnv != "":
+		token := os.Getenv(r.TokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("environment variable %s containing the token for %q is not set", r.TokenEnv, r.URL)
+		}
+		scope, err := r.tokenScope()
+		if err != nil {
+			return nil, err
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(r.tokenUsername() + ":" + token))
+		env = append(env,
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http."+scope+".extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	case r.SSHKeyFile != "":
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+shellQuote(r.SSHKeyFile)+" -o IdentitiesOnly=yes")
+	}
+	return env, nil
+}
+
+// shellQuote quotes s as a single word for the shell git runs
+// GIT_SSH_COMMAND with.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,137 @@
+package multiversion
+
+import (
+	"path"
+	"sort"
+
+	"github.com/go-logr/logr"
+)
+
+// removedPage is a page that exists in a version but not in a newer version.
+type removedPage struct {
+	// version is the newer version that the page has been removed from.
+	version string
+	// path is the page path of the removed page.
+	path string
+	// target is the page path in version that the removed page should
+	// redirect to.
+	target string
+	// renamed is true if target is the same page moved to a new path, rather
+	// than its nearest ancestor.
+	renamed bool
+}
+
+// findRemovedPages compares the pages of each version with those of every
+// older version, and returns the pages that have been removed or moved in the
+// newer version. A page removed from several versions, such as a page only in
+// the oldest version, is returned for each of them, so that its URL in
+// 'latest' redirects as well as in the version it was first removed from.
+func findRemovedPages(idx *contentIndex) []removedPage {
+	var removed []removedPage
+	// versions are ordered newest first, so each version is compared against
+	// the versions that follow it in the list, nearest first, so that moved
+	// pages are matched against the newest version that still had them.
+	for i, newer := range idx.versions {
+		seen := make(map[string]bool)
+		for _, older := range idx.versions[i+1:] {
+			var paths []string
+			for pp := range idx.pages[older] {
+				if !idx.hasPage(newer, pp) && !seen[pp] {
+					seen[pp] = true
+					paths = append(paths, pp)
+				}
+			}
+			sort.Strings(paths)
+			for _, pp := range paths {
+				r := removedPage{version: newer, path: pp}
+				if target, ok := idx.findRenamed(older, newer, pp); ok {
+					r.target, r.renamed = target, true
+				} else {
+					r.target = idx.nearestAncestor(newer, pp)
+				}
+				removed = append(removed, r)
+			}
+		}
+	}
+	return removed
+}
+
+// findRenamed attempts to find the page in newer that the page pp in older
+// was moved to. Only pages that were added in newer are considered, and a
+// candidate is only returned if it is the single added page with the same
+// title, or failing that the single added page with the same name.
+func (idx *contentIndex) findRenamed(older, newer, pp string) (string, bool) {
+	var byTitle, byName []string
+	title := idx.titles[older][pp]
+	for candidate := range idx.pages[newer] {
+		if idx.hasPage(older, candidate) {
+			continue
+		}
+		if title != "" && idx.titles[newer][candidate] == title {
+			byTitle = append(byTitle, candidate)
+		}
+		if path.Base(candidate) == path.Base(pp) {
+			byName = append(byName, candidate)
+		}
+	}
+	if len(byTitle) == 1 {
+		return byTitle[0], true
+	}
+	if len(byName) == 1 {
+		return byName[0], true
+	}
+	return "", false
+}
+
+// addRemovedPageAliases adds the URL of each removed page to the 'aliases'
+// of the page it should redirect to, so that Hugo generates a redirect for it.
+// Pages redirecting to the root of a version without an _index page are
+// skipped.
+func (st *state) addRemovedPageAliases(log logr.Logger, idx *contentIndex) error {
+	aliases := make(map[string]map[string][]string)
+	for _, r := range findRemovedPages(idx) {
+		if !idx.hasPage(r.version, r.target) {
+			log.Info("No page to add alias for removed page to", "version", r.version, "page", r.path)
+			continue
+		}
+		if aliases[r.version] == nil {
+			aliases[r.version] = make(map[string][]string)
+		}
+		rel := idx.pages[r.version][r.target]
+		aliases[r.version][rel] = append(aliases[r.version][rel], st.versionURL(r.version)+r.path)
+	}
+
+	for vers, pages := range aliases {
+		log := log.WithValues("version", vers)
+		log.Info("Adding aliases for pages removed since the previous version", "pages", len(pages))
+		err := st.updatePages(st.versionDir(vers), func(rel string, p *page) (bool, error) {
+			add, ok := pages[rel]
+			if !ok {
+				return false, nil
+			}
+			existing, _ := p.frontMatter["aliases"].([]interface{})
+			for _, a := range add {
+				if !containsAlias(existing, a) {
+					existing = append(existing, a)
+				}
+			}
+			p.frontMatter["aliases"] = existing
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsAlias returns true if alias is in aliases, so that aliases are not
+// added twice when the output directory is finalized again.
+func containsAlias(aliases []interface{}, alias string) bool {
+	for _, a := range aliases {
+		if a == alias {
+			return true
+		}
+	}
+	return false
+}
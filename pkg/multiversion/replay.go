@@ -0,0 +1,250 @@
+package multiversion
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// recording is the structure of the replay.json file written by --record.
+// It contains all of the resolved inputs to a build, so that the build can be
+// re-executed with --replay without network access.
+type recording struct {
+	RepoURL        string            `json:"repoURL"`
+	RepoContentDir string            `json:"repoContentDir"`
+	Versions       []recordedVersion `json:"versions"`
+
+	// mu guards Versions whilst versions are fetched in parallel.
+	mu sync.Mutex
+}
+
+// recordedVersion records the inputs used to build a single version.
+type recordedVersion struct {
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+	// Source is the repository or archive URL the version was fetched from.
+	Source string `json:"source"`
+	// Commit is the commit SHA that was checked out, if the version was
+	// fetched using git.
+	Commit string         `json:"commit,omitempty"`
+	Files  []recordedFile `json:"files"`
+}
+
+// recordedFile is a single file in the content directory of a version.
+type recordedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// recordingSourcePath returns the path of the archive containing the content
+// directory of the named version within a recording directory.
+func recordingSourcePath(dir, version string) string {
+	return filepath.Join(dir, "sources", version+".tar.gz")
+}
+
+// recordVersion adds the version fetched to loc to the recording, and archives
+// its content directory into the recording directory.
+func (st *state) recordVersion(r *recording, log logr.Logger, version, branch, source, loc string) error {
+	log.Info("Recording version inputs", "path", st.opts.Fetch.RecordDir)
+	commit, err := st.resolveCommit(log, loc)
+	if err != nil {
+		return err
+	}
+	rv := recordedVersion{Name: version, Branch: branch, Source: source, Commit: commit}
+
+	contentDir := filepath.Join(loc, r.RepoContentDir)
+	files, err := listFiles(contentDir)
+	if err != nil {
+		return err
+	}
+	rv.Files = files
+	if err := os.MkdirAll(filepath.Join(st.opts.Fetch.RecordDir, "sources"), 0755); err != nil {
+		return err
+	}
+	if err := createTarGz(contentDir, recordingSourcePath(st.opts.Fetch.RecordDir, version)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Versions = append(r.Versions, rv)
+	return nil
+}
+
+// writeRecording writes the recording to replay.json in the recording
+// directory.
+func (st *state) writeRecording(r *recording) error {
+	sort.Slice(r.Versions, func(i, j int) bool { return r.Versions[i].Name < r.Versions[j].Name })
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(st.opts.Fetch.RecordDir, "replay.json"), append(data, '\n'), 0644)
+}
+
+// loadRecording reads the recording in the given directory.
+func loadRecording(dir string) (*recording, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "replay.json"))
+	if err != nil {
+		return nil, err
+	}
+	r := &recording{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// version returns the recorded inputs for the named version.
+func (r *recording) version(name string) (*recordedVersion, bool) {
+	for i := range r.Versions {
+		if r.Versions[i].Name == name {
+			return &r.Versions[i], true
+		}
+	}
+	return nil, false
+}
+
+// versionMap returns the version to branch mapping that was recorded.
+func (r *recording) versionMap() map[string]string {
+	out := make(map[string]string, len(r.Versions))
+	for _, v := range r.Versions {
+		out[v.Name] = v.Branch
+	}
+	return out
+}
+
+// replayVersion extracts the recorded content directory of the named version,
+// returning a path that can be used in place of a fetched repository.
+// An error is returned if the extracted files do not match those recorded.
+func (st *state) replayVersion(r *recording, log logr.Logger, tmpdir, version string) (string, error) {
+	rv, ok := r.version(version)
+	if !ok {
+		return "", fmt.Errorf("version %q was not recorded", version)
+	}
+	log.Info("Replaying recorded version", "path", st.opts.Fetch.ReplayDir, "commit", rv.Commit)
+
+	loc := filepath.Join(tmpdir, "repo", version)
+	contentDir := filepath.Join(loc, r.RepoContentDir)
+	if err := extractTarGz(recordingSourcePath(st.opts.Fetch.ReplayDir, version), contentDir); err != nil {
+		return "", err
+	}
+	files, err := listFiles(contentDir)
+	if err != nil {
+		return "", err
+	}
+	if len(files) != len(rv.Files) {
+		return "", fmt.Errorf("recorded sources for version %q contain %d files, expected %d", version, len(files), len(rv.Files))
+	}
+	for i := range files {
+		if files[i] != rv.Files[i] {
+			return "", fmt.Errorf("recorded sources for version %q do not match the recorded file %q", version, rv.Files[i].Path)
+		}
+	}
+	return loc, nil
+}
+
+// listFiles returns the path, size and SHA256 of every file beneath dir, sorted
+// by path.
+func listFiles(dir string) ([]recordedFile, error) {
+	files := []recordedFile{}
+	err := filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(fp)
+		if err != nil {
+			return err
+		}
+		files = append(files, recordedFile{Path: filepath.ToSlash(rel), Size: info.Size(), SHA256: sum})
+		return nil
+	})
+	return files, err
+}
+
+// hashFile returns the hex encoded SHA256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(f)
+}
+
+// hashReader returns the hex encoded SHA256 of the content of r.
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// createTarGz writes a gzipped tarball containing the contents of the
+// directory src to dst.
+func createTarGz(src, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(fp)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
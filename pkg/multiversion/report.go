@@ -0,0 +1,164 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// warningPrefix is the prefix of messages logged as warnings.
+const warningPrefix = "WARNING: "
+
+// buildReport is the structure of the report written to --build-report.
+type buildReport struct {
+	Success bool `json:"success"`
+	// Error is the error the build failed with, if it failed.
+	Error    string           `json:"error,omitempty"`
+	Versions []*versionReport `json:"versions"`
+}
+
+// versionReport describes the build of a single version.
+type versionReport struct {
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+	// Commit is the commit SHA that was built, if the version was fetched
+	// using git.
+	Commit string `json:"commit,omitempty"`
+	// FilesCopied is the number of files placed into the output directory.
+	FilesCopied int `json:"filesCopied"`
+	// BytesWritten is the total size of the files placed into the output
+	// directory.
+	BytesWritten    int64   `json:"bytesWritten"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Warnings are the warnings logged whilst building the version, followed
+	// by the key/value pairs logged with them.
+	Warnings []string `json:"warnings"`
+	// Transforms are the names of the transforms applied to its pages.
+	Transforms []string `json:"transforms"`
+	// Error is the error the version failed to build with, if it failed.
+	Error string `json:"error,omitempty"`
+
+	// span is the trace span of the build of the version, the parent of the
+	// spans of its phases.
+	span *traceSpan
+	// mu is the state's reportMu, which guards the fields of the report.
+	mu *sync.Mutex
+}
+
+// validateBuildReport returns an error if --build-report cannot be used with
+// the other flags.
+func (st *state) validateBuildReport() error {
+	if st.opts.Output.BuildReport != "" && len(st.opts.Languages.Languages) > 0 {
+		return fmt.Errorf("cannot be used with --languages, use --matrix-report instead")
+	}
+	return nil
+}
+
+// startVersionReport starts a new report for the build of a version,
+// replacing any previous report for the version.
+func (st *state) startVersionReport(vers, branch string) *versionReport {
+	st.reportMu.Lock()
+	defer st.reportMu.Unlock()
+	r := &versionReport{mu: &st.reportMu, Name: vers, Branch: branch, Warnings: []string{}, Transforms: []string{}}
+	r.span = st.runSpan.child("version", "version", vers, "branch", branch)
+	st.versionReports[vers] = r
+	return r
+}
+
+// reportFor returns the report of the version being built, or a report that
+// is discarded if the version is not being built by buildVersion.
+func (st *state) reportFor(vers string) *versionReport {
+	st.reportMu.Lock()
+	defer st.reportMu.Unlock()
+	if r, ok := st.versionReports[vers]; ok {
+		return r
+	}
+	return &versionReport{mu: &st.reportMu}
+}
+
+// update calls fn with the report locked.
+func (r *versionReport) update(fn func(r *versionReport)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(r)
+}
+
+// finish records the outcome of the build of the version.
+func (r *versionReport) finish(d time.Duration, err error) {
+	r.update(func(r *versionReport) {
+		r.DurationSeconds = d.Seconds()
+		if err != nil {
+			r.Error = err.Error()
+		}
+		if r.Commit != "" {
+			r.span.setAttr("commit", r.Commit)
+		}
+		r.span.finish(err)
+	})
+}
+
+// logger returns a logger that records the warnings logged with it, and with
+// the loggers derived from it, in the report.
+func (r *versionReport) logger(log logr.Logger) logr.Logger {
+	return warningRecorder{Logger: log, report: r}
+}
+
+// warningRecorder is a logr.Logger adding the warnings logged to a report.
+type warningRecorder struct {
+	logr.Logger
+	report *versionReport
+}
+
+func (l warningRecorder) Info(msg string, keysAndValues ...interface{}) {
+	if strings.HasPrefix(msg, warningPrefix) {
+		warning := strings.TrimPrefix(msg, warningPrefix)
+		for i := 0; i+1 < len(keysAndValues); i += 2 {
+			warning += fmt.Sprintf(" %v=%v", keysAndValues[i], keysAndValues[i+1])
+		}
+		l.report.update(func(r *versionReport) {
+			r.Warnings = append(r.Warnings, warning)
+		})
+	}
+	l.Logger.Info(msg, keysAndValues...)
+}
+
+func (l warningRecorder) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return warningRecorder{Logger: l.Logger.WithValues(keysAndValues...), report: l.report}
+}
+
+func (l warningRecorder) WithName(name string) logr.Logger {
+	return warningRecorder{Logger: l.Logger.WithName(name), report: l.report}
+}
+
+// writeBuildReport writes the report of the versions built to
+// --build-report, if it is set. err is the error the build failed with, if
+// any.
+func (st *state) writeBuildReport(log logr.Logger, err error) error {
+	if st.opts.Output.BuildReport == "" {
+		return nil
+	}
+	report := buildReport{Success: err == nil, Versions: []*versionReport{}}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	st.reportMu.Lock()
+	versions := make(map[string]string, len(st.versionReports))
+	for vers, r := range st.versionReports {
+		versions[vers] = r.Branch
+	}
+	for _, vers := range sortedVersionNames(versions) {
+		report.Versions = append(report.Versions, st.versionReports[vers])
+	}
+	data, jsonErr := json.MarshalIndent(report, "", "  ")
+	st.reportMu.Unlock()
+	if jsonErr != nil {
+		return jsonErr
+	}
+	log.Info("Writing build report", "path", st.opts.Output.BuildReport)
+	return ioutil.WriteFile(st.opts.Output.BuildReport, append(data, '\n'), 0644)
+}
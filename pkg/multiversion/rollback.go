@@ -0,0 +1,244 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// keptBuildsFile is the file in --builds-dir listing the kept builds.
+const keptBuildsFile = "builds.json"
+
+// keptBuilds lists the builds kept in --builds-dir, oldest first.
+type keptBuilds struct {
+	// Current is the ID of the build the output directory was last written
+	// from, by a build or by the rollback command.
+	Current string      `json:"current"`
+	Builds  []keptBuild `json:"builds"`
+}
+
+// keptBuild is a successful build whose output is kept in --builds-dir.
+type keptBuild struct {
+	ID       string   `json:"id"`
+	Time     string   `json:"time"`
+	Versions []string `json:"versions"`
+}
+
+// validateKeepBuilds returns an error if builds cannot be kept with the other
+// flags.
+func (st *state) validateKeepBuilds() error {
+	if st.opts.Output.KeepBuilds < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	if st.opts.Output.KeepBuilds == 0 {
+		return nil
+	}
+	if st.opts.Output.BuildsDir == "" {
+		return fmt.Errorf("--builds-dir must be set")
+	}
+	if st.opts.Output.CopyMode == copyModeMount || st.opts.Output.Archive != "" || len(st.opts.Languages.Languages) > 0 {
+		return fmt.Errorf("cannot be used with --copy-mode=mount, --output or --languages")
+	}
+	for _, dir := range []string{st.opts.Output.Dir, st.opts.Output.DataDir} {
+		if dir != "" && withinDir(dir, st.opts.Output.BuildsDir) {
+			return fmt.Errorf("--builds-dir must not be within --output-dir or --data-dir")
+		}
+	}
+	return nil
+}
+
+// withinDir returns true if path is dir or is beneath it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// keptTrees returns the directories copied into each kept build, keyed by
+// the name of the directory they are copied to.
+func (st *state) keptTrees() map[string]string {
+	trees := map[string]string{"output": st.opts.Output.Dir}
+	if st.opts.Output.DataDir != "" {
+		trees["data"] = st.opts.Output.DataDir
+	}
+	return trees
+}
+
+// loadKeptBuilds reads the list of kept builds from --builds-dir, which is
+// empty if no build has been kept yet.
+func (st *state) loadKeptBuilds() (*keptBuilds, error) {
+	data, err := ioutil.ReadFile(filepath.Join(st.opts.Output.BuildsDir, keptBuildsFile))
+	if os.IsNotExist(err) {
+		return &keptBuilds{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	kb := &keptBuilds{}
+	if err := json.Unmarshal(data, kb); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", keptBuildsFile, err)
+	}
+	return kb, nil
+}
+
+// saveKeptBuilds writes the list of kept builds to --builds-dir.
+func (st *state) saveKeptBuilds(kb *keptBuilds) error {
+	data, err := json.MarshalIndent(kb, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(st.opts.Output.BuildsDir, keptBuildsFile), append(data, '\n'), 0644)
+}
+
+// keepBuild copies the output directory and --data-dir of a successful build
+// into --builds-dir, so that the rollback command can restore them, and
+// removes the oldest builds beyond --keep-builds. If the output directory is
+// backed by --store-dir, its manifest is kept rather than a copy.
+func (st *state) keepBuild(log logr.Logger, versionMap map[string]string, manifest storeManifest) error {
+	if st.opts.Output.KeepBuilds == 0 {
+		return nil
+	}
+	kb, err := st.loadKeptBuilds()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	build := keptBuild{
+		ID:       now.Format("20060102-150405") + "-" + randomID(2),
+		Time:     now.Format(time.RFC3339),
+		Versions: sortedVersionNames(versionMap),
+	}
+	dir := filepath.Join(st.opts.Output.BuildsDir, build.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	trees := st.keptTrees()
+	if manifest != nil {
+		delete(trees, "output")
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, storeManifestFile), data, 0644); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	for name, src := range trees {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := st.syncDir(src, filepath.Join(dir, name), nil); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	kb.Builds = append(kb.Builds, build)
+	kb.Current = build.ID
+	for len(kb.Builds) > st.opts.Output.KeepBuilds {
+		log.V(4).Info("Removing kept build", "build", kb.Builds[0].ID)
+		if err := os.RemoveAll(filepath.Join(st.opts.Output.BuildsDir, kb.Builds[0].ID)); err != nil {
+			return err
+		}
+		kb.Builds = kb.Builds[1:]
+	}
+	if err := st.saveKeptBuilds(kb); err != nil {
+		return err
+	}
+	log.Info("Kept build for rollback", "build", build.ID, "path", dir, "kept", len(kb.Builds))
+	return nil
+}
+
+// runRollback restores the output directory and --data-dir from the kept
+// build with the given ID, or by default from the build before the one they
+// were last written from. Only the files that differ from the kept build are
+// written, and Hugo is run afterwards with --run-hugo.
+func (st *state) runRollback(id string) error {
+	if st.opts.Output.BuildsDir == "" {
+		return fmt.Errorf("--builds-dir must be set to the directory builds were kept in")
+	}
+	kb, err := st.loadKeptBuilds()
+	if err != nil {
+		return err
+	}
+	target := -1
+	for i, b := range kb.Builds {
+		if (id != "" && b.ID == id) || (id == "" && b.ID == kb.Current) {
+			target = i
+		}
+	}
+	switch {
+	case id != "" && target < 0:
+		return fmt.Errorf("build %q is not kept in %s", id, st.opts.Output.BuildsDir)
+	case id == "" && target <= 0:
+		return fmt.Errorf("no build before the current build %q is kept in %s", kb.Current, st.opts.Output.BuildsDir)
+	case id == "":
+		target--
+	}
+	build := kb.Builds[target]
+
+	versionMap := make(map[string]string, len(build.Versions))
+	for _, vers := range build.Versions {
+		versionMap[vers] = ""
+	}
+	if err := st.openAuditLog(versionMap); err != nil {
+		return err
+	}
+	defer st.closeAuditLog()
+	st.auditStep("", "restore")
+	log := st.log.WithValues("build", build.ID)
+	buildDir := filepath.Join(st.opts.Output.BuildsDir, build.ID)
+	manifest, err := loadStoreManifest(filepath.Join(buildDir, storeManifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if manifest != nil {
+		// the output is assembled out of links to the store alongside it, and
+		// synced from there
+		if st.opts.Output.StoreDir == "" {
+			return fmt.Errorf("build %q was kept in a store, --store-dir must be set", build.ID)
+		}
+		tmpdir, err := ioutil.TempDir(st.opts.Output.StoreDir, "restore-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpdir)
+		if err := st.materializeTree(manifest, filepath.Join(tmpdir, "output")); err != nil {
+			return err
+		}
+		buildDir = tmpdir
+	}
+	for name, dst := range st.keptTrees() {
+		src := filepath.Join(buildDir, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		stats, err := st.syncDir(src, dst, nil)
+		if err != nil {
+			log.Error(err, "Failed to restore kept build", "path", dst)
+			return err
+		}
+		log.Info("Restored kept build", "path", dst, "written", stats.written, "unchanged", stats.unchanged, "deleted", stats.deleted)
+	}
+	kb.Current = build.ID
+	if err := st.saveKeptBuilds(kb); err != nil {
+		return err
+	}
+	// files written by the sync are copies, so are linked to the store again
+	if manifest, err = st.storeOutput(log); err != nil {
+		return err
+	}
+	if err := st.collectStore(log, manifest); err != nil {
+		return err
+	}
+	log.Info("Rolled back to kept build", "time", build.Time, "versions", build.Versions)
+	if st.opts.Hugo.Run {
+		return st.runHugo(log)
+	}
+	return nil
+}
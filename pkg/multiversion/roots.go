@@ -0,0 +1,133 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// Root is a directory in the source repository that is copied for a
+// version, and the directory it is copied to.
+type Root struct {
+	// Source is the path of the directory, relative to the root of the
+	// repository.
+	Source string `yaml:"source"`
+
+	// Target is the directory the source is copied to. If it contains the
+	// {version} placeholder it is relative to the working directory, e.g.
+	// 'static/{version}/images', and is replaced on every build as with
+	// --extra-dirs. Otherwise it is relative to the version's directory in
+	// --output-dir and the files are copied as content, so an empty target
+	// is the version's directory itself.
+	Target string `yaml:"target"`
+
+	// Optional skips the root in versions that do not contain the source
+	// directory, instead of failing the build.
+	Optional bool `yaml:"optional"`
+}
+
+// content returns whether the root is copied into the version's directory.
+func (r Root) content() bool {
+	return !strings.Contains(r.Target, versionPlaceholder)
+}
+
+// rootDestination returns the directory the root is copied to for the
+// version.
+func (st *state) rootDestination(r Root, version string) string {
+	if !r.content() {
+		return strings.Replace(r.Target, versionPlaceholder, version, -1)
+	}
+	return filepath.Join(st.versionDir(version), r.Target)
+}
+
+// roots returns the roots copied for the version, which are those set for
+// the version in the config file if any, then the top-level roots, and
+// otherwise --repo-content-dir copied to the version's directory.
+func (vc *VersionConfig) roots(c *Config) []Root {
+	if len(vc.Roots) > 0 {
+		return vc.Roots
+	}
+	if len(c.Roots) > 0 {
+		return c.Roots
+	}
+	return []Root{{Source: c.Fetch.RepoContentDir}}
+}
+
+// rootSources returns the source of each of the roots.
+func rootSources(roots []Root) []string {
+	var sources []string
+	for _, r := range roots {
+		sources = append(sources, r.Source)
+	}
+	return sources
+}
+
+// validateRoots returns an error if the roots are invalid or cannot be used
+// with the other flags.
+func (st *state) validateRoots(roots []Root) error {
+	if len(roots) == 0 {
+		return nil
+	}
+	switch {
+	case st.opts.Output.CopyMode == copyModeMount:
+		return fmt.Errorf("roots cannot be used with --copy-mode=mount")
+	case st.opts.Fetch.RecordDir != "" || st.opts.Fetch.ReplayDir != "":
+		return fmt.Errorf("roots cannot be used with --record or --replay, as only the content directory is recorded")
+	case len(st.opts.Languages.Languages) > 0:
+		return fmt.Errorf("roots cannot be used with --languages")
+	}
+	for _, r := range roots {
+		src := filepath.Clean(r.Source)
+		if r.Source == "" || filepath.IsAbs(src) || src == ".." || strings.HasPrefix(src, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("roots: source %q must be within the repository", r.Source)
+		}
+		dst := filepath.Clean(r.Target)
+		if filepath.IsAbs(dst) || dst == ".." || strings.HasPrefix(dst, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("roots: target %q must be a relative path within the site", r.Target)
+		}
+		if r.content() {
+			continue
+		}
+		switch {
+		case st.opts.Output.DeltaSync:
+			return fmt.Errorf("roots: target %q is outside the version's directory, which cannot be used with --delta-sync", r.Target)
+		case st.opts.Output.Archive != "":
+			return fmt.Errorf("roots: target %q is outside the version's directory, which cannot be used with --output as only the output directory is written", r.Target)
+		}
+	}
+	return nil
+}
+
+// copyRoots copies each root of the version from the source tree at loc in
+// order, so that later roots are merged into or override earlier ones.
+// Roots copied outside the version's directory replace anything previously
+// copied there.
+func (st *state) copyRoots(log logr.Logger, c *copyContext, loc string) error {
+	for _, r := range c.vc.roots(st.opts) {
+		src := filepath.Join(loc, r.Source)
+		dst := c.st.rootDestination(r, c.version)
+		log := log.WithValues("source", r.Source, "destination", dst)
+		if _, err := os.Stat(src); os.IsNotExist(err) && r.Optional {
+			log.V(4).Info("Root does not exist in version, skipping")
+			continue
+		}
+		if r.content() && filepath.Clean(r.Target) == "." {
+			if err := st.checkRootCollisions(src, c.version); err != nil {
+				return err
+			}
+		}
+		log.V(2).Info("Copying root")
+		if !r.content() {
+			if err := st.output.RemoveAll(dst); err != nil {
+				return err
+			}
+		}
+		if err := st.copyDir(c, src, dst); err != nil {
+			return fmt.Errorf("copying %q: %v", r.Source, err)
+		}
+	}
+	return nil
+}
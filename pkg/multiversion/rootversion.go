@@ -0,0 +1,145 @@
+package multiversion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// validateRootVersion returns an error if --root-version is not a version
+// being built, or cannot be used with the other flags.
+func (st *state) validateRootVersion() error {
+	root := st.opts.Output.RootVersion
+	if root == "" {
+		return nil
+	}
+	if st.opts.Output.CopyMode == copyModeMount {
+		return fmt.Errorf("cannot be used with --copy-mode=%s", copyModeMount)
+	}
+	// the versions of a recording are only known once it is loaded
+	if _, ok := st.resolveVersions()[root]; !ok && st.opts.Fetch.ReplayDir == "" {
+		return fmt.Errorf("version %q is not being built", root)
+	}
+	return nil
+}
+
+// versionPath returns the path of the directory of the named version,
+// relative to the output directory. It is empty for --root-version, which is
+// written directly to the output directory.
+func (st *state) versionPath(version string) string {
+	if version != "" && version == st.opts.Output.RootVersion {
+		return ""
+	}
+	return version
+}
+
+// versionDir returns the directory the named version is written to.
+func (st *state) versionDir(version string) string {
+	return filepath.Join(st.opts.Output.Dir, st.versionPath(version))
+}
+
+// nestedVersionDirs returns the names of the directories written alongside
+// the content of --root-version in the output directory, being those of the
+// other versions and of the aliases of every version. It returns nil if no
+// version is written to the output directory.
+func (st *state) nestedVersionDirs() map[string]bool {
+	if st.opts.Output.RootVersion == "" {
+		return nil
+	}
+	names := make(map[string]bool)
+	for vers := range st.resolveVersions() {
+		if vers != st.opts.Output.RootVersion {
+			// the preview version is nested beneath the 'preview' directory
+			names[strings.SplitN(vers, "/", 2)[0]] = true
+		}
+		for _, alias := range st.opts.versionConfig(vers).Aliases {
+			names[alias] = true
+		}
+	}
+	return names
+}
+
+// skipVersionDirs wraps fn so that the directories in names directly beneath
+// root are skipped.
+func skipVersionDirs(root string, names map[string]bool, fn filepath.WalkFunc) filepath.WalkFunc {
+	root = filepath.Clean(root)
+	return func(fp string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && filepath.Dir(fp) == root && names[info.Name()] {
+			return filepath.SkipDir
+		}
+		return fn(fp, info, err)
+	}
+}
+
+// nestedVersionURLDirs returns the names of the directories of the other
+// versions beneath the URL path u, if it is the URL of --root-version.
+func (st *state) nestedVersionURLDirs(u string) map[string]bool {
+	if st.opts.Output.RootVersion == "" || u != st.versionURL(st.opts.Output.RootVersion) {
+		return nil
+	}
+	return st.nestedVersionDirs()
+}
+
+// walkOutput walks dir in the output, skipping the directories of the other
+// versions if dir is the directory of --root-version.
+func (st *state) walkOutput(dir string, fn filepath.WalkFunc) error {
+	if root := st.opts.Output.RootVersion; root != "" && filepath.Clean(dir) == st.versionDir(root) {
+		fn = skipVersionDirs(dir, st.nestedVersionDirs(), fn)
+	}
+	return st.output.Walk(dir, fn)
+}
+
+// removeVersionDir removes the directory of the named version from the
+// output. The content of --root-version is removed without removing the
+// directories of the other versions.
+func (st *state) removeVersionDir(version string) error {
+	if st.versionPath(version) != "" {
+		return st.output.RemoveAll(st.versionDir(version))
+	}
+	dir := st.versionDir(version)
+	var entries []string
+	err := st.walkOutput(dir, func(fp string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && fp == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || fp == dir {
+			return err
+		}
+		entries = append(entries, fp)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fp := range entries {
+		if err := st.output.RemoveAll(fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRootCollisions returns an error if the content of --root-version at
+// src contains a file or directory with the name of the directory of another
+// version or alias, which would be overwritten by or mixed into that version.
+func (st *state) checkRootCollisions(src, version string) error {
+	if st.versionPath(version) != "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	names := st.nestedVersionDirs()
+	for _, e := range entries {
+		if names[e.Name()] {
+			return fmt.Errorf("version %q cannot be written to the root of the output directory, as its content contains %q which is the directory of another version or alias", version, e.Name())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package multiversion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+)
+
+// rtdVersionsData is the structure of the versions.json file written to
+// --rtd-api-dir, modelled on the versions returned by the Read the Docs API
+// so that its flyout menus can be reused.
+type rtdVersionsData struct {
+	// DefaultVersion is the slug of the latest version, if one is built.
+	DefaultVersion string `json:"default_version,omitempty"`
+	Versions       struct {
+		Active []rtdVersion `json:"active"`
+	} `json:"versions"`
+}
+
+// rtdVersion is a version listed in rtdVersionsData.
+type rtdVersion struct {
+	Slug        string   `json:"slug"`
+	VerboseName string   `json:"verbose_name"`
+	Aliases     []string `json:"aliases"`
+	URLs        struct {
+		Documentation string `json:"documentation"`
+	} `json:"urls"`
+}
+
+// rtdAlternatesData is the structure of the file written for each page to
+// --rtd-api-dir, listing the versions the page exists in.
+type rtdAlternatesData struct {
+	Alternates []rtdAlternate `json:"alternates"`
+}
+
+// rtdAlternate is a version of a page listed in rtdAlternatesData.
+type rtdAlternate struct {
+	Slug        string `json:"slug"`
+	VerboseName string `json:"verbose_name"`
+	URL         string `json:"url"`
+}
+
+// writeRTDAPI writes a static API describing the versions to --rtd-api-dir,
+// for flyout menus written for Read the Docs. versions.json lists every
+// version in the versions data file, and alternates/<page path>/index.json
+// lists the versions each page exists in. Alternates of pages that no longer
+// exist are removed.
+func (st *state) writeRTDAPI(log logr.Logger, versions map[string]string, idx *contentIndex) error {
+	dir := st.opts.Output.RTDAPIDir
+	if dir == "" {
+		return nil
+	}
+	data := st.buildVersionsData(versions)
+	var api rtdVersionsData
+	api.DefaultVersion = data.Latest
+	api.Versions.Active = []rtdVersion{}
+	names := map[string]string{}
+	for _, v := range data.Versions {
+		rv := rtdVersion{Slug: v.Name, VerboseName: v.Name, Aliases: v.Aliases}
+		if v.DisplayName != "" {
+			rv.VerboseName = v.DisplayName
+		}
+		if rv.Aliases == nil {
+			rv.Aliases = []string{}
+		}
+		rv.URLs.Documentation = v.URL
+		api.Versions.Active = append(api.Versions.Active, rv)
+		names[v.Name] = rv.VerboseName
+	}
+	if err := writeJSONFile(filepath.Join(dir, "versions.json"), api); err != nil {
+		return err
+	}
+
+	alternates := map[string]*rtdAlternatesData{}
+	for _, vers := range idx.versions {
+		if st.opts.versionConfig(vers).Hidden {
+			continue
+		}
+		for pp, rel := range idx.pages[vers] {
+			a, ok := alternates[pp]
+			if !ok {
+				a = &rtdAlternatesData{}
+				alternates[pp] = a
+			}
+			a.Alternates = append(a.Alternates, rtdAlternate{Slug: vers, VerboseName: names[vers], URL: st.pageURL(vers, rel)})
+		}
+	}
+	alternatesDir := filepath.Join(dir, "alternates")
+	if err := os.RemoveAll(alternatesDir); err != nil {
+		return err
+	}
+	for pp, a := range alternates {
+		if err := writeJSONFile(filepath.Join(alternatesDir, filepath.FromSlash(pp), "index.json"), a); err != nil {
+			return err
+		}
+	}
+	log.Info("Wrote Read the Docs API", "path", dir, "versions", len(api.Versions.Active), "pages", len(alternates))
+	return nil
+}
+
+// writeJSONFile writes v to path as indented JSON, creating its directory.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,110 @@
+package multiversion
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// scaffoldFiles are the templates written into the site by the scaffold
+// command. They are Go templates using [[ and ]] as delimiters, so that the
+// Hugo templates they render are left as they are.
+//
+//go:embed scaffold
+var scaffoldFiles embed.FS
+
+// scaffoldDefaultDataDir is the data directory the scaffolded templates read
+// if --data-dir is not set.
+const scaffoldDefaultDataDir = "data/multiversion"
+
+// scaffoldData is passed to the scaffold templates.
+type scaffoldData struct {
+	// DataKeys are the quoted keys of the data files within site.Data.
+	DataKeys string
+	// DataDir is --data-dir, for error messages.
+	DataDir string
+	// Languages is set if --data-dir contains {lang}, so that the data files
+	// of the page's language are read.
+	Languages bool
+}
+
+// runScaffold writes a version switcher partial and a 'version' shortcode
+// that read the versions data file into --site-root. Unlike the theme
+// component, they do not depend on one another or on any theme, and are
+// meant to be edited, so files that already exist are never overwritten.
+func (st *state) runScaffold() error {
+	data, err := st.scaffoldDataFor(st.opts.Output.DataDir)
+	if err != nil {
+		return err
+	}
+	return fs.WalkDir(scaffoldFiles, "scaffold", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel("scaffold", filepath.FromSlash(name))
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(st.opts.Hugo.SiteRoot, rel)
+		if _, err := os.Stat(dst); err == nil {
+			st.log.Info("WARNING: not overwriting existing file", "path", dst)
+			return nil
+		}
+		src, err := scaffoldFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(name).Delims("[[", "]]").Parse(string(src))
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, data); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		st.log.Info("Writing scaffolded template", "path", dst)
+		return ioutil.WriteFile(dst, b.Bytes(), 0644)
+	})
+}
+
+// scaffoldDataFor returns the keys the data files written to dataDir are
+// read from within site.Data, which is the data directory of --site-root.
+func (st *state) scaffoldDataFor(dataDir string) (*scaffoldData, error) {
+	if dataDir == "" {
+		st.log.Info("WARNING: --data-dir is not set, the templates read the data files written with --data-dir=" + scaffoldDefaultDataDir)
+		dataDir = filepath.Join(st.opts.Hugo.SiteRoot, scaffoldDefaultDataDir)
+	}
+	data := &scaffoldData{DataDir: dataDir}
+	if strings.HasSuffix(dataDir, "/"+languagePlaceholder) {
+		data.Languages = true
+		dataDir = strings.TrimSuffix(dataDir, "/"+languagePlaceholder)
+	}
+	siteData, err := filepath.Abs(filepath.Join(st.opts.Hugo.SiteRoot, "data"))
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(siteData, abs)
+	if err != nil || rel == "." || !withinDir(siteData, abs) || strings.Contains(rel, languagePlaceholder) {
+		return nil, fmt.Errorf("--data-dir must be a directory within %s, optionally ending in /%s", siteData, languagePlaceholder)
+	}
+	var keys []string
+	for _, key := range strings.Split(filepath.ToSlash(rel), "/") {
+		keys = append(keys, strconv.Quote(key))
+	}
+	data.DataKeys = strings.Join(keys, " ")
+	return data, nil
+}
@@ -0,0 +1,143 @@
+package multiversion
+
+// versionsSchemaV1 is the JSON schema for format version 1 of the versions
+// data file.
+const versionsSchemaV1 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/munnerz/hugo-multiversion/schemas/v1/versions.schema.json",
+  "title": "hugo-multiversion versions data file",
+  "type": "object",
+  "required": ["formatVersion", "versions"],
+  "properties": {
+    "formatVersion": {
+      "description": "Format version of this file. Backwards incompatible changes are only made when this number changes.",
+      "const": 1
+    },
+    "latest": {
+      "description": "Name of the latest version, if one was built.",
+      "type": "string"
+    },
+    "versions": {
+      "description": "All built versions, latest first.",
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["name", "branch", "url", "latest", "outdated", "deprecated"],
+        "properties": {
+          "name": {"description": "Name of the version, also used as its directory name.", "type": "string"},
+          "branch": {"description": "Branch the version was built from.", "type": "string"},
+          "url": {"description": "URL path the root of the version is served from.", "type": "string"},
+          "latest": {"description": "Whether this is the latest version.", "type": "boolean"},
+          "outdated": {"description": "Whether the version is marked as outdated.", "type": "boolean"},
+          "deprecated": {"description": "Whether the version is deprecated.", "type": "boolean"},
+          "eol": {"description": "Whether the version has reached its end of life.", "type": "boolean"},
+          "eolDate": {"description": "Date the version's support period ends, in the form YYYY-MM-DD.", "type": "string"},
+          "aliases": {"description": "Other names the version is reachable at, each served from the URL path of the alias.", "type": "array", "items": {"type": "string"}},
+          "archived": {"description": "Whether the version is no longer built, in which case url links to --archived-versions-url.", "type": "boolean"},
+          "root": {"description": "Whether the version is served from the root of the site rather than a directory named after it.", "type": "boolean"},
+          "prerelease": {"description": "Whether the version was discovered from a pre-release.", "type": "boolean"},
+          "published": {"description": "Date the release the version was discovered from was published, in the form YYYY-MM-DD.", "type": "string"},
+          "displayName": {"description": "Human readable name of the version, from the version's metadata file.", "type": "string"},
+          "minProductVersion": {"description": "Oldest product version documented by the version, from the version's metadata file.", "type": "string"},
+          "deprecationNote": {"description": "Explanation of why the version is deprecated, from the version's metadata file.", "type": "string"},
+          "params": {"description": "Arbitrary params from the version's metadata file.", "type": "object"}
+        }
+      }
+    }
+  }
+}
+`
+
+// availabilitySchemaV1 is the JSON schema for format version 1 of the page
+// availability data file.
+const availabilitySchemaV1 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/munnerz/hugo-multiversion/schemas/v1/availability.schema.json",
+  "title": "hugo-multiversion page availability data file",
+  "type": "object",
+  "required": ["formatVersion", "pages"],
+  "properties": {
+    "formatVersion": {
+      "description": "Format version of this file. Backwards incompatible changes are only made when this number changes.",
+      "const": 1
+    },
+    "pages": {
+      "description": "Maps the URL path of each page, relative to the root of its version, to the versions containing that page, latest first.",
+      "type": "object",
+      "additionalProperties": {
+        "type": "array",
+        "items": {"type": "string"}
+      }
+    }
+  }
+}
+`
+
+// anchorsSchemaV1 is the JSON schema for format version 1 of the heading
+// anchors data file.
+const anchorsSchemaV1 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/munnerz/hugo-multiversion/schemas/v1/anchors.schema.json",
+  "title": "hugo-multiversion heading anchors data file",
+  "type": "object",
+  "required": ["formatVersion", "versions"],
+  "properties": {
+    "formatVersion": {
+      "description": "Format version of this file. Backwards incompatible changes are only made when this number changes.",
+      "const": 1
+    },
+    "versions": {
+      "description": "Maps each version name to the URL path of each page in that version, relative to the root of the version, and the heading anchors on that page in the order they appear.",
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "additionalProperties": {
+          "type": "array",
+          "items": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
+
+// glossarySchemaV1 is the JSON schema for format version 1 of the glossary
+// data file.
+const glossarySchemaV1 = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/munnerz/hugo-multiversion/schemas/v1/glossary.schema.json",
+  "title": "hugo-multiversion glossary data file",
+  "type": "object",
+  "required": ["formatVersion", "terms"],
+  "properties": {
+    "formatVersion": {
+      "description": "Format version of this file. Backwards incompatible changes are only made when this number changes.",
+      "const": 1
+    },
+    "terms": {
+      "description": "Maps each term defined by any version to its definitions.",
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "required": ["versions", "definitions", "changedIn"],
+        "properties": {
+          "versions": {"description": "Versions defining the term, latest first.", "type": "array", "items": {"type": "string"}},
+          "definitions": {
+            "description": "Distinct definitions of the term, ordered by the latest version using each. Definitions that only differ in whitespace are the same.",
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["definition", "versions"],
+              "properties": {
+                "definition": {"description": "Definition of the term.", "type": "string"},
+                "versions": {"description": "Versions using this definition, latest first.", "type": "array", "items": {"type": "string"}}
+              }
+            }
+          },
+          "changedIn": {"description": "Versions whose definition differs from that of the next older version defining the term, latest first.", "type": "array", "items": {"type": "string"}}
+        }
+      }
+    }
+  }
+}
+`
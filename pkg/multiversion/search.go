@@ -0,0 +1,171 @@
+package multiversion
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// searchSummaryWords is the number of words of a page's content used as its
+// summary if it does not set one, which is the same as Hugo's default
+// 'summaryLength'.
+const searchSummaryWords = 70
+
+var (
+	// htmlHeadingRE matches an HTML heading, capturing its content.
+	htmlHeadingRE = regexp.MustCompile(`(?is)<h[1-6][^>]*>(.*?)</h[1-6]>`)
+	// htmlAnyTagRE matches any HTML tag or comment.
+	htmlAnyTagRE = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+	// shortcodeRE matches a shortcode tag.
+	shortcodeRE = regexp.MustCompile(`(?s)\{\{[<%].*?[%>]\}\}`)
+	// markdownPrefixRE matches the markers at the start of headings, block
+	// quotes and list items.
+	markdownPrefixRE = regexp.MustCompile(`(?m)^[ \t]*(?:#{1,6}[ \t]|>[ \t]?|[-*+][ \t]|[0-9]+[.)][ \t])`)
+	// headingAttrsRE matches the custom attributes at the end of a heading.
+	headingAttrsRE = regexp.MustCompile(`(?m)[ \t]*\{#[^}\s]+[^}]*\}[ \t]*$`)
+)
+
+// searchEntry is a page in the search index of a version. The index is an
+// array of entries that can be loaded into Lunr, with 'url' as the ref, or
+// into Fuse.js as is.
+type searchEntry struct {
+	URL      string   `json:"url"`
+	Title    string   `json:"title"`
+	Headings []string `json:"headings"`
+	Summary  string   `json:"summary"`
+	Version  string   `json:"version"`
+}
+
+// searchIndexFile returns the path of the search index of the named version.
+func (st *state) searchIndexFile(version string) string {
+	return filepath.Join(st.opts.Output.SearchIndexDir, filepath.FromSlash(version)+".json")
+}
+
+// beginSearchIndex returns a PageTransform adding each page of the version to
+// its search index, which is written to --search-index-dir once every page
+// has been transformed. Pages are read after the transforms listed before
+// it, and pages with the 'search_exclude' param set to true are left out.
+func (st *state) beginSearchIndex(v *TransformVersion) (PageTransform, error) {
+	log := v.copy.log
+	entries := []searchEntry{}
+	v.ends = append(v.ends, func() error {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].URL < entries[j].URL })
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		file := st.searchIndexFile(v.Name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		log.Info("Writing search index", "path", file, "pages", len(entries))
+		return ioutil.WriteFile(file, data, 0644)
+	})
+	return func(p *Page) (bool, error) {
+		if exclude, ok := st.getParam(p.FrontMatter, "search_exclude").(bool); ok && exclude {
+			return false, nil
+		}
+		entries = append(entries, searchEntry{
+			URL:      st.pageURL(v.Name, p.Path),
+			Title:    searchTitle(p),
+			Headings: searchHeadings(p),
+			Summary:  searchSummary(p),
+			Version:  v.Name,
+		})
+		return false, nil
+	}, nil
+}
+
+// searchTitle returns the title of the page, defaulting to the name of its
+// file, or of its directory for index pages.
+func searchTitle(p *Page) string {
+	if title, ok := p.FrontMatter["title"].(string); ok && title != "" {
+		return title
+	}
+	name := strings.TrimSuffix(path.Base(p.Path), path.Ext(p.Path))
+	if name == "_index" || name == "index" {
+		name = path.Base(path.Dir(p.Path))
+	}
+	return name
+}
+
+// searchHeadings returns the text of the headings in the page, in the order
+// they appear.
+func searchHeadings(p *Page) []string {
+	headings := []string{}
+	add := func(text string) {
+		if text = strings.TrimSpace(text); text != "" {
+			headings = append(headings, text)
+		}
+	}
+	switch lowerExt(p.Path) {
+	case ".html", ".htm":
+		for _, m := range htmlHeadingRE.FindAllSubmatch(p.Body, -1) {
+			add(htmlAnyTagRE.ReplaceAllString(string(m[1]), ""))
+		}
+	case ".md", ".markdown":
+		scanHeadings(p.Body, func(text string) {
+			text = customHeadingRE.ReplaceAllString(text, "")
+			add(inlineMarkupChar.Replace(markdownLinkRE.ReplaceAllString(text, "$1")))
+		})
+	}
+	return headings
+}
+
+// searchSummary returns the 'summary' or 'description' of the page, or the
+// content before its '<!--more-->' divider, or otherwise its first words, as
+// plain text.
+func searchSummary(p *Page) string {
+	for _, key := range []string{"summary", "description"} {
+		if s, ok := p.FrontMatter[key].(string); ok && strings.TrimSpace(s) != "" {
+			return strings.TrimSpace(s)
+		}
+	}
+	body := p.Body
+	if i := bytes.Index(body, []byte("<!--more-->")); i >= 0 {
+		return strings.Join(strings.Fields(plainText(body[:i])), " ")
+	}
+	words := strings.Fields(plainText(body))
+	if len(words) > searchSummaryWords {
+		words = words[:searchSummaryWords]
+	}
+	return strings.Join(words, " ")
+}
+
+// plainText strips the code blocks, shortcodes, HTML tags and Markdown
+// syntax from a page's content.
+func plainText(body []byte) string {
+	var b strings.Builder
+	var fence string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := fenceRE.FindStringSubmatch(line); m != nil {
+			switch fence {
+			case "":
+				fence = m[1]
+			case m[1]:
+				fence = ""
+			}
+			continue
+		}
+		if fence == "" && !setextHeadingRE.MatchString(line) {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	text := shortcodeRE.ReplaceAllString(b.String(), "")
+	text = htmlAnyTagRE.ReplaceAllString(text, "")
+	text = markdownPrefixRE.ReplaceAllString(text, "")
+	text = headingAttrsRE.ReplaceAllString(text, "")
+	text = markdownLinkRE.ReplaceAllString(text, "$1")
+	return strings.NewReplacer("`", "", "*", "", "__", "").Replace(text)
+}
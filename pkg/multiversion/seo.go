@@ -0,0 +1,204 @@
+package multiversion
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+)
+
+// canonicalNone is the 'canonical' of a seoPolicy that adds no canonical
+// URLs to the pages of a version.
+const canonicalNone = "none"
+
+// SEOPolicy is how search engines treat the pages of a version. The params
+// injected into its pages, its sitemap hints and sitemap, and robots.txt are
+// all derived from it, so that they cannot disagree.
+type SEOPolicy struct {
+	// Index is whether search engines may index the pages of the version.
+	// Defaults to false for deprecated and hidden versions. Versions that are
+	// not indexed are also left out of sitemaps and disallowed in robots.txt.
+	Index *bool `yaml:"index"`
+
+	// Canonical is the version the canonical URL of each page points at, if
+	// the page exists in that version, or 'none'. Defaults to 'latest' for
+	// the versions other than latest with --canonical-latest.
+	Canonical string `yaml:"canonical"`
+
+	// Sitemap overrides the sitemap hints of the version.
+	Sitemap *SitemapConfig `yaml:"sitemap"`
+}
+
+// validate returns an error if the policy is invalid given the configured
+// versions.
+func (sp *SEOPolicy) validate(versions map[string]string) error {
+	if sp == nil {
+		return nil
+	}
+	if c := sp.Canonical; c != "" && c != canonicalNone && c != latestVersion {
+		if _, ok := versions[c]; !ok {
+			return fmt.Errorf("seoPolicy: canonical version %q is not configured", c)
+		}
+	}
+	if err := sp.Sitemap.validate(); err != nil {
+		return fmt.Errorf("seoPolicy: %v", err)
+	}
+	return nil
+}
+
+// seoPolicy is the SEOPolicy resolved for a version.
+type seoPolicy struct {
+	index bool
+	// canonical is the version canonical URLs point at, if any.
+	canonical string
+	sitemap   sitemapHint
+}
+
+// seoPolicyFor returns the search engine policy of the named version. The
+// defaults derived from its support status are overridden by the top-level
+// seoPolicy, and then by the version's own.
+func (st *state) seoPolicyFor(version string) seoPolicy {
+	deprecated, hidden := st.isDeprecated(version), st.opts.versionConfig(version).Hidden
+	p := seoPolicy{index: !deprecated && !hidden}
+	if st.opts.Transform.CanonicalLatest && version != latestVersion {
+		p.canonical = latestVersion
+	}
+	exclude := deprecated || hidden || st.isEOL(version)
+	policies := []*SEOPolicy{st.opts.SEOPolicy, st.opts.versionConfig(version).SEOPolicy}
+	for _, sp := range policies {
+		if sp == nil {
+			continue
+		}
+		if sp.Index != nil {
+			p.index = *sp.Index
+		}
+		if sp.Canonical != "" {
+			p.canonical = sp.Canonical
+		}
+		if sp.Sitemap != nil && sp.Sitemap.Exclude != nil {
+			exclude = *sp.Sitemap.Exclude
+		}
+	}
+	if p.canonical == canonicalNone || p.canonical == version {
+		p.canonical = ""
+	}
+
+	// by default the latest version is expected to change weekly and has the
+	// highest priority, and other versions change monthly with a lower
+	// priority
+	switch {
+	case exclude || !p.index:
+		p.sitemap = sitemapHint{changeFreq: "yearly", priority: 0.1, exclude: true}
+	case version == latestVersion || version == st.opts.Output.RootVersion:
+		p.sitemap = sitemapHint{changeFreq: "weekly", priority: 1.0}
+	default:
+		p.sitemap = sitemapHint{changeFreq: "monthly", priority: 0.5}
+	}
+	for _, sp := range policies {
+		if sp == nil || sp.Sitemap == nil {
+			continue
+		}
+		if sp.Sitemap.ChangeFreq != "" {
+			p.sitemap.changeFreq = sp.Sitemap.ChangeFreq
+		}
+		if sp.Sitemap.Priority != nil {
+			p.sitemap.priority = *sp.Sitemap.Priority
+		}
+	}
+	return p
+}
+
+// addCanonicalURLs sets the 'canonical' param on every page in the version
+// directory dir that also exists in the canonical version, whose pages are
+// canonicalPages, pointing at the page's URL in the canonical version.
+func (st *state) addCanonicalURLs(log logr.Logger, dir, canonical string, canonicalPages map[string]bool) error {
+	log.Info("Adding canonical URLs to pages that exist in the canonical version", "canonical", canonical)
+	return st.updatePages(dir, func(rel string, p *page) (bool, error) {
+		if !canonicalPages[rel] {
+			return false, nil
+		}
+		st.setParams(p.frontMatter, map[string]interface{}{
+			"canonical": st.pageURL(canonical, rel),
+		})
+		return true, nil
+	})
+}
+
+// supportParams returns the params describing the support status and search
+// engine policy of the named version that are set on each of its pages, or
+// nil if the version is supported, has no EOL date, is not hidden and is
+// indexed and listed in sitemaps.
+func (st *state) supportParams(version string) map[string]interface{} {
+	params := make(map[string]interface{})
+	if st.isDeprecated(version) {
+		params["deprecated"] = true
+	}
+	if st.isEOL(version) {
+		params["eol"] = true
+	}
+	if eolDate := st.computedSupport[version].eolDate; !eolDate.IsZero() {
+		params["eol_date"] = eolDate.Format("2006-01-02")
+	}
+	if st.opts.versionConfig(version).Hidden {
+		params["hidden"] = true
+	}
+	policy := st.seoPolicyFor(version)
+	if !policy.index {
+		params["noindex"] = true
+	}
+	if policy.sitemap.exclude {
+		params["sitemap_exclude"] = true
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// markSupportStatus sets the support params of the named version on every
+// page in the version directory dir.
+func (st *state) markSupportStatus(log logr.Logger, dir string, params map[string]interface{}) error {
+	log.Info("Marking pages with the support status of the version", "params", params)
+	return st.updatePages(dir, func(rel string, p *page) (bool, error) {
+		st.setParams(p.frontMatter, params)
+		return true, nil
+	})
+}
+
+// applySEOParams injects the params derived from the support status and
+// search engine policy of each version into its pages once all versions have
+// been copied.
+func (st *state) applySEOParams(log logr.Logger, versions map[string]string) error {
+	canonicalPages := make(map[string]map[string]bool)
+	for _, vers := range sortedVersionNames(versions) {
+		log := log.WithValues("version", vers)
+		dir := st.versionDir(vers)
+		canonical := st.seoPolicyFor(vers).canonical
+		params := st.supportParams(vers)
+		if st.opts.Output.CopyMode == copyModeMount {
+			if canonical != "" || params != nil {
+				log.Info("WARNING: the support status and search engine policy of the version cannot be applied to its pages with --copy-mode=mount")
+			}
+			continue
+		}
+		if _, ok := versions[canonical]; canonical != "" && !ok {
+			log.Info("WARNING: the canonical version is not being built, no canonical URLs are added", "canonical", canonical)
+		} else if canonical != "" {
+			if canonicalPages[canonical] == nil {
+				pages, err := st.listPages(st.versionDir(canonical))
+				if err != nil {
+					return err
+				}
+				canonicalPages[canonical] = pages
+			}
+			if err := st.addCanonicalURLs(log, dir, canonical, canonicalPages[canonical]); err != nil {
+				return err
+			}
+		}
+		if params != nil {
+			if err := st.markSupportStatus(log, dir, params); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
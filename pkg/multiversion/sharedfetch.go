@@ -0,0 +1,83 @@
+package multiversion
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// sharedFetch is a source tree fetched once for every version built from the
+// same branch of the same source.
+type sharedFetch struct {
+	done    chan struct{}
+	version string
+	loc     string
+	err     error
+}
+
+// sharedFetchKey returns the key identifying the source tree of a version
+// fetched to tmpdir, which is the same for every version fetched from the
+// same branch of the same remote or archive. It returns an empty string if the
+// version's tree must be fetched on its own, as it is fetched with a custom
+// Fetcher or from a local directory, or is modified by pins or preCopy hooks
+// before it is copied.
+func (st *state) sharedFetchKey(tmpdir, vers, branch string, vc *VersionConfig) string {
+	if _, custom := st.opts.Fetch.Fetchers[vers]; custom || len(vc.Pins) > 0 || len(vc.hooks(st.opts).PreCopy) > 0 {
+		return ""
+	}
+	var source string
+	switch vc.fetcher(st.opts) {
+	case fetcherGit, fetcherGoGit:
+		source = vc.Remote + "\x00" + vc.repoURL(st.opts) + "\x00" + branch
+	case fetcherArchive:
+		source = vc.Archive
+	default:
+		return ""
+	}
+	return strings.Join([]string{tmpdir, vc.fetcher(st.opts), source}, "\x00")
+}
+
+// fetchSharedVersion fetches the source tree of a version with its fetcher,
+// reusing the tree already fetched for another version built from the same
+// branch of the same source, so that a branch published under several
+// version names is only cloned once. It returns the path to the root of the
+// tree.
+func (st *state) fetchSharedVersion(ctx context.Context, log logr.Logger, tmpdir, vers, branch string, vc *VersionConfig) (string, error) {
+	key := st.sharedFetchKey(tmpdir, vers, branch, vc)
+	if key == "" {
+		return st.fetchVersion(ctx, tmpdir, vers, branch, vc)
+	}
+
+	st.sharedFetchesMu.Lock()
+	f, fetched := st.sharedFetches[key]
+	if !fetched {
+		f = &sharedFetch{done: make(chan struct{}), version: vers}
+		st.sharedFetches[key] = f
+	}
+	st.sharedFetchesMu.Unlock()
+
+	if !fetched {
+		f.loc, f.err = st.fetchVersion(ctx, tmpdir, vers, branch, vc)
+		close(f.done)
+		return f.loc, f.err
+	}
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if f.err != nil {
+		return "", f.err
+	}
+	log.Info("Reusing source tree fetched for another version of the same branch", "sharedWith", f.version)
+	return f.loc, nil
+}
+
+// forgetSharedFetches clears the source trees fetched so far, so that they
+// are fetched again.
+func (st *state) forgetSharedFetches() {
+	st.sharedFetchesMu.Lock()
+	defer st.sharedFetchesMu.Unlock()
+	st.sharedFetches = map[string]*sharedFetch{}
+}
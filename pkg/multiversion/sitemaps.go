@@ -0,0 +1,289 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// robotsBegin and robotsEnd delimit the section of --robots-file written
+	// by hugo-multiversion. The rest of the file is left as it is.
+	robotsBegin = "# BEGIN hugo-multiversion"
+	robotsEnd   = "# END hugo-multiversion"
+
+	// sitemapIndexFile is the name of the sitemap index in --sitemap-dir.
+	sitemapIndexFile = "index.xml"
+)
+
+// sitemapChangeFreqs are the values of a sitemap's 'changefreq' field.
+var sitemapChangeFreqs = map[string]bool{"always": true, "hourly": true, "daily": true, "weekly": true, "monthly": true, "yearly": true, "never": true}
+
+// SitemapConfig overrides the sitemap hints given to the pages of a version
+// by its seoPolicy.
+type SitemapConfig struct {
+	// Exclude leaves the pages of the version out of sitemaps. Defaults to
+	// true for deprecated, EOL and hidden versions, and for versions that
+	// are not indexed.
+	Exclude *bool `yaml:"exclude"`
+
+	// ChangeFreq is how often the pages of the version are expected to
+	// change, e.g. 'weekly'.
+	ChangeFreq string `yaml:"changefreq"`
+
+	// Priority is the priority of the pages of the version relative to the
+	// other pages of the site, between 0.0 and 1.0.
+	Priority *float64 `yaml:"priority"`
+}
+
+// validate returns an error if the sitemap hints are invalid.
+func (s *SitemapConfig) validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.ChangeFreq != "" && !sitemapChangeFreqs[s.ChangeFreq] {
+		return fmt.Errorf("sitemap: changefreq must be one of 'always', 'hourly', 'daily', 'weekly', 'monthly', 'yearly' or 'never'")
+	}
+	if s.Priority != nil && (*s.Priority < 0 || *s.Priority > 1) {
+		return fmt.Errorf("sitemap: priority must be between 0.0 and 1.0")
+	}
+	return nil
+}
+
+// sitemapHint is how the pages of a version are listed in sitemaps.
+type sitemapHint struct {
+	changeFreq string
+	priority   float64
+	// exclude is set for versions whose pages are left out of sitemaps.
+	exclude bool
+}
+
+// validateSitemaps returns an error if sitemaps and robots.txt cannot be
+// written with the options given.
+func (st *state) validateSitemaps() error {
+	if (st.opts.Output.SitemapDir != "" || st.opts.Output.RobotsFile != "") && st.opts.Output.BaseURL == "" {
+		return fmt.Errorf("must be set with --sitemap-dir or --robots-file, as sitemaps are listed by absolute URL")
+	}
+	if u := st.opts.Output.BaseURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return fmt.Errorf("%q must be an http:// or https:// URL", u)
+	}
+	return nil
+}
+
+// sitemapHintFor returns the sitemap hints of the named version, as given
+// by its seoPolicy.
+func (st *state) sitemapHintFor(version string) sitemapHint {
+	return st.seoPolicyFor(version).sitemap
+}
+
+// writeSitemapHints cascades Hugo's 'sitemap' front matter from the _index
+// page at the root of each version, so that Hugo's own sitemap lists the
+// pages of each version with its hints, and leaves out the pages of excluded
+// versions. The hints are written once the support status of every version
+// is known, replacing those of the _index page itself, but other pages that
+// set the fields keep their own values.
+func (st *state) writeSitemapHints(log logr.Logger, versions map[string]string) error {
+	if !st.opts.Transform.SitemapHints {
+		return nil
+	}
+	for _, vers := range sortedVersionNames(versions) {
+		hint := st.sitemapHintFor(vers)
+		fields := map[string]interface{}{
+			"changefreq": hint.changeFreq,
+			"priority":   hint.priority,
+		}
+		if hint.exclude {
+			fields["disable"] = true
+		}
+		sitemap := map[string]interface{}{"sitemap": fields}
+		indexPath, p, err := st.readOrCreateSectionIndex(st.versionDir(vers), vers)
+		if err != nil {
+			return err
+		}
+		mergeFields(p.frontMatter, sitemap, true)
+		mergeCascadeFields(p.frontMatter, sitemap)
+		log.V(4).Info("Writing sitemap hints", "version", vers, "path", indexPath, "hints", fields)
+		if err := st.writePage(indexPath, p, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sitemapURLSet is a sitemap, as defined by sitemaps.org.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// sitemapIndex is a sitemap index, listing other sitemaps.
+type sitemapIndex struct {
+	XMLName  xml.Name         `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapIndexed `xml:"sitemap"`
+}
+
+type sitemapIndexed struct {
+	Loc string `xml:"loc"`
+}
+
+// absoluteURL returns the URL path u on --base-url.
+func (st *state) absoluteURL(u string) string {
+	return strings.TrimSuffix(st.opts.Output.BaseURL, "/") + u
+}
+
+// sitemapLoc returns the URL of the named file in --sitemap-dir.
+func (st *state) sitemapLoc(name string) string {
+	u := st.opts.Output.SitemapURL
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	return st.absoluteURL(u + name)
+}
+
+// writeXML writes v to the file at path with an XML declaration.
+func writeXML(path string, v interface{}) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
+
+// writeSitemaps writes a sitemap of the pages of each version that is not
+// excluded from sitemaps to --sitemap-dir as <version>.xml, and a sitemap
+// index listing them as index.xml. Other sitemaps in the directory, such as
+// those of versions that are no longer built or have since been excluded,
+// are removed.
+func (st *state) writeSitemaps(log logr.Logger, idx *contentIndex) error {
+	if st.opts.Output.SitemapDir == "" {
+		return nil
+	}
+	written := map[string]bool{sitemapIndexFile: true}
+	index := sitemapIndex{Sitemaps: []sitemapIndexed{}}
+	for _, vers := range idx.versions {
+		hint := st.sitemapHintFor(vers)
+		if hint.exclude {
+			continue
+		}
+		pages := make([]string, 0, len(idx.pages[vers]))
+		for pp := range idx.pages[vers] {
+			pages = append(pages, pp)
+		}
+		sort.Strings(pages)
+		set := sitemapURLSet{URLs: make([]sitemapURL, len(pages))}
+		for i, pp := range pages {
+			set.URLs[i] = sitemapURL{
+				Loc:        st.absoluteURL(st.versionURL(vers) + pp),
+				ChangeFreq: hint.changeFreq,
+				Priority:   fmt.Sprintf("%.1f", hint.priority),
+			}
+		}
+		name := strings.Replace(vers, "/", "-", -1) + ".xml"
+		if err := writeXML(filepath.Join(st.opts.Output.SitemapDir, name), set); err != nil {
+			return err
+		}
+		written[name] = true
+		index.Sitemaps = append(index.Sitemaps, sitemapIndexed{Loc: st.sitemapLoc(name)})
+	}
+	if err := writeXML(filepath.Join(st.opts.Output.SitemapDir, sitemapIndexFile), index); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(st.opts.Output.SitemapDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() && filepath.Ext(f.Name()) == ".xml" && !written[f.Name()] {
+			log.V(4).Info("Removing stale sitemap", "path", filepath.Join(st.opts.Output.SitemapDir, f.Name()))
+			if err := os.Remove(filepath.Join(st.opts.Output.SitemapDir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	log.Info("Writing sitemaps", "path", st.opts.Output.SitemapDir, "sitemaps", len(index.Sitemaps))
+	return nil
+}
+
+// robotsSection returns the section of robots.txt written by
+// hugo-multiversion, which disallows crawling the versions that are not
+// indexed and their aliases, and points at the sitemap index.
+func (st *state) robotsSection(versions []string) string {
+	var disallow []string
+	for _, vers := range versions {
+		if st.seoPolicyFor(vers).index {
+			continue
+		}
+		// the pages of other versions are nested beneath --root-version
+		if u := st.versionURL(vers); u != "/" {
+			disallow = append(disallow, u)
+		}
+		for _, alias := range st.opts.versionConfig(vers).Aliases {
+			disallow = append(disallow, st.versionURL(alias))
+		}
+	}
+	sort.Strings(disallow)
+
+	var b strings.Builder
+	b.WriteString(robotsBegin + "\n")
+	if len(disallow) > 0 {
+		b.WriteString("User-agent: *\n")
+		for _, u := range disallow {
+			b.WriteString("Disallow: " + u + "\n")
+		}
+	}
+	if st.opts.Output.SitemapDir != "" {
+		b.WriteString("Sitemap: " + st.sitemapLoc(sitemapIndexFile) + "\n")
+	}
+	b.WriteString(robotsEnd + "\n")
+	return b.String()
+}
+
+// writeRobots writes the section of --robots-file generated from the
+// versions, replacing the section written by a previous build and keeping
+// the rest of the file.
+func (st *state) writeRobots(log logr.Logger, versions []string) error {
+	if st.opts.Output.RobotsFile == "" {
+		return nil
+	}
+	existing, err := ioutil.ReadFile(st.opts.Output.RobotsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	section := st.robotsSection(versions)
+	var data []byte
+	begin, end := bytes.Index(existing, []byte(robotsBegin)), bytes.Index(existing, []byte(robotsEnd))
+	switch {
+	case begin >= 0 && end > begin:
+		end += len(robotsEnd)
+		if end < len(existing) && existing[end] == '\n' {
+			end++
+		}
+		data = append(append(append([]byte{}, existing[:begin]...), section...), existing[end:]...)
+	case len(existing) > 0:
+		data = append(bytes.TrimRight(existing, "\n"), "\n\n"+section...)
+	default:
+		data = []byte(section)
+	}
+	if err := os.MkdirAll(filepath.Dir(st.opts.Output.RobotsFile), 0755); err != nil {
+		return err
+	}
+	log.Info("Writing robots.txt", "path", st.opts.Output.RobotsFile)
+	return ioutil.WriteFile(st.opts.Output.RobotsFile, data, 0644)
+}
@@ -0,0 +1,124 @@
+package multiversion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// builtCommit is a commit that a version was built from.
+type builtCommit struct {
+	version string
+	branch  string
+	commit  string
+}
+
+// validateSnapshotTag returns an error if --snapshot-tag would give every
+// version the same tag.
+func (st *state) validateSnapshotTag() error {
+	if !strings.Contains(st.opts.Snapshot.TagTemplate, "{version}") {
+		return fmt.Errorf("must contain the {version} placeholder")
+	}
+	return nil
+}
+
+// snapshotTagName returns the name of the tag created for the version by the
+// snapshot command on the given date.
+func (st *state) snapshotTagName(version string, date time.Time) string {
+	r := strings.NewReplacer("{version}", version, "{date}", date.Format("2006-01-02"))
+	return r.Replace(st.opts.Snapshot.TagTemplate)
+}
+
+// builtCommits returns the commit each version was built from, read from
+// the manifests in --manifest-dir or the recording in --replay.
+func (st *state) builtCommits() ([]builtCommit, error) {
+	var commits []builtCommit
+	switch {
+	case st.opts.Jobs.ManifestDir != "":
+		manifests, err := st.loadManifests(st.opts.Jobs.ManifestDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range manifests {
+			commits = append(commits, builtCommit{version: m.Name, branch: m.Branch, commit: m.Commit})
+		}
+	case st.opts.Fetch.ReplayDir != "":
+		rec, err := loadRecording(st.opts.Fetch.ReplayDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range rec.Versions {
+			commits = append(commits, builtCommit{version: v.Name, branch: v.Branch, commit: v.Commit})
+		}
+	default:
+		return nil, fmt.Errorf("--manifest-dir or --replay must be set to the manifests or recording of the build")
+	}
+	sort.Slice(commits, func(i, j int) bool { return commits[i].version < commits[j].version })
+	return commits, nil
+}
+
+// runSnapshot tags the commit each version of a build was built from in the
+// repository it was fetched from, so that the published content can be
+// recovered after its branch has moved on. Tags that already exist are only
+// accepted if they point at the same commit, and are never moved.
+func (st *state) runSnapshot() error {
+	commits, err := st.builtCommits()
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("no versions were built")
+	}
+
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(st.log, tmpdir)
+	if _, err := st.commandOutput(st.log, tmpdir, "git", "init", "--quiet", "--bare"); err != nil {
+		return err
+	}
+
+	date := time.Now().UTC()
+	created := 0
+	for _, c := range commits {
+		log := st.log.WithValues("version", c.version, "branch", c.branch)
+		if c.commit == "" {
+			log.Info("WARNING: version was not fetched using git, it cannot be snapshotted")
+			continue
+		}
+		tag := st.snapshotTagName(c.version, date)
+		if _, err := st.commandOutput(log, tmpdir, "git", "check-ref-format", "refs/tags/"+tag); err != nil {
+			return fmt.Errorf("version %q: %q is not a valid tag name", c.version, tag)
+		}
+		r := st.opts.versionConfig(c.version).remote(st.opts)
+		existing, err := st.lsRemote(log, r, []string{"refs/tags/" + tag})
+		if err != nil {
+			return err
+		}
+		if sha, ok := existing[tag]; ok {
+			if sha != c.commit {
+				return fmt.Errorf("version %q: tag %q already exists at commit %s, not %s", c.version, tag, sha, c.commit)
+			}
+			log.Info("Snapshot tag already exists", "tag", tag, "commit", c.commit)
+			continue
+		}
+
+		env, err := r.env()
+		if err != nil {
+			return err
+		}
+		log.Info("Tagging built commit", "tag", tag, "commit", c.commit, "repo", r.URL)
+		if _, err := st.commandOutputEnv(log, env, tmpdir, "git", "fetch", "--quiet", "--no-tags", r.URL, c.commit); err != nil {
+			return fmt.Errorf("version %q: fetching commit %s: %v", c.version, c.commit, err)
+		}
+		if _, err := st.commandOutputEnv(log, env, tmpdir, "git", "push", "--quiet", r.URL, c.commit+":refs/tags/"+tag); err != nil {
+			return fmt.Errorf("version %q: pushing tag %q: %v", c.version, tag, err)
+		}
+		created++
+	}
+	st.log.Info("Snapshot complete", "tags", created)
+	return nil
+}
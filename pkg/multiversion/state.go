@@ -0,0 +1,94 @@
+package multiversion
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// state is the state of a single call to a Builder's methods. Each call gets
+// its own state, so builders may run concurrently within a process.
+type state struct {
+	// opts are the options of the Builder.
+	opts *Config
+	// log is the logger of the Builder.
+	log logr.Logger
+	// runCtx is the context of the call. Commands and requests are cancelled
+	// once it is done.
+	runCtx context.Context
+
+	// outputAudit is the audit log of the build, or nil if --audit-log is not
+	// set.
+	outputAudit *auditLog
+	// syncedChanges are the files written to or deleted from the output
+	// directory by --delta-sync, relative to the directory of each version
+	// and keyed by version.
+	syncedChanges map[string][]string
+	// reviewRouting holds the routing data of each version built.
+	reviewRouting map[string]*versionRouting
+	// discoveredVersions are the versions discovered by the Builder, keyed by
+	// version name.
+	discoveredVersions map[string]*discoveredVersion
+	// loadedGlossaries holds the terms and definitions read from the glossary
+	// files of each version, keyed by version name.
+	loadedGlossaries map[string]map[string]string
+	// hugoServerExited receives the result of the Hugo server started in
+	// watch mode once it exits. It is nil if no server is running.
+	hugoServerExited chan error
+	// loadedVersionMetadata holds the metadata read from each version, keyed
+	// by version name.
+	loadedVersionMetadata map[string]*versionMetadata
+	// metrics holds the metrics of the build.
+	metrics *buildMetrics
+	// output is the storage that versions are written to.
+	output outputFS
+	// reportMu guards versionReports, and the fields of each report.
+	reportMu sync.Mutex
+	// versionReports are the reports of the versions built, keyed by version
+	// name.
+	versionReports  map[string]*versionReport
+	sharedFetchesMu sync.Mutex
+	// sharedFetches are the source trees fetched so far, keyed by
+	// sharedFetchKey.
+	sharedFetches map[string]*sharedFetch
+	// commandStdout is where the output of commands run with --debug is
+	// written. It is stderr when the output directory is streamed to stdout.
+	commandStdout io.Writer
+	// computedSupport holds the support status of each built version,
+	// computed by computeSupportStatus.
+	computedSupport map[string]supportStatus
+	// publishedOutputDir is the output directory content is synced to when
+	// --delta-sync is set, whilst outputDir points at the staging directory.
+	publishedOutputDir string
+	// tracing records the spans of the build, or is nil if tracing is
+	// disabled.
+	tracing *tracer
+	// runSpan is the span of the build or rebuild, which the spans of its
+	// phases are children of.
+	runSpan *traceSpan
+}
+
+// newState returns the state of a call made with the given context and
+// options.
+func newState(ctx context.Context, c *Config) *state {
+	st := &state{
+		opts:                  c,
+		log:                   c.Log,
+		runCtx:                ctx,
+		syncedChanges:         map[string][]string{},
+		reviewRouting:         map[string]*versionRouting{},
+		loadedGlossaries:      map[string]map[string]string{},
+		loadedVersionMetadata: map[string]*versionMetadata{},
+		metrics:               newBuildMetrics(),
+		output:                localFS{},
+		versionReports:        map[string]*versionReport{},
+		sharedFetches:         map[string]*sharedFetch{},
+		commandStdout:         os.Stdout,
+		computedSupport:       map[string]supportStatus{},
+	}
+	st.tracing = st.newTracer()
+	return st
+}
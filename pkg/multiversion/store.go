@@ -0,0 +1,305 @@
+package multiversion
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// storeManifestFile is the file a kept build's manifest is written to within
+// its directory in --builds-dir, in place of a copy of the output directory.
+const storeManifestFile = "output.json"
+
+// storeSymlinkPrefix prefixes the target of a symlink in a storeManifest, in
+// place of the key of an object.
+const storeSymlinkPrefix = "symlink:"
+
+// storeManifest maps the slash-separated path of each file in a tree to the
+// key of the object in --store-dir holding its content.
+type storeManifest map[string]string
+
+// storeStats counts the files handled by storeTree.
+type storeStats struct {
+	added, linked, unchanged int
+}
+
+// validateStore returns an error if the output directory cannot be backed by
+// --store-dir with the other flags.
+func (st *state) validateStore() error {
+	if st.opts.Output.StoreDir == "" {
+		return nil
+	}
+	if st.opts.Output.CopyMode != copyModeCopy {
+		return fmt.Errorf("cannot be used with --copy-mode=%s", st.opts.Output.CopyMode)
+	}
+	if st.opts.Output.Archive != "" || len(st.opts.Languages.Languages) > 0 || st.opts.Transform.PreserveMtimes {
+		return fmt.Errorf("cannot be used with --output, --languages or --preserve-mtimes")
+	}
+	for _, dir := range []string{st.opts.Output.Dir, st.opts.Output.DataDir} {
+		if dir != "" && withinDir(dir, st.opts.Output.StoreDir) {
+			return fmt.Errorf("must not be within --output-dir or --data-dir")
+		}
+	}
+	return nil
+}
+
+// storeObject returns the path of the object with the given key.
+func (st *state) storeObject(key string) string {
+	return filepath.Join(st.opts.Output.StoreDir, "objects", key[:2], key[2:])
+}
+
+// storeKey returns the key of the object holding the content of the file at
+// fp, which is the SHA256 of its content and its permissions, as files
+// sharing an object share permissions too.
+func storeKey(fp string, info os.FileInfo) (string, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%o", hex.EncodeToString(h.Sum(nil)), info.Mode().Perm()), nil
+}
+
+// storeOutput adds each file in the output directory to --store-dir and
+// replaces it with a hard link to its object, so that identical files across
+// versions and builds are only stored once. It returns the manifest of the
+// output directory, or nil if --store-dir is not set.
+func (st *state) storeOutput(log logr.Logger) (storeManifest, error) {
+	if st.opts.Output.StoreDir == "" {
+		return nil, nil
+	}
+	manifest, stats, err := st.storeTree(st.opts.Output.Dir)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Stored output directory", "path", st.opts.Output.StoreDir, "files", len(manifest), "added", stats.added, "linked", stats.linked, "unchanged", stats.unchanged)
+	return manifest, nil
+}
+
+// storeTree adds each file beneath dir to the store, replacing it with a
+// hard link to its object if it is not one already. The content of a file is
+// unchanged by linking it, so it is not recorded to the audit log.
+func (st *state) storeTree(dir string) (storeManifest, *storeStats, error) {
+	manifest := storeManifest{}
+	stats := &storeStats{}
+	err := filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(fp)
+			if err != nil {
+				return err
+			}
+			manifest[rel] = storeSymlinkPrefix + target
+			return nil
+		}
+		key, err := storeKey(fp, info)
+		if err != nil {
+			return err
+		}
+		manifest[rel] = key
+		obj := st.storeObject(key)
+		objInfo, err := os.Stat(obj)
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+				return err
+			}
+			stats.added++
+			return storeLinkError(os.Link(fp, obj))
+		}
+		if err != nil {
+			return err
+		}
+		if os.SameFile(info, objInfo) {
+			stats.unchanged++
+			return nil
+		}
+		tmp := fp + ".multiversion-link"
+		if err := storeLinkError(os.Link(obj, tmp)); err != nil {
+			return err
+		}
+		stats.linked++
+		return os.Rename(tmp, fp)
+	})
+	return manifest, stats, err
+}
+
+// storeLinkError explains an error hard linking a file into or out of the
+// store.
+func storeLinkError(err error) error {
+	if err != nil {
+		return fmt.Errorf("%v (--store-dir must be on the same filesystem as --output-dir)", err)
+	}
+	return nil
+}
+
+// materializeTree creates the tree described by manifest in dir, which must
+// not exist, out of hard links to the objects in the store.
+func (st *state) materializeTree(manifest storeManifest, dir string) error {
+	for rel, key := range manifest {
+		fp := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			return err
+		}
+		if strings.HasPrefix(key, storeSymlinkPrefix) {
+			if err := os.Symlink(strings.TrimPrefix(key, storeSymlinkPrefix), fp); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := storeLinkError(os.Link(st.storeObject(key), fp)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadStoreManifest reads the manifest of a kept build.
+func loadStoreManifest(path string) (storeManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := storeManifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return manifest, nil
+}
+
+// collectStore removes the objects that are neither in the output directory,
+// as described by its manifest, nor in a build kept in --builds-dir.
+func (st *state) collectStore(log logr.Logger, current storeManifest) error {
+	if st.opts.Output.StoreDir == "" {
+		return nil
+	}
+	used := map[string]bool{}
+	for _, key := range current {
+		used[key] = true
+	}
+	if st.opts.Output.BuildsDir != "" {
+		kb, err := st.loadKeptBuilds()
+		if err != nil {
+			return err
+		}
+		for _, b := range kb.Builds {
+			manifest, err := loadStoreManifest(filepath.Join(st.opts.Output.BuildsDir, b.ID, storeManifestFile))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, key := range manifest {
+				used[key] = true
+			}
+		}
+	}
+
+	objects := filepath.Join(st.opts.Output.StoreDir, "objects")
+	var removed int
+	err := filepath.Walk(objects, func(fp string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && fp == objects {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		key := filepath.Base(filepath.Dir(fp)) + info.Name()
+		if used[key] {
+			return nil
+		}
+		removed++
+		return os.Remove(fp)
+	})
+	if err != nil {
+		return err
+	}
+	log.V(4).Info("Removed unused objects from the store", "removed", removed, "used", len(used))
+	return nil
+}
+
+// keepOutput stores the output of a build in --store-dir, keeps it for
+// rollback if every version was built, and then removes the objects that are
+// no longer used.
+func (st *state) keepOutput(log logr.Logger, versionMap map[string]string, complete bool) error {
+	manifest, err := st.storeOutput(log)
+	if err != nil {
+		return fmt.Errorf("storing output: %v", err)
+	}
+	if complete {
+		if err := st.keepBuild(log, versionMap, manifest); err != nil {
+			return fmt.Errorf("keeping build for rollback: %v", err)
+		}
+	}
+	return st.collectStore(log, manifest)
+}
+
+// storeFS is an outputFS backed by --store-dir. Files in the output directory
+// may be hard links to objects in the store, so files are removed before they
+// are written rather than being truncated, which would modify the object and
+// every other file linked to it.
+type storeFS struct {
+	outputFS
+}
+
+// storeLinkFS is a storeFS for an output that supports links.
+type storeLinkFS struct {
+	storeFS
+	linkFS
+}
+
+// useStore wraps the output so that files linked to objects in --store-dir
+// are never modified in place.
+func (st *state) useStore() {
+	if st.opts.Output.StoreDir == "" {
+		return
+	}
+	s := storeFS{st.output}
+	if l, ok := st.output.(linkFS); ok {
+		st.output = storeLinkFS{s, l}
+		return
+	}
+	st.output = s
+}
+
+// unlink removes the file at name if it exists, so that it can be written
+// without modifying the object it may be linked to.
+func (s storeFS) unlink(name string) error {
+	if info, err := s.outputFS.Stat(name); err != nil || info.IsDir() {
+		return nil
+	}
+	return s.outputFS.Remove(name)
+}
+
+func (s storeFS) Create(name string, perm os.FileMode) (io.WriteCloser, error) {
+	if err := s.unlink(name); err != nil {
+		return nil, err
+	}
+	return s.outputFS.Create(name, perm)
+}
+
+func (s storeFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := s.unlink(name); err != nil {
+		return err
+	}
+	return s.outputFS.WriteFile(name, data, perm)
+}
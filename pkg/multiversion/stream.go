@@ -0,0 +1,124 @@
+package multiversion
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// streamOutput is the value of --output that streams the output directory as
+// a tar archive to stdout.
+const streamOutput = "-"
+
+// validateOutput returns an error if --output is not supported or cannot be
+// used with the other flags.
+func (st *state) validateOutput() error {
+	switch st.opts.Output.Archive {
+	case "":
+		return nil
+	case streamOutput:
+	default:
+		return fmt.Errorf("unsupported output %q, only '-' is supported", st.opts.Output.Archive)
+	}
+	switch {
+	case st.opts.Output.CopyMode != copyModeCopy:
+		return fmt.Errorf("cannot be used with --copy-mode=%s", st.opts.Output.CopyMode)
+	case st.opts.Output.DeltaSync:
+		return fmt.Errorf("cannot be used with --delta-sync")
+	case st.opts.Output.AuditLog != "":
+		return fmt.Errorf("cannot be used with --audit-log, as content is not written to disk")
+	case st.opts.Watch.Enabled:
+		return fmt.Errorf("cannot be used with --watch")
+	case len(st.opts.Languages.Languages) > 0:
+		return fmt.Errorf("cannot be used with --languages")
+	case st.opts.Jobs.FinalizeOnly:
+		return fmt.Errorf("cannot be used with --finalize-only")
+	case st.opts.Hugo.Run:
+		return fmt.Errorf("cannot be used with --run-hugo, as content is not written to disk")
+	}
+	return nil
+}
+
+// setupStreamOutput assembles content in memory rather than on disk if the
+// output directory is streamed to stdout.
+func (st *state) setupStreamOutput() {
+	if st.opts.Output.Archive != streamOutput {
+		return
+	}
+	st.output = newMemFS()
+	st.commandStdout = os.Stderr
+}
+
+// writeStreamOutput writes the output directory to stdout as a tar archive, if
+// --output=- is set.
+func (st *state) writeStreamOutput(log logr.Logger) error {
+	if st.opts.Output.Archive != streamOutput {
+		return nil
+	}
+	log.Info("Writing output directory to stdout as a tar archive")
+	return st.writeTar(os.Stdout, st.opts.Output.Dir, "", nil)
+}
+
+// writeTar writes the tree rooted at dir in the output to w as a tar archive.
+// Paths in the archive are relative to dir, within the directory prefix if it
+// is not empty. The directories in skip directly beneath dir are left out.
+func (st *state) writeTar(w io.Writer, dir, prefix string, skip map[string]bool) error {
+	tw := tar.NewWriter(w)
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+	if prefix != "" {
+		// write the parent directories of the prefix first
+		parts := strings.Split(prefix, "/")
+		for i := range parts {
+			hdr := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     strings.Join(parts[:i+1], "/") + "/",
+				Mode:     0755,
+				ModTime:  time.Now(),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+	}
+	err := st.output.Walk(dir, skipVersionDirs(dir, skip, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := st.output.Open(fp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
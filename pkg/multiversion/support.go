@@ -0,0 +1,144 @@
+package multiversion
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// SupportPolicy contains rules used to determine which versions have reached
+// their end of life (EOL). A version is EOL if any rule marks it as EOL.
+type SupportPolicy struct {
+	// LatestVersions is the number of the newest versions, including
+	// 'latest', that are supported. Older versions are EOL.
+	LatestVersions int `yaml:"latestVersions"`
+
+	// SupportPeriod is how long each version is supported for after its
+	// release date, e.g. '9m'. Supported units are d, w, m and y.
+	// Versions without a release date are not affected by this rule.
+	SupportPeriod string `yaml:"supportPeriod"`
+
+	// DeprecateEOL marks EOL versions as deprecated.
+	DeprecateEOL bool `yaml:"deprecateEOL"`
+}
+
+// supportStatus is the computed support status of a version.
+type supportStatus struct {
+	eol bool
+	// eolDate is the date the version's support period ends, if known.
+	eolDate time.Time
+}
+
+var supportPeriodRE = regexp.MustCompile(`^([0-9]+)([dwmy])$`)
+
+// parseSupportPeriod returns a function that adds the support period given
+// as a string to a release date.
+func parseSupportPeriod(period string) (func(time.Time) time.Time, error) {
+	m := supportPeriodRE.FindStringSubmatch(period)
+	if m == nil {
+		return nil, fmt.Errorf("invalid support period %q, must be a number followed by one of d, w, m or y", period)
+	}
+	n, _ := strconv.Atoi(m[1])
+	return func(t time.Time) time.Time {
+		switch m[2] {
+		case "d":
+			return t.AddDate(0, 0, n)
+		case "w":
+			return t.AddDate(0, 0, 7*n)
+		case "m":
+			return t.AddDate(0, n, 0)
+		}
+		return t.AddDate(n, 0, 0)
+	}, nil
+}
+
+// validate returns an error if the support policy is invalid.
+func (p *SupportPolicy) validate() error {
+	if p.LatestVersions < 0 {
+		return fmt.Errorf("latestVersions must not be negative")
+	}
+	if p.SupportPeriod != "" {
+		if _, err := parseSupportPeriod(p.SupportPeriod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseDate returns the release date of the named version, as set in the
+// config file or the version's metadata file, or otherwise the date its
+// release was published if it was discovered from a release.
+func (st *state) releaseDate(version string) (time.Time, bool, error) {
+	s := st.opts.versionConfig(version).ReleaseDate
+	if s == "" {
+		s = st.metadataFor(version).ReleaseDate
+	}
+	if dv := st.discoveredVersions[version]; s == "" && dv != nil && !dv.published.IsZero() {
+		return dv.published.Truncate(24 * time.Hour), true, nil
+	}
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid release date %q for version %q, must be of the form YYYY-MM-DD", s, version)
+	}
+	return t, true, nil
+}
+
+// eolDate returns the 'eolDate' set for the version in the config file, or
+// the zero time if it is not set.
+func (vc *VersionConfig) eolDate() (time.Time, error) {
+	if vc.EOLDate == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", vc.EOLDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid eolDate %q, must be of the form YYYY-MM-DD", vc.EOLDate)
+	}
+	return t, nil
+}
+
+// computeSupportStatus applies the support policy in the config file to the
+// built versions, as of now. Versions with 'eolDate' set in the config file
+// are EOL from that date rather than as computed by the policy, and versions
+// with 'eol' set are not affected by the policy or their 'eolDate'.
+func (st *state) computeSupportStatus(versions map[string]string, now time.Time) error {
+	st.computedSupport = map[string]supportStatus{}
+	var addPeriod func(time.Time) time.Time
+	policy := st.opts.SupportPolicy
+	if policy != nil && policy.SupportPeriod != "" {
+		addPeriod, _ = parseSupportPeriod(policy.SupportPeriod)
+	}
+	for i, vers := range sortedVersionNames(versions) {
+		var status supportStatus
+		if addPeriod != nil {
+			released, ok, err := st.releaseDate(vers)
+			if err != nil {
+				return err
+			}
+			if ok {
+				status.eolDate = addPeriod(released)
+				status.eol = !now.Before(status.eolDate)
+			}
+		}
+		if policy != nil && policy.LatestVersions > 0 && i >= policy.LatestVersions {
+			status.eol = true
+		}
+		if eolDate, _ := st.opts.versionConfig(vers).eolDate(); !eolDate.IsZero() {
+			status.eolDate = eolDate
+			status.eol = status.eol || !now.Before(eolDate)
+		}
+		if eol := st.opts.versionConfig(vers).EOL; eol != nil {
+			status.eol = *eol
+		}
+		st.computedSupport[vers] = status
+	}
+	return nil
+}
+
+// isEOL returns true if the named version has reached its end of life.
+func (st *state) isEOL(version string) bool {
+	return st.computedSupport[version].eol
+}
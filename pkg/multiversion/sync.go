@@ -0,0 +1,206 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-logr/logr"
+)
+
+// finalOutputDir returns the directory content is ultimately written to.
+func (st *state) finalOutputDir() string {
+	if st.publishedOutputDir != "" {
+		return st.publishedOutputDir
+	}
+	return st.opts.Output.Dir
+}
+
+// validateDeltaSync returns an error if --delta-sync cannot be used with the
+// other flags.
+func (st *state) validateDeltaSync() error {
+	if !st.opts.Output.DeltaSync {
+		return nil
+	}
+	if st.opts.Output.CopyMode != copyModeCopy {
+		return fmt.Errorf("cannot be used with --copy-mode=%s", st.opts.Output.CopyMode)
+	}
+	if len(st.opts.Languages.Languages) > 0 {
+		return fmt.Errorf("cannot be used with --languages")
+	}
+	return nil
+}
+
+// stageOutput points outputDir at a staging directory within tmpdir, so that
+// versions are built and transformed there before being synced to the output
+// directory by syncStagedOutput.
+func (st *state) stageOutput(tmpdir string) {
+	st.publishedOutputDir = st.opts.Output.Dir
+	st.opts.Output.Dir = filepath.Join(tmpdir, "output")
+}
+
+// syncStagedOutput syncs each of the given versions from the staging
+// directory to the output directory, and points outputDir back at the output
+// directory.
+func (st *state) syncStagedOutput(log logr.Logger, versions map[string]string) error {
+	if st.publishedOutputDir == "" {
+		return nil
+	}
+	staging := st.opts.Output.Dir
+	st.opts.Output.Dir, st.publishedOutputDir = st.publishedOutputDir, ""
+	for _, vers := range sortedVersionNames(versions) {
+		log := log.WithValues("version", vers)
+		var skip map[string]bool
+		if st.versionPath(vers) == "" {
+			skip = st.nestedVersionDirs()
+		}
+		st.auditStep(vers, "delta-sync")
+		stats, err := st.syncDir(filepath.Join(staging, st.versionPath(vers)), st.versionDir(vers), skip)
+		if err != nil {
+			log.Error(err, "Failed to sync version to output directory")
+			return err
+		}
+		log.Info("Synced version to output directory", "written", stats.written, "unchanged", stats.unchanged, "deleted", stats.deleted)
+		st.syncedChanges[vers] = append(st.syncedChanges[vers], stats.changed...)
+	}
+	return nil
+}
+
+// syncStats counts the files handled by syncDir.
+type syncStats struct {
+	written, unchanged, deleted int
+	// changed are the files written or deleted, relative to the synced
+	// directory.
+	changed []string
+}
+
+// syncDir makes the directory dst identical to src, only writing files whose
+// content or permissions differ and deleting files that do not exist in src.
+// Files that are written keep the modification time of the file in src. The
+// directories in skip directly beneath src and dst are left untouched.
+func (st *state) syncDir(src, dst string, skip map[string]bool) (*syncStats, error) {
+	stats := &syncStats{}
+	keep := map[string]bool{}
+	err := filepath.Walk(src, skipVersionDirs(src, skip, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		keep[rel] = true
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			if existing, err := os.Lstat(target); err == nil && !existing.IsDir() {
+				st.outputAudit.record(auditDeleted, target)
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			return os.MkdirAll(target, info.Mode())
+		}
+		same, err := sameFile(fp, info, target)
+		if err != nil || same {
+			stats.unchanged++
+			return err
+		}
+		if existing, err := os.Lstat(target); err == nil && existing.IsDir() {
+			st.outputAudit.recordRemoval(filepath.Walk, target)
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		op := auditCreated
+		if _, err := os.Lstat(target); err == nil {
+			op = auditModified
+		}
+		tmp := target + ".multiversion-tmp"
+		if err := copyFile(fp, tmp); err != nil {
+			return err
+		}
+		if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+		stats.written++
+		stats.changed = append(stats.changed, filepath.ToSlash(rel))
+		if err := os.Rename(tmp, target); err != nil {
+			return err
+		}
+		st.outputAudit.record(op, target)
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	// remove files and directories that no longer exist in src, deepest
+	// first
+	var stale []string
+	err = filepath.Walk(dst, skipVersionDirs(dst, skip, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dst, fp)
+		if err != nil {
+			return err
+		}
+		if !keep[rel] {
+			stale = append(stale, fp)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(stale)))
+	for _, fp := range stale {
+		st.outputAudit.recordRemoval(filepath.Walk, fp)
+		err := filepath.Walk(fp, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dst, path)
+			stats.changed = append(stats.changed, filepath.ToSlash(rel))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(fp); err != nil {
+			return nil, err
+		}
+		stats.deleted++
+	}
+	return stats, nil
+}
+
+// sameFile returns true if the file at dst has the same content and
+// permissions as the file at src.
+func sameFile(src string, srcInfo os.FileInfo, dst string) (bool, error) {
+	dstInfo, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !dstInfo.Mode().IsRegular() || dstInfo.Size() != srcInfo.Size() || dstInfo.Mode().Perm() != srcInfo.Mode().Perm() {
+		return false, nil
+	}
+	a, err := ioutil.ReadFile(src)
+	if err != nil {
+		return false, err
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(a, b), nil
+}
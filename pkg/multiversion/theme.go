@@ -0,0 +1,42 @@
+package multiversion
+
+import (
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+)
+
+// themeFiles is the Hugo theme component containing partials and shortcodes
+// that consume the data files generated by this tool.
+//
+//go:embed theme
+var themeFiles embed.FS
+
+// installTheme writes the embedded theme component to dir, replacing any files
+// from a previous installation so that the templates always match the format
+// of the data files generated by this version of the tool.
+func installTheme(log logr.Logger, dir string) error {
+	log.Info("Installing theme component", "path", dir)
+	return fs.WalkDir(themeFiles, "theme", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel("theme", filepath.FromSlash(name))
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, rel)
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		data, err := themeFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dst, data, 0644)
+	})
+}
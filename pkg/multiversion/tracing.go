@@ -0,0 +1,304 @@
+package multiversion
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// otlpExportTimeout is how long exporting the spans of a build may take.
+const otlpExportTimeout = 10 * time.Second
+
+// traceparentRE matches a W3C trace context 'traceparent' header, capturing
+// the trace and parent span IDs.
+var traceparentRE = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// tracer records the spans of a build, which are exported to
+// --otlp-endpoint with OTLP over HTTP.
+type tracer struct {
+	traceID  string
+	parentID string
+
+	mu    sync.Mutex
+	ended []*traceSpan
+}
+
+// traceSpan is a phase of the build, such as fetching a version. All of its
+// methods may be called on a nil span, which is returned when tracing is
+// disabled.
+type traceSpan struct {
+	t        *tracer
+	name     string
+	spanID   string
+	parentID string
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs map[string]string
+	err   error
+}
+
+// otlpEndpoint returns the URL spans are exported to, or an empty string if
+// tracing is disabled. It defaults to the standard OpenTelemetry environment
+// variables if --otlp-endpoint is not set.
+func (st *state) otlpEndpoint() string {
+	if u := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); st.opts.Tracing.OTLPEndpoint == "" && u != "" {
+		return u
+	}
+	u := st.opts.Tracing.OTLPEndpoint
+	if u == "" {
+		u = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if u == "" || strings.HasSuffix(u, "/v1/traces") {
+		return u
+	}
+	return strings.TrimSuffix(u, "/") + "/v1/traces"
+}
+
+// otlpHeaders returns the headers sent when exporting spans, from
+// --otlp-headers or otherwise OTEL_EXPORTER_OTLP_HEADERS.
+func (st *state) otlpHeaders() (map[string]string, error) {
+	pairs := st.opts.Tracing.OTLPHeaders
+	if len(pairs) == 0 && os.Getenv("OTEL_EXPORTER_OTLP_HEADERS") != "" {
+		pairs = strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",")
+	}
+	headers := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("header %q must be of the form key=value", pair)
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers, nil
+}
+
+// otlpServiceName returns the service name spans are exported with.
+func (st *state) otlpServiceName() string {
+	switch {
+	case st.opts.Tracing.ServiceName != "":
+		return st.opts.Tracing.ServiceName
+	case os.Getenv("OTEL_SERVICE_NAME") != "":
+		return os.Getenv("OTEL_SERVICE_NAME")
+	}
+	return "hugo-multiversion"
+}
+
+// validateOTLPEndpoint returns an error if --otlp-endpoint is not an HTTP
+// URL.
+func (st *state) validateOTLPEndpoint() error {
+	if st.opts.Tracing.OTLPEndpoint != "" && !strings.HasPrefix(st.opts.Tracing.OTLPEndpoint, "http://") && !strings.HasPrefix(st.opts.Tracing.OTLPEndpoint, "https://") {
+		return fmt.Errorf("%q must be an http:// or https:// URL", st.opts.Tracing.OTLPEndpoint)
+	}
+	return nil
+}
+
+// newTracer returns a tracer for a build, or nil if tracing is disabled.
+// The build joins the trace in the TRACEPARENT environment variable if it is
+// set, for example by a CI system that traces the steps of a pipeline.
+func (st *state) newTracer() *tracer {
+	if st.otlpEndpoint() == "" {
+		return nil
+	}
+	t := &tracer{traceID: randomID(16)}
+	if m := traceparentRE.FindStringSubmatch(os.Getenv("TRACEPARENT")); m != nil {
+		t.traceID, t.parentID = m[1], m[2]
+	}
+	return t
+}
+
+// randomID returns n random bytes, hex encoded.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startRunSpan starts the span of a build or rebuild as runSpan.
+func (st *state) startRunSpan(name string) *traceSpan {
+	if st.tracing == nil {
+		st.runSpan = nil
+		return nil
+	}
+	st.runSpan = st.tracing.start(name, st.tracing.parentID)
+	return st.runSpan
+}
+
+// start starts a span with the given parent span ID.
+func (t *tracer) start(name, parentID string) *traceSpan {
+	return &traceSpan{t: t, name: name, spanID: randomID(8), parentID: parentID, start: time.Now(), attrs: map[string]string{}}
+}
+
+// child starts a span that is a child of s. Attributes are given as pairs
+// of keys and values.
+func (s *traceSpan) child(name string, attrs ...string) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	c := s.t.start(name, s.spanID)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		c.attrs[attrs[i]] = attrs[i+1]
+	}
+	return c
+}
+
+// setAttr sets an attribute of the span.
+func (s *traceSpan) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// finish ends the span, recording err if the phase failed. Only the first
+// call has any effect.
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end, s.err = time.Now(), err
+	s.mu.Unlock()
+
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.t.ended = append(s.t.ended, s)
+}
+
+// finishRunSpan ends runSpan and exports the spans ended so far. Failing to
+// export spans is logged, and does not fail the build.
+func (st *state) finishRunSpan(log logr.Logger, err error) {
+	if st.runSpan == nil {
+		return
+	}
+	st.runSpan.finish(err)
+	if err := st.exportSpans(); err != nil {
+		log.Info("WARNING: failed to export trace spans", "endpoint", st.otlpEndpoint(), "error", err.Error())
+		return
+	}
+	log.V(4).Info("Exported trace spans", "endpoint", st.otlpEndpoint(), "trace", st.tracing.traceID)
+}
+
+// otlpKeyValue is an attribute in the OTLP JSON encoding.
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// otlpSpan is a span in the OTLP JSON encoding.
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlpAttributes converts attributes to the OTLP JSON encoding, sorted by
+// key.
+func otlpAttributes(attrs map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]otlpKeyValue, len(keys))
+	for i, k := range keys {
+		out[i].Key = k
+		out[i].Value.StringValue = attrs[k]
+	}
+	return out
+}
+
+// exportSpans sends the spans ended since the last export to the OTLP
+// endpoint, encoded as JSON.
+func (st *state) exportSpans() error {
+	st.tracing.mu.Lock()
+	ended := st.tracing.ended
+	st.tracing.ended = nil
+	st.tracing.mu.Unlock()
+	if len(ended) == 0 {
+		return nil
+	}
+
+	spans := make([]otlpSpan, 0, len(ended))
+	for _, s := range ended {
+		span := otlpSpan{
+			TraceID:           st.tracing.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.err != nil {
+			span.Status.Code, span.Status.Message = 2, s.err.Error() // STATUS_CODE_ERROR
+		}
+		spans = append(spans, span)
+	}
+	resource := map[string]string{"service.name": st.otlpServiceName()}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/munnerz/hugo-multiversion"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, st.otlpEndpoint(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	headers, _ := st.otlpHeaders()
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: otlpExportTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package multiversion
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// transformParams injects the edit URL and git metadata params.
+	transformParams = "params"
+	// transformRewriteLinks rewrites absolute links to point into the version.
+	transformRewriteLinks = "rewrite-links"
+	// transformRewriteRefs rewrites the targets of ref and relref shortcodes.
+	transformRewriteRefs = "rewrite-refs"
+	// transformSearchIndex adds pages to the search index of their version.
+	transformSearchIndex = "search-index"
+)
+
+// Page is a page of a version passed to a Transformer. Changes to the front
+// matter and body are written back to the output directory.
+type Page struct {
+	// Path is the path of the page relative to the version directory, using
+	// forward slashes.
+	Path string
+	// Source is the path of the page's source file relative to the root of
+	// the source tree, using forward slashes.
+	Source string
+	// FrontMatter is the page's parsed front matter.
+	FrontMatter map[string]interface{}
+	// Body is the content of the page following its front matter.
+	Body []byte
+}
+
+// TransformVersion describes the version whose pages are being transformed.
+type TransformVersion struct {
+	// Name is the name of the version, e.g. 'v1.2'.
+	Name string
+	// Branch is the branch or tag the version was built from.
+	Branch string
+	// Dir is the version's directory in the output.
+	Dir string
+	// Pages are the paths of every page in the version, relative to Dir and
+	// using forward slashes.
+	Pages map[string]bool
+
+	copy *copyContext
+	// ends are called once every page of the version has been transformed.
+	ends []func() error
+}
+
+// PageTransform modifies a page, returning true if it was modified.
+type PageTransform func(p *Page) (bool, error)
+
+// Transformer transforms the pages of each version once they have been
+// copied into the output directory.
+type Transformer interface {
+	// Begin is called before the pages of a version are transformed, and
+	// returns the function applied to each of its pages, or nil if the pages
+	// of the version are left unchanged.
+	Begin(v *TransformVersion) (PageTransform, error)
+}
+
+// TransformerFunc is a Transformer that applies a function to every page of
+// every version.
+type TransformerFunc func(v *TransformVersion, p *Page) (bool, error)
+
+// Begin returns a PageTransform calling f with the version.
+func (f TransformerFunc) Begin(v *TransformVersion) (PageTransform, error) {
+	return func(p *Page) (bool, error) {
+		return f(v, p)
+	}, nil
+}
+
+// builtinTransformer is a transform provided by hugo-multiversion, which is
+// enabled by a command line flag.
+type builtinTransformer struct {
+	enabled func(c *Config) bool
+	begin   func(st *state, v *TransformVersion) (PageTransform, error)
+}
+
+func (t builtinTransformer) Begin(v *TransformVersion) (PageTransform, error) {
+	if !t.enabled(v.copy.st.opts) {
+		return nil, nil
+	}
+	return t.begin(v.copy.st, v)
+}
+
+// builtinTransformers are the built-in transforms, in the order they are
+// applied unless 'transforms' is set in the config file.
+var builtinTransformers = []struct {
+	name string
+	t    builtinTransformer
+}{
+	{transformParams, builtinTransformer{enabled: (*Config).paramsEnabled, begin: (*state).beginInjectParams}},
+	{transformRewriteLinks, builtinTransformer{enabled: func(c *Config) bool { return c.Transform.RewriteLinks }, begin: (*state).beginRewriteLinks}},
+	{transformRewriteRefs, builtinTransformer{enabled: func(c *Config) bool { return c.Transform.RewriteRefs }, begin: (*state).beginRewriteRefs}},
+	{transformPinURLs, builtinTransformer{enabled: func(c *Config) bool { return len(c.PinnedURLs) > 0 }, begin: (*state).beginPinURLs}},
+	{transformSearchIndex, builtinTransformer{enabled: func(c *Config) bool { return c.Transform.SearchIndex || c.Search.AlgoliaIndex != "" }, begin: (*state).beginSearchIndex}},
+}
+
+// lookupBuiltinTransformer returns the built-in transform with the given name.
+func lookupBuiltinTransformer(name string) (builtinTransformer, bool) {
+	for _, b := range builtinTransformers {
+		if b.name == name {
+			return b.t, true
+		}
+	}
+	return builtinTransformer{}, false
+}
+
+// validateTransforms returns an error if 'transforms' names an unknown
+// transform, or omits a transform that is enabled.
+func (c *Config) validateTransforms() error {
+	for name := range c.Transform.Transformers {
+		if _, ok := lookupBuiltinTransformer(name); ok {
+			return fmt.Errorf("transformer %q has the same name as a built-in transform", name)
+		}
+	}
+	if c.Transforms == nil {
+		return nil
+	}
+	if err := c.validateTransformList(c.Transforms); err != nil {
+		return fmt.Errorf("transforms: %v", err)
+	}
+	listed := make(map[string]bool)
+	for _, name := range c.Transforms {
+		listed[name] = true
+	}
+	for _, name := range defaultTransforms(c) {
+		if !listed[name] {
+			return fmt.Errorf("transforms: %q is enabled but not listed", name)
+		}
+	}
+	return nil
+}
+
+// validateTransformList returns an error if names contains an unknown
+// transform, or lists a transform more than once.
+func (c *Config) validateTransformList(names []string) error {
+	listed := make(map[string]bool)
+	for _, name := range names {
+		_, builtin := lookupBuiltinTransformer(name)
+		if _, ok := c.Transform.Transformers[name]; !ok && !builtin {
+			return fmt.Errorf("unknown transform %q", name)
+		}
+		if listed[name] {
+			return fmt.Errorf("%q is listed more than once", name)
+		}
+		listed[name] = true
+	}
+	return nil
+}
+
+// defaultTransforms returns the names of the enabled built-in transforms,
+// followed by the transformers registered with Config.Transform.Transformers
+// in name order.
+func defaultTransforms(c *Config) []string {
+	var names []string
+	for _, b := range builtinTransformers {
+		if b.t.enabled(c) {
+			names = append(names, b.name)
+		}
+	}
+	var custom []string
+	for name := range c.Transform.Transformers {
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+	return append(names, custom...)
+}
+
+// transformPipeline returns the names of the transforms applied to a
+// version, in order.
+func (st *state) transformPipeline(vc *VersionConfig) []string {
+	if vc.Transforms != nil {
+		return vc.Transforms
+	}
+	if st.opts.Transforms != nil {
+		return st.opts.Transforms
+	}
+	return defaultTransforms(st.opts)
+}
+
+// transformPages applies the transform pipeline to every page copied into
+// the version directory dir, reading and writing each page once.
+func (st *state) transformPages(c *copyContext, dir string) error {
+	names := st.transformPipeline(st.opts.versionConfig(c.version))
+	if len(names) == 0 {
+		return nil
+	}
+	pages, err := st.listPages(dir)
+	if err != nil {
+		return err
+	}
+	v := &TransformVersion{Name: c.version, Branch: c.branch, Dir: dir, Pages: pages, copy: c}
+	var applied []string
+	var fns []PageTransform
+	for _, name := range names {
+		var t Transformer
+		if b, ok := lookupBuiltinTransformer(name); ok {
+			t = b
+		} else {
+			t = st.opts.Transform.Transformers[name]
+		}
+		fn, err := t.Begin(v)
+		if err != nil {
+			return fmt.Errorf("transform %q: %v", name, err)
+		}
+		if fn != nil {
+			applied = append(applied, name)
+			fns = append(fns, fn)
+		}
+	}
+	if len(fns) == 0 {
+		return nil
+	}
+
+	c.log.Info("Transforming pages", "transforms", applied)
+	c.report.update(func(r *versionReport) { r.Transforms = applied })
+	span := c.report.span.child("transform", "transforms", strings.Join(applied, ","))
+	err = st.updatePages(dir, func(rel string, p *page) (bool, error) {
+		pg := &Page{Path: rel, Source: c.sources[rel], FrontMatter: p.frontMatter, Body: p.body}
+		var modifiedBy []string
+		for i, fn := range fns {
+			m, err := fn(pg)
+			if err != nil {
+				return false, fmt.Errorf("transform %q of %q: %v", applied[i], rel, err)
+			}
+			if m {
+				modifiedBy = append(modifiedBy, applied[i])
+			}
+		}
+		p.frontMatter, p.body = pg.FrontMatter, pg.Body
+		// pages are written one at a time, once this function returns
+		st.auditStep(c.version, "transform:"+strings.Join(modifiedBy, ","))
+		return len(modifiedBy) > 0, nil
+	})
+	for _, end := range v.ends {
+		if err != nil {
+			break
+		}
+		err = end()
+	}
+	span.finish(err)
+	return err
+}
+
+// paramsEnabled returns true if any params derived from the source of pages
+// are injected.
+func (c *Config) paramsEnabled() bool {
+	if c.Transform.EditURLs || c.Transform.EditURLTemplate != "" || c.Transform.GitDates || c.Transform.GitContributors {
+		return true
+	}
+	for _, vc := range c.Versions {
+		if vc != nil && vc.EditURLTemplate != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// beginInjectParams returns a PageTransform injecting the 'edit_url' and git
+// metadata params into the front matter of each page.
+func (st *state) beginInjectParams(v *TransformVersion) (PageTransform, error) {
+	c := v.copy
+	tmpl := c.vc.editURLTemplate(st.opts)
+	if strings.Contains(tmpl, "{repo}") && repoWebURL(c.vc.repoURL(st.opts)) == "" {
+		c.log.Info("WARNING: not injecting 'edit_url' params, as the repository has no web interface to link to; set --edit-url-template without {repo} to link elsewhere", "repo", c.vc.repoURL(st.opts))
+		tmpl = ""
+	}
+	gitParams := st.opts.Transform.GitDates || st.opts.Transform.GitContributors
+	return func(p *Page) (bool, error) {
+		h := c.history[p.Source]
+		if p.Source == "" || tmpl == "" && (h == nil || !gitParams) {
+			return false, nil
+		}
+		params := map[string]interface{}{}
+		if tmpl != "" {
+			params["edit_url"] = st.editURL(tmpl, c.branch, c.version, p.Source)
+		}
+		if h != nil {
+			fields, gitParams := st.gitMetadataParams(p.FrontMatter, h)
+			for k, v := range fields {
+				p.FrontMatter[k] = v
+			}
+			for k, v := range gitParams {
+				params[k] = v
+			}
+		}
+		if len(params) == 0 {
+			return false, nil
+		}
+		st.setParams(p.FrontMatter, params)
+		return true, nil
+	}, nil
+}
+
+// beginRewriteLinks returns a PageTransform prefixing absolute links in each
+// page with the URL of the version, if the link points at a page or file in
+// the version. Links on lines containing noRewriteMarker, and all links in
+// pages with the 'rewrite_links' param set to false, are left unchanged.
+func (st *state) beginRewriteLinks(v *TransformVersion) (PageTransform, error) {
+	log := v.copy.log
+	r := &linkRewriter{st: st, version: v.Name, dir: v.Dir, pages: make(map[string]bool, len(v.Pages))}
+	for rel := range v.Pages {
+		r.pages[pagePath(rel)] = true
+	}
+	return func(p *Page) (bool, error) {
+		if v, ok := st.getParam(p.FrontMatter, "rewrite_links").(bool); ok && !v {
+			log.V(4).Info("Skipping rewriting links in page", "page", p.Path)
+			return false, nil
+		}
+		body := r.rewrite(p.Body, lowerExt(p.Path))
+		if bytes.Equal(body, p.Body) {
+			return false, nil
+		}
+		p.Body = body
+		return true, nil
+	}, nil
+}
+
+// beginRewriteRefs returns a PageTransform rewriting the targets of 'ref' and
+// 'relref' shortcodes in each page so that they resolve to pages within the
+// version.
+// Absolute targets are prefixed with the path of the version directory, and
+// targets that are a bare file name are replaced with the absolute path of the
+// file with that name in the version, if there is exactly one. Relative
+// targets are left unchanged as they continue to resolve correctly.
+func (st *state) beginRewriteRefs(v *TransformVersion) (PageTransform, error) {
+	log := v.copy.log
+	prefix, err := st.versionRefPrefix(v.Name)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string][]string)
+	for rel := range v.Pages {
+		name := path.Base(rel)
+		byName[name] = append(byName[name], rel)
+		byName[strings.TrimSuffix(name, path.Ext(name))] = append(byName[strings.TrimSuffix(name, path.Ext(name))], rel)
+	}
+	return func(p *Page) (bool, error) {
+		body, modified := rewriteRefTargets(log, p.Path, p.Body, prefix, byName)
+		p.Body = body
+		return modified, nil
+	}, nil
+}
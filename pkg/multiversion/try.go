@@ -0,0 +1,93 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runTry builds branch as a throwaway version named version into a temporary
+// directory, runs every checker against it and, with --run-hugo, renders it
+// with Hugo, returning an error if the version is not ready to be added to
+// the published versions. Steps that would write outside the temporary
+// directory, such as writing data files or redirects, are skipped.
+func (st *state) runTry(ctx context.Context, branch, version string) error {
+	switch {
+	case st.opts.Fetch.RepoURL == "":
+		return fmt.Errorf("--repo-url must be specified")
+	case len(st.opts.Languages.Languages) > 0:
+		return fmt.Errorf("cannot be used with --languages")
+	case st.opts.Fetch.ReplayDir != "":
+		return fmt.Errorf("cannot be used with --replay")
+	case st.opts.Hugo.Run && st.isHugoServer():
+		return fmt.Errorf("cannot run a Hugo server")
+	}
+	if version == "" {
+		version = branch
+	}
+	log := st.log.WithValues("version", version, "branch", branch)
+	if configured, ok := st.resolveVersions()[version]; ok {
+		log.Info("WARNING: version is already configured, it is built from the given branch instead", "configured", configured)
+	}
+
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(log, tmpdir)
+
+	if err := st.useThrowawayOutput(tmpdir); err != nil {
+		return err
+	}
+	if err := st.buildVersion(ctx, log, tmpdir, nil, version, branch); err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range checkers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	findings, err := st.runChecks(log, names, []string{version})
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		log.Info("WARNING: "+f.Message, "check", f.Checker, "file", f.File, "line", f.Line)
+	}
+
+	if st.opts.Hugo.Run {
+		st.opts.Hugo.Args = append(append([]string{}, st.opts.Hugo.Args...), "--contentDir", st.opts.Hugo.ContentDir, "--destination", filepath.Join(tmpdir, "public"))
+		if err := st.runHugo(log); err != nil {
+			return fmt.Errorf("version is not ready to be added, %v", err)
+		}
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("version is not ready to be added, checks reported %d problems", len(findings))
+	}
+	log.Info("Version is ready to be added")
+	return nil
+}
+
+// useThrowawayOutput places the output directory within a throwaway Hugo
+// content directory in tmpdir, at the same path relative to it as the real
+// output directory, and disables the steps that would write outside of it.
+func (st *state) useThrowawayOutput(tmpdir string) error {
+	rel, err := filepath.Rel(st.opts.Hugo.ContentDir, st.opts.Output.Dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(st.opts.Output.Dir)
+	}
+	st.opts.Hugo.ContentDir = filepath.Join(tmpdir, "content")
+	st.opts.Output.Dir = filepath.Join(st.opts.Hugo.ContentDir, rel)
+	st.opts.Output.CopyMode = copyModeCopy
+	st.opts.Output.DeltaSync = false
+	st.opts.Output.Archive = ""
+	st.opts.Output.ExtraDirs = nil
+	st.opts.Fetch.RecordDir = ""
+	st.opts.Jobs.ManifestDir = ""
+	st.opts.Review.RoutingFile = ""
+	return st.output.MkdirAll(st.opts.Output.Dir, 0755)
+}
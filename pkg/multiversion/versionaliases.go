@@ -0,0 +1,203 @@
+package multiversion
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// aliasStrategyAliases adds the URL of each page under every alias of
+	// its version to the page's 'aliases', so that Hugo generates a redirect
+	// page for it.
+	aliasStrategyAliases = "aliases"
+	// aliasStrategyRedirect adds a redirect for each page under every alias
+	// of its version to the redirects file.
+	aliasStrategyRedirect = "redirect"
+	// aliasStrategyCopy copies the version directory to a directory for each
+	// alias, so that the version is served from each alias.
+	aliasStrategyCopy = "copy"
+)
+
+// aliasNameRE matches the names that may be used as version aliases, which
+// are a single path segment.
+var aliasNameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validateVersionAliasStrategy returns an error if the given version alias
+// strategy is not supported.
+func validateVersionAliasStrategy(strategy string) error {
+	switch strategy {
+	case aliasStrategyAliases, aliasStrategyRedirect, aliasStrategyCopy:
+		return nil
+	}
+	return fmt.Errorf("unsupported strategy %q, must be one of %q, %q or %q", strategy, aliasStrategyAliases, aliasStrategyRedirect, aliasStrategyCopy)
+}
+
+// validateVersionAliases returns an error if the aliases of any version are
+// invalid, clash with another version or alias, or cannot be served with
+// --version-alias-strategy.
+func (st *state) validateVersionAliases() error {
+	c := st.opts
+	versions := st.resolveVersions()
+	owners := make(map[string]string)
+	for _, name := range sortedVersionNames(versions) {
+		for _, alias := range c.versionConfig(name).Aliases {
+			_, isVersion := versions[alias]
+			switch {
+			case !aliasNameRE.MatchString(alias) || alias == "." || alias == "..":
+				return fmt.Errorf("version %q: alias %q must be a single path segment", name, alias)
+			case isVersion:
+				return fmt.Errorf("version %q: alias %q is also the name of a version", name, alias)
+			case owners[alias] != "":
+				return fmt.Errorf("version %q: alias %q is also an alias of version %q", name, alias, owners[alias])
+			}
+			owners[alias] = name
+		}
+	}
+	if len(owners) == 0 {
+		return nil
+	}
+	switch {
+	case c.Output.VersionAliasStrategy == aliasStrategyRedirect && c.Output.RedirectsFormat == "":
+		return fmt.Errorf("--version-alias-strategy=%s requires --redirects-format to be set", aliasStrategyRedirect)
+	case c.Output.VersionAliasStrategy != aliasStrategyRedirect && c.Output.CopyMode == copyModeMount:
+		return fmt.Errorf("--version-alias-strategy=%s cannot be used with --copy-mode=%s, as mounted versions are not modified", c.Output.VersionAliasStrategy, copyModeMount)
+	}
+	return nil
+}
+
+// versionAliases returns the name of the version each alias of the versions
+// in versionMap refers to, keyed by alias.
+func (st *state) versionAliases(versionMap map[string]string) map[string]string {
+	aliases := make(map[string]string)
+	for vers := range versionMap {
+		for _, alias := range st.opts.versionConfig(vers).Aliases {
+			aliases[alias] = vers
+		}
+	}
+	return aliases
+}
+
+// isVersionAliasURL returns true if u is beneath the URL of one of the
+// aliases of the named version.
+func (st *state) isVersionAliasURL(version, u string) bool {
+	for _, alias := range st.opts.versionConfig(version).Aliases {
+		if strings.HasPrefix(u, st.versionURL(alias)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCopiedAliases returns versionMap with the directory of each alias
+// copied with --version-alias-strategy=copy added, mapped to the branch of
+// the version it is a copy of.
+func (st *state) withCopiedAliases(versionMap map[string]string) map[string]string {
+	if st.opts.Output.VersionAliasStrategy != aliasStrategyCopy {
+		return versionMap
+	}
+	out := make(map[string]string, len(versionMap))
+	for vers, branch := range versionMap {
+		out[vers] = branch
+	}
+	for alias, vers := range st.versionAliases(versionMap) {
+		out[alias] = versionMap[vers]
+	}
+	return out
+}
+
+// applyVersionAliases makes each version reachable at the URLs of its
+// aliases, using the aliases or copy strategy. Redirects for the redirect
+// strategy are added to the redirects file by buildRedirects.
+func (st *state) applyVersionAliases(log logr.Logger, versionMap map[string]string) error {
+	aliases := st.versionAliases(versionMap)
+	if len(aliases) == 0 {
+		return nil
+	}
+	switch st.opts.Output.VersionAliasStrategy {
+	case aliasStrategyAliases:
+		for _, vers := range sortedVersionNames(versionMap) {
+			names := st.opts.versionConfig(vers).Aliases
+			if len(names) == 0 {
+				continue
+			}
+			log.Info("Adding version aliases to the aliases of each page", "version", vers, "aliases", names)
+			err := st.updatePages(st.versionDir(vers), func(rel string, p *page) (bool, error) {
+				existing, _ := p.frontMatter["aliases"].([]interface{})
+				modified := false
+				for _, alias := range names {
+					if u := st.pageURL(alias, rel); !containsAlias(existing, u) {
+						existing = append(existing, u)
+						modified = true
+					}
+				}
+				p.frontMatter["aliases"] = existing
+				return modified, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case aliasStrategyCopy:
+		for alias, vers := range aliases {
+			dst := filepath.Join(st.opts.Output.Dir, alias)
+			log.Info("Copying version to alias directory", "version", vers, "alias", alias, "path", dst)
+			if err := st.output.RemoveAll(dst); err != nil {
+				return err
+			}
+			if err := st.copyOutputTree(st.versionDir(vers), dst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// versionAliasRedirects returns a redirect from the URL of each page under
+// every alias of its version to the page, for --version-alias-strategy=redirect.
+// The redirects are temporary, as aliases such as 'stable' move between
+// versions.
+func (st *state) versionAliasRedirects(idx *contentIndex) []redirect {
+	if st.opts.Output.VersionAliasStrategy != aliasStrategyRedirect {
+		return nil
+	}
+	var redirects []redirect
+	for _, vers := range idx.versions {
+		for _, alias := range st.opts.versionConfig(vers).Aliases {
+			redirects = append(redirects, redirect{From: st.versionURL(alias), To: st.versionURL(vers), Status: 302})
+			for pp := range idx.pages[vers] {
+				if pp == "" {
+					continue
+				}
+				redirects = append(redirects, redirect{From: st.versionURL(alias) + pp, To: st.versionURL(vers) + pp, Status: 302})
+			}
+		}
+	}
+	return redirects
+}
+
+// copyOutputTree copies the directory src in the output to dst in the output.
+func (st *state) copyOutputTree(src, dst string) error {
+	return st.walkOutput(src, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, fp)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return st.output.MkdirAll(target, info.Mode().Perm())
+		}
+		data, err := st.output.ReadFile(fp)
+		if err != nil {
+			return err
+		}
+		return st.output.WriteFile(target, data, info.Mode().Perm())
+	})
+}
@@ -0,0 +1,188 @@
+package multiversion
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// outputFormatDirectory writes the output directory only.
+	outputFormatDirectory = "directory"
+	// outputFormatArchive also writes an archive of each version, and of the
+	// whole site, to --archive-dir.
+	outputFormatArchive = "archive"
+)
+
+const (
+	archiveTypeTarGz = "tar.gz"
+	archiveTypeZip   = "zip"
+)
+
+// combinedArchiveName is the name, without its extension, of the archive
+// containing every version.
+const combinedArchiveName = "all-versions"
+
+// validateOutputFormat returns an error if --output-format is not supported
+// or cannot be used with the other flags.
+func (st *state) validateOutputFormat() error {
+	switch st.opts.Output.Format {
+	case outputFormatDirectory:
+		return nil
+	case outputFormatArchive:
+	default:
+		return fmt.Errorf("unsupported output format %q, must be one of %q or %q", st.opts.Output.Format, outputFormatDirectory, outputFormatArchive)
+	}
+	switch {
+	case st.opts.Archives.Type != archiveTypeTarGz && st.opts.Archives.Type != archiveTypeZip:
+		return fmt.Errorf("unsupported --archive-type %q, must be one of %q or %q", st.opts.Archives.Type, archiveTypeTarGz, archiveTypeZip)
+	case st.opts.Archives.Dir == "":
+		return fmt.Errorf("--archive-dir must be set")
+	case st.opts.Watch.Enabled:
+		return fmt.Errorf("cannot be used with --watch")
+	case st.opts.Hugo.Run && st.isHugoServer():
+		return fmt.Errorf("cannot be used when running a Hugo server")
+	case st.opts.Output.Archive != "":
+		return fmt.Errorf("cannot be used with --output, as content is not written to disk")
+	case st.opts.Archives.SourceDir == "" && !st.opts.Hugo.Run && (st.opts.Output.CopyMode == copyModeSymlink || st.opts.Output.CopyMode == copyModeMount):
+		return fmt.Errorf("cannot archive the output directory with --copy-mode=%s, as versions are not copied into it", st.opts.Output.CopyMode)
+	}
+	src, _ := st.archiveSourceDir()
+	if withinDir(src, st.opts.Archives.Dir) {
+		return fmt.Errorf("--archive-dir cannot be within the archived directory %s, as the archives would contain each other", src)
+	}
+	return nil
+}
+
+// archiveSourceDir returns the directory archived, chosen as for container
+// images, and whether versions are found in it at their URL, as in Hugo's
+// rendered site, rather than at their directory in the output directory.
+func (st *state) archiveSourceDir() (string, bool) {
+	switch {
+	case st.opts.Archives.SourceDir != "":
+		return st.opts.Archives.SourceDir, st.opts.Hugo.Run
+	case st.opts.Hugo.Run:
+		return filepath.Join(st.opts.Hugo.SiteRoot, "public"), true
+	}
+	return st.opts.Output.Dir, false
+}
+
+// writeVersionArchives writes an archive of each of the versions to
+// --archive-dir, named after the version, for offline use. Unless only some
+// versions were built with --only-versions, an archive of the whole site is
+// also written. The files of each version are placed in a directory named
+// after the version within its archive, with any slashes in its name
+// replaced with dashes, and the versions nested beneath the
+// root version are left out of its archive.
+func (st *state) writeVersionArchives(log logr.Logger, versions []string) error {
+	dir, rendered := st.archiveSourceDir()
+	if err := os.MkdirAll(st.opts.Archives.Dir, 0755); err != nil {
+		return err
+	}
+	for _, vers := range versions {
+		rel := st.versionPath(vers)
+		if rendered {
+			rel = strings.Trim(st.versionURL(vers), "/")
+		}
+		var skip map[string]bool
+		if st.versionPath(vers) == "" {
+			skip = st.nestedVersionDirs()
+		}
+		src := filepath.Join(dir, filepath.FromSlash(rel))
+		if _, err := st.output.Stat(src); os.IsNotExist(err) {
+			log.Info("WARNING: version was not found in the archived directory, skipping its archive", "version", vers, "path", src)
+			continue
+		}
+		if err := st.writeArchive(log.WithValues("version", vers), src, strings.Replace(vers, "/", "-", -1), skip); err != nil {
+			return err
+		}
+	}
+	if len(st.opts.Jobs.OnlyVersions) > 0 {
+		return nil
+	}
+	return st.writeArchive(log, dir, combinedArchiveName, nil)
+}
+
+// writeArchive writes the tree rooted at src to the archive named name in
+// --archive-dir, within a directory of the same name. The archive is written
+// to a temporary file first so that a failed build does not leave a partial
+// archive behind.
+func (st *state) writeArchive(log logr.Logger, src, name string, skip map[string]bool) error {
+	dst := filepath.Join(st.opts.Archives.Dir, name+"."+st.opts.Archives.Type)
+	f, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	switch st.opts.Archives.Type {
+	case archiveTypeZip:
+		err = st.writeZip(f, src, name, skip)
+	default:
+		gw := gzip.NewWriter(f)
+		if err = st.writeTar(gw, src, name, skip); err == nil {
+			err = gw.Close()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %v", dst, err)
+	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return err
+	}
+	log.Info("Wrote archive", "path", dst, "source", src)
+	return nil
+}
+
+// writeZip writes the tree rooted at dir in the output to w as a zip
+// archive, in the same way as writeTar.
+func (st *state) writeZip(w io.Writer, dir, prefix string, skip map[string]bool) error {
+	zw := zip.NewWriter(w)
+	prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+	err := st.output.Walk(dir, skipVersionDirs(dir, skip, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fp)
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := st.output.Open(fp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(fw, f)
+		return err
+	}))
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
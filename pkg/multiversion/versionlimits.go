@@ -0,0 +1,150 @@
+package multiversion
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// versionNumberRE matches version names that look like semantic version
+// numbers, such as 'v1.8', '1.10.2' or 'v2.0.0-rc.1'.
+var versionNumberRE = regexp.MustCompile(`^v?([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?(?:-([0-9A-Za-z.-]+))?$`)
+
+// versionNumber is a version name parsed by parseVersionNumber.
+type versionNumber struct {
+	parts      [3]int
+	prerelease string
+}
+
+// parseVersionNumber parses a version name that looks like a semantic
+// version number. Missing minor and patch numbers are zero.
+func parseVersionNumber(name string) (versionNumber, bool) {
+	m := versionNumberRE.FindStringSubmatch(name)
+	if m == nil {
+		return versionNumber{}, false
+	}
+	var v versionNumber
+	for i := range v.parts {
+		v.parts[i], _ = strconv.Atoi(m[i+1])
+	}
+	v.prerelease = m[4]
+	return v, true
+}
+
+// compare returns -1, 0 or 1 if v is older than, the same as or newer than o.
+// A pre-release is older than the release it precedes.
+func (v versionNumber) compare(o versionNumber) int {
+	for i := range v.parts {
+		switch {
+		case v.parts[i] < o.parts[i]:
+			return -1
+		case v.parts[i] > o.parts[i]:
+			return 1
+		}
+	}
+	switch {
+	case v.prerelease == o.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case o.prerelease == "":
+		return -1
+	}
+	return strings.Compare(v.prerelease, o.prerelease)
+}
+
+// newerVersionName returns true if the version named a sorts before b in
+// sortedVersionNames. Names that look like version numbers are compared as
+// semantic versions and sort before other names, which are compared in
+// reverse lexical order.
+func newerVersionName(a, b string) bool {
+	va, aok := parseVersionNumber(a)
+	vb, bok := parseVersionNumber(b)
+	switch {
+	case aok && bok:
+		if c := va.compare(vb); c != 0 {
+			return c > 0
+		}
+		return a > b
+	case aok != bok:
+		return aok
+	}
+	return a > b
+}
+
+// validateMinVersion returns an error if --min-version is not a version
+// number.
+func (st *state) validateMinVersion() error {
+	if st.opts.Fetch.MinVersion == "" {
+		return nil
+	}
+	if _, ok := parseVersionNumber(st.opts.Fetch.MinVersion); !ok {
+		return fmt.Errorf("%q is not a version number such as 'v1.8'", st.opts.Fetch.MinVersion)
+	}
+	return nil
+}
+
+// limitVersions returns the versions in versionMap that are built with
+// --max-versions and --min-version, removing versions that are older than
+// --min-version and then all but the newest --max-versions versions.
+// Only 'latest' and versions whose names look like version numbers count
+// towards --max-versions. Other versions, such as 'dev', are never older than
+// --min-version, and are always built along with hidden versions.
+func (st *state) limitVersions(versionMap map[string]string) map[string]string {
+	if st.opts.Fetch.MaxVersions == 0 && st.opts.Fetch.MinVersion == "" {
+		return versionMap
+	}
+	minVersion, hasMin := parseVersionNumber(st.opts.Fetch.MinVersion)
+	out := make(map[string]string, len(versionMap))
+	counted := 0
+	for _, vers := range sortedVersionNames(versionMap) {
+		v, numbered := parseVersionNumber(vers)
+		if hasMin && numbered && v.compare(minVersion) < 0 {
+			continue
+		}
+		if (numbered || vers == latestVersion) && !st.opts.versionConfig(vers).Hidden {
+			if st.opts.Fetch.MaxVersions > 0 && counted == st.opts.Fetch.MaxVersions {
+				continue
+			}
+			counted++
+		}
+		out[vers] = versionMap[vers]
+	}
+	return out
+}
+
+// archivedVersions returns the configured versions that are not built as they
+// are excluded by --max-versions or --min-version, mapped to their branches.
+func (st *state) archivedVersions() map[string]string {
+	configured := st.configuredVersions()
+	built := st.limitVersions(configured)
+	archived := make(map[string]string)
+	for vers, branch := range configured {
+		if _, ok := built[vers]; !ok {
+			archived[vers] = branch
+		}
+	}
+	return archived
+}
+
+// archivedVersionsData returns the entries of the versions data file for the
+// versions excluded by --max-versions or --min-version, linking to
+// --archived-versions-url, or nil if it is not set.
+func (st *state) archivedVersionsData() []versionData {
+	if st.opts.Output.ArchivedVersionsURL == "" {
+		return nil
+	}
+	archived := st.archivedVersions()
+	var data []versionData
+	for _, name := range sortedVersionNames(archived) {
+		data = append(data, versionData{
+			Name:     name,
+			Branch:   archived[name],
+			URL:      strings.Replace(st.opts.Output.ArchivedVersionsURL, versionPlaceholder, name, -1),
+			Outdated: true,
+			Archived: true,
+		})
+	}
+	return data
+}
@@ -0,0 +1,60 @@
+package multiversion
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestLimitVersions(t *testing.T) {
+	versions := map[string]string{
+		latestVersion: "main",
+		"dev":         "dev",
+		"next":        "next",
+		"preview":     "preview",
+		"v1.10":       "release-1.10",
+		"v1.9":        "release-1.9",
+		"v1.8":        "release-1.8",
+		"v1.7":        "release-1.7",
+	}
+	tests := []struct {
+		name       string
+		maxVersion int
+		minVersion string
+		want       []string
+	}{
+		{
+			name:       "max versions",
+			maxVersion: 3,
+			want:       []string{latestVersion, "v1.10", "v1.9", "v1.8", "preview", "next", "dev"},
+		},
+		{
+			name:       "min version",
+			minVersion: "v1.9",
+			want:       []string{latestVersion, "v1.10", "v1.9", "preview", "next", "dev"},
+		},
+		{
+			name:       "max and min versions",
+			maxVersion: 2,
+			minVersion: "v1.8",
+			want:       []string{latestVersion, "v1.10", "v1.9", "preview", "next", "dev"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.Log = testLogger{t: t}
+			c.Fetch.MaxVersions = test.maxVersion
+			c.Fetch.MinVersion = test.minVersion
+			// v1.9 is hidden, so it is built without counting towards
+			// --max-versions
+			c.Versions = map[string]*VersionConfig{"v1.9": {Hidden: true}}
+			st := newState(context.Background(), &c)
+
+			got := sortedVersionNames(st.limitVersions(versions))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
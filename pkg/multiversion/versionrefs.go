@@ -0,0 +1,126 @@
+package multiversion
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// VersionReferencesConfig configures the 'version-references' checker.
+type VersionReferencesConfig struct {
+	// Patterns are regular expressions matching references to versions of the
+	// documented product, e.g. 'available since v(\d+\.\d+)'. The first group
+	// of each expression must capture the referenced version.
+	Patterns []string `yaml:"patterns"`
+
+	// patterns are the compiled Patterns, set when the config file is loaded.
+	patterns []*regexp.Regexp
+}
+
+// compile compiles the configured patterns.
+func (c *VersionReferencesConfig) compile() error {
+	var res []*regexp.Regexp
+	for _, p := range c.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("pattern %q must contain a group capturing the version", p)
+		}
+		res = append(res, re)
+	}
+	c.patterns = res
+	return nil
+}
+
+// productVersion returns the version of the product documented by the named
+// version. It is set with 'productVersion' in the config file, or otherwise
+// derived from the version name, e.g. 'v1.2' documents product version '1.2'.
+func (st *state) productVersion(version string) (string, bool) {
+	if pv := st.opts.versionConfig(version).ProductVersion; pv != "" {
+		return pv, true
+	}
+	pv := strings.TrimPrefix(version, "v")
+	if _, ok := parseDottedVersion(pv); !ok {
+		return "", false
+	}
+	return pv, true
+}
+
+// parseDottedVersion parses a version of the form '1.2.3' into its numeric
+// components.
+func parseDottedVersion(v string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	out := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+// newerThan returns true if ref is newer than pv, comparing only as many
+// components as pv has, so that '1.2.3' is not newer than '1.2'.
+func newerThan(ref, pv []int) bool {
+	for i := range pv {
+		if i >= len(ref) {
+			return false
+		}
+		if ref[i] != pv[i] {
+			return ref[i] > pv[i]
+		}
+	}
+	return false
+}
+
+// versionReferenceChecker reports references to versions of the product that
+// are newer than the version documented by the version directory the page is
+// in, which are usually caused by backporting content to older versions.
+type versionReferenceChecker struct{}
+
+func (versionReferenceChecker) check(cache *checkCache, t checkTarget) []finding {
+	if cache.st.opts.VersionReferences == nil {
+		return nil
+	}
+	pv, ok := cache.st.productVersion(t.version)
+	if !ok {
+		return nil
+	}
+	current, ok := parseDottedVersion(pv)
+	if !ok {
+		return []finding{{Checker: "version-references", Version: t.version, File: t.rel, Message: fmt.Sprintf("product version %q is not of the form 1.2.3", pv)}}
+	}
+	data, _, err := cache.source(t)
+	if data == nil && err != nil {
+		return []finding{{Checker: "version-references", Version: t.version, File: t.rel, Message: err.Error()}}
+	}
+
+	var findings []finding
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		for _, re := range cache.st.opts.VersionReferences.patterns {
+			for _, m := range re.FindAllStringSubmatch(scanner.Text(), -1) {
+				ref, ok := parseDottedVersion(m[1])
+				if !ok || !newerThan(ref, current) {
+					continue
+				}
+				findings = append(findings, finding{
+					Checker: "version-references",
+					Version: t.version,
+					File:    t.rel,
+					Line:    line,
+					Message: fmt.Sprintf("%q references product version %s, which is newer than the documented version %s", m[0], m[1], pv),
+				})
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,122 @@
+package multiversion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/go-logr/logr"
+)
+
+// The formats the versions file can be exported in with --versions-format.
+const (
+	// versionsFormatMike is the versions.json format of mike, the
+	// versioning tool for MkDocs.
+	versionsFormatMike = "mike"
+	// versionsFormatDocusaurus is the versions.json format of Docusaurus.
+	versionsFormatDocusaurus = "docusaurus"
+	// versionsFormatTemplate renders --versions-template.
+	versionsFormatTemplate = "template"
+)
+
+// validateVersionsExport returns an error if --versions-format is not
+// supported, or the files it requires are not set.
+func (st *state) validateVersionsExport() error {
+	switch st.opts.Output.VersionsFormat {
+	case "":
+		return nil
+	case versionsFormatMike, versionsFormatDocusaurus:
+	case versionsFormatTemplate:
+		if st.opts.Output.VersionsTemplate == "" {
+			return fmt.Errorf("--versions-template must be set with --versions-format=%s", versionsFormatTemplate)
+		}
+	default:
+		return fmt.Errorf("unsupported format %q, must be one of %s, %s or %s", st.opts.Output.VersionsFormat, versionsFormatMike, versionsFormatDocusaurus, versionsFormatTemplate)
+	}
+	if st.opts.Output.VersionsFile == "" {
+		return fmt.Errorf("--versions-file must be set")
+	}
+	return nil
+}
+
+// writeVersionsExport writes the versions listed in the versions data file to
+// --versions-file in the format of --versions-format, for version selectors
+// built for other tools. Archived versions are not listed in the mike and
+// Docusaurus formats, which expect every version to be served from the site.
+func (st *state) writeVersionsExport(log logr.Logger, versions map[string]string) error {
+	if st.opts.Output.VersionsFormat == "" {
+		return nil
+	}
+	data := st.buildVersionsData(versions)
+	var out []byte
+	var err error
+	switch st.opts.Output.VersionsFormat {
+	case versionsFormatMike:
+		list := []mikeVersion{}
+		for _, v := range data.Versions {
+			if v.Archived {
+				continue
+			}
+			title := v.Name
+			if v.DisplayName != "" {
+				title = v.DisplayName
+			}
+			aliases := v.Aliases
+			if aliases == nil {
+				aliases = []string{}
+			}
+			list = append(list, mikeVersion{Version: v.Name, Title: title, Aliases: aliases})
+		}
+		out, err = json.MarshalIndent(list, "", "  ")
+	case versionsFormatDocusaurus:
+		// Docusaurus lists the released versions, newest first, and
+		// serves the current version separately.
+		list := []string{}
+		for _, v := range data.Versions {
+			if !v.Archived && !v.Latest {
+				list = append(list, v.Name)
+			}
+		}
+		out, err = json.MarshalIndent(list, "", "  ")
+	case versionsFormatTemplate:
+		out, err = st.renderVersionsTemplate(data)
+	}
+	if err != nil {
+		return err
+	}
+	if st.opts.Output.VersionsFormat != versionsFormatTemplate {
+		out = append(out, '\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(st.opts.Output.VersionsFile), 0755); err != nil {
+		return err
+	}
+	log.Info("Writing versions file", "path", st.opts.Output.VersionsFile, "format", st.opts.Output.VersionsFormat)
+	return ioutil.WriteFile(st.opts.Output.VersionsFile, out, 0644)
+}
+
+// renderVersionsTemplate executes --versions-template with the versions data
+// file. The 'json' function encodes a value as JSON.
+func (st *state) renderVersionsTemplate(data *versionsData) ([]byte, error) {
+	src, err := ioutil.ReadFile(st.opts.Output.VersionsTemplate)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(st.opts.Output.VersionsTemplate)).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", st.opts.Output.VersionsTemplate, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("executing %s: %w", st.opts.Output.VersionsTemplate, err)
+	}
+	return buf.Bytes(), nil
+}
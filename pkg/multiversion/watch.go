@@ -0,0 +1,240 @@
+package multiversion
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// validateWatch returns an error if --watch cannot be used with the other
+// flags.
+func (st *state) validateWatch() error {
+	if !st.opts.Watch.Enabled {
+		return nil
+	}
+	if st.opts.Watch.PollInterval <= 0 {
+		return fmt.Errorf("--poll-interval must be greater than zero")
+	}
+	switch {
+	case st.opts.Fetch.ReplayDir != "":
+		return fmt.Errorf("cannot be used with --replay")
+	case st.opts.Fetch.RecordDir != "":
+		return fmt.Errorf("cannot be used with --record")
+	case st.opts.Jobs.FinalizeOnly:
+		return fmt.Errorf("cannot be used with --finalize-only")
+	case len(st.opts.Jobs.OnlyVersions) > 0:
+		return fmt.Errorf("cannot be used with --only-versions")
+	case len(st.opts.Languages.Languages) > 0:
+		return fmt.Errorf("cannot be used with --languages")
+	case st.opts.Output.DeltaSync:
+		return fmt.Errorf("cannot be used with --delta-sync")
+	}
+	return nil
+}
+
+// remoteHeads returns the commit the branch of each of the given versions
+// points to in the repository it is fetched from, keyed by version. Branches
+// that may be tags resolve to the commit the tag points to. Versions that are
+// not cloned from a remote are not included.
+func (st *state) remoteHeads(log logr.Logger, versionMap map[string]string) (map[string]string, error) {
+	// list the refs of each repository once
+	byRemote := make(map[string][]string)
+	remotes := make(map[string]*Remote)
+	for vers := range versionMap {
+		vc := st.opts.versionConfig(vers)
+		if !st.polled(vers, versionMap[vers], vc) {
+			continue
+		}
+		r := vc.remote(st.opts)
+		byRemote[r.URL] = append(byRemote[r.URL], vers)
+		remotes[r.URL] = r
+	}
+
+	heads := make(map[string]string)
+	for u, versions := range byRemote {
+		var refs []string
+		for _, vers := range versions {
+			branch := versionMap[vers]
+			if refKind(branch) == refFull {
+				refs = append(refs, branch)
+				continue
+			}
+			refs = append(refs, "refs/heads/"+branch, "refs/tags/"+branch)
+		}
+		branchHeads, err := st.lsRemote(log, remotes[u], refs)
+		if err != nil {
+			return nil, err
+		}
+		for _, vers := range versions {
+			if sha, ok := branchHeads[versionMap[vers]]; ok {
+				heads[vers] = sha
+			}
+		}
+	}
+	return heads, nil
+}
+
+// lsRemote returns the commit each of the given refs points to in the remote,
+// keyed by branch or tag name, and by full ref name for other refs.
+func (st *state) lsRemote(log logr.Logger, r *Remote, refs []string) (map[string]string, error) {
+	env, err := r.env()
+	if err != nil {
+		return nil, err
+	}
+	out, err := st.commandOutputEnv(log, env, "", "git", append([]string{"ls-remote", r.URL}, refs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	heads := make(map[string]string)
+	peeled := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		sha, ref := fields[0], fields[1]
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			heads[strings.TrimPrefix(ref, "refs/heads/")] = sha
+		case strings.HasPrefix(ref, "refs/tags/") && strings.HasSuffix(ref, "^{}"):
+			name := strings.TrimSuffix(strings.TrimPrefix(ref, "refs/tags/"), "^{}")
+			heads[name] = sha
+			peeled[name] = true
+		case strings.HasPrefix(ref, "refs/tags/"):
+			name := strings.TrimPrefix(ref, "refs/tags/")
+			if !peeled[name] {
+				heads[name] = sha
+			}
+		default:
+			heads[ref] = sha
+		}
+	}
+	return heads, nil
+}
+
+// watchVersions polls the remote repository every --poll-interval and rebuilds
+// the versions whose branch has moved since heads was recorded, followed by
+// the steps that depend on every version. Versions fetched from a local
+// directory are resynced as soon as their sources change. Errors polling or
+// rebuilding are logged and retried on the next poll. It only returns if the
+// Hugo server started by --run-hugo exits.
+func (st *state) watchVersions(ctx context.Context, log logr.Logger, versionMap map[string]string, heads map[string]string) error {
+	local, err := st.watchLocalSources(ctx, log, versionMap)
+	if err != nil {
+		log.Error(err, "Failed to watch local sources")
+		return err
+	}
+	log.Info("Watching branches for changes", "interval", st.opts.Watch.PollInterval)
+	poll := time.NewTicker(st.opts.Watch.PollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-poll.C:
+		case changed := <-local:
+			log.Info("Resyncing versions whose local sources have changed", "versions", sortedVersionNames(changed))
+			if err := st.resyncVersions(ctx, log, versionMap, changed); err != nil {
+				log.Error(err, "Failed to resync versions")
+				continue
+			}
+			st.refreshHugo(log)
+			continue
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-st.hugoServerExited:
+			if err == nil {
+				err = fmt.Errorf("hugo server exited")
+			}
+			return err
+		}
+		current, err := st.remoteHeads(log, versionMap)
+		st.metrics.observePoll(err)
+		if err != nil {
+			log.Error(err, "Failed to poll branches for changes")
+			continue
+		}
+
+		changed := make(map[string]string)
+		for vers, branch := range versionMap {
+			sha, ok := current[vers]
+			if !ok {
+				if st.polled(vers, branch, st.opts.versionConfig(vers)) {
+					log.Info("WARNING: branch no longer exists in the remote repository", "version", vers, "branch", branch)
+				}
+				continue
+			}
+			if sha != heads[vers] {
+				changed[vers] = branch
+			}
+		}
+		if len(changed) == 0 {
+			log.V(4).Info("No branches have changed")
+			continue
+		}
+
+		log.Info("Rebuilding versions whose branch has changed", "versions", sortedVersionNames(changed))
+		if err := st.rebuildVersions(ctx, log, versionMap, changed); err != nil {
+			// heads is left unchanged so that the versions are rebuilt again
+			// on the next poll.
+			log.Error(err, "Failed to rebuild versions")
+			continue
+		}
+		for vers := range changed {
+			heads[vers] = current[vers]
+		}
+		st.refreshHugo(log)
+	}
+}
+
+// refreshHugo runs Hugo again with --run-hugo once versions have been rebuilt.
+// A Hugo server reloads the rebuilt pages itself.
+func (st *state) refreshHugo(log logr.Logger) {
+	if st.opts.Hugo.Run && !st.isHugoServer() {
+		if err := st.runHugo(log); err != nil {
+			log.Error(err, "Failed to run Hugo")
+		}
+	}
+}
+
+// rebuildVersions replaces the output of each version in changed with a fresh
+// build, and re-runs the steps that depend on every version.
+func (st *state) rebuildVersions(ctx context.Context, log logr.Logger, versionMap, changed map[string]string) (err error) {
+	st.startRunSpan("rebuild").setAttr("versions", strings.Join(sortedVersionNames(changed), ","))
+	defer func() { st.finishRunSpan(log, err) }()
+	st.newAuditRun()
+	tmpdir, err := ioutil.TempDir("", "hugo-multiversion-")
+	if err != nil {
+		return err
+	}
+	defer st.cleanup(log, tmpdir)
+
+	// the sources shared between versions are fetched again, as the
+	// sources directory of --copy-mode=symlink is reused between rebuilds
+	st.forgetSharedFetches()
+	for vers, branch := range changed {
+		log := log.WithValues("version", vers, "branch", branch)
+		// mounted versions are replaced when they are fetched again
+		if st.opts.Output.CopyMode != copyModeMount {
+			st.auditStep(vers, "rebuild")
+			if err := st.removeVersionDir(vers); err != nil {
+				return err
+			}
+		}
+		if err := st.buildVersion(ctx, log, tmpdir, nil, vers, branch); err != nil {
+			return err
+		}
+	}
+	err = st.finalize(log, versionMap)
+	st.metrics.observeFinalize(err)
+	if err != nil {
+		return err
+	}
+	if err := st.pushSearchRecords(log, changed, versionMap); err != nil {
+		return err
+	}
+	return st.keepOutput(log, versionMap, true)
+}